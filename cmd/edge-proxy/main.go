@@ -3,16 +3,29 @@ package main
 import (
 	"context"
 	"log"
+	"nextgen-sip/internal/auth"
 	"nextgen-sip/internal/billing"
+	"nextgen-sip/internal/cdr"
+	"nextgen-sip/internal/dialplan"
+	"nextgen-sip/internal/did"
 	"nextgen-sip/internal/engine"
 	"nextgen-sip/internal/firewall"
+	"nextgen-sip/internal/models"
+	"nextgen-sip/internal/money"
+	"nextgen-sip/internal/rating"
 	"nextgen-sip/internal/registrar"
 	"nextgen-sip/internal/router"
+	"nextgen-sip/internal/trunk"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/emiago/sipgo"
+	"github.com/emiago/sipgo/sip"
+	_ "github.com/mattn/go-sqlite3"
 )
 
 func main() {
@@ -37,18 +50,147 @@ func main() {
 		sipProtocol = "udp"
 	}
 
+	// Address advertised in Record-Route and Path; must be reachable by
+	// clients and, when several proxies share the registrar, be this
+	// node's own address so that the others route to its flows through it
+	sipPublicHost := os.Getenv("SIP_PUBLIC_HOST")
+	if sipPublicHost == "" {
+		ip, err := sip.ResolveSelfIP()
+		if err != nil {
+			log.Fatalf("Failed to resolve public SIP host, set SIP_PUBLIC_HOST: %v", err)
+		}
+		sipPublicHost = ip.String()
+	}
+	sipPublicPort, err := strconv.Atoi(sipPort)
+	if err != nil {
+		log.Fatalf("Invalid SIP_PORT %q: %v", sipPort, err)
+	}
+
+	sipRealm := os.Getenv("SIP_REALM")
+	if sipRealm == "" {
+		sipRealm = "xsip"
+	}
+
+	// Accounts and rate decks that do not name a currency use this one
+	if cur := os.Getenv("BILLING_CURRENCY"); cur != "" {
+		money.DefaultCurrency = strings.ToUpper(cur)
+	}
+
+	// Dial plans turn what users dial into E.164. Tenants without a plan of
+	// their own use the default tenant's, or until one is set this one.
+	plans, err := dialplan.NewPlans(os.Getenv("DIALPLAN_FILE"), dialplan.Plan{
+		CountryCode:         envString("DIALPLAN_COUNTRY_CODE", "972"),
+		NationalPrefix:      envString("DIALPLAN_NATIONAL_PREFIX", "0"),
+		InternationalPrefix: envString("DIALPLAN_INTERNATIONAL_PREFIX", "00"),
+		ExtensionLength:     envInt("DIALPLAN_EXTENSION_LENGTH", 4),
+	})
+	if err != nil {
+		log.Fatalf("Failed to load dial plans: %v", err)
+	}
+
+	// Carrier trunks for calls to numbers that are not our subscribers
+	trunks, err := trunk.NewTrunks(os.Getenv("TRUNKS_FILE"))
+	if err != nil {
+		log.Fatalf("Failed to load trunks: %v", err)
+	}
+
+	// DIDs and where their calls go
+	dids, err := did.NewInventory(os.Getenv("DID_FILE"))
+	if err != nil {
+		log.Fatalf("Failed to load DIDs: %v", err)
+	}
+
 	// 2. Initialize Components
-	reg := registrar.NewRedisRegistrar(redisURL)
-	bill := billing.NewInMemoryBilling()
+	var reg router.Registrar
+	switch os.Getenv("REGISTRAR_BACKEND") {
+	case "memory":
+		mr := registrar.NewMemoryRegistrar(30 * time.Second)
+		defer mr.Close()
+		reg = mr
+	default:
+		// A local cache keeps calls routing through a Redis outage
+		cr := registrar.NewCachedRegistrar(registrar.NewRedisRegistrar(redisURL), registrar.CacheConfig{
+			StaleFor:      envDuration("REGISTRAR_STALE_FOR", 10*time.Minute),
+			MaxBuffered:   envInt("REGISTRAR_WRITE_BUFFER", 10000),
+			CheckInterval: envDuration("REGISTRAR_HEALTH_INTERVAL", 5*time.Second),
+		})
+		defer cr.Close()
+		reg = cr
+	}
+	var bill engine.BillingEngine
+	switch os.Getenv("BILLING_BACKEND") {
+	case "redis":
+		bill = billing.NewRedisBilling(redisURL)
+	case "sqlite":
+		dbPath := os.Getenv("BILLING_DB")
+		if dbPath == "" {
+			dbPath = "billing.db"
+		}
+		sb, err := billing.NewSQLBilling("sqlite3", dbPath+"?_journal_mode=WAL&_busy_timeout=5000")
+		if err != nil {
+			log.Fatalf("Failed to open billing database: %v", err)
+		}
+		defer sb.Close()
+		bill = sb
+	default:
+		mb := billing.NewInMemoryBilling()
+		// Seed some test data; persistent backends keep real subscribers
+		mb.SetBalance("sip:100@localhost", 50*money.Scale, billing.ActorSystem, "test seed")
+		mb.SetBalance("sip:200@localhost", 10*money.Scale, billing.ActorSystem, "test seed")
+		bill = mb
+	}
 	fw := firewall.NewFirewall()
-	cc := engine.NewCallControl(bill)
-	admin := engine.NewAdminAPI(cc, bill)
-	
-	// Seed some test data
-	bill.SetBalance("sip:100@localhost", 50.0)
-	bill.SetBalance("sip:200@localhost", 10.0)
 
-	rt := router.NewRoutingEngine(reg, bill)
+	var cdrs engine.CDRStore
+	switch os.Getenv("CDR_BACKEND") {
+	case "file":
+		cdrPath := os.Getenv("CDR_FILE")
+		if cdrPath == "" {
+			cdrPath = "cdrs.jsonl"
+		}
+		fs, err := cdr.NewFileStore(cdrPath)
+		if err != nil {
+			log.Fatalf("Failed to open CDR store: %v", err)
+		}
+		defer fs.Close()
+		cdrs = fs
+	default:
+		cdrs = cdr.NewMemoryStore(100000)
+	}
+
+	var deckStore *rating.Store
+	if dir := os.Getenv("RATE_DECK_DIR"); dir != "" {
+		if deckStore, err = rating.NewStore(dir); err != nil {
+			log.Fatalf("Failed to open rate deck store: %v", err)
+		}
+	}
+	rater, err := rating.NewEngine(deckStore, plans)
+	if err != nil {
+		log.Fatalf("Failed to load rate decks: %v", err)
+	}
+
+	// Catch-all deck at the previous flat rate of $0.01/sec until real
+	// decks are uploaded and assigned through the admin API
+	if !rater.HasDeck("default") {
+		rater.Publish(rating.RateDeck{
+			ID:   "default",
+			Name: "Default",
+			Rates: []models.Rate{
+				{Prefix: "", Description: "All destinations", PerMinute: 600000, FirstIncrement: 1, NextIncrement: 1},
+			},
+		})
+	}
+	rater.SetDefault("default")
+
+	cc := engine.NewCallControl(bill, rater, cdrs)
+
+	// Registration lifetimes granted to clients, in seconds
+	expiry := router.ExpiryLimits{
+		Min:     envInt("REGISTER_MIN_EXPIRES", 60),
+		Max:     envInt("REGISTER_MAX_EXPIRES", 3600),
+		Default: envInt("REGISTER_DEFAULT_EXPIRES", 3600),
+	}
+	rt := router.NewRoutingEngine(reg, bill, plans, trunks, rater, dids, envDuration("DID_WEBHOOK_TIMEOUT", 2*time.Second), sip.Uri{Host: sipPublicHost, Port: sipPublicPort}, expiry)
 
 	ua, err := sipgo.NewUA(
 		sipgo.WithUserAgent("NextGen-SIP-Proxy/2.5-Railway"),
@@ -58,7 +200,31 @@ func main() {
 	}
 
 	sipAddr := "0.0.0.0:" + sipPort
-	sipEngine := engine.NewSIPEngine(ua, rt, cc, fw, sipAddr)
+	da := auth.NewDigestAuthenticator(sipRealm, 5*time.Minute)
+	defer da.Close()
+	sipEngine := engine.NewSIPEngine(ua, rt, cc, fw, da, sipAddr)
+
+	// Keep NAT pinholes open and drop bindings whose client has gone away;
+	// an interval of 0 turns this off
+	var ka *engine.Keepalive
+	if interval := envDuration("NAT_KEEPALIVE_INTERVAL", 30*time.Second); interval > 0 {
+		ka = engine.NewKeepalive(sipEngine, reg, engine.KeepaliveConfig{
+			Interval:    interval,
+			Timeout:     envDuration("NAT_KEEPALIVE_TIMEOUT", 5*time.Second),
+			MaxFailures: envInt("NAT_KEEPALIVE_MAX_FAILURES", 3),
+		})
+		defer ka.Close()
+	}
+	// Register with the carriers of trunks that ask for it
+	trunkRegs := engine.NewTrunkRegistrations(sipEngine, trunks, engine.TrunkRegConfig{
+		Contact:  sip.Uri{Host: sipPublicHost, Port: sipPublicPort},
+		Check:    envDuration("TRUNK_REGISTER_CHECK_INTERVAL", 5*time.Second),
+		Timeout:  envDuration("TRUNK_REGISTER_TIMEOUT", 10*time.Second),
+		RetryMin: envDuration("TRUNK_REGISTER_RETRY_MIN", 5*time.Second),
+		RetryMax: envDuration("TRUNK_REGISTER_RETRY_MAX", 5*time.Minute),
+	})
+	defer trunkRegs.Close()
+	admin := engine.NewAdminAPI(cc, bill, rater, cdrs, reg, ka, plans, trunks, trunkRegs, dids, expiry)
 
 	// Context for graceful shutdown
 	ctx, cancel := context.WithCancel(context.Background())
@@ -89,4 +255,38 @@ func main() {
 	}
 }
 
+// envString reads a setting that may be set to empty, falling back to def
+// when unset
+func envString(name, def string) string {
+	if v, ok := os.LookupEnv(name); ok {
+		return v
+	}
+	return def
+}
+
+// envInt reads an integer setting, falling back to def when unset
+func envInt(name string, def int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Fatalf("Invalid %s %q: %v", name, v, err)
+	}
+	return n
+}
 
+// envDuration reads a duration setting such as "30s", falling back to def
+// when unset
+func envDuration(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Fatalf("Invalid %s %q: %v", name, v, err)
+	}
+	return d
+}
@@ -0,0 +1,229 @@
+// Command ratedeck validates rate deck CSVs and manages deck versions
+// through the admin API.
+//
+//	ratedeck validate deck.csv
+//	ratedeck upload -deck carrier-a [-name "Carrier A"] [-effective 2024-07-01] [-currency EUR] deck.csv
+//	ratedeck versions -deck carrier-a
+//	ratedeck rollback -deck carrier-a [-version 3]
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"nextgen-sip/internal/rating"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	var err error
+	switch cmd, args := os.Args[1], os.Args[2:]; cmd {
+	case "validate":
+		err = validate(args)
+	case "upload":
+		err = upload(args)
+	case "versions":
+		err = versions(args)
+	case "rollback":
+		err = rollback(args)
+	default:
+		usage()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "✗", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, `usage: ratedeck <command> [flags]
+
+commands:
+  validate FILE                   check a CSV rate deck locally
+  upload -deck ID [flags] FILE    upload a CSV as a new deck version
+  versions -deck ID               list deck versions
+  rollback -deck ID [-version N]  withdraw the active (or given) version
+
+The admin API address is taken from -api or $XSIP_API (default http://localhost:8080).`)
+	os.Exit(2)
+}
+
+func newFlags(name string) (*flag.FlagSet, *string) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	def := os.Getenv("XSIP_API")
+	if def == "" {
+		def = "http://localhost:8080"
+	}
+	api := fs.String("api", def, "admin API base URL")
+	return fs, api
+}
+
+func validate(args []string) error {
+	if len(args) != 1 {
+		usage()
+	}
+	f, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	rates, effective, err := rating.ParseCSV(f)
+	if err != nil {
+		if ce, ok := err.(*rating.CSVError); ok {
+			for _, e := range ce.Errors {
+				fmt.Fprintln(os.Stderr, "  ", e)
+			}
+			return fmt.Errorf("%d invalid rows", len(ce.Errors))
+		}
+		return err
+	}
+	when := "on upload"
+	if !effective.IsZero() {
+		when = effective.Format(time.RFC3339)
+	}
+	fmt.Printf("✓ %d rates, effective %s\n", len(rates), when)
+	return nil
+}
+
+func upload(args []string) error {
+	fs, api := newFlags("upload")
+	deck := fs.String("deck", "", "deck ID")
+	name := fs.String("name", "", "deck name")
+	effective := fs.String("effective", "", "activation time (RFC3339 or YYYY-MM-DD), overrides the CSV")
+	currency := fs.String("currency", "", "deck currency (default: the server's)")
+	rounding := fs.String("rounding", "", "cost rounding: half_up, up or down")
+	dryRun := fs.Bool("dry-run", false, "validate on the server without publishing")
+	fs.Parse(args)
+	if *deck == "" || fs.NArg() != 1 {
+		usage()
+	}
+
+	data, err := os.ReadFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	q := url.Values{}
+	if *name != "" {
+		q.Set("name", *name)
+	}
+	if *effective != "" {
+		q.Set("effective_at", *effective)
+	}
+	if *currency != "" {
+		q.Set("currency", *currency)
+	}
+	if *rounding != "" {
+		q.Set("rounding", *rounding)
+	}
+	if *dryRun {
+		q.Set("dry_run", "true")
+	}
+
+	var out map[string]interface{}
+	err = call(http.MethodPost, *api+"/api/ratedecks/"+url.PathEscape(*deck)+"/upload?"+q.Encode(), "text/csv", data, &out)
+	if err != nil {
+		return err
+	}
+	if *dryRun {
+		fmt.Printf("✓ valid, %v rates\n", out["rates"])
+		return nil
+	}
+	fmt.Printf("✓ %s version %v, effective %v\n", *deck, out["version"], out["effective_at"])
+	return nil
+}
+
+func versions(args []string) error {
+	fs, api := newFlags("versions")
+	deck := fs.String("deck", "", "deck ID")
+	fs.Parse(args)
+	if *deck == "" {
+		usage()
+	}
+
+	var list []rating.RateDeck
+	if err := call(http.MethodGet, *api+"/api/ratedecks/"+url.PathEscape(*deck)+"/versions", "", nil, &list); err != nil {
+		return err
+	}
+	now := time.Now()
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tUPLOADED\tEFFECTIVE\tSTATUS\tSOURCE")
+	active := false
+	for _, d := range list {
+		status := "superseded"
+		switch {
+		case d.RolledBack:
+			status = "rolled back"
+		case d.EffectiveAt.After(now):
+			status = "scheduled"
+		case !active:
+			status, active = "active", true
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n", d.Version,
+			d.UploadedAt.Format(time.RFC3339), d.EffectiveAt.Format(time.RFC3339), status, d.Source)
+	}
+	return w.Flush()
+}
+
+func rollback(args []string) error {
+	fs, api := newFlags("rollback")
+	deck := fs.String("deck", "", "deck ID")
+	version := fs.Int("version", 0, "version to withdraw (default: the active one)")
+	fs.Parse(args)
+	if *deck == "" {
+		usage()
+	}
+
+	body, _ := json.Marshal(map[string]int{"version": *version})
+	var d rating.RateDeck
+	if err := call(http.MethodPost, *api+"/api/ratedecks/"+url.PathEscape(*deck)+"/rollback", "application/json", body, &d); err != nil {
+		return err
+	}
+	fmt.Printf("✓ %s version %d rolled back\n", *deck, d.Version)
+	return nil
+}
+
+// call sends a request to the admin API and decodes the JSON response into out
+func call(method, target, contentType string, body []byte, out interface{}) error {
+	req, err := http.NewRequest(method, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		var e struct {
+			Error string   `json:"error"`
+			Rows  []string `json:"rows"`
+		}
+		if json.Unmarshal(data, &e) != nil || e.Error == "" {
+			return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(data))
+		}
+		for _, r := range e.Rows {
+			fmt.Fprintln(os.Stderr, "  ", r)
+		}
+		return fmt.Errorf("%s: %s", resp.Status, e.Error)
+	}
+	return json.Unmarshal(data, out)
+}
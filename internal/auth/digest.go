@@ -0,0 +1,174 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/icholy/digest"
+)
+
+var (
+	ErrNoCredentials      = errors.New("no digest credentials")
+	ErrStaleNonce         = errors.New("stale nonce")
+	ErrInvalidCredentials = errors.New("invalid digest credentials")
+)
+
+// Algorithms offered in challenges, strongest first (RFC 8760 section 2.4)
+var digestAlgorithms = []string{"SHA-256", "MD5"}
+
+type nonceState struct {
+	issued time.Time
+	lastNC int
+}
+
+// DigestAuthenticator issues and verifies SIP digest challenges
+// (RFC 3261 section 22.4, RFC 8760) with qop=auth.
+type DigestAuthenticator struct {
+	mu       sync.Mutex
+	realm    string
+	opaque   string
+	nonceTTL time.Duration
+	nonces   map[string]*nonceState
+	done     chan struct{}
+}
+
+func NewDigestAuthenticator(realm string, nonceTTL time.Duration) *DigestAuthenticator {
+	a := &DigestAuthenticator{
+		realm:    realm,
+		opaque:   randomHex(8),
+		nonceTTL: nonceTTL,
+		nonces:   make(map[string]*nonceState),
+		done:     make(chan struct{}),
+	}
+	go a.sweeper()
+	return a
+}
+
+// Close stops the nonce sweeper
+func (a *DigestAuthenticator) Close() {
+	close(a.done)
+}
+
+func (a *DigestAuthenticator) Realm() string {
+	return a.realm
+}
+
+// Challenges returns one header value per supported algorithm, all sharing
+// a freshly issued nonce. stale=true tells the UA to retry with the new
+// nonce without prompting for a password.
+func (a *DigestAuthenticator) Challenges(stale bool) []string {
+	nonce := randomHex(16)
+
+	a.mu.Lock()
+	a.nonces[nonce] = &nonceState{issued: time.Now()}
+	a.mu.Unlock()
+
+	list := make([]string, 0, len(digestAlgorithms))
+	for _, alg := range digestAlgorithms {
+		chal := digest.Challenge{
+			Realm:     a.realm,
+			Nonce:     nonce,
+			Opaque:    a.opaque,
+			Stale:     stale,
+			Algorithm: alg,
+			QOP:       []string{"auth"},
+		}
+		list = append(list, chal.String())
+	}
+	return list
+}
+
+// Verify checks an Authorization / Proxy-Authorization header value against
+// the password returned by lookup. The nonce must have been issued by us,
+// be younger than nonceTTL, and every nonce-count may be used only once.
+func (a *DigestAuthenticator) Verify(method string, header string, lookup func(username string) (string, bool)) (string, error) {
+	if header == "" {
+		return "", ErrNoCredentials
+	}
+	cred, err := digest.ParseCredentials(header)
+	if err != nil {
+		return "", ErrInvalidCredentials
+	}
+	if cred.Realm != a.realm || cred.Opaque != a.opaque {
+		return cred.Username, ErrInvalidCredentials
+	}
+	if cred.QOP != "auth" || cred.Nc <= 0 || cred.Cnonce == "" {
+		return cred.Username, ErrInvalidCredentials
+	}
+
+	password, ok := lookup(cred.Username)
+	if !ok {
+		return cred.Username, ErrInvalidCredentials
+	}
+
+	expected, err := digest.Digest(&digest.Challenge{
+		Realm:     a.realm,
+		Nonce:     cred.Nonce,
+		Opaque:    a.opaque,
+		Algorithm: cred.Algorithm,
+		QOP:       []string{"auth"},
+	}, digest.Options{
+		Method:   method,
+		URI:      cred.URI,
+		Username: cred.Username,
+		Password: password,
+		Cnonce:   cred.Cnonce,
+		Count:    cred.Nc,
+	})
+	if err != nil {
+		return cred.Username, ErrInvalidCredentials
+	}
+	if subtle.ConstantTimeCompare([]byte(expected.Response), []byte(cred.Response)) != 1 {
+		return cred.Username, ErrInvalidCredentials
+	}
+
+	// Only a correct response may consume the nonce-count, otherwise an
+	// attacker could burn counts of a legitimate client.
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	st, ok := a.nonces[cred.Nonce]
+	if !ok || time.Since(st.issued) > a.nonceTTL {
+		delete(a.nonces, cred.Nonce)
+		return cred.Username, ErrStaleNonce
+	}
+	if cred.Nc <= st.lastNC {
+		// Replayed request
+		return cred.Username, ErrInvalidCredentials
+	}
+	st.lastNC = cred.Nc
+	return cred.Username, nil
+}
+
+// sweeper drops expired nonces until Close
+func (a *DigestAuthenticator) sweeper() {
+	ticker := time.NewTicker(a.nonceTTL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			a.sweep(time.Now())
+		case <-a.done:
+			return
+		}
+	}
+}
+
+func (a *DigestAuthenticator) sweep(now time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for n, st := range a.nonces {
+		if now.Sub(st.issued) > a.nonceTTL {
+			delete(a.nonces, n)
+		}
+	}
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,172 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/icholy/digest"
+)
+
+const testPassword = "secret"
+
+func lookup(username string) (string, bool) {
+	return testPassword, username == "alice"
+}
+
+// answer builds the Authorization header a UA would send for challenge
+func answer(t *testing.T, challenge string, nc int, password string) string {
+	t.Helper()
+	chal, err := digest.ParseChallenge(challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cred, err := digest.Digest(chal, digest.Options{
+		Method:   "REGISTER",
+		URI:      "sip:example.com",
+		Username: "alice",
+		Password: password,
+		Cnonce:   "0a4f113b",
+		Count:    nc,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nc == 0 {
+		// The library sends 1 in place of 0, as a UA would
+		return strings.Replace(cred.String(), "nc=00000001", "nc=00000000", 1)
+	}
+	return cred.String()
+}
+
+func TestVerifyNonceCount(t *testing.T) {
+	type step struct {
+		nc       int
+		password string
+		want     error
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"first use", []step{{1, testPassword, nil}}},
+		{"increasing counts", []step{{1, testPassword, nil}, {2, testPassword, nil}, {3, testPassword, nil}}},
+		{"counts may skip", []step{{1, testPassword, nil}, {5, testPassword, nil}}},
+		{"replay", []step{{1, testPassword, nil}, {1, testPassword, ErrInvalidCredentials}}},
+		{"count going back", []step{{3, testPassword, nil}, {2, testPassword, ErrInvalidCredentials}}},
+		{"zero count", []step{{0, testPassword, ErrInvalidCredentials}}},
+		{"wrong password", []step{{1, "guess", ErrInvalidCredentials}}},
+		// A wrong response must not use up a count of the real client
+		{"wrong password keeps the count", []step{{1, "guess", ErrInvalidCredentials}, {1, testPassword, nil}}},
+	}
+	for _, tt := range tests {
+		// The challenges of one algorithm share a nonce, so each algorithm
+		// gets an authenticator of its own
+		for i, alg := range digestAlgorithms {
+			a := NewDigestAuthenticator("example.com", time.Minute)
+			chal := a.Challenges(false)[i]
+			for j, s := range tt.steps {
+				user, err := a.Verify("REGISTER", answer(t, chal, s.nc, s.password), lookup)
+				if err != s.want {
+					t.Errorf("%s (%s) step %d: Verify(nc=%d) = %v, want %v", tt.name, alg, j+1, s.nc, err, s.want)
+				}
+				if user != "alice" {
+					t.Errorf("%s (%s) step %d: user %q, want alice", tt.name, alg, j+1, user)
+				}
+			}
+			a.Close()
+		}
+	}
+}
+
+func TestVerifyStaleNonce(t *testing.T) {
+	a := NewDigestAuthenticator("example.com", time.Minute)
+	defer a.Close()
+
+	other := NewDigestAuthenticator("example.com", time.Minute)
+	defer other.Close()
+	other.opaque = a.opaque
+	foreign := other.Challenges(false)[0]
+	if _, err := a.Verify("REGISTER", answer(t, foreign, 1, testPassword), lookup); err != ErrStaleNonce {
+		t.Errorf("nonce we never issued: %v, want ErrStaleNonce", err)
+	}
+
+	chal := a.Challenges(false)[0]
+	parsed, _ := digest.ParseChallenge(chal)
+	a.mu.Lock()
+	a.nonces[parsed.Nonce].issued = time.Now().Add(-2 * time.Minute)
+	a.mu.Unlock()
+	if _, err := a.Verify("REGISTER", answer(t, chal, 1, testPassword), lookup); err != ErrStaleNonce {
+		t.Errorf("expired nonce: %v, want ErrStaleNonce", err)
+	}
+	if _, err := a.Verify("REGISTER", answer(t, chal, 2, testPassword), lookup); err != ErrStaleNonce {
+		t.Errorf("expired nonce retried: %v, want ErrStaleNonce", err)
+	}
+}
+
+func TestVerifyRejects(t *testing.T) {
+	a := NewDigestAuthenticator("example.com", time.Minute)
+	defer a.Close()
+	chal := a.Challenges(false)[0]
+	valid := answer(t, chal, 1, testPassword)
+
+	wrongRealm := NewDigestAuthenticator("other.example.com", time.Minute)
+	defer wrongRealm.Close()
+	wrongRealm.opaque = a.opaque
+
+	tests := []struct {
+		name   string
+		header string
+		want   error
+	}{
+		{"no header", "", ErrNoCredentials},
+		{"garbage", "Basic YWxpY2U6c2VjcmV0", ErrInvalidCredentials},
+		{"other realm", answer(t, wrongRealm.Challenges(false)[0], 1, testPassword), ErrInvalidCredentials},
+	}
+	for _, tt := range tests {
+		if _, err := a.Verify("REGISTER", tt.header, lookup); err != tt.want {
+			t.Errorf("%s: Verify = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+
+	unknown := func(string) (string, bool) { return "", false }
+	if _, err := a.Verify("REGISTER", valid, unknown); err != ErrInvalidCredentials {
+		t.Errorf("unknown user: %v, want ErrInvalidCredentials", err)
+	}
+	if _, err := a.Verify("INVITE", valid, lookup); err != ErrInvalidCredentials {
+		t.Errorf("response for another method: %v, want ErrInvalidCredentials", err)
+	}
+	if _, err := a.Verify("REGISTER", valid, lookup); err != nil {
+		t.Errorf("valid response after rejected ones: %v", err)
+	}
+}
+
+func TestSweep(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		age  time.Duration
+		kept bool
+	}{
+		{0, true},
+		{30 * time.Second, true},
+		{time.Minute, true},
+		{time.Minute + time.Millisecond, false},
+		{time.Hour, false},
+	}
+
+	a := NewDigestAuthenticator("example.com", time.Minute)
+	defer a.Close()
+	a.mu.Lock()
+	for i, tt := range tests {
+		a.nonces[string(rune('a'+i))] = &nonceState{issued: now.Add(-tt.age)}
+	}
+	a.mu.Unlock()
+	a.sweep(now)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i, tt := range tests {
+		if _, ok := a.nonces[string(rune('a'+i))]; ok != tt.kept {
+			t.Errorf("nonce issued %v ago kept=%v, want %v", tt.age, ok, tt.kept)
+		}
+	}
+}
@@ -1,73 +1,195 @@
 package billing
 
 import (
-	"fmt"
+	"errors"
 	"log"
-	"sync"
-	"strings"
+	"nextgen-sip/internal/dialplan"
 	"nextgen-sip/internal/models"
+	"nextgen-sip/internal/money"
+	"strings"
+	"sync"
+	"time"
 )
 
+// ErrIDTaken refuses to save a subscriber under an ID another tenant's
+// subscriber already has: accounts are keyed by ID alone, so one of them
+// would silently take over the other
+var ErrIDTaken = errors.New("account ID is taken by another tenant")
+
 type InMemoryBilling struct {
 	mu       sync.RWMutex
 	users    map[string]models.User
-	balances map[string]float64
+	balances map[string]money.Amount
+	holds    map[string]map[string]hold      // by user, then Call-ID
+	ledger   map[string][]models.Transaction // oldest first, kept after user deletion
 }
 
 func NewInMemoryBilling() *InMemoryBilling {
 	return &InMemoryBilling{
 		users:    make(map[string]models.User),
-		balances: make(map[string]float64),
+		balances: make(map[string]money.Amount),
+		holds:    make(map[string]map[string]hold),
+		ledger:   make(map[string][]models.Transaction),
+	}
+}
+
+// SetBalance books the difference to amount as an adjustment. The returned
+// transaction has no ID when the balance was already amount.
+func (b *InMemoryBilling) SetBalance(user string, amount money.Amount, actor, reason string) (models.Transaction, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	uri := normalizeURI(user)
+	t := newTransaction(uri, models.TxAdjustment, actor, reason, "")
+	t.Amount = amount - b.balances[uri]
+	if t.Amount == 0 {
+		b.balances[uri] = amount
+		return models.Transaction{}, nil
 	}
+	return b.applyLocked(uri, t), nil
 }
 
-func (b *InMemoryBilling) SetBalance(user string, amount float64) {
+// Post books a top-up, refund, charge or adjustment of t.Amount
+func (b *InMemoryBilling) Post(user string, t models.Transaction) (models.Transaction, error) {
+	if err := ValidatePost(t); err != nil {
+		return models.Transaction{}, err
+	}
 	b.mu.Lock()
 	defer b.mu.Unlock()
-	b.balances[user] = amount
+	uri := normalizeURI(user)
+	entry := newTransaction(uri, t.Type, t.Actor, t.Reason, t.Reference)
+	entry.Amount = t.Amount
+	return b.applyLocked(uri, entry), nil
 }
 
-func (b *InMemoryBilling) SaveUser(u models.User) {
+// applyLocked changes the balance and books the entry in one step
+func (b *InMemoryBilling) applyLocked(uri string, t models.Transaction) models.Transaction {
+	b.balances[uri] += t.Amount
+	t.Balance = b.balances[uri]
+	b.ledger[uri] = append(b.ledger[uri], t)
+	return t
+}
+
+// SaveUser stores the profile. Balances only change through the ledger;
+// a new user starts at zero.
+func (b *InMemoryBilling) SaveUser(u models.User) error {
 	b.mu.Lock()
 	defer b.mu.Unlock()
-	uri := "sip:" + u.ID + "@localhost"
+	uri := normalizeURI(u.ID)
+	if old, ok := b.users[uri]; ok && tenantOf(old) != tenantOf(u) {
+		return ErrIDTaken
+	}
 	b.users[uri] = u
-	b.balances[uri] = u.Balance
+	if _, ok := b.balances[uri]; !ok {
+		b.balances[uri] = 0
+	}
+	return nil
+}
+
+// Transactions returns the user's ledger, newest first
+func (b *InMemoryBilling) Transactions(user string, cursor string, limit int) ([]models.Transaction, string, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return pageNewestFirst(b.ledger[normalizeURI(user)], cursor, limit)
+}
+
+// VerifyBalance checks the stored balance against the sum of the ledger
+func (b *InMemoryBilling) VerifyBalance(user string) (Verification, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	uri := normalizeURI(user)
+	var sum money.Amount
+	for _, t := range b.ledger[uri] {
+		sum += t.Amount
+	}
+	return verification(b.balances[uri], sum, len(b.ledger[uri])), nil
+}
+
+// GetUser returns the subscriber for a SIP URI or bare username
+func (b *InMemoryBilling) GetUser(uri string) (models.User, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	key := normalizeURI(uri)
+	u, ok := b.users[key]
+	u.Balance = b.balances[key]
+	return u, ok
 }
 
 func (b *InMemoryBilling) ListUsers() ([]models.User, error) {
 	b.mu.RLock()
 	defer b.mu.RUnlock()
 	list := make([]models.User, 0, len(b.users))
-	for _, u := range b.users {
+	for uri, u := range b.users {
+		u.Balance = b.balances[uri]
 		list = append(list, u)
 	}
 	return list, nil
 }
 
-func (b *InMemoryBilling) DeleteUser(uri string) {
+// DeleteUser removes the subscriber; its ledger is kept for audits. A
+// subscriber with a balance is refused with ErrBalanceNotZero.
+func (b *InMemoryBilling) DeleteUser(uri string) error {
 	b.mu.Lock()
 	defer b.mu.Unlock()
+	uri = normalizeURI(uri)
+	if b.balances[uri] != 0 {
+		return ErrBalanceNotZero
+	}
 	delete(b.users, uri)
 	delete(b.balances, uri)
+	return nil
 }
 
-// normalizeURI extracts the user part for flexible billing lookup
-func (b *InMemoryBilling) normalizeURI(uri string) string {
+// normalizeURI reduces a SIP URI or bare user name to the key of its
+// account: the user part, which is the subscriber's ID and the name it
+// authenticates with. Every backend keys subscribers by the result, so IDs
+// are unique across tenants and SaveUser refuses one another tenant has.
+// Dial plans are deliberately not applied; they belong to a tenant, and
+// the key must not depend on which tenant's plan read the number.
+func normalizeURI(uri string) string {
 	s := strings.TrimPrefix(uri, "sip:")
 	s = strings.TrimPrefix(s, "sips:")
 	parts := strings.Split(s, "@")
 	user := parts[0]
-	// Strip + and country codes
 	user = strings.TrimPrefix(user, "+")
 	return "sip:" + user + "@localhost"
 }
 
+// tenantOf is the tenant of a subscriber, the default one when unset
+func tenantOf(u models.User) string {
+	if u.TenantID == "" {
+		return dialplan.DefaultTenant
+	}
+	return u.TenantID
+}
+
+// hold is the part of a balance reserved by one call in progress
+type hold struct {
+	amount  money.Amount
+	expires time.Time
+}
+
+// heldLocked returns the total of the user's unexpired holds and drops
+// the expired ones
+func (b *InMemoryBilling) heldLocked(uri string, now time.Time) money.Amount {
+	var sum money.Amount
+	for callID, h := range b.holds[uri] {
+		if !h.expires.After(now) {
+			delete(b.holds[uri], callID)
+			continue
+		}
+		sum += h.amount
+	}
+	if len(b.holds[uri]) == 0 {
+		delete(b.holds, uri)
+	}
+	return sum
+}
+
 func (b *InMemoryBilling) CanCall(from string, to string) (bool, error) {
-	b.mu.RLock()
-	defer b.mu.RUnlock()
+	b.mu.Lock()
+	defer b.mu.Unlock()
 
-	normalized := b.normalizeURI(from)
+	normalized := normalizeURI(from)
 	balance, ok := b.balances[normalized]
 	if !ok {
 		// User not in billing system — ALLOW the call by default
@@ -76,27 +198,61 @@ func (b *InMemoryBilling) CanCall(from string, to string) (bool, error) {
 		return true, nil
 	}
 
-	if balance <= 0 {
-		log.Printf("[Billing] User %s has no balance ($%.2f), denying", from, balance)
+	if balance -= b.heldLocked(normalized, time.Now()); balance <= 0 {
+		log.Printf("[Billing] User %s has no available balance (%s), denying", from, balance)
 		return false, nil
 	}
 	return true, nil
 }
 
-func (b *InMemoryBilling) Deduct(user string, amount float64) error {
+// Reserve adds up to amount of the user's available balance to the hold
+// of call callID and returns how much was granted. Users not in billing
+// are granted the full amount. The hold lapses ttl from now unless renewed
+// by another Reserve, so a call that is never settled, because the proxy
+// restarted or lost it, does not keep the balance held.
+func (b *InMemoryBilling) Reserve(user string, amount money.Amount, callID string, ttl time.Duration) (money.Amount, error) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
-	normalized := b.normalizeURI(user)
+	normalized := normalizeURI(user)
 	balance, ok := b.balances[normalized]
 	if !ok {
-		return nil // User not in billing — skip deduction
+		return amount, nil
 	}
-	if balance < amount {
-		return fmt.Errorf("insufficient funds")
+	now := time.Now()
+	available := balance - b.heldLocked(normalized, now)
+	if available <= 0 {
+		return 0, nil
 	}
+	if amount > available {
+		amount = available
+	}
+	if b.holds[normalized] == nil {
+		b.holds[normalized] = make(map[string]hold)
+	}
+	h := b.holds[normalized][callID]
+	b.holds[normalized][callID] = hold{amount: h.amount + amount, expires: now.Add(ttl)}
+	return amount, nil
+}
 
-	b.balances[normalized] -= amount
+// Settle releases the hold of call callID and books the real cost of the
+// call as a charge referencing it
+func (b *InMemoryBilling) Settle(user string, cost money.Amount, callID string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	normalized := normalizeURI(user)
+	if delete(b.holds[normalized], callID); len(b.holds[normalized]) == 0 {
+		delete(b.holds, normalized)
+	}
+	if _, ok := b.balances[normalized]; !ok {
+		return nil // User not in billing
+	}
+	if cost > 0 {
+		t := newTransaction(normalized, models.TxCharge, ActorSystem, "call charge", callID)
+		t.Amount = -cost
+		b.applyLocked(normalized, t)
+	}
 	return nil
 }
 
@@ -0,0 +1,184 @@
+package billing
+
+import (
+	"nextgen-sip/internal/models"
+	"nextgen-sip/internal/money"
+	"path/filepath"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// store is what every backend offers the tests
+type store interface {
+	SaveUser(u models.User) error
+	GetUser(uri string) (models.User, bool)
+	SetBalance(user string, amount money.Amount, actor, reason string) (models.Transaction, error)
+	CanCall(from string, to string) (bool, error)
+	Reserve(user string, amount money.Amount, callID string, ttl time.Duration) (money.Amount, error)
+	Settle(user string, cost money.Amount, callID string) error
+	Post(user string, t models.Transaction) (models.Transaction, error)
+	Transactions(user string, cursor string, limit int) ([]models.Transaction, string, error)
+	VerifyBalance(user string) (Verification, error)
+	DeleteUser(uri string) error
+}
+
+// backends returns a fresh in-memory and SQLite store. Redis is left out:
+// it needs a server.
+func backends(t *testing.T) map[string]store {
+	t.Helper()
+	db, err := NewSQLBilling("sqlite3", filepath.Join(t.TempDir(), "billing.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]store{
+		"memory": NewInMemoryBilling(),
+		"sql":    db,
+	}
+}
+
+func TestSaveUserTenant(t *testing.T) {
+	tests := []struct {
+		name   string
+		first  string // tenant of the account saved first
+		second string // tenant saving the same ID again
+		taken  bool
+	}{
+		{"same tenant", "acme", "acme", false},
+		{"other tenant", "acme", "globex", true},
+		{"default unset then named", "", "default", false},
+		{"default named then unset", "default", "", false},
+		{"default then other", "", "acme", true},
+		{"other then default", "acme", "", true},
+	}
+	for _, tt := range tests {
+		for name, b := range backends(t) {
+			if err := b.SaveUser(models.User{ID: "100", TenantID: tt.first, Username: "first"}); err != nil {
+				t.Fatalf("%s/%s: first save: %v", tt.name, name, err)
+			}
+			err := b.SaveUser(models.User{ID: "100", TenantID: tt.second, Username: "second"})
+			if tt.taken && err != ErrIDTaken {
+				t.Errorf("%s/%s: err = %v, want %v", tt.name, name, err, ErrIDTaken)
+			}
+			if !tt.taken && err != nil {
+				t.Errorf("%s/%s: err = %v", tt.name, name, err)
+			}
+
+			want := "second"
+			if tt.taken {
+				want = "first"
+			}
+			if u, _ := b.GetUser("sip:100@localhost"); u.Username != want {
+				t.Errorf("%s/%s: stored profile is %q's, want %q's", tt.name, name, u.Username, want)
+			}
+		}
+	}
+}
+
+// subscriber saves user 100 with balance
+func subscriber(t *testing.T, b store, balance string) {
+	t.Helper()
+	if err := b.SaveUser(models.User{ID: "100"}); err != nil {
+		t.Fatal(err)
+	}
+	amount, err := money.Parse(balance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.SetBalance("100", amount, ActorSystem, "opening balance"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReserveSettle(t *testing.T) {
+	// Steps run in order against one subscriber with a balance of 10
+	steps := []struct {
+		name    string
+		op      string // reserve, settle or can
+		call    string
+		amount  string // asked to reserve, or the cost settled
+		granted string // reserved, or the balance after settling
+		can     bool
+	}{
+		{"first hold", "reserve", "a", "4", "4", false},
+		{"capped by what is left", "reserve", "b", "8", "6", false},
+		{"nothing left", "reserve", "c", "1", "0", false},
+		{"held balance cannot call", "can", "", "", "", false},
+		{"settle below the hold", "settle", "a", "3", "7", false},
+		{"released hold is available", "reserve", "c", "5", "1", false},
+		{"settle free call", "settle", "b", "0", "7", false},
+		{"renew hold", "reserve", "c", "2", "2", false},
+		{"holds add up", "can", "", "", "", true},
+		{"settle renewed hold", "settle", "c", "3", "4", false},
+		{"all released", "reserve", "d", "9", "4", false},
+	}
+	for name, b := range backends(t) {
+		subscriber(t, b, "10")
+		for _, st := range steps {
+			label := name + "/" + st.name
+			amount, _ := money.Parse(st.amount)
+			want, _ := money.Parse(st.granted)
+			switch st.op {
+			case "reserve":
+				got, err := b.Reserve("sip:100@example.com", amount, st.call, time.Hour)
+				if err != nil || got != want {
+					t.Errorf("%s: Reserve = %s, %v, want %s", label, got, err, want)
+				}
+			case "settle":
+				if err := b.Settle("sip:100@example.com", amount, st.call); err != nil {
+					t.Errorf("%s: Settle: %v", label, err)
+				}
+				if u, _ := b.GetUser("100"); u.Balance != want {
+					t.Errorf("%s: balance = %s, want %s", label, u.Balance, want)
+				}
+			case "can":
+				if ok, err := b.CanCall("sip:100@example.com", "sip:200@example.com"); err != nil || ok != st.can {
+					t.Errorf("%s: CanCall = %v, %v, want %v", label, ok, err, st.can)
+				}
+			}
+		}
+	}
+}
+
+func TestHoldLapses(t *testing.T) {
+	for name, b := range backends(t) {
+		subscriber(t, b, "10")
+		if got, err := b.Reserve("100", money.FromFloat(10), "lost", 10*time.Millisecond); err != nil || got != money.FromFloat(10) {
+			t.Fatalf("%s: Reserve = %s, %v", name, got, err)
+		}
+		if ok, _ := b.CanCall("100", "200"); ok {
+			t.Errorf("%s: balance held in full, call allowed", name)
+		}
+
+		// A call the proxy lost is never settled; its hold must not
+		// outlive the ttl
+		time.Sleep(50 * time.Millisecond)
+		if ok, _ := b.CanCall("100", "200"); !ok {
+			t.Errorf("%s: lapsed hold still blocks calls", name)
+		}
+		if got, err := b.Reserve("100", money.FromFloat(10), "next", time.Hour); err != nil || got != money.FromFloat(10) {
+			t.Errorf("%s: Reserve after lapse = %s, %v, want 10", name, got, err)
+		}
+		if u, _ := b.GetUser("100"); u.Balance != money.FromFloat(10) {
+			t.Errorf("%s: a lapsed hold changed the balance to %s", name, u.Balance)
+		}
+	}
+}
+
+func TestNotInBilling(t *testing.T) {
+	for name, b := range backends(t) {
+		if got, err := b.Reserve("sip:999@example.com", money.FromFloat(5), "a", time.Hour); err != nil || got != money.FromFloat(5) {
+			t.Errorf("%s: Reserve = %s, %v, want the full amount", name, got, err)
+		}
+		if ok, err := b.CanCall("sip:999@example.com", "sip:200@example.com"); err != nil || !ok {
+			t.Errorf("%s: CanCall = %v, %v, want allowed", name, ok, err)
+		}
+		if err := b.Settle("sip:999@example.com", money.FromFloat(5), "a"); err != nil {
+			t.Errorf("%s: Settle: %v", name, err)
+		}
+		if _, ok := b.GetUser("999"); ok {
+			t.Errorf("%s: Settle created the user", name)
+		}
+	}
+}
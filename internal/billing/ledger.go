@@ -0,0 +1,125 @@
+package billing
+
+import (
+	"errors"
+	"fmt"
+	"nextgen-sip/internal/models"
+	"nextgen-sip/internal/money"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Every balance change is booked as a ledger transaction in the same atomic
+// step as the balance update, so the stored balance always equals the sum
+// of the user's ledger. Reservations are holds, not transactions; only the
+// charge settled at hangup is booked.
+
+var ErrBadCursor = errors.New("invalid cursor")
+
+// ErrBalanceNotZero refuses to delete a subscriber whose ledger does not
+// close at zero; book the balance off first, so the ledger shows where it
+// went
+var ErrBalanceNotZero = errors.New("balance is not zero")
+
+// ActorSystem books changes made by the proxy itself, e.g. call charges
+const ActorSystem = "system"
+
+// ActorAnonymous books admin changes made without a valid token
+const ActorAnonymous = "anonymous"
+
+// counterAccounts is the other side of each transaction type
+var counterAccounts = map[string]string{
+	models.TxTopUp:      "cash",
+	models.TxCharge:     "revenue",
+	models.TxRefund:     "revenue",
+	models.TxAdjustment: "adjustments",
+}
+
+// newTransaction fills in the bookkeeping fields of a ledger entry;
+// Amount and Balance are set by the backend when it is applied
+func newTransaction(uri, typ, actor, reason, reference string) models.Transaction {
+	if actor == "" {
+		actor = ActorSystem
+	}
+	return models.Transaction{
+		ID:             uuid.New().String(),
+		UserID:         userID(uri),
+		Type:           typ,
+		CounterAccount: counterAccounts[typ],
+		Actor:          actor,
+		Reason:         reason,
+		Reference:      reference,
+		Time:           time.Now().UTC(),
+	}
+}
+
+// ValidatePost checks the sign of a manual posting against its type
+func ValidatePost(t models.Transaction) error {
+	if _, ok := counterAccounts[t.Type]; !ok {
+		return fmt.Errorf("unknown transaction type %q", t.Type)
+	}
+	switch t.Type {
+	case models.TxTopUp, models.TxRefund:
+		if t.Amount <= 0 {
+			return fmt.Errorf("%s amount must be positive", t.Type)
+		}
+	case models.TxCharge:
+		if t.Amount >= 0 {
+			return fmt.Errorf("charge amount must be negative")
+		}
+	case models.TxAdjustment:
+		if t.Amount == 0 {
+			return fmt.Errorf("adjustment amount must not be zero")
+		}
+	}
+	return nil
+}
+
+// Verification compares a stored balance with the sum of its ledger
+type Verification struct {
+	Balance       money.Amount `json:"balance"`
+	LedgerBalance money.Amount `json:"ledger_balance"`
+	Entries       int          `json:"entries"`
+	Consistent    bool         `json:"consistent"`
+}
+
+func verification(balance, ledger money.Amount, entries int) Verification {
+	return Verification{
+		Balance:       balance,
+		LedgerBalance: ledger,
+		Entries:       entries,
+		Consistent:    balance == ledger,
+	}
+}
+
+// pageNewestFirst pages through an oldest-first slice newest first; the
+// cursor is the number of newer entries already returned
+func pageNewestFirst(list []models.Transaction, cursor string, limit int) ([]models.Transaction, string, error) {
+	offset, err := parseOffset(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+
+	page := make([]models.Transaction, 0, limit)
+	for i := len(list) - 1 - offset; i >= 0 && len(page) < limit; i-- {
+		page = append(page, list[i])
+	}
+	next := ""
+	if offset+len(page) < len(list) {
+		next = strconv.Itoa(offset + len(page))
+	}
+	return page, next, nil
+}
+
+func parseOffset(cursor string) (int, error) {
+	if cursor == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(cursor)
+	if err != nil || n < 0 {
+		return 0, ErrBadCursor
+	}
+	return n, nil
+}
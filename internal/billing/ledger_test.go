@@ -0,0 +1,146 @@
+package billing
+
+import (
+	"nextgen-sip/internal/models"
+	"nextgen-sip/internal/money"
+	"testing"
+	"time"
+)
+
+func amount(t *testing.T, s string) money.Amount {
+	t.Helper()
+	a, err := money.Parse(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestValidatePost(t *testing.T) {
+	tests := []struct {
+		typ    string
+		amount string
+		valid  bool
+	}{
+		{models.TxTopUp, "5", true},
+		{models.TxTopUp, "-5", false},
+		{models.TxTopUp, "0", false},
+		{models.TxRefund, "1.5", true},
+		{models.TxRefund, "-1.5", false},
+		{models.TxCharge, "-0.01", true},
+		{models.TxCharge, "0.01", false},
+		{models.TxAdjustment, "-3", true},
+		{models.TxAdjustment, "3", true},
+		{models.TxAdjustment, "0", false},
+		{"gift", "3", false},
+	}
+	for _, tt := range tests {
+		err := ValidatePost(models.Transaction{Type: tt.typ, Amount: amount(t, tt.amount)})
+		if (err == nil) != tt.valid {
+			t.Errorf("%s %s: err = %v, want valid %v", tt.typ, tt.amount, err, tt.valid)
+		}
+	}
+}
+
+func TestLedger(t *testing.T) {
+	for name, b := range backends(t) {
+		subscriber(t, b, "10")
+		if _, err := b.Post("100", models.Transaction{Type: models.TxTopUp, Amount: amount(t, "5"), Actor: "admin", Reason: "card"}); err != nil {
+			t.Fatalf("%s: top-up: %v", name, err)
+		}
+		if _, err := b.Reserve("100", amount(t, "2"), "call-1", time.Hour); err != nil {
+			t.Fatalf("%s: reserve: %v", name, err)
+		}
+		if err := b.Settle("100", amount(t, "1.25"), "call-1"); err != nil {
+			t.Fatalf("%s: settle: %v", name, err)
+		}
+		if _, err := b.Post("100", models.Transaction{Type: models.TxTopUp, Amount: amount(t, "-1")}); err == nil {
+			t.Errorf("%s: negative top-up was booked", name)
+		}
+		if _, err := b.SetBalance("100", amount(t, "20"), "admin", "correction"); err != nil {
+			t.Fatalf("%s: set balance: %v", name, err)
+		}
+		// Setting the balance it already has books nothing
+		if tx, err := b.SetBalance("100", amount(t, "20"), "admin", "again"); err != nil || tx.ID != "" {
+			t.Errorf("%s: unchanged balance booked %+v, %v", name, tx, err)
+		}
+
+		// Newest first, each with the balance it left
+		want := []struct {
+			typ, amount, balance, counter, reference string
+		}{
+			{models.TxAdjustment, "6.25", "20", "adjustments", ""},
+			{models.TxCharge, "-1.25", "13.75", "revenue", "call-1"},
+			{models.TxTopUp, "5", "15", "cash", ""},
+			{models.TxAdjustment, "10", "10", "adjustments", ""},
+		}
+		var got []models.Transaction
+		cursor := ""
+		for pages := 0; pages < 10; pages++ {
+			list, next, err := b.Transactions("sip:100@example.com", cursor, 3)
+			if err != nil {
+				t.Fatalf("%s: transactions: %v", name, err)
+			}
+			got = append(got, list...)
+			if cursor = next; cursor == "" {
+				break
+			}
+		}
+		if len(got) != len(want) {
+			t.Fatalf("%s: %d transactions, want %d", name, len(got), len(want))
+		}
+		for i, w := range want {
+			tx := got[i]
+			if tx.Type != w.typ || tx.Amount != amount(t, w.amount) || tx.Balance != amount(t, w.balance) ||
+				tx.CounterAccount != w.counter || tx.Reference != w.reference || tx.UserID != "100" || tx.ID == "" {
+				t.Errorf("%s: transaction %d = %+v, want %+v", name, i, tx, w)
+			}
+		}
+
+		v, err := b.VerifyBalance("100")
+		if err != nil {
+			t.Fatalf("%s: verify: %v", name, err)
+		}
+		if !v.Consistent || v.Balance != amount(t, "20") || v.Entries != len(want) {
+			t.Errorf("%s: verification = %+v", name, v)
+		}
+	}
+}
+
+func TestBadCursor(t *testing.T) {
+	for name, b := range backends(t) {
+		subscriber(t, b, "10")
+		for _, cursor := range []string{"x", "-1"} {
+			if _, _, err := b.Transactions("100", cursor, 10); err != ErrBadCursor {
+				t.Errorf("%s: cursor %q: err = %v, want %v", name, cursor, err, ErrBadCursor)
+			}
+		}
+	}
+}
+
+func TestDeleteUser(t *testing.T) {
+	for name, b := range backends(t) {
+		subscriber(t, b, "10")
+		if err := b.DeleteUser("100"); err != ErrBalanceNotZero {
+			t.Errorf("%s: delete with balance: err = %v, want %v", name, err, ErrBalanceNotZero)
+		}
+		if _, err := b.SetBalance("100", 0, "admin", "closing"); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.DeleteUser("100"); err != nil {
+			t.Errorf("%s: delete at zero: %v", name, err)
+		}
+		if _, ok := b.GetUser("100"); ok {
+			t.Errorf("%s: user still there", name)
+		}
+
+		// The ledger is kept for audits and still adds up
+		list, _, err := b.Transactions("100", "", 10)
+		if err != nil || len(list) != 2 {
+			t.Errorf("%s: ledger after delete = %d entries, %v, want 2", name, len(list), err)
+		}
+		if v, err := b.VerifyBalance("100"); err != nil || !v.Consistent {
+			t.Errorf("%s: verification after delete = %+v, %v", name, v, err)
+		}
+	}
+}
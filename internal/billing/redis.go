@@ -0,0 +1,449 @@
+package billing
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"nextgen-sip/internal/dialplan"
+	"nextgen-sip/internal/models"
+	"nextgen-sip/internal/money"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Each subscriber is one hash, billing:user:<uri>, holding the profile as
+// JSON plus its balance in micro-units. Its ledger is the list
+// billing:ledger:<uri>. Every balance change is a script that updates the
+// hash and appends the ledger entry, so both stay in step and are atomic
+// across all proxy instances. The balance held by calls in progress is the
+// hash billing:holds:<uri>, one field per Call-ID holding
+// "<micro-units>:<expiry in Unix ms>"; a hold no instance renews lapses.
+const (
+	userKeyPrefix   = "billing:user:"
+	ledgerKeyPrefix = "billing:ledger:"
+	holdKeyPrefix   = "billing:holds:"
+	usersKey        = "billing:users" // set of subscriber URIs
+)
+
+// migrateScript converts the float balance written by earlier versions to
+// integer micro-units. Reserved totals from before holds were per call
+// cannot be told apart from ones leaked by lost calls, so they are
+// released. It is a no-op for migrated keys.
+var migrateScript = redis.NewScript(`
+local legacy = redis.call('HGET', KEYS[1], 'balance')
+if legacy then
+	redis.call('HSETNX', KEYS[1], 'balance_micros', string.format('%d', math.floor(tonumber(legacy) * 1000000 + 0.5)))
+end
+return redis.call('HDEL', KEYS[1], 'balance', 'reserved', 'reserved_micros')
+`)
+
+// heldLua defines held(key, now), the total of the unexpired holds in the
+// hold hash key. Expired holds are deleted on the way.
+const heldLua = `
+local function held(key, now)
+	local sum = 0
+	local holds = redis.call('HGETALL', key)
+	for i = 1, #holds, 2 do
+		local amt, exp = string.match(holds[i + 1], '^(%d+):(%d+)$')
+		if amt and tonumber(exp) > now then
+			sum = sum + tonumber(amt)
+		else
+			redis.call('HDEL', key, holds[i])
+		end
+	end
+	return sum
+end
+`
+
+// availableScript returns the balance not held by calls, or nil for
+// subscribers without a balance. ARGV[1] is the time in Unix ms.
+var availableScript = redis.NewScript(heldLua + `
+local bal = redis.call('HGET', KEYS[1], 'balance_micros')
+if not bal then
+	return false
+end
+return string.format('%d', tonumber(bal) - held(KEYS[2], tonumber(ARGV[1])))
+`)
+
+// reserveScript adds up to ARGV[1] micro-units of the available balance to
+// the hold of call ARGV[2], renews it until ARGV[4] (Unix ms, ARGV[3] is
+// now) and returns the amount granted. Subscribers without a balance are
+// not billed.
+var reserveScript = redis.NewScript(heldLua + `
+local bal = redis.call('HGET', KEYS[1], 'balance_micros')
+if not bal then
+	return ARGV[1]
+end
+local now, expires = tonumber(ARGV[3]), tonumber(ARGV[4])
+local avail = tonumber(bal) - held(KEYS[2], now)
+if avail <= 0 then
+	return '0'
+end
+local amt = math.min(tonumber(ARGV[1]), avail)
+local total = amt
+local cur = redis.call('HGET', KEYS[2], ARGV[2])
+if cur then
+	total = total + tonumber(string.match(cur, '^(%d+):'))
+end
+redis.call('HSET', KEYS[2], ARGV[2], string.format('%d:%d', total, expires))
+local left = redis.call('PTTL', KEYS[2])
+if left < 0 or now + left < expires then
+	redis.call('PEXPIREAT', KEYS[2], string.format('%d', expires))
+end
+return string.format('%d', amt)
+`)
+
+// applyScript changes the balance and books the ledger entry ARGV[4].
+// Amounts are micro-units. ARGV[1] is the mode:
+//
+//	set     set the balance to ARGV[2], booking the difference
+//	add     add ARGV[2] (signed)
+//	settle  release the hold of call ARGV[3] in KEYS[4] and charge ARGV[2]
+//
+// It returns the booked entry as JSON, or "" when nothing was booked
+// because the user is not billed or the amount is zero.
+var applyScript = redis.NewScript(`
+local function units(m)
+	local sign = ''
+	if m < 0 then
+		sign = '-'
+		m = -m
+	end
+	return string.format('%s%d.%06d', sign, math.floor(m / 1000000), m % 1000000)
+end
+
+local mode = ARGV[1]
+local amount = tonumber(ARGV[2])
+if mode == 'settle' then
+	redis.call('HDEL', KEYS[4], ARGV[3])
+end
+local bal = redis.call('HGET', KEYS[1], 'balance_micros')
+if not bal then
+	if mode == 'settle' then
+		return ''
+	end
+	bal = '0'
+end
+bal = tonumber(bal)
+
+if mode == 'set' then
+	amount = amount - bal
+elseif mode == 'settle' then
+	amount = -amount
+end
+
+redis.call('SADD', KEYS[3], ARGV[5])
+if amount == 0 then
+	redis.call('HSETNX', KEYS[1], 'balance_micros', '0')
+	return ''
+end
+local newbal = redis.call('HINCRBY', KEYS[1], 'balance_micros', string.format('%d', amount))
+
+-- Amounts go into the entry as decimal strings so cjson keeps every digit
+local entry = cjson.decode(ARGV[4])
+entry.amount = units(amount)
+entry.balance = units(newbal)
+local enc = cjson.encode(entry)
+redis.call('RPUSH', KEYS[2], enc)
+return enc
+`)
+
+// deleteScript removes the subscriber hash KEYS[1] and its URI ARGV[1]
+// from the set KEYS[2], unless the balance is not zero
+var deleteScript = redis.NewScript(`
+local bal = redis.call('HGET', KEYS[1], 'balance_micros')
+if bal and tonumber(bal) ~= 0 then
+	return redis.error_reply('balance is not zero')
+end
+redis.call('DEL', KEYS[1])
+return redis.call('SREM', KEYS[2], ARGV[1])
+`)
+
+// saveUserScript stores the profile ARGV[1] of tenant ARGV[2] in the hash
+// KEYS[1] and adds its URI ARGV[3] to the set KEYS[2], unless the stored
+// profile is another tenant's. A profile without a tenant is ARGV[4]'s.
+var saveUserScript = redis.NewScript(`
+local old = redis.call('HGET', KEYS[1], 'profile')
+if old then
+	local tenant = cjson.decode(old).tenant_id
+	if type(tenant) ~= 'string' or tenant == '' then
+		tenant = ARGV[4]
+	end
+	if tenant ~= ARGV[2] then
+		return redis.error_reply('account ID is taken by another tenant')
+	end
+end
+redis.call('HSET', KEYS[1], 'profile', ARGV[1])
+redis.call('HSETNX', KEYS[1], 'balance_micros', '0')
+return redis.call('SADD', KEYS[2], ARGV[3])
+`)
+
+type RedisBilling struct {
+	rdb *redis.Client
+	ctx context.Context
+}
+
+func NewRedisBilling(addr string) *RedisBilling {
+	opt, err := redis.ParseURL(addr)
+	var rdb *redis.Client
+	if err != nil {
+		rdb = redis.NewClient(&redis.Options{
+			Addr: addr,
+		})
+	} else {
+		rdb = redis.NewClient(opt)
+	}
+
+	b := &RedisBilling{
+		rdb: rdb,
+		ctx: context.Background(),
+	}
+	if err := b.migrate(); err != nil {
+		log.Printf("[Billing] ✗ Redis balance migration failed: %v", err)
+	}
+	return b
+}
+
+// migrate converts every subscriber hash to micro-unit balances
+func (b *RedisBilling) migrate() error {
+	uris, err := b.rdb.SMembers(b.ctx, usersKey).Result()
+	if err != nil {
+		return err
+	}
+	migrated := 0
+	for _, uri := range uris {
+		n, err := migrateScript.Run(b.ctx, b.rdb, []string{userKeyPrefix + uri}).Int()
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			migrated++
+		}
+	}
+	if migrated > 0 {
+		log.Printf("[Billing] ✓ Migrated %d Redis balances to micro-units", migrated)
+	}
+	return nil
+}
+
+func userKey(uri string) string {
+	return userKeyPrefix + normalizeURI(uri)
+}
+
+// apply runs applyScript for the entry t and returns the booked entry.
+// callID names the hold a settlement releases.
+func (b *RedisBilling) apply(uri, mode string, amount money.Amount, callID string, t models.Transaction) (models.Transaction, error) {
+	data, err := json.Marshal(t)
+	if err != nil {
+		return models.Transaction{}, err
+	}
+	keys := []string{userKeyPrefix + uri, ledgerKeyPrefix + uri, usersKey, holdKeyPrefix + uri}
+	res, err := applyScript.Run(b.ctx, b.rdb, keys, mode, int64(amount), callID, data, uri).Text()
+	if err != nil || res == "" {
+		return models.Transaction{}, err
+	}
+	var booked models.Transaction
+	err = json.Unmarshal([]byte(res), &booked)
+	return booked, err
+}
+
+// SetBalance books the difference to amount as an adjustment. The returned
+// transaction has no ID when the balance was already amount.
+func (b *RedisBilling) SetBalance(user string, amount money.Amount, actor, reason string) (models.Transaction, error) {
+	uri := normalizeURI(user)
+	return b.apply(uri, "set", amount, "", newTransaction(uri, models.TxAdjustment, actor, reason, ""))
+}
+
+// Post books a top-up, refund, charge or adjustment of t.Amount
+func (b *RedisBilling) Post(user string, t models.Transaction) (models.Transaction, error) {
+	if err := ValidatePost(t); err != nil {
+		return models.Transaction{}, err
+	}
+	uri := normalizeURI(user)
+	return b.apply(uri, "add", t.Amount, "", newTransaction(uri, t.Type, t.Actor, t.Reason, t.Reference))
+}
+
+// SaveUser stores the profile. Balances only change through the ledger;
+// a new user starts at zero.
+func (b *RedisBilling) SaveUser(u models.User) error {
+	uri := normalizeURI(u.ID)
+	u.Balance = 0
+	data, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	keys := []string{userKeyPrefix + uri, usersKey}
+	err = saveUserScript.Run(b.ctx, b.rdb, keys, data, tenantOf(u), uri, dialplan.DefaultTenant).Err()
+	if err != nil && err.Error() == ErrIDTaken.Error() {
+		return ErrIDTaken
+	}
+	return err
+}
+
+// Transactions returns the user's ledger, newest first. The cursor is the
+// number of newer entries already returned.
+func (b *RedisBilling) Transactions(user string, cursor string, limit int) ([]models.Transaction, string, error) {
+	offset, err := parseOffset(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+
+	key := ledgerKeyPrefix + normalizeURI(user)
+	pipe := b.rdb.TxPipeline()
+	total := pipe.LLen(b.ctx, key)
+	entries := pipe.LRange(b.ctx, key, int64(-offset-limit), int64(-offset-1))
+	if _, err := pipe.Exec(b.ctx); err != nil {
+		return nil, "", err
+	}
+
+	// LRANGE clamps a start before the head, so the last page is short
+	raw := entries.Val()
+	list := make([]models.Transaction, 0, len(raw))
+	for i := len(raw) - 1; i >= 0; i-- {
+		var t models.Transaction
+		if err := json.Unmarshal([]byte(raw[i]), &t); err != nil {
+			return nil, "", err
+		}
+		list = append(list, t)
+	}
+	next := ""
+	if offset+len(list) < int(total.Val()) {
+		next = strconv.Itoa(offset + len(list))
+	}
+	return list, next, nil
+}
+
+// VerifyBalance checks the stored balance against the sum of the ledger
+func (b *RedisBilling) VerifyBalance(user string) (Verification, error) {
+	uri := normalizeURI(user)
+	pipe := b.rdb.TxPipeline()
+	bal := pipe.HGet(b.ctx, userKeyPrefix+uri, "balance_micros")
+	entries := pipe.LRange(b.ctx, ledgerKeyPrefix+uri, 0, -1)
+	if _, err := pipe.Exec(b.ctx); err != nil && err != redis.Nil {
+		return Verification{}, err
+	}
+
+	var sum money.Amount
+	for _, raw := range entries.Val() {
+		var t models.Transaction
+		if err := json.Unmarshal([]byte(raw), &t); err != nil {
+			return Verification{}, err
+		}
+		sum += t.Amount
+	}
+	return verification(parseAmount(bal.Val()), sum, len(entries.Val())), nil
+}
+
+// GetUser returns the subscriber for a SIP URI or bare username
+func (b *RedisBilling) GetUser(uri string) (models.User, bool) {
+	fields, err := b.rdb.HGetAll(b.ctx, userKey(uri)).Result()
+	if err != nil {
+		log.Printf("[Billing] ✗ Failed to load %s: %v", uri, err)
+		return models.User{}, false
+	}
+	return decodeUser(normalizeURI(uri), fields)
+}
+
+func (b *RedisBilling) ListUsers() ([]models.User, error) {
+	uris, err := b.rdb.SMembers(b.ctx, usersKey).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	pipe := b.rdb.Pipeline()
+	cmds := make([]*redis.StringStringMapCmd, len(uris))
+	for i, uri := range uris {
+		cmds[i] = pipe.HGetAll(b.ctx, userKeyPrefix+uri)
+	}
+	if _, err := pipe.Exec(b.ctx); err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	list := make([]models.User, 0, len(uris))
+	for i, cmd := range cmds {
+		if u, ok := decodeUser(uris[i], cmd.Val()); ok {
+			list = append(list, u)
+		}
+	}
+	return list, nil
+}
+
+// DeleteUser removes the subscriber; its ledger is kept for audits. A
+// subscriber with a balance is refused with ErrBalanceNotZero.
+func (b *RedisBilling) DeleteUser(uri string) error {
+	uri = normalizeURI(uri)
+	err := deleteScript.Run(b.ctx, b.rdb, []string{userKeyPrefix + uri, usersKey}, uri).Err()
+	if err != nil && err.Error() == ErrBalanceNotZero.Error() {
+		return ErrBalanceNotZero
+	}
+	return err
+}
+
+func (b *RedisBilling) CanCall(from string, to string) (bool, error) {
+	uri := normalizeURI(from)
+	keys := []string{userKeyPrefix + uri, holdKeyPrefix + uri}
+	res, err := availableScript.Run(b.ctx, b.rdb, keys, time.Now().UnixMilli()).Result()
+	if err == redis.Nil {
+		// Same policy as the in-memory store: unknown users are not billed
+		log.Printf("[Billing] User %s not in billing, allowing call", from)
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	balance := parseAmount(res)
+	if balance <= 0 {
+		log.Printf("[Billing] User %s has no available balance (%s), denying", from, balance)
+		return false, nil
+	}
+	return true, nil
+}
+
+// Reserve adds up to amount of the user's available balance to the hold
+// of call callID, renewed until ttl from now, and returns how much was
+// granted
+func (b *RedisBilling) Reserve(user string, amount money.Amount, callID string, ttl time.Duration) (money.Amount, error) {
+	uri := normalizeURI(user)
+	keys := []string{userKeyPrefix + uri, holdKeyPrefix + uri}
+	now := time.Now()
+	res, err := reserveScript.Run(b.ctx, b.rdb, keys, int64(amount), callID, now.UnixMilli(), now.Add(ttl).UnixMilli()).Text()
+	if err != nil {
+		return 0, err
+	}
+	granted, err := strconv.ParseInt(res, 10, 64)
+	return money.Amount(granted), err
+}
+
+// Settle releases the hold of call callID and books the real cost of the
+// call as a charge referencing it
+func (b *RedisBilling) Settle(user string, cost money.Amount, callID string) error {
+	uri := normalizeURI(user)
+	_, err := b.apply(uri, "settle", cost, callID, newTransaction(uri, models.TxCharge, ActorSystem, "call charge", callID))
+	return err
+}
+
+func decodeUser(uri string, fields map[string]string) (models.User, bool) {
+	if len(fields) == 0 {
+		return models.User{}, false
+	}
+	var u models.User
+	if p, ok := fields["profile"]; ok {
+		if err := json.Unmarshal([]byte(p), &u); err != nil {
+			log.Printf("[Billing] ✗ Corrupt profile for %s: %v", uri, err)
+		}
+	} else {
+		// Balance set without a profile
+		u.ID = userID(uri)
+	}
+	u.Balance = parseAmount(fields["balance_micros"])
+	return u, true
+}
+
+// parseAmount reads a micro-unit hash field
+func parseAmount(v interface{}) money.Amount {
+	s, _ := v.(string)
+	n, _ := strconv.ParseInt(s, 10, 64)
+	return money.Amount(n)
+}
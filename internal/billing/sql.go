@@ -0,0 +1,474 @@
+package billing
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"nextgen-sip/internal/dialplan"
+	"nextgen-sip/internal/models"
+	"nextgen-sip/internal/money"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Amounts are stored as integer micro-units (see package money)
+const sqlSchema = `
+CREATE TABLE IF NOT EXISTS billing_users (
+	uri             TEXT PRIMARY KEY,
+	id              TEXT NOT NULL,
+	tenant_id       TEXT NOT NULL DEFAULT '',
+	username        TEXT NOT NULL DEFAULT '',
+	password        TEXT NOT NULL DEFAULT '',
+	level           INTEGER NOT NULL DEFAULT 0,
+	rate_deck       TEXT NOT NULL DEFAULT '',
+	currency        TEXT NOT NULL DEFAULT '',
+	balance_micros  INTEGER NOT NULL DEFAULT 0
+);
+CREATE TABLE IF NOT EXISTS billing_holds (
+	uri             TEXT NOT NULL,
+	call_id         TEXT NOT NULL,
+	amount_micros   INTEGER NOT NULL,
+	expires_ms      INTEGER NOT NULL, -- Unix ms
+	PRIMARY KEY (uri, call_id)
+);
+CREATE TABLE IF NOT EXISTS billing_ledger (
+	seq             INTEGER PRIMARY KEY AUTOINCREMENT,
+	id              TEXT NOT NULL UNIQUE,
+	uri             TEXT NOT NULL,
+	user_id         TEXT NOT NULL,
+	type            TEXT NOT NULL,
+	amount_micros   INTEGER NOT NULL,
+	balance_micros  INTEGER NOT NULL,
+	counter_account TEXT NOT NULL,
+	actor           TEXT NOT NULL,
+	reason          TEXT NOT NULL,
+	reference       TEXT NOT NULL DEFAULT '',
+	time            TIMESTAMP NOT NULL
+);
+CREATE INDEX IF NOT EXISTS billing_ledger_uri ON billing_ledger (uri, seq);
+`
+
+// floatTables renames tables that still hold REAL amounts out of the way
+// of sqlSchema; copyFloatTables then converts their rows
+const floatTables = `
+ALTER TABLE billing_users RENAME TO billing_users_float;
+DROP INDEX IF EXISTS billing_ledger_uri;
+ALTER TABLE billing_ledger RENAME TO billing_ledger_float;
+`
+
+const copyFloatTables = `
+INSERT INTO billing_users (uri, id, tenant_id, username, password, level, rate_deck, balance_micros)
+SELECT uri, id, tenant_id, username, password, level, rate_deck,
+       CAST(ROUND(balance * 1000000) AS INTEGER)
+FROM billing_users_float;
+INSERT INTO billing_ledger (seq, id, uri, user_id, type, amount_micros, balance_micros, counter_account, actor, reason, reference, time)
+SELECT seq, id, uri, user_id, type,
+       CAST(ROUND(amount * 1000000) AS INTEGER), CAST(ROUND(balance * 1000000) AS INTEGER),
+       counter_account, actor, reason, reference, time
+FROM billing_ledger_float;
+DROP TABLE billing_users_float;
+DROP TABLE billing_ledger_float;
+`
+
+// openingBalances books balances that predate the ledger as adjustments,
+// so every stored balance can be verified against its ledger
+const openingBalances = `
+INSERT INTO billing_ledger (id, uri, user_id, type, amount_micros, balance_micros, counter_account, actor, reason, time)
+SELECT 'opening:' || uri, uri, id, 'adjustment', balance_micros, balance_micros, 'adjustments', 'system', 'opening balance', ?
+FROM billing_users u
+WHERE balance_micros != 0 AND NOT EXISTS (SELECT 1 FROM billing_ledger l WHERE l.uri = u.uri)`
+
+// SQLBilling stores subscribers and balances in an embedded SQLite
+// database. Balance changes are single statements or short transactions,
+// so they are atomic, but the database file belongs to one proxy instance;
+// use the Redis store to share balances between instances.
+type SQLBilling struct {
+	db *sql.DB
+}
+
+// NewSQLBilling opens the database with the given database/sql driver
+// (e.g. "sqlite3") and creates the schema if needed
+func NewSQLBilling(driver, dsn string) (*SQLBilling, error) {
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows one writer; serializing here avoids "database is locked"
+	db.SetMaxOpenConns(1)
+	if err := migrateSchema(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("create schema: %w", err)
+	}
+	if _, err := db.Exec(openingBalances, time.Now().UTC()); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("book opening balances: %w", err)
+	}
+	// The database belongs to this instance, so no call holding balance
+	// survived its restart
+	res, err := db.Exec(`DELETE FROM billing_holds`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("release holds: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		log.Printf("[Billing] Released %d hold(s) left by calls of a previous run", n)
+	}
+	return &SQLBilling{db: db}, nil
+}
+
+// migrateSchema creates the tables, converting REAL amounts written by
+// earlier versions to micro-units in the same transaction
+func migrateSchema(db *sql.DB) error {
+	var legacy int
+	err := db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('billing_users') WHERE name = 'balance'`).Scan(&legacy)
+	if err != nil {
+		return err
+	}
+	if legacy == 0 {
+		_, err := db.Exec(sqlSchema)
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	// Databases from before the ledger have no billing_ledger yet
+	if _, err := tx.Exec(`CREATE TABLE IF NOT EXISTS billing_ledger (
+		seq INTEGER PRIMARY KEY AUTOINCREMENT, id TEXT NOT NULL UNIQUE, uri TEXT NOT NULL,
+		user_id TEXT NOT NULL, type TEXT NOT NULL, amount REAL NOT NULL, balance REAL NOT NULL,
+		counter_account TEXT NOT NULL, actor TEXT NOT NULL, reason TEXT NOT NULL,
+		reference TEXT NOT NULL DEFAULT '', time TIMESTAMP NOT NULL)`); err != nil {
+		return err
+	}
+	for _, stmt := range []string{floatTables, sqlSchema, copyFloatTables} {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	log.Printf("[Billing] ✓ Migrated SQLite balances to micro-units")
+	return nil
+}
+
+func (b *SQLBilling) Close() error {
+	return b.db.Close()
+}
+
+// applyTx changes the balance by t.Amount and books t in the same
+// transaction, creating the balance if the user has none yet
+func applyTx(tx *sql.Tx, uri string, t models.Transaction) (models.Transaction, error) {
+	_, err := tx.Exec(`
+		INSERT INTO billing_users (uri, id, balance_micros) VALUES (?, ?, ?)
+		ON CONFLICT (uri) DO UPDATE SET balance_micros = balance_micros + excluded.balance_micros`,
+		uri, userID(uri), t.Amount)
+	if err != nil {
+		return t, err
+	}
+	if err := tx.QueryRow(`SELECT balance_micros FROM billing_users WHERE uri = ?`, uri).Scan(&t.Balance); err != nil {
+		return t, err
+	}
+	_, err = tx.Exec(`
+		INSERT INTO billing_ledger (id, uri, user_id, type, amount_micros, balance_micros, counter_account, actor, reason, reference, time)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		t.ID, uri, t.UserID, t.Type, t.Amount, t.Balance, t.CounterAccount, t.Actor, t.Reason, t.Reference, t.Time)
+	return t, err
+}
+
+// SetBalance books the difference to amount as an adjustment. The returned
+// transaction has no ID when the balance was already amount.
+func (b *SQLBilling) SetBalance(user string, amount money.Amount, actor, reason string) (models.Transaction, error) {
+	tx, err := b.db.Begin()
+	if err != nil {
+		return models.Transaction{}, err
+	}
+	defer tx.Rollback()
+
+	uri := normalizeURI(user)
+	var current money.Amount
+	err = tx.QueryRow(`SELECT balance_micros FROM billing_users WHERE uri = ?`, uri).Scan(&current)
+	if err != nil && err != sql.ErrNoRows {
+		return models.Transaction{}, err
+	}
+
+	t := newTransaction(uri, models.TxAdjustment, actor, reason, "")
+	t.Amount = amount - current
+	if t.Amount == 0 {
+		_, err = tx.Exec(`INSERT INTO billing_users (uri, id) VALUES (?, ?) ON CONFLICT (uri) DO NOTHING`, uri, userID(uri))
+		if err != nil {
+			return models.Transaction{}, err
+		}
+		return models.Transaction{}, tx.Commit()
+	}
+	if t, err = applyTx(tx, uri, t); err != nil {
+		return models.Transaction{}, err
+	}
+	return t, tx.Commit()
+}
+
+// Post books a top-up, refund, charge or adjustment of t.Amount
+func (b *SQLBilling) Post(user string, t models.Transaction) (models.Transaction, error) {
+	if err := ValidatePost(t); err != nil {
+		return models.Transaction{}, err
+	}
+	tx, err := b.db.Begin()
+	if err != nil {
+		return models.Transaction{}, err
+	}
+	defer tx.Rollback()
+
+	uri := normalizeURI(user)
+	entry := newTransaction(uri, t.Type, t.Actor, t.Reason, t.Reference)
+	entry.Amount = t.Amount
+	if entry, err = applyTx(tx, uri, entry); err != nil {
+		return models.Transaction{}, err
+	}
+	return entry, tx.Commit()
+}
+
+// SaveUser stores the profile. Balances only change through the ledger;
+// a new user starts at zero.
+func (b *SQLBilling) SaveUser(u models.User) error {
+	// The update is skipped when the account is another tenant's
+	res, err := b.db.Exec(`
+		INSERT INTO billing_users (uri, id, tenant_id, username, password, level, rate_deck, currency)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (uri) DO UPDATE SET
+			id = excluded.id, tenant_id = excluded.tenant_id, username = excluded.username,
+			password = excluded.password, level = excluded.level, rate_deck = excluded.rate_deck,
+			currency = excluded.currency
+		WHERE COALESCE(NULLIF(billing_users.tenant_id, ''), ?) = ?`,
+		normalizeURI(u.ID), u.ID, u.TenantID, u.Username, u.Password, u.Level, u.RateDeck, u.Currency,
+		dialplan.DefaultTenant, tenantOf(u))
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrIDTaken
+	}
+	return nil
+}
+
+// Transactions returns the user's ledger, newest first. The cursor is the
+// sequence number of the last entry returned.
+func (b *SQLBilling) Transactions(user string, cursor string, limit int) ([]models.Transaction, string, error) {
+	before := int64(math.MaxInt64)
+	if cursor != "" {
+		n, err := strconv.ParseInt(cursor, 10, 64)
+		if err != nil || n < 0 {
+			return nil, "", ErrBadCursor
+		}
+		before = n
+	}
+
+	// One extra row tells whether there is another page
+	rows, err := b.db.Query(`
+		SELECT seq, id, user_id, type, amount_micros, balance_micros, counter_account, actor, reason, reference, time
+		FROM billing_ledger WHERE uri = ? AND seq < ? ORDER BY seq DESC LIMIT ?`,
+		normalizeURI(user), before, limit+1)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	list := make([]models.Transaction, 0, limit)
+	var seq int64
+	next := ""
+	for rows.Next() {
+		if len(list) == limit {
+			next = strconv.FormatInt(seq, 10)
+			break
+		}
+		var t models.Transaction
+		err := rows.Scan(&seq, &t.ID, &t.UserID, &t.Type, &t.Amount, &t.Balance,
+			&t.CounterAccount, &t.Actor, &t.Reason, &t.Reference, &t.Time)
+		if err != nil {
+			return nil, "", err
+		}
+		list = append(list, t)
+	}
+	return list, next, rows.Err()
+}
+
+// VerifyBalance checks the stored balance against the sum of the ledger
+func (b *SQLBilling) VerifyBalance(user string) (Verification, error) {
+	uri := normalizeURI(user)
+	var balance, sum money.Amount
+	var entries int
+	err := b.db.QueryRow(`
+		SELECT COALESCE((SELECT balance_micros FROM billing_users WHERE uri = ?1), 0),
+		       COALESCE(SUM(amount_micros), 0), COUNT(*)
+		FROM billing_ledger WHERE uri = ?1`, uri).Scan(&balance, &sum, &entries)
+	if err != nil {
+		return Verification{}, err
+	}
+	return verification(balance, sum, entries), nil
+}
+
+const userColumns = `id, tenant_id, username, password, level, rate_deck, currency, balance_micros`
+
+func scanUser(row interface{ Scan(...interface{}) error }) (models.User, error) {
+	var u models.User
+	err := row.Scan(&u.ID, &u.TenantID, &u.Username, &u.Password, &u.Level, &u.RateDeck, &u.Currency, &u.Balance)
+	return u, err
+}
+
+// GetUser returns the subscriber for a SIP URI or bare username
+func (b *SQLBilling) GetUser(uri string) (models.User, bool) {
+	u, err := scanUser(b.db.QueryRow(`SELECT `+userColumns+` FROM billing_users WHERE uri = ?`, normalizeURI(uri)))
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("[Billing] ✗ Failed to load %s: %v", uri, err)
+		}
+		return models.User{}, false
+	}
+	return u, true
+}
+
+func (b *SQLBilling) ListUsers() ([]models.User, error) {
+	rows, err := b.db.Query(`SELECT ` + userColumns + ` FROM billing_users ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []models.User
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, u)
+	}
+	return list, rows.Err()
+}
+
+// DeleteUser removes the subscriber; its ledger is kept for audits. A
+// subscriber with a balance is refused with ErrBalanceNotZero.
+func (b *SQLBilling) DeleteUser(uri string) error {
+	tx, err := b.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	uri = normalizeURI(uri)
+	var balance money.Amount
+	err = tx.QueryRow(`SELECT balance_micros FROM billing_users WHERE uri = ?`, uri).Scan(&balance)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if balance != 0 {
+		return ErrBalanceNotZero
+	}
+	if _, err := tx.Exec(`DELETE FROM billing_users WHERE uri = ?`, uri); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// availableQuery reads a user's balance less its unexpired holds
+const availableQuery = `
+SELECT balance_micros - COALESCE((SELECT SUM(amount_micros) FROM billing_holds h WHERE h.uri = u.uri AND h.expires_ms > ?2), 0)
+FROM billing_users u WHERE uri = ?1`
+
+func (b *SQLBilling) CanCall(from string, to string) (bool, error) {
+	var available money.Amount
+	err := b.db.QueryRow(availableQuery, normalizeURI(from), time.Now().UnixMilli()).Scan(&available)
+	if err == sql.ErrNoRows {
+		log.Printf("[Billing] User %s not in billing, allowing call", from)
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if available <= 0 {
+		log.Printf("[Billing] User %s has no available balance (%s), denying", from, available)
+		return false, nil
+	}
+	return true, nil
+}
+
+// Reserve adds up to amount of the user's available balance to the hold
+// of call callID, renewed until ttl from now, and returns how much was
+// granted
+func (b *SQLBilling) Reserve(user string, amount money.Amount, callID string, ttl time.Duration) (money.Amount, error) {
+	tx, err := b.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	uri := normalizeURI(user)
+	now := time.Now()
+	if _, err := tx.Exec(`DELETE FROM billing_holds WHERE uri = ? AND expires_ms <= ?`, uri, now.UnixMilli()); err != nil {
+		return 0, err
+	}
+	var available money.Amount
+	err = tx.QueryRow(availableQuery, uri, now.UnixMilli()).Scan(&available)
+	if err == sql.ErrNoRows {
+		return amount, nil // User not in billing
+	}
+	if err != nil {
+		return 0, err
+	}
+	if available <= 0 {
+		return 0, nil
+	}
+	if amount > available {
+		amount = available
+	}
+	_, err = tx.Exec(`
+		INSERT INTO billing_holds (uri, call_id, amount_micros, expires_ms) VALUES (?, ?, ?, ?)
+		ON CONFLICT (uri, call_id) DO UPDATE SET
+			amount_micros = amount_micros + excluded.amount_micros, expires_ms = excluded.expires_ms`,
+		uri, callID, amount, now.Add(ttl).UnixMilli())
+	if err != nil {
+		return 0, err
+	}
+	return amount, tx.Commit()
+}
+
+// Settle releases the hold of call callID and books the real cost of the
+// call as a charge referencing it
+func (b *SQLBilling) Settle(user string, cost money.Amount, callID string) error {
+	tx, err := b.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	uri := normalizeURI(user)
+	if _, err := tx.Exec(`DELETE FROM billing_holds WHERE uri = ? AND call_id = ?`, uri, callID); err != nil {
+		return err
+	}
+	var billed bool
+	err = tx.QueryRow(`SELECT 1 FROM billing_users WHERE uri = ?`, uri).Scan(&billed)
+	if err == sql.ErrNoRows {
+		return tx.Commit() // User not in billing
+	}
+	if err != nil {
+		return err
+	}
+	if cost > 0 {
+		t := newTransaction(uri, models.TxCharge, ActorSystem, "call charge", callID)
+		t.Amount = -cost
+		if _, err := applyTx(tx, uri, t); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// userID recovers the subscriber ID from a normalized URI
+func userID(uri string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(uri, "sip:"), "@localhost")
+}
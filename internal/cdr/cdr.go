@@ -0,0 +1,234 @@
+package cdr
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"nextgen-sip/internal/models"
+	"os"
+	"strconv"
+	"sync"
+)
+
+var ErrBadCursor = errors.New("invalid cursor")
+
+// Records are returned oldest first. Cursors are opaque to callers: the
+// memory store uses a sequence number, the file store a byte offset.
+
+// MemoryStore keeps the most recent CDRs in memory. Once limit is reached
+// it is a ring: each record saved overwrites the oldest in place.
+type MemoryStore struct {
+	mu      sync.RWMutex
+	records []models.CDR
+	head    int   // index in records of the oldest record
+	first   int64 // sequence number of the oldest record
+	limit   int
+}
+
+func NewMemoryStore(limit int) *MemoryStore {
+	return &MemoryStore{
+		records: make([]models.CDR, 0, 1024),
+		limit:   limit,
+	}
+}
+
+func (s *MemoryStore) Save(c models.CDR) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.limit <= 0 || len(s.records) < s.limit {
+		s.records = append(s.records, c)
+		return nil
+	}
+	// Full: drop the oldest record
+	s.records[s.head] = c
+	s.head = (s.head + 1) % len(s.records)
+	s.first++
+	return nil
+}
+
+// at returns the i-th oldest record
+func (s *MemoryStore) at(i int) models.CDR {
+	return s.records[(s.head+i)%len(s.records)]
+}
+
+func (s *MemoryStore) Query(f Filter, cursor string, limit int) ([]models.CDR, string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	start, err := parseCursor(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	i := int(start - s.first)
+	if i < 0 {
+		// Cursor points at records that were already evicted
+		i = 0
+	}
+
+	list := make([]models.CDR, 0, limit)
+	for ; i < len(s.records); i++ {
+		c := s.at(i)
+		if !f.Match(c) {
+			continue
+		}
+		if len(list) == limit {
+			return list, strconv.FormatInt(s.first+int64(i), 10), nil
+		}
+		list = append(list, c)
+	}
+	return list, "", nil
+}
+
+func (s *MemoryStore) Export(f Filter, fn func(models.CDR) error) error {
+	s.mu.RLock()
+	snapshot := make([]models.CDR, len(s.records))
+	for i := range snapshot {
+		snapshot[i] = s.at(i)
+	}
+	s.mu.RUnlock()
+
+	for _, c := range snapshot {
+		if !f.Match(c) {
+			continue
+		}
+		if err := fn(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FileStore appends CDRs as JSON lines to a file
+type FileStore struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+	w    *bufio.Writer
+}
+
+func NewFileStore(path string) (*FileStore, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("open cdr file: %w", err)
+	}
+	return &FileStore{
+		path: path,
+		f:    f,
+		w:    bufio.NewWriter(f),
+	}, nil
+}
+
+func (s *FileStore) Save(c models.CDR) error {
+	line, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.w.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	// Flush per record: a crash must not lose billed calls
+	return s.w.Flush()
+}
+
+func (s *FileStore) Query(f Filter, cursor string, limit int) ([]models.CDR, string, error) {
+	offset, err := parseCursor(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+
+	list := make([]models.CDR, 0, limit)
+	next := ""
+	err = s.scan(offset, func(c models.CDR, pos int64) error {
+		if !f.Match(c) {
+			return nil
+		}
+		if len(list) == limit {
+			next = strconv.FormatInt(pos, 10)
+			return io.EOF
+		}
+		list = append(list, c)
+		return nil
+	})
+	if err != nil && err != io.EOF {
+		return nil, "", err
+	}
+	return list, next, nil
+}
+
+func (s *FileStore) Export(f Filter, fn func(models.CDR) error) error {
+	err := s.scan(0, func(c models.CDR, _ int64) error {
+		if !f.Match(c) {
+			return nil
+		}
+		return fn(c)
+	})
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+// scan reads records starting at byte offset, passing each with its own
+// offset. It uses a separate read handle so writers are never blocked.
+func (s *FileStore) scan(offset int64, fn func(c models.CDR, pos int64) error) error {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return ErrBadCursor
+	}
+
+	r := bufio.NewReader(f)
+	pos := offset
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			// Ignore a partially written trailing line
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		start := pos
+		pos += int64(len(line))
+
+		var c models.CDR
+		if err := json.Unmarshal(line, &c); err != nil {
+			// Corrupt line, e.g. after a crash mid-write
+			continue
+		}
+		if err := fn(c, start); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *FileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.w.Flush(); err != nil {
+		return err
+	}
+	return s.f.Close()
+}
+
+func parseCursor(cursor string) (int64, error) {
+	if cursor == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(cursor, 10, 64)
+	if err != nil || n < 0 {
+		return 0, ErrBadCursor
+	}
+	return n, nil
+}
@@ -0,0 +1,193 @@
+package cdr
+
+import (
+	"nextgen-sip/internal/models"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// fill saves n records with IDs "0" to n-1, alternating tenants a and b
+func fill(t *testing.T, s *MemoryStore, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		tenant := "a"
+		if i%2 == 1 {
+			tenant = "b"
+		}
+		if err := s.Save(models.CDR{ID: strconv.Itoa(i), TenantID: tenant}); err != nil {
+			t.Fatalf("save %d: %v", i, err)
+		}
+	}
+}
+
+func ids(list []models.CDR) string {
+	var out []string
+	for _, c := range list {
+		out = append(out, c.ID)
+	}
+	return strings.Join(out, ",")
+}
+
+func TestMemoryQuery(t *testing.T) {
+	tests := []struct {
+		name   string
+		limit  int // store limit
+		saved  int
+		filter Filter
+		cursor string
+		page   int
+		want   string
+		next   string
+	}{
+		{"first page", 0, 5, Filter{}, "", 2, "0,1", "2"},
+		{"next page", 0, 5, Filter{}, "2", 2, "2,3", "4"},
+		{"last page", 0, 5, Filter{}, "4", 2, "4", ""},
+		{"exact page", 0, 4, Filter{}, "2", 2, "2,3", ""},
+		{"filtered", 0, 6, Filter{TenantID: "b"}, "", 2, "1,3", "5"},
+		{"filtered next", 0, 6, Filter{TenantID: "b"}, "5", 2, "5", ""},
+		{"not yet full", 5, 4, Filter{}, "", 10, "0,1,2,3", ""},
+		{"wrapped", 3, 7, Filter{}, "", 10, "4,5,6", ""},
+		{"wrapped page", 3, 7, Filter{}, "", 2, "4,5", "6"},
+		{"wrapped cursor", 3, 7, Filter{}, "5", 2, "5,6", ""},
+		{"evicted cursor", 3, 7, Filter{}, "1", 2, "4,5", "6"},
+		{"past the end", 3, 7, Filter{}, "9", 2, "", ""},
+		{"wrapped filtered", 3, 8, Filter{TenantID: "a"}, "", 10, "6", ""},
+	}
+	for _, tt := range tests {
+		s := NewMemoryStore(tt.limit)
+		fill(t, s, tt.saved)
+		list, next, err := s.Query(tt.filter, tt.cursor, tt.page)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got := ids(list); got != tt.want || next != tt.next {
+			t.Errorf("%s: got %q next %q, want %q next %q", tt.name, got, next, tt.want, tt.next)
+		}
+	}
+}
+
+func TestMemoryBadCursor(t *testing.T) {
+	s := NewMemoryStore(0)
+	fill(t, s, 2)
+	for _, cursor := range []string{"x", "-1", "1.5"} {
+		if _, _, err := s.Query(Filter{}, cursor, 10); err != ErrBadCursor {
+			t.Errorf("%s: err = %v, want %v", cursor, err, ErrBadCursor)
+		}
+	}
+}
+
+func TestMemoryExport(t *testing.T) {
+	s := NewMemoryStore(4)
+	fill(t, s, 10)
+	var list []models.CDR
+	err := s.Export(Filter{}, func(c models.CDR) error {
+		list = append(list, c)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ids(list); got != "6,7,8,9" {
+		t.Errorf("export = %q, want oldest first %q", got, "6,7,8,9")
+	}
+}
+
+// fileStore writes n records like fill does, to a file in a temp dir
+func fileStore(t *testing.T, n int) *FileStore {
+	t.Helper()
+	s, err := NewFileStore(filepath.Join(t.TempDir(), "cdr.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	for i := 0; i < n; i++ {
+		tenant := "a"
+		if i%2 == 1 {
+			tenant = "b"
+		}
+		if err := s.Save(models.CDR{ID: strconv.Itoa(i), TenantID: tenant}); err != nil {
+			t.Fatalf("save %d: %v", i, err)
+		}
+	}
+	return s
+}
+
+func TestFileQuery(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter Filter
+		page   int
+		want   []string // IDs of each page in turn
+	}{
+		{"single page", Filter{}, 10, []string{"0,1,2,3,4"}},
+		{"paged", Filter{}, 2, []string{"0,1", "2,3", "4"}},
+		{"exact pages", Filter{}, 5, []string{"0,1,2,3,4"}},
+		{"filtered", Filter{TenantID: "b"}, 1, []string{"1", "3"}},
+		{"nothing matches", Filter{TenantID: "c"}, 2, []string{""}},
+	}
+	for _, tt := range tests {
+		s := fileStore(t, 5)
+		cursor := ""
+		var pages []string
+		for len(pages) < 10 {
+			list, next, err := s.Query(tt.filter, cursor, tt.page)
+			if err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			pages = append(pages, ids(list))
+			if cursor = next; cursor == "" {
+				break
+			}
+		}
+		if strings.Join(pages, "|") != strings.Join(tt.want, "|") {
+			t.Errorf("%s: pages %q, want %q", tt.name, pages, tt.want)
+		}
+	}
+}
+
+func TestFileSkipsBadLines(t *testing.T) {
+	s := fileStore(t, 2)
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A corrupt line, then a record still being written
+	f.WriteString("{\"id\": \"torn\n{\"id\":\"partial\"")
+	f.Close()
+
+	list, next, err := s.Query(Filter{}, "", 10)
+	if err != nil || next != "" {
+		t.Fatalf("query: next %q, %v", next, err)
+	}
+	if got := ids(list); got != "0,1" {
+		t.Errorf("records = %q, want %q", got, "0,1")
+	}
+}
+
+func TestFileBadCursor(t *testing.T) {
+	s := fileStore(t, 2)
+	for _, cursor := range []string{"x", "-1"} {
+		if _, _, err := s.Query(Filter{}, cursor, 10); err != ErrBadCursor {
+			t.Errorf("%s: err = %v, want %v", cursor, err, ErrBadCursor)
+		}
+	}
+}
+
+func TestFileExport(t *testing.T) {
+	s := fileStore(t, 4)
+	var list []models.CDR
+	err := s.Export(Filter{TenantID: "a"}, func(c models.CDR) error {
+		list = append(list, c)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ids(list); got != "0,2" {
+		t.Errorf("export = %q, want %q", got, "0,2")
+	}
+}
@@ -0,0 +1,43 @@
+package cdr
+
+import (
+	"nextgen-sip/internal/models"
+	"strings"
+	"time"
+)
+
+// Filter selects CDRs for queries and exports. Zero fields match everything.
+type Filter struct {
+	TenantID string
+	Caller   string // substring of From
+	Callee   string // substring of To
+	Status   string
+	Trunk    string
+	Since    time.Time // setup time, inclusive
+	Until    time.Time // setup time, exclusive
+}
+
+func (f Filter) Match(c models.CDR) bool {
+	if f.TenantID != "" && c.TenantID != f.TenantID {
+		return false
+	}
+	if f.Caller != "" && !strings.Contains(c.From, f.Caller) {
+		return false
+	}
+	if f.Callee != "" && !strings.Contains(c.To, f.Callee) {
+		return false
+	}
+	if f.Status != "" && !strings.EqualFold(c.Status, f.Status) {
+		return false
+	}
+	if f.Trunk != "" && c.Trunk != f.Trunk {
+		return false
+	}
+	if !f.Since.IsZero() && c.SetupTime.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !c.SetupTime.Before(f.Until) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,181 @@
+package dialplan
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// DefaultTenant is the tenant whose plan applies to tenants without one
+const DefaultTenant = "default"
+
+var (
+	errBadCountryCode = errors.New("country code must be 1 to 3 digits")
+	errBadPrefix      = errors.New("dialing prefixes may only contain digits")
+	digitsRe          = regexp.MustCompile(`^[0-9]*$`)
+	// Spaces, dashes, dots and brackets people type inside phone numbers
+	visualSeparators = strings.NewReplacer(" ", "", "-", "", ".", "", "(", "", ")", "")
+)
+
+// Rule rewrites dialed numbers matching a regular expression; Replace may
+// refer to submatches as $1, ${name} and so on
+type Rule struct {
+	Match       string `json:"match"`
+	Replace     string `json:"replace"`
+	Description string `json:"description,omitempty"`
+
+	re *regexp.Regexp
+}
+
+// Route sends calls to normalized numbers matching a regular expression
+// out through a trunk, when they are not for one of our subscribers. With
+// several trunks the cheapest is tried first and the others take over
+// when it fails.
+type Route struct {
+	Match       string   `json:"match"`
+	Trunk       string   `json:"trunk,omitempty"`
+	Trunks      []string `json:"trunks,omitempty"`
+	Description string   `json:"description,omitempty"`
+
+	re *regexp.Regexp
+}
+
+// Plan is how a tenant's users dial. Numbers are turned into E.164 by the
+// first matching rule, then by the plan's prefixes: an international
+// prefix is replaced with +, a national prefix with + and the country
+// code. Numbers neither a rule nor a prefix accounts for, such as
+// extensions and user names, are left as dialed. Routes pick the trunk
+// for numbers off our network.
+type Plan struct {
+	TenantID            string  `json:"tenant_id"`
+	CountryCode         string  `json:"country_code"`         // Home country, e.g. "972"
+	NationalPrefix      string  `json:"national_prefix"`      // Trunk prefix for national calls, e.g. "0"
+	InternationalPrefix string  `json:"international_prefix"` // Exit code, e.g. "00"
+	ExtensionLength     int     `json:"extension_length"`     // Numbers this short are extensions, never expanded
+	Rules               []Rule  `json:"rules"`
+	Routes              []Route `json:"routes"`
+}
+
+// Translation is the outcome of normalizing one number
+type Translation struct {
+	Dialed string `json:"dialed"`
+	Number string `json:"number"`
+	E164   bool   `json:"e164"`
+	Rule   int    `json:"rule"` // Index of the rule applied, -1 for none
+}
+
+// Compile validates p and prepares its rules
+func (p *Plan) Compile() error {
+	if p.CountryCode != "" && (len(p.CountryCode) > 3 || !digitsRe.MatchString(p.CountryCode)) {
+		return errBadCountryCode
+	}
+	if !digitsRe.MatchString(p.NationalPrefix) || !digitsRe.MatchString(p.InternationalPrefix) {
+		return errBadPrefix
+	}
+	if p.ExtensionLength < 0 {
+		return errors.New("extension length must not be negative")
+	}
+	if p.NationalPrefix != "" && p.NationalPrefix == p.InternationalPrefix {
+		return fmt.Errorf("national and international prefix are both %q", p.NationalPrefix)
+	}
+	if p.Rules == nil {
+		p.Rules = []Rule{}
+	}
+	for i := range p.Rules {
+		re, err := regexp.Compile(p.Rules[i].Match)
+		if err != nil {
+			return fmt.Errorf("rule %d: %w", i+1, err)
+		}
+		p.Rules[i].re = re
+	}
+	if p.Routes == nil {
+		p.Routes = []Route{}
+	}
+	for i := range p.Routes {
+		if p.Routes[i].Trunk == "" && len(p.Routes[i].Trunks) == 0 {
+			return fmt.Errorf("route %d: a trunk is required", i+1)
+		}
+		re, err := regexp.Compile(p.Routes[i].Match)
+		if err != nil {
+			return fmt.Errorf("route %d: %w", i+1, err)
+		}
+		p.Routes[i].re = re
+	}
+	return nil
+}
+
+// TrunksFor returns the trunks of the first route matching a normalized
+// number, nil when none matches
+func (p *Plan) TrunksFor(number string) []string {
+	for _, r := range p.Routes {
+		if r.re != nil && r.re.MatchString(number) {
+			return r.trunks()
+		}
+	}
+	return nil
+}
+
+// trunks lists Trunk and Trunks once each
+func (r Route) trunks() []string {
+	ids := make([]string, 0, len(r.Trunks)+1)
+	seen := make(map[string]bool, len(r.Trunks)+1)
+	for _, id := range append([]string{r.Trunk}, r.Trunks...) {
+		if id != "" && !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// Normalize returns the canonical form of a dialed number
+func (p *Plan) Normalize(number string) string {
+	return p.Translate(number).Number
+}
+
+// Translate normalizes a dialed number and reports how
+func (p *Plan) Translate(number string) Translation {
+	t := Translation{Dialed: number, Rule: -1}
+	s := number
+	if isPhoneNumber(s) {
+		s = visualSeparators.Replace(s)
+	}
+
+	for i, r := range p.Rules {
+		if r.re != nil && r.re.MatchString(s) {
+			s = r.re.ReplaceAllString(s, r.Replace)
+			t.Rule = i
+			break
+		}
+	}
+
+	switch {
+	case strings.HasPrefix(s, "+"):
+	case !digitsRe.MatchString(s) || len(s) <= p.ExtensionLength:
+	case p.InternationalPrefix != "" && strings.HasPrefix(s, p.InternationalPrefix):
+		s = "+" + s[len(p.InternationalPrefix):]
+	case p.CountryCode != "" && p.NationalPrefix != "" && strings.HasPrefix(s, p.NationalPrefix):
+		s = "+" + p.CountryCode + s[len(p.NationalPrefix):]
+	}
+	t.Number = s
+	t.E164 = len(s) > 1 && s[0] == '+' && digitsRe.MatchString(s[1:])
+	return t
+}
+
+// isPhoneNumber reports whether s looks like a phone number written with
+// visual separators
+func isPhoneNumber(s string) bool {
+	digits := 0
+	for i, c := range s {
+		switch {
+		case c >= '0' && c <= '9':
+			digits++
+		case c == '+' && i == 0:
+		case strings.ContainsRune(" -.()", c):
+		default:
+			return false
+		}
+	}
+	return digits > 0
+}
@@ -0,0 +1,144 @@
+package dialplan
+
+import "testing"
+
+func TestTranslate(t *testing.T) {
+	plan := Plan{
+		CountryCode:         "972",
+		NationalPrefix:      "0",
+		InternationalPrefix: "00",
+		ExtensionLength:     4,
+		Rules: []Rule{
+			{Match: `^\*1([0-9]+)$`, Replace: "+1$1"},
+			{Match: `^9([0-9]{9,})$`, Replace: "$1"},
+		},
+	}
+	if err := plan.Compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		dialed string
+		want   string
+		e164   bool
+		rule   int
+	}{
+		{"+14155550100", "+14155550100", true, -1},
+		{"0049301234567", "+49301234567", true, -1},
+		{"0521234567", "+972521234567", true, -1},
+		{"052-123 4567", "+972521234567", true, -1},
+		{"(052) 123.4567", "+972521234567", true, -1},
+		{"+1 (415) 555-0100", "+14155550100", true, -1},
+		// Extensions and names are left as dialed
+		{"0123", "0123", false, -1},
+		{"101", "101", false, -1},
+		{"alice", "alice", false, -1},
+		{"alice-smith", "alice-smith", false, -1},
+		// Rules run first, then the prefixes
+		{"*14155550100", "+14155550100", true, 0},
+		{"90521234567", "+972521234567", true, 1},
+		{"900441234567", "+441234567", true, 1},
+		// Digits without either prefix are not guessed at
+		{"521234567", "521234567", false, -1},
+		{"", "", false, -1},
+		{"+", "+", false, -1},
+	}
+	for _, tt := range tests {
+		got := plan.Translate(tt.dialed)
+		if got.Number != tt.want || got.E164 != tt.e164 || got.Rule != tt.rule {
+			t.Errorf("Translate(%q) = %q e164=%v rule=%d; want %q e164=%v rule=%d",
+				tt.dialed, got.Number, got.E164, got.Rule, tt.want, tt.e164, tt.rule)
+		}
+	}
+}
+
+func TestCompile(t *testing.T) {
+	tests := []struct {
+		name  string
+		plan  Plan
+		valid bool
+	}{
+		{"empty", Plan{}, true},
+		{"country code too long", Plan{CountryCode: "1234"}, false},
+		{"country code not digits", Plan{CountryCode: "+1"}, false},
+		{"prefix not digits", Plan{InternationalPrefix: "+"}, false},
+		{"same prefixes", Plan{NationalPrefix: "0", InternationalPrefix: "0"}, false},
+		{"negative extension length", Plan{ExtensionLength: -1}, false},
+		{"bad rule", Plan{Rules: []Rule{{Match: "("}}}, false},
+		{"route without trunk", Plan{Routes: []Route{{Match: "^\\+1"}}}, false},
+		{"bad route", Plan{Routes: []Route{{Match: "(", Trunk: "t1"}}}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.plan.Compile(); (err == nil) != tt.valid {
+			t.Errorf("%s: Compile() = %v, want valid=%v", tt.name, err, tt.valid)
+		}
+	}
+}
+
+func TestTrunksFor(t *testing.T) {
+	plan := Plan{Routes: []Route{
+		{Match: `^\+1`, Trunk: "us", Trunks: []string{"us", "backup"}},
+		{Match: `^\+`, Trunks: []string{"world"}},
+	}}
+	if err := plan.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		number string
+		want   []string
+	}{
+		{"+14155550100", []string{"us", "backup"}},
+		{"+441234567", []string{"world"}},
+		{"101", nil},
+	}
+	for _, tt := range tests {
+		got := plan.TrunksFor(tt.number)
+		if len(got) != len(tt.want) {
+			t.Errorf("TrunksFor(%q) = %v, want %v", tt.number, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("TrunksFor(%q) = %v, want %v", tt.number, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestPlansNormalize(t *testing.T) {
+	plans, err := NewPlans("", Plan{CountryCode: "1", NationalPrefix: "1", InternationalPrefix: "011"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := plans.Set(Plan{TenantID: "il", CountryCode: "972", NationalPrefix: "0", InternationalPrefix: "00"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		tenant, dialed, want string
+	}{
+		{"il", "0521234567", "+972521234567"},
+		{"il", "00442071234567", "+442071234567"},
+		{"acme", "011442071234567", "+442071234567"},
+		{"acme", "14155550100", "+14155550100"},
+	}
+	for _, tt := range tests {
+		if got := plans.Normalize(tt.tenant, tt.dialed); got != tt.want {
+			t.Errorf("Normalize(%q, %q) = %q, want %q", tt.tenant, tt.dialed, got, tt.want)
+		}
+	}
+
+	// A default tenant plan replaces the fallback for everyone else
+	if _, err := plans.Set(Plan{TenantID: DefaultTenant, CountryCode: "44", NationalPrefix: "0", InternationalPrefix: "00"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := plans.Normalize("acme", "02071234567"); got != "+442071234567" {
+		t.Errorf("Normalize with default tenant plan = %q, want +442071234567", got)
+	}
+
+	var none *Plans
+	if got := none.Normalize("acme", "0521234567"); got != "0521234567" {
+		t.Errorf("nil Plans changed the number to %q", got)
+	}
+}
@@ -0,0 +1,155 @@
+package dialplan
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sort"
+	"sync"
+)
+
+// Plans holds the dial plan of every tenant. With a file set, plans are
+// loaded from it and every change is written back.
+type Plans struct {
+	mu       sync.RWMutex
+	plans    map[string]Plan
+	fallback Plan
+	path     string
+}
+
+// NewPlans loads the plans in path, if any. fallback applies to tenants
+// without a plan as long as the default tenant has none either.
+func NewPlans(path string, fallback Plan) (*Plans, error) {
+	fallback.TenantID = DefaultTenant
+	if err := fallback.Compile(); err != nil {
+		return nil, err
+	}
+	p := &Plans{plans: make(map[string]Plan), fallback: fallback, path: path}
+	if path == "" {
+		return p, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return p, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var plans []Plan
+	if err := json.Unmarshal(data, &plans); err != nil {
+		return nil, err
+	}
+	for _, plan := range plans {
+		if err := plan.Compile(); err != nil {
+			return nil, err
+		}
+		p.plans[plan.TenantID] = plan
+	}
+	return p, nil
+}
+
+// For returns the plan that applies to a tenant: its own, else the default
+// tenant's
+func (p *Plans) For(tenantID string) Plan {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if plan, ok := p.plans[tenantID]; ok {
+		return plan
+	}
+	if plan, ok := p.plans[DefaultTenant]; ok {
+		return plan
+	}
+	return p.fallback
+}
+
+// Normalize returns the canonical form of a number dialed by a user of
+// the tenant. Without plans the number is returned as dialed.
+func (p *Plans) Normalize(tenantID, number string) string {
+	if p == nil {
+		return number
+	}
+	plan := p.For(tenantID)
+	return plan.Normalize(number)
+}
+
+// Get returns the tenant's own plan
+func (p *Plans) Get(tenantID string) (Plan, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	plan, ok := p.plans[tenantID]
+	return plan, ok
+}
+
+// List returns every tenant's plan, ordered by tenant
+func (p *Plans) List() []Plan {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	list := make([]Plan, 0, len(p.plans))
+	for _, plan := range p.plans {
+		list = append(list, plan)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].TenantID < list[j].TenantID })
+	return list
+}
+
+// Set validates and stores a tenant's plan
+func (p *Plans) Set(plan Plan) (Plan, error) {
+	if plan.TenantID == "" {
+		return Plan{}, errors.New("tenant_id is required")
+	}
+	if err := plan.Compile(); err != nil {
+		return Plan{}, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	old, had := p.plans[plan.TenantID]
+	p.plans[plan.TenantID] = plan
+	if err := p.saveLocked(); err != nil {
+		if had {
+			p.plans[plan.TenantID] = old
+		} else {
+			delete(p.plans, plan.TenantID)
+		}
+		return Plan{}, err
+	}
+	return plan, nil
+}
+
+// Delete removes a tenant's plan; the tenant falls back to the default
+func (p *Plans) Delete(tenantID string) (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	old, ok := p.plans[tenantID]
+	if !ok {
+		return false, nil
+	}
+	delete(p.plans, tenantID)
+	if err := p.saveLocked(); err != nil {
+		p.plans[tenantID] = old
+		return false, err
+	}
+	return true, nil
+}
+
+// saveLocked writes every plan to the file, through a rename so a crash
+// never leaves it half-written
+func (p *Plans) saveLocked() error {
+	if p.path == "" {
+		return nil
+	}
+	list := make([]Plan, 0, len(p.plans))
+	for _, plan := range p.plans {
+		list = append(list, plan)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].TenantID < list[j].TenantID })
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := p.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p.path)
+}
@@ -0,0 +1,94 @@
+package did
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+
+	"nextgen-sip/internal/dialplan"
+)
+
+// How long each ring group member rings when the group does not say
+const DefaultRingTimeout = 20
+
+var e164Re = regexp.MustCompile(`^\+[1-9][0-9]{1,14}$`)
+
+// TargetType says where calls to a DID go
+type TargetType string
+
+const (
+	TargetSubscriber TargetType = "subscriber" // One of our users
+	TargetRingGroup  TargetType = "ring_group" // Several users, one after another
+	TargetForward    TargetType = "forward"    // A number elsewhere, out through the tenant's trunks
+	TargetWebhook    TargetType = "webhook"    // Wherever an HTTP endpoint says, call by call
+)
+
+// Target is where calls to a DID go
+type Target struct {
+	Type        TargetType `json:"type"`
+	Subscriber  string     `json:"subscriber,omitempty"`   // AOR or user name
+	Members     []string   `json:"members,omitempty"`      // AORs or user names, in the order they ring
+	RingTimeout int        `json:"ring_timeout,omitempty"` // Seconds each member rings, 0 for the default
+	Number      string     `json:"number,omitempty"`       // As the tenant dials it
+	URL         string     `json:"url,omitempty"`
+}
+
+// DID is a phone number of ours and where its calls go
+type DID struct {
+	Number      string `json:"number"` // E.164
+	TenantID    string `json:"tenant_id"`
+	Target      Target `json:"target"`
+	Description string `json:"description,omitempty"`
+}
+
+// Validate checks d and fills in defaults
+func (d *DID) Validate() error {
+	if !e164Re.MatchString(d.Number) {
+		return fmt.Errorf("number %q is not in E.164", d.Number)
+	}
+	if d.TenantID == "" {
+		d.TenantID = dialplan.DefaultTenant
+	}
+	if err := d.Target.Validate(); err != nil {
+		return err
+	}
+	if d.Target.Type == TargetWebhook {
+		u, err := url.Parse(d.Target.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("webhook url %q is not an http(s) URL", d.Target.URL)
+		}
+	}
+	return nil
+}
+
+// Validate checks that t names what its type needs
+func (t *Target) Validate() error {
+	switch t.Type {
+	case TargetSubscriber:
+		if t.Subscriber == "" {
+			return errors.New("subscriber target needs a subscriber")
+		}
+	case TargetRingGroup:
+		if len(t.Members) == 0 {
+			return errors.New("ring group needs members")
+		}
+		if t.RingTimeout < 0 {
+			return errors.New("ring timeout must not be negative")
+		}
+		if t.RingTimeout == 0 {
+			t.RingTimeout = DefaultRingTimeout
+		}
+	case TargetForward:
+		if t.Number == "" {
+			return errors.New("forward target needs a number")
+		}
+	case TargetWebhook:
+		if t.URL == "" {
+			return errors.New("webhook target needs a url")
+		}
+	default:
+		return fmt.Errorf("unknown target type %q", t.Type)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package did
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestValidate(t *testing.T) {
+	sub := Target{Type: TargetSubscriber, Subscriber: "100"}
+	tests := []struct {
+		name   string
+		did    DID
+		valid  bool
+		tenant string
+		ring   int
+	}{
+		{"subscriber", DID{Number: "+15550100", Target: sub}, true, "default", 0},
+		{"tenant kept", DID{Number: "+15550100", TenantID: "acme", Target: sub}, true, "acme", 0},
+		{"national number", DID{Number: "5550100", Target: sub}, false, "", 0},
+		{"leading zero", DID{Number: "+05550100", Target: sub}, false, "", 0},
+		{"too long", DID{Number: "+1234567890123456", Target: sub}, false, "", 0},
+		{"no subscriber", DID{Number: "+15550100", Target: Target{Type: TargetSubscriber}}, false, "", 0},
+		{"ring group", DID{Number: "+15550100", Target: Target{Type: TargetRingGroup, Members: []string{"100", "101"}}}, true, "default", DefaultRingTimeout},
+		{"ring group timeout kept", DID{Number: "+15550100", Target: Target{Type: TargetRingGroup, Members: []string{"100"}, RingTimeout: 5}}, true, "default", 5},
+		{"empty ring group", DID{Number: "+15550100", Target: Target{Type: TargetRingGroup}}, false, "", 0},
+		{"negative ring timeout", DID{Number: "+15550100", Target: Target{Type: TargetRingGroup, Members: []string{"100"}, RingTimeout: -1}}, false, "", 0},
+		{"forward", DID{Number: "+15550100", Target: Target{Type: TargetForward, Number: "02079460000"}}, true, "default", 0},
+		{"forward without number", DID{Number: "+15550100", Target: Target{Type: TargetForward}}, false, "", 0},
+		{"webhook", DID{Number: "+15550100", Target: Target{Type: TargetWebhook, URL: "https://hooks.example.com/route"}}, true, "default", 0},
+		{"webhook not http", DID{Number: "+15550100", Target: Target{Type: TargetWebhook, URL: "ftp://hooks.example.com/route"}}, false, "", 0},
+		{"webhook without host", DID{Number: "+15550100", Target: Target{Type: TargetWebhook, URL: "http:///route"}}, false, "", 0},
+		{"webhook without url", DID{Number: "+15550100", Target: Target{Type: TargetWebhook}}, false, "", 0},
+		{"unknown type", DID{Number: "+15550100", Target: Target{Type: "voicemail"}}, false, "", 0},
+	}
+	for _, tt := range tests {
+		d := tt.did
+		err := d.Validate()
+		if (err == nil) != tt.valid {
+			t.Errorf("%s: err = %v, want valid %v", tt.name, err, tt.valid)
+			continue
+		}
+		if tt.valid && (d.TenantID != tt.tenant || d.Target.RingTimeout != tt.ring) {
+			t.Errorf("%s: tenant %q ring timeout %d, want %q %d", tt.name, d.TenantID, d.Target.RingTimeout, tt.tenant, tt.ring)
+		}
+	}
+}
+
+func TestAsk(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		answer string
+		fails  bool
+		want   Target
+	}{
+		{"subscriber", 200, `{"type":"subscriber","subscriber":"100"}`, false, Target{Type: TargetSubscriber, Subscriber: "100"}},
+		{"ring group with defaults", 200, `{"type":"ring_group","members":["100","101"]}`, false,
+			Target{Type: TargetRingGroup, Members: []string{"100", "101"}, RingTimeout: DefaultRingTimeout}},
+		{"forward", 200, `{"type":"forward","number":"+442079460000"}`, false, Target{Type: TargetForward, Number: "+442079460000"}},
+		{"another webhook", 200, `{"type":"webhook","url":"https://hooks.example.com/next"}`, true, Target{}},
+		{"invalid target", 200, `{"type":"subscriber"}`, true, Target{}},
+		{"not json", 200, `busy`, true, Target{}},
+		{"error status", 500, `{"type":"subscriber","subscriber":"100"}`, true, Target{}},
+	}
+	for _, tt := range tests {
+		var got Call
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+				t.Errorf("%s: %s with %q", tt.name, r.Method, r.Header.Get("Content-Type"))
+			}
+			json.NewDecoder(r.Body).Decode(&got)
+			w.WriteHeader(tt.status)
+			w.Write([]byte(tt.answer))
+		}))
+		call := Call{DID: "+15550100", TenantID: "acme", From: "sip:+15551234@carrier.example.com", To: "sip:+15550100@198.51.100.1", CallID: "c"}
+		target, err := Ask(context.Background(), srv.Client(), srv.URL, call)
+		srv.Close()
+
+		if got != call {
+			t.Errorf("%s: webhook was told %+v, want %+v", tt.name, got, call)
+		}
+		if (err != nil) != tt.fails {
+			t.Errorf("%s: err = %v, want failure %v", tt.name, err, tt.fails)
+			continue
+		}
+		if target.Type != tt.want.Type || target.Subscriber != tt.want.Subscriber || target.Number != tt.want.Number ||
+			target.RingTimeout != tt.want.RingTimeout || len(target.Members) != len(tt.want.Members) {
+			t.Errorf("%s: target %+v, want %+v", tt.name, target, tt.want)
+		}
+	}
+}
+
+func TestAskTimeout(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	client := &http.Client{Timeout: 50 * time.Millisecond}
+	if _, err := Ask(context.Background(), client, srv.URL, Call{DID: "+15550100"}); err == nil {
+		t.Errorf("webhook that never answers gave a target")
+	}
+}
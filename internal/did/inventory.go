@@ -0,0 +1,124 @@
+package did
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sort"
+	"sync"
+)
+
+// Inventory holds the DIDs we own. With a file set, DIDs are loaded from
+// it and every change is written back.
+type Inventory struct {
+	mu   sync.RWMutex
+	dids map[string]DID // by number
+	path string
+}
+
+func NewInventory(path string) (*Inventory, error) {
+	inv := &Inventory{dids: make(map[string]DID), path: path}
+	if path == "" {
+		return inv, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return inv, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var list []DID
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+	for _, d := range list {
+		if err := d.Validate(); err != nil {
+			return nil, err
+		}
+		inv.dids[d.Number] = d
+	}
+	return inv, nil
+}
+
+// Get returns a DID by its E.164 number
+func (inv *Inventory) Get(number string) (DID, bool) {
+	inv.mu.RLock()
+	defer inv.mu.RUnlock()
+	d, ok := inv.dids[number]
+	return d, ok
+}
+
+// List returns the DIDs of a tenant, or every DID for an empty tenant,
+// ordered by number
+func (inv *Inventory) List(tenantID string) []DID {
+	inv.mu.RLock()
+	defer inv.mu.RUnlock()
+	list := make([]DID, 0, len(inv.dids))
+	for _, d := range inv.dids {
+		if tenantID == "" || d.TenantID == tenantID {
+			list = append(list, d)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Number < list[j].Number })
+	return list
+}
+
+// Set validates and stores a DID
+func (inv *Inventory) Set(d DID) (DID, error) {
+	if err := d.Validate(); err != nil {
+		return DID{}, err
+	}
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	old, had := inv.dids[d.Number]
+	inv.dids[d.Number] = d
+	if err := inv.saveLocked(); err != nil {
+		if had {
+			inv.dids[d.Number] = old
+		} else {
+			delete(inv.dids, d.Number)
+		}
+		return DID{}, err
+	}
+	return d, nil
+}
+
+// Delete removes a DID
+func (inv *Inventory) Delete(number string) (bool, error) {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	old, ok := inv.dids[number]
+	if !ok {
+		return false, nil
+	}
+	delete(inv.dids, number)
+	if err := inv.saveLocked(); err != nil {
+		inv.dids[number] = old
+		return false, err
+	}
+	return true, nil
+}
+
+// saveLocked writes every DID to the file, through a rename so a crash
+// never leaves it half-written
+func (inv *Inventory) saveLocked() error {
+	if inv.path == "" {
+		return nil
+	}
+	list := make([]DID, 0, len(inv.dids))
+	for _, d := range inv.dids {
+		list = append(list, d)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Number < list[j].Number })
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := inv.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, inv.path)
+}
@@ -0,0 +1,54 @@
+package did
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// Call is what a routing webhook is told about an incoming call
+type Call struct {
+	DID      string `json:"did"`
+	TenantID string `json:"tenant_id"`
+	From     string `json:"from"`
+	To       string `json:"to"`
+	CallID   string `json:"call_id"`
+}
+
+// Ask posts a call to a routing webhook, which answers with the target to
+// send it to. The target may be anything but another webhook.
+func Ask(ctx context.Context, client *http.Client, url string, call Call) (Target, error) {
+	body, err := json.Marshal(call)
+	if err != nil {
+		return Target{}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return Target{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := client.Do(req)
+	if err != nil {
+		return Target{}, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return Target{}, fmt.Errorf("webhook answered %s", res.Status)
+	}
+
+	var t Target
+	if err := json.NewDecoder(io.LimitReader(res.Body, 1<<16)).Decode(&t); err != nil {
+		return Target{}, fmt.Errorf("webhook answer: %w", err)
+	}
+	if t.Type == TargetWebhook {
+		return Target{}, errors.New("webhook answered with another webhook")
+	}
+	if err := t.Validate(); err != nil {
+		return Target{}, fmt.Errorf("webhook answer: %w", err)
+	}
+	return t, nil
+}
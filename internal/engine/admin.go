@@ -1,8 +1,26 @@
 package engine
 
 import (
+	"encoding/csv"
+	"encoding/json"
+	"log"
 	"net/http"
+	"net/url"
+	"nextgen-sip/internal/auth"
+	"nextgen-sip/internal/billing"
+	"nextgen-sip/internal/cdr"
+	"nextgen-sip/internal/dialplan"
+	"nextgen-sip/internal/did"
 	"nextgen-sip/internal/models"
+	"nextgen-sip/internal/money"
+	"nextgen-sip/internal/rating"
+	"nextgen-sip/internal/registrar"
+	"nextgen-sip/internal/router"
+	"nextgen-sip/internal/trunk"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
@@ -10,14 +28,32 @@ import (
 )
 
 type AdminAPI struct {
-	cc      *CallControl
-	billing BillingEngine
+	cc        *CallControl
+	billing   BillingEngine
+	rating    *rating.Engine
+	cdrs      CDRStore
+	registrar router.Registrar
+	keepalive *Keepalive // nil when NAT keepalives are off
+	plans     *dialplan.Plans
+	trunks    *trunk.Trunks
+	trunkRegs *TrunkRegistrations
+	dids      *did.Inventory
+	expiry    router.ExpiryLimits // What the registrar grants, reported by /api/config
 }
 
-func NewAdminAPI(cc *CallControl, bill BillingEngine) *AdminAPI {
+func NewAdminAPI(cc *CallControl, bill BillingEngine, rt *rating.Engine, cdrs CDRStore, reg router.Registrar, ka *Keepalive, plans *dialplan.Plans, trunks *trunk.Trunks, trunkRegs *TrunkRegistrations, dids *did.Inventory, expiry router.ExpiryLimits) *AdminAPI {
 	return &AdminAPI{
-		cc:      cc,
-		billing: bill,
+		cc:        cc,
+		billing:   bill,
+		rating:    rt,
+		cdrs:      cdrs,
+		registrar: reg,
+		keepalive: ka,
+		plans:     plans,
+		trunks:    trunks,
+		trunkRegs: trunkRegs,
+		dids:      dids,
+		expiry:    expiry,
 	}
 }
 
@@ -39,6 +75,7 @@ func (a *AdminAPI) Start(addr string) error {
 
 	// ─── Stats ───────────────────────────────────────────
 	e.GET("/api/stats", a.getStats)
+	e.GET("/api/health", a.getHealth)
 
 	// ─── User Management CRUD ────────────────────────────
 	e.GET("/api/users", a.listUsers)
@@ -46,10 +83,53 @@ func (a *AdminAPI) Start(addr string) error {
 	e.PUT("/api/users/:id", a.updateUser)
 	e.POST("/api/users/:id/balance", a.updateBalance)
 	e.DELETE("/api/users/:id", a.deleteUser)
+	e.GET("/api/users/:id/transactions", a.listTransactions)
+
+	// ─── Registrations ───────────────────────────────────
+	e.GET("/api/registrations", a.listRegistrations)
+	e.GET("/api/registrations/:aor", a.getRegistration)
+	e.DELETE("/api/registrations/:aor", a.deleteRegistration)
 
 	// ─── Active Calls ────────────────────────────────────
 	e.GET("/api/calls/active", a.listActiveCalls)
 
+	// ─── Call Detail Records ─────────────────────────────
+	e.GET("/api/cdrs", a.listCDRs)
+	e.GET("/api/cdrs/export", a.exportCDRs)
+
+	// ─── Rating ──────────────────────────────────────────
+	e.GET("/api/ratedecks", a.listRateDecks)
+	e.GET("/api/ratedecks/:id", a.getRateDeck)
+	e.PUT("/api/ratedecks/:id", a.putRateDeck)
+	e.POST("/api/ratedecks/:id/upload", a.uploadRateDeck)
+	e.GET("/api/ratedecks/:id/versions", a.listRateDeckVersions)
+	e.GET("/api/ratedecks/:id/versions/:version", a.getRateDeckVersion)
+	e.POST("/api/ratedecks/:id/rollback", a.rollbackRateDeck)
+	e.GET("/api/tenants/ratedecks", a.listTenantDecks)
+	e.PUT("/api/tenants/:id/ratedeck", a.assignTenantDeck)
+	e.GET("/api/rate", a.lookupRate)
+
+	// ─── Dial Plans ──────────────────────────────────────
+	e.GET("/api/tenants/dialplans", a.listDialPlans)
+	e.GET("/api/tenants/:id/dialplan", a.getDialPlan)
+	e.PUT("/api/tenants/:id/dialplan", a.putDialPlan)
+	e.DELETE("/api/tenants/:id/dialplan", a.deleteDialPlan)
+	e.GET("/api/dialplan/normalize", a.normalizeNumber)
+
+	// ─── Trunks ──────────────────────────────────────────
+	e.GET("/api/trunks", a.listTrunks)
+	e.GET("/api/trunks/registrations", a.listTrunkRegistrations)
+	e.GET("/api/trunks/:id/registration", a.getTrunkRegistration)
+	e.GET("/api/trunks/:id", a.getTrunk)
+	e.PUT("/api/trunks/:id", a.putTrunk)
+	e.DELETE("/api/trunks/:id", a.deleteTrunk)
+
+	// ─── DIDs ────────────────────────────────────────────
+	e.GET("/api/dids", a.listDIDs)
+	e.GET("/api/dids/:number", a.getDID)
+	e.PUT("/api/dids/:number", a.putDID)
+	e.DELETE("/api/dids/:number", a.deleteDID)
+
 	// ─── System Config ───────────────────────────────────
 	e.GET("/api/config", a.getConfig)
 
@@ -60,18 +140,42 @@ func (a *AdminAPI) Start(addr string) error {
 func (a *AdminAPI) getStats(c echo.Context) error {
 	calls := a.cc.GetActiveCalls()
 	users, _ := a.billing.ListUsers()
+	status := "operational"
+	if a.registrar.Health().Degraded {
+		status = "degraded"
+	}
 	return c.JSON(http.StatusOK, map[string]interface{}{
 		"active_calls":  len(calls),
 		"total_users":   len(users),
-		"system_status": "operational",
+		"system_status": status,
 		"version":       "3.0.0-carrier",
 		"uptime":        "running",
 	})
 }
 
+// getHealth reports the connection to the registrar store. It answers 503
+// only when registrations can neither be stored nor served from the cache.
+func (a *AdminAPI) getHealth(c echo.Context) error {
+	reg := a.registrar.Health()
+	code, status := http.StatusOK, "ok"
+	switch {
+	case reg.Degraded:
+		status = "degraded"
+	case !reg.Healthy:
+		code, status = http.StatusServiceUnavailable, "unavailable"
+	}
+	return c.JSON(code, map[string]interface{}{
+		"status":    status,
+		"registrar": reg,
+	})
+}
+
 // ─── Users ───────────────────────────────────────────────────────────────────
 func (a *AdminAPI) listUsers(c echo.Context) error {
-	users, _ := a.billing.ListUsers()
+	users, err := a.billing.ListUsers()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
 	return c.JSON(http.StatusOK, users)
 }
 
@@ -83,7 +187,19 @@ func (a *AdminAPI) createUser(c echo.Context) error {
 	if user.ID == "" {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "id is required"})
 	}
-	a.billing.SaveUser(user)
+	err := a.billing.SaveUser(user)
+	if err == billing.ErrIDTaken {
+		return c.JSON(http.StatusConflict, map[string]string{"error": err.Error()})
+	}
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	if user.Balance != 0 {
+		_, err := a.billing.SetBalance("sip:"+user.ID+"@localhost", user.Balance, actor(c), "opening balance")
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		}
+	}
 	return c.JSON(http.StatusCreated, user)
 }
 
@@ -92,26 +208,243 @@ func (a *AdminAPI) updateUser(c echo.Context) error {
 	if err := c.Bind(&user); err != nil {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
 	}
+	// The balance is not part of the profile; it only changes through
+	// POST /api/users/:id/balance so that every change is in the ledger
 	user.ID = c.Param("id")
-	a.billing.SaveUser(user)
-	return c.JSON(http.StatusOK, user)
+	err := a.billing.SaveUser(user)
+	if err == billing.ErrIDTaken {
+		return c.JSON(http.StatusConflict, map[string]string{"error": err.Error()})
+	}
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	saved, _ := a.billing.GetUser(user.ID)
+	return c.JSON(http.StatusOK, saved)
 }
 
+// deleteUser removes a subscriber whose balance has been booked to zero,
+// so that its ledger accounts for every unit it ever held
 func (a *AdminAPI) deleteUser(c echo.Context) error {
 	id := c.Param("id")
-	a.billing.DeleteUser("sip:" + id + "@localhost")
+	err := a.billing.DeleteUser("sip:" + id + "@localhost")
+	if err == billing.ErrBalanceNotZero {
+		return c.JSON(http.StatusConflict, map[string]string{"error": "balance is not zero; refund or adjust it to zero first"})
+	}
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	log.Printf("[Billing] User %s deleted by %s", id, actor(c))
 	return c.NoContent(http.StatusOK)
 }
 
+// updateBalance books a balance change. Without a type, amount is the new
+// balance and the difference is booked as an adjustment. With type topup,
+// refund or charge, amount is a positive sum to credit or charge; with
+// type adjustment it is a signed correction.
 func (a *AdminAPI) updateBalance(c echo.Context) error {
 	id := c.Param("id")
 	var data struct {
-		Amount float64 `json:"amount"`
+		Amount money.Amount `json:"amount"`
+		Type   string       `json:"type"`
+		Reason string       `json:"reason"`
 	}
 	if err := c.Bind(&data); err != nil {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
 	}
-	a.billing.SetBalance("sip:"+id+"@localhost", data.Amount)
+	uri := "sip:" + id + "@localhost"
+
+	var t models.Transaction
+	var err error
+	if data.Type == "" {
+		reason := data.Reason
+		if reason == "" {
+			reason = "balance set"
+		}
+		t, err = a.billing.SetBalance(uri, data.Amount, actor(c), reason)
+	} else {
+		if data.Reason == "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "reason is required"})
+		}
+		amount := data.Amount
+		if data.Type == models.TxCharge {
+			amount = -amount
+		}
+		entry := models.Transaction{
+			Type:   data.Type,
+			Amount: amount,
+			Actor:  actor(c),
+			Reason: data.Reason,
+		}
+		if err := billing.ValidatePost(entry); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		}
+		t, err = a.billing.Post(uri, entry)
+	}
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	if t.ID == "" {
+		return c.NoContent(http.StatusOK)
+	}
+	log.Printf("[Billing] %s %s %s by %s: %s", id, t.Type, t.Amount, t.Actor, t.Reason)
+	return c.JSON(http.StatusCreated, t)
+}
+
+func (a *AdminAPI) listTransactions(c echo.Context) error {
+	uri := "sip:" + c.Param("id") + "@localhost"
+	limit := 100
+	if v := c.QueryParam("limit"); v != "" {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 || limit > 1000 {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "limit must be 1-1000"})
+		}
+	}
+
+	list, next, err := a.billing.Transactions(uri, c.QueryParam("cursor"), limit)
+	if err == billing.ErrBadCursor {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	v, err := a.billing.VerifyBalance(uri)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"transactions": list,
+		"next_cursor":  next,
+		"verification": v,
+	})
+}
+
+// actor identifies who made an admin change for the ledger: the user in a
+// valid bearer token, else anonymous. Nothing else the client sends is
+// trusted to name them.
+func actor(c echo.Context) string {
+	if h := c.Request().Header.Get(echo.HeaderAuthorization); strings.HasPrefix(h, "Bearer ") {
+		if claims, err := auth.ValidateToken(strings.TrimPrefix(h, "Bearer ")); err == nil {
+			return claims.UserID
+		}
+	}
+	return billing.ActorAnonymous
+}
+
+// ─── Registrations ───────────────────────────────────────────────────────────
+
+// bindingView is a binding as shown by the API, with the seconds it has
+// left and, for NATed bindings, what the keepalives found
+type bindingView struct {
+	registrar.Binding
+	ExpiresIn int           `json:"expires_in"`
+	Keepalive *Reachability `json:"keepalive,omitempty"`
+}
+
+type registrationView struct {
+	AOR      string        `json:"aor"`
+	Aliases  []string      `json:"aliases,omitempty"`
+	Bindings []bindingView `json:"bindings"`
+}
+
+func (a *AdminAPI) registrationView(aor string, aliases []string, bindings []registrar.Binding, now time.Time) registrationView {
+	v := registrationView{AOR: aor, Aliases: aliases, Bindings: make([]bindingView, len(bindings))}
+	for i, b := range bindings {
+		v.Bindings[i] = bindingView{Binding: b, ExpiresIn: b.ExpiresIn(now)}
+		if a.keepalive != nil {
+			if r, ok := a.keepalive.Reachability(aor, b); ok {
+				v.Bindings[i].Keepalive = &r
+			}
+		}
+	}
+	return v
+}
+
+// listRegistrations lists registered AORs. user matches part of the AOR,
+// tenant the tenant ID, user_agent part of the User-Agent and source the
+// start of the address a REGISTER came from; only the bindings that match
+// are shown.
+func (a *AdminAPI) listRegistrations(c echo.Context) error {
+	regs, err := a.registrar.Registrations()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	user := strings.ToLower(c.QueryParam("user"))
+	tenant := c.QueryParam("tenant")
+	userAgent := strings.ToLower(c.QueryParam("user_agent"))
+	source := c.QueryParam("source")
+
+	now := time.Now()
+	views := make([]registrationView, 0, len(regs))
+	for _, reg := range regs {
+		if user != "" && !strings.Contains(strings.ToLower(reg.AOR), user) {
+			continue
+		}
+		var bindings []registrar.Binding
+		for _, b := range reg.Bindings {
+			if tenant != "" && !strings.EqualFold(b.TenantID, tenant) {
+				continue
+			}
+			if userAgent != "" && !strings.Contains(strings.ToLower(b.UserAgent), userAgent) {
+				continue
+			}
+			if source != "" && !strings.HasPrefix(b.Source, source) {
+				continue
+			}
+			bindings = append(bindings, b)
+		}
+		if len(bindings) > 0 {
+			views = append(views, a.registrationView(reg.AOR, reg.Aliases, bindings, now))
+		}
+	}
+	sort.Slice(views, func(i, j int) bool { return views[i].AOR < views[j].AOR })
+	return c.JSON(http.StatusOK, views)
+}
+
+func (a *AdminAPI) getRegistration(c echo.Context) error {
+	aor, err := url.PathUnescape(c.Param("aor"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid aor"})
+	}
+	aor = router.CanonicalAOR(aor)
+	bindings, err := a.registrar.Bindings(aor)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	if len(bindings) == 0 {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "not registered"})
+	}
+	return c.JSON(http.StatusOK, a.registrationView(aor, nil, bindings, time.Now()))
+}
+
+// deleteRegistration de-registers the device at ?contact=, or every device
+// of the AOR without it
+func (a *AdminAPI) deleteRegistration(c echo.Context) error {
+	aor, err := url.PathUnescape(c.Param("aor"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid aor"})
+	}
+	aor = router.CanonicalAOR(aor)
+	contact := c.QueryParam("contact")
+	bindings, err := a.registrar.Bindings(aor)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	found := contact == "" && len(bindings) > 0
+	for _, b := range bindings {
+		if b.Contact == contact {
+			found = true
+		}
+	}
+	if !found {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "not registered"})
+	}
+	if err := a.registrar.Remove(aor, contact); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	if contact == "" {
+		contact = "all contacts"
+	}
+	log.Printf("[Registrar] %s de-registered by %s: %s", aor, actor(c), contact)
 	return c.NoContent(http.StatusOK)
 }
 
@@ -121,13 +454,485 @@ func (a *AdminAPI) listActiveCalls(c echo.Context) error {
 	return c.JSON(http.StatusOK, calls)
 }
 
+// ─── Rating ──────────────────────────────────────────────────────────────────
+func (a *AdminAPI) listRateDecks(c echo.Context) error {
+	return c.JSON(http.StatusOK, a.rating.ListDecks())
+}
+
+func (a *AdminAPI) getRateDeck(c echo.Context) error {
+	d, ok := a.rating.GetDeck(c.Param("id"))
+	if !ok {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "rate deck not found"})
+	}
+	return c.JSON(http.StatusOK, d)
+}
+
+func (a *AdminAPI) putRateDeck(c echo.Context) error {
+	var d rating.RateDeck
+	if err := c.Bind(&d); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	d.ID = c.Param("id")
+	d.Source = "api"
+	d, err := a.rating.Publish(d)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	d.Rates = nil
+	return c.JSON(http.StatusCreated, d)
+}
+
+// uploadRateDeck publishes a CSV rate deck as a new version. The CSV is the
+// request body or a multipart "file" field. The version takes effect at
+// ?effective_at=, else at the latest effective_date in the file, else now.
+// With ?dry_run=true the file is only validated.
+func (a *AdminAPI) uploadRateDeck(c echo.Context) error {
+	body := c.Request().Body
+	source := "upload"
+	if fh, err := c.FormFile("file"); err == nil {
+		f, err := fh.Open()
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		}
+		defer f.Close()
+		body, source = f, fh.Filename
+	}
+
+	rates, effective, err := rating.ParseCSV(body)
+	if err != nil {
+		resp := map[string]interface{}{"error": err.Error()}
+		if ce, ok := err.(*rating.CSVError); ok {
+			resp["error"] = "invalid rate deck"
+			resp["rows"] = ce.Errors
+		}
+		return c.JSON(http.StatusBadRequest, resp)
+	}
+	if v := c.QueryParam("effective_at"); v != "" {
+		if effective, err = rating.ParseTime(v); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid effective_at: " + err.Error()})
+		}
+	}
+
+	d := rating.RateDeck{
+		ID:          c.Param("id"),
+		Name:        c.QueryParam("name"),
+		Currency:    c.QueryParam("currency"),
+		Rounding:    money.Rounding(c.QueryParam("rounding")),
+		EffectiveAt: effective,
+		Source:      source,
+		Rates:       rates,
+	}
+	if c.QueryParam("dry_run") == "true" {
+		if err := rating.ValidateRates(rates); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"valid":        true,
+			"rates":        len(rates),
+			"effective_at": effective,
+		})
+	}
+
+	d, err = a.rating.Publish(d)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	log.Printf("[Rating] ✓ Deck %s v%d uploaded (%d rates, effective %s)", d.ID, d.Version, len(d.Rates), d.EffectiveAt.Format(time.RFC3339))
+	d.Rates = nil
+	return c.JSON(http.StatusCreated, d)
+}
+
+func (a *AdminAPI) listRateDeckVersions(c echo.Context) error {
+	if !a.rating.HasDeck(c.Param("id")) {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "rate deck not found"})
+	}
+	return c.JSON(http.StatusOK, a.rating.Versions(c.Param("id")))
+}
+
+func (a *AdminAPI) getRateDeckVersion(c echo.Context) error {
+	version, err := strconv.Atoi(c.Param("version"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid version"})
+	}
+	d, ok := a.rating.GetVersion(c.Param("id"), version)
+	if !ok {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "rate deck version not found"})
+	}
+	return c.JSON(http.StatusOK, d)
+}
+
+// rollbackRateDeck withdraws a version: by default the one in effect, so the
+// previous version takes over, or a given version, e.g. a scheduled one
+func (a *AdminAPI) rollbackRateDeck(c echo.Context) error {
+	var data struct {
+		Version int `json:"version"`
+	}
+	if err := c.Bind(&data); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	d, err := a.rating.Rollback(c.Param("id"), data.Version)
+	switch err {
+	case nil:
+	case rating.ErrNoVersion:
+		return c.JSON(http.StatusNotFound, map[string]string{"error": err.Error()})
+	case rating.ErrNoFallback:
+		return c.JSON(http.StatusConflict, map[string]string{"error": err.Error()})
+	default:
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	log.Printf("[Rating] Deck %s v%d rolled back", d.ID, d.Version)
+	return c.JSON(http.StatusOK, d)
+}
+
+func (a *AdminAPI) listTenantDecks(c echo.Context) error {
+	return c.JSON(http.StatusOK, a.rating.TenantAssignments())
+}
+
+func (a *AdminAPI) assignTenantDeck(c echo.Context) error {
+	var data struct {
+		DeckID string `json:"deck_id"`
+	}
+	if err := c.Bind(&data); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	if err := a.rating.AssignTenant(c.Param("id"), data.DeckID); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	return c.NoContent(http.StatusOK)
+}
+
+// lookupRate shows which rate a call would get, for checking deck setup
+func (a *AdminAPI) lookupRate(c echo.Context) error {
+	tenant := c.QueryParam("tenant")
+	if tenant == "" {
+		tenant = "default"
+	}
+	userDeck := ""
+	if id := c.QueryParam("user"); id != "" {
+		if u, ok := a.billing.GetUser("sip:" + id + "@localhost"); ok {
+			userDeck = u.RateDeck
+		}
+	}
+	rate, err := a.rating.Rate(tenant, userDeck, c.QueryParam("number"))
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": err.Error()})
+	}
+	return c.JSON(http.StatusOK, rate)
+}
+
+// ─── Dial Plans ──────────────────────────────────────────────────────────────
+func (a *AdminAPI) listDialPlans(c echo.Context) error {
+	return c.JSON(http.StatusOK, a.plans.List())
+}
+
+func (a *AdminAPI) getDialPlan(c echo.Context) error {
+	plan, ok := a.plans.Get(c.Param("id"))
+	if !ok {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "tenant has no dial plan of its own"})
+	}
+	return c.JSON(http.StatusOK, plan)
+}
+
+func (a *AdminAPI) putDialPlan(c echo.Context) error {
+	var plan dialplan.Plan
+	if err := c.Bind(&plan); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	plan.TenantID = c.Param("id")
+	plan, err := a.plans.Set(plan)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	log.Printf("[DialPlan] Tenant %s: country %s, %d rule(s)", plan.TenantID, plan.CountryCode, len(plan.Rules))
+	return c.JSON(http.StatusOK, plan)
+}
+
+func (a *AdminAPI) deleteDialPlan(c echo.Context) error {
+	ok, err := a.plans.Delete(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	if !ok {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "tenant has no dial plan of its own"})
+	}
+	return c.NoContent(http.StatusOK)
+}
+
+// normalizeNumber shows how a tenant's dial plan reads a number, for
+// checking plan setup
+func (a *AdminAPI) normalizeNumber(c echo.Context) error {
+	tenant := c.QueryParam("tenant")
+	if tenant == "" {
+		tenant = dialplan.DefaultTenant
+	}
+	plan := a.plans.For(tenant)
+	return c.JSON(http.StatusOK, plan.Translate(c.QueryParam("number")))
+}
+
+// ─── Trunks ──────────────────────────────────────────────────────────────────
+
+// trunkView is a trunk as the API shows it, without its password
+func trunkView(t trunk.Trunk) trunk.Trunk {
+	t.Password = ""
+	return t
+}
+
+func (a *AdminAPI) listTrunks(c echo.Context) error {
+	list := a.trunks.List()
+	for i := range list {
+		list[i] = trunkView(list[i])
+	}
+	return c.JSON(http.StatusOK, list)
+}
+
+func (a *AdminAPI) getTrunk(c echo.Context) error {
+	t, ok := a.trunks.Get(c.Param("id"))
+	if !ok {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "trunk not found"})
+	}
+	return c.JSON(http.StatusOK, trunkView(t))
+}
+
+// putTrunk creates or replaces a trunk; leaving out the password keeps the
+// stored one
+func (a *AdminAPI) putTrunk(c echo.Context) error {
+	var t trunk.Trunk
+	if err := c.Bind(&t); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	t.ID = c.Param("id")
+	t, err := a.trunks.Set(t)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	log.Printf("[Trunk] %s saved: %s (%s)", t.ID, t.Dest(), t.Transport)
+	return c.JSON(http.StatusOK, trunkView(t))
+}
+
+func (a *AdminAPI) deleteTrunk(c echo.Context) error {
+	ok, err := a.trunks.Delete(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	if !ok {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "trunk not found"})
+	}
+	return c.NoContent(http.StatusOK)
+}
+
+// listTrunkRegistrations shows how our registrations with carriers stand
+func (a *AdminAPI) listTrunkRegistrations(c echo.Context) error {
+	return c.JSON(http.StatusOK, a.trunkRegs.List())
+}
+
+func (a *AdminAPI) getTrunkRegistration(c echo.Context) error {
+	r, ok := a.trunkRegs.Get(c.Param("id"))
+	if !ok {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "trunk does not register"})
+	}
+	return c.JSON(http.StatusOK, r)
+}
+
+// ─── DIDs ────────────────────────────────────────────────────────────────────
+
+// didNumber is the number in the path, which may leave out the "+" as it
+// is awkward in URLs
+func didNumber(c echo.Context) string {
+	n := c.Param("number")
+	if !strings.HasPrefix(n, "+") {
+		n = "+" + n
+	}
+	return n
+}
+
+func (a *AdminAPI) listDIDs(c echo.Context) error {
+	return c.JSON(http.StatusOK, a.dids.List(c.QueryParam("tenant")))
+}
+
+func (a *AdminAPI) getDID(c echo.Context) error {
+	d, ok := a.dids.Get(didNumber(c))
+	if !ok {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "DID not found"})
+	}
+	return c.JSON(http.StatusOK, d)
+}
+
+// putDID adds a DID or changes where its calls go
+func (a *AdminAPI) putDID(c echo.Context) error {
+	var d did.DID
+	if err := c.Bind(&d); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	d.Number = didNumber(c)
+	d, err := a.dids.Set(d)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	log.Printf("[DID] %s saved: tenant %s, %s", d.Number, d.TenantID, d.Target.Type)
+	return c.JSON(http.StatusOK, d)
+}
+
+func (a *AdminAPI) deleteDID(c echo.Context) error {
+	ok, err := a.dids.Delete(didNumber(c))
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	if !ok {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "DID not found"})
+	}
+	return c.NoContent(http.StatusOK)
+}
+
+// ─── CDRs ────────────────────────────────────────────────────────────────────
+func cdrFilter(c echo.Context) (cdr.Filter, error) {
+	f := cdr.Filter{
+		TenantID: c.QueryParam("tenant"),
+		Caller:   c.QueryParam("caller"),
+		Callee:   c.QueryParam("callee"),
+		Status:   c.QueryParam("status"),
+		Trunk:    c.QueryParam("trunk"),
+	}
+	var err error
+	if v := c.QueryParam("from"); v != "" {
+		if f.Since, _, err = parseTime(v); err != nil {
+			return f, err
+		}
+	}
+	if v := c.QueryParam("to"); v != "" {
+		var dateOnly bool
+		if f.Until, dateOnly, err = parseTime(v); err != nil {
+			return f, err
+		}
+		if dateOnly {
+			// "to=2024-01-31" includes the whole day
+			f.Until = f.Until.AddDate(0, 0, 1)
+		}
+	}
+	return f, nil
+}
+
+// parseTime accepts RFC 3339 timestamps or plain dates (UTC midnight)
+func parseTime(v string) (time.Time, bool, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, false, nil
+	}
+	t, err := time.Parse("2006-01-02", v)
+	return t, true, err
+}
+
+func (a *AdminAPI) listCDRs(c echo.Context) error {
+	f, err := cdrFilter(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid date: " + err.Error()})
+	}
+	limit := 100
+	if v := c.QueryParam("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 || limit > 1000 {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "limit must be 1-1000"})
+		}
+	}
+
+	list, next, err := a.cdrs.Query(f, c.QueryParam("cursor"), limit)
+	if err == cdr.ErrBadCursor {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	} else if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"cdrs":        list,
+		"next_cursor": next,
+	})
+}
+
+var cdrCSVHeader = []string{
+	"id", "tenant_id", "call_id", "from", "to", "setup_time", "answer_time", "end_time",
+	"duration", "billable_duration", "rate_deck", "rate_prefix", "rate_per_minute",
+	"cost", "currency", "status", "disconnect_code", "disconnect_reason", "hangup_by",
+	"trunk",
+}
+
+// exportCDRs streams every matching record as CSV or JSON lines, so large
+// date ranges never have to be held in memory
+func (a *AdminAPI) exportCDRs(c echo.Context) error {
+	f, err := cdrFilter(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid date: " + err.Error()})
+	}
+
+	res := c.Response()
+	switch c.QueryParam("format") {
+	case "", "csv":
+		res.Header().Set(echo.HeaderContentType, "text/csv")
+		res.Header().Set(echo.HeaderContentDisposition, `attachment; filename="cdrs.csv"`)
+		res.WriteHeader(http.StatusOK)
+
+		w := csv.NewWriter(res)
+		w.Write(cdrCSVHeader)
+		n := 0
+		err = a.cdrs.Export(f, func(r models.CDR) error {
+			w.Write([]string{
+				r.ID, r.TenantID, r.CallID, r.From, r.To,
+				formatTime(r.SetupTime), formatTime(r.AnswerTime), formatTime(r.EndTime),
+				strconv.FormatFloat(r.Duration, 'f', 0, 64),
+				strconv.Itoa(r.BillableDuration),
+				r.Rate.DeckID, r.Rate.Prefix,
+				r.Rate.PerMinute.String(),
+				r.Cost.String(), r.Currency,
+				r.Status, strconv.Itoa(r.DisconnectCode), r.DisconnectReason, r.HangupBy,
+				r.Trunk,
+			})
+			if n++; n%1000 == 0 {
+				w.Flush()
+				res.Flush()
+			}
+			return w.Error()
+		})
+		w.Flush()
+
+	case "jsonl":
+		res.Header().Set(echo.HeaderContentType, "application/x-ndjson")
+		res.Header().Set(echo.HeaderContentDisposition, `attachment; filename="cdrs.jsonl"`)
+		res.WriteHeader(http.StatusOK)
+
+		enc := json.NewEncoder(res)
+		n := 0
+		err = a.cdrs.Export(f, func(r models.CDR) error {
+			if n++; n%1000 == 0 {
+				res.Flush()
+			}
+			return enc.Encode(r)
+		})
+
+	default:
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "format must be csv or jsonl"})
+	}
+
+	// Headers are already sent, so an error can only cut the stream short
+	if err != nil {
+		c.Logger().Errorf("CDR export aborted: %v", err)
+	}
+	return nil
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
 // ─── Config ──────────────────────────────────────────────────────────────────
 func (a *AdminAPI) getConfig(c echo.Context) error {
 	return c.JSON(http.StatusOK, map[string]interface{}{
-		"sip_protocol":        "TCP",
+		"sip_protocol":         "TCP",
 		"max_concurrent_calls": 100000,
-		"billing_rate":        0.01,
-		"registration_ttl":   "1h",
+		"default_rate_deck":    a.rating.DefaultDeck(),
+		"registration_ttl":     (time.Duration(a.expiry.Default) * time.Second).String(),
+		"registration_expires": map[string]int{
+			"min":     a.expiry.Min,
+			"max":     a.expiry.Max,
+			"default": a.expiry.Default,
+		},
 		"firewall_threshold": 5,
 	})
 }
@@ -1,45 +1,53 @@
 package engine
 
 import (
+	"fmt"
 	"log"
+	"nextgen-sip/internal/billing"
+	"nextgen-sip/internal/cdr"
 	"nextgen-sip/internal/models"
+	"nextgen-sip/internal/money"
 	"nextgen-sip/pkg/utils"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/google/uuid"
 )
 
-
 // CallControl manages the state of active calls
 type CallControl struct {
 	mu          sync.RWMutex
-	activeCalls map[string]*models.ActiveCall
+	activeCalls map[string]*dialog // keyed by dialogKey(Call-ID, caller From tag)
 	billing     BillingEngine
-	workers     int
-	jobQueue    chan *models.ActiveCall
+	rater       Rater
+	cdrs        CDRStore
+	bye         byeSender
 }
 
-func NewCallControl(bill BillingEngine) *CallControl {
+func NewCallControl(bill BillingEngine, rater Rater, cdrs CDRStore) *CallControl {
 	cc := &CallControl{
-		activeCalls: make(map[string]*models.ActiveCall),
+		activeCalls: make(map[string]*dialog),
 		billing:     bill,
-		workers:     100, // Handle deduction for millions of calls in parallel
-		jobQueue:    make(chan *models.ActiveCall, 10000),
-	}
-	
-	// Start Billing Worker Pool
-	for i := 0; i < cc.workers; i++ {
-		go cc.billingWorker()
+		rater:       rater,
+		cdrs:        cdrs,
 	}
-
-	// Start the main dispatcher loop
-	go cc.dispatcher()
-	
 	return cc
 }
 
-func (cc *CallControl) StartCall(from, to, callID, tenantID string) string {
+// StartCall rates the call and starts tracking it. It fails when the
+// destination has no rate for the caller. Inbound calls from a carrier
+// trunk are tracked unrated: their From is the carrier's caller ID, which
+// must never be taken for one of our accounts.
+func (cc *CallControl) StartCall(from, to, callID, fromTag, tenantID string, inbound bool) (string, error) {
+	var rate models.CallRate
+	if !inbound {
+		var err error
+		if rate, err = cc.rateCall(from, to, tenantID); err != nil {
+			return "", err
+		}
+	}
+
 	cc.mu.Lock()
 	defer cc.mu.Unlock()
 
@@ -50,89 +58,118 @@ func (cc *CallControl) StartCall(from, to, callID, tenantID string) string {
 		From:      from,
 		To:        to,
 		CallID:    callID,
+		FromTag:   fromTag,
 		State:     models.StateTrying,
 		StartTime: time.Now(),
-		Rate:      0.01,
+		Rate:      rate,
+		Inbound:   inbound,
 	}
-	cc.activeCalls[callID] = call
-	
+	cc.activeCalls[dialogKey(callID, fromTag)] = newDialog(call)
+
 	utils.ActiveCalls.Inc()
-	log.Printf("[CallControl] Call session %s started (Tenant: %s)", sessionID, tenantID)
-	return sessionID
+	log.Printf("[CallControl] Call session %s started (Tenant: %s, Deck: %s, Prefix: %q)", sessionID, tenantID, rate.DeckID, rate.Prefix)
+	return sessionID, nil
 }
 
-func (cc *CallControl) OnAnswer(callID string) {
-	cc.mu.Lock()
-	defer cc.mu.Unlock()
+// rateCall picks the rate for a subscriber's call: from the subscriber's
+// own deck or the tenant's, in the subscriber's currency
+func (cc *CallControl) rateCall(from, to, tenantID string) (models.CallRate, error) {
+	userDeck, currency := "", money.DefaultCurrency
+	if u, ok := cc.billing.GetUser(from); ok {
+		userDeck = u.RateDeck
+		if u.Currency != "" {
+			currency = u.Currency
+		}
+	}
+	rate, err := cc.rater.Rate(tenantID, userDeck, to)
+	if err != nil {
+		return models.CallRate{}, err
+	}
+	if !strings.EqualFold(rate.Currency, currency) {
+		return models.CallRate{}, fmt.Errorf("rate deck %s is in %s, account is in %s", rate.DeckID, rate.Currency, currency)
+	}
+	return rate, nil
+}
 
-	if call, ok := cc.activeCalls[callID]; ok {
-		call.State = models.StateConnected
-		call.StartTime = time.Now()
-		log.Printf("[CallControl] Call %s connected", callID)
+// RejectCall records a call refused before it was tracked, so that the
+// attempt shows in the CDRs like any other failed call
+func (cc *CallControl) RejectCall(from, to, callID, tenantID string, code int, reason string) {
+	now := time.Now()
+	call := &models.ActiveCall{
+		SessionID: uuid.New().String(),
+		TenantID:  tenantID,
+		From:      from,
+		To:        to,
+		CallID:    callID,
+		StartTime: now,
 	}
+	go cc.saveCDR(buildCDR(call, now, code, reason, models.HangupSystem))
 }
 
-func (cc *CallControl) EndCall(callID string) {
+// EndCall removes a call torn down by the system itself
+func (cc *CallControl) EndCall(key string, code int, reason string) {
 	cc.mu.Lock()
 	defer cc.mu.Unlock()
-
-	if _, ok := cc.activeCalls[callID]; ok {
-		delete(cc.activeCalls, callID)
-		utils.ActiveCalls.Dec()
-		log.Printf("[CallControl] Call %s ended", callID)
-	}
+	cc.endLocked(key, code, reason, models.HangupSystem)
 }
 
-// dispatcher collects jobs for the workers
-func (cc *CallControl) dispatcher() {
-	ticker := time.NewTicker(1 * time.Second)
-	for range ticker.C {
-		cc.mu.RLock()
-		for _, call := range cc.activeCalls {
-			if call.State == models.StateConnected {
-				cc.jobQueue <- call
-			}
+// endLocked removes the call and emits its CDR
+func (cc *CallControl) endLocked(key string, code int, reason, hangupBy string) {
+	if d, ok := cc.activeCalls[key]; ok {
+		d.call.State = models.StateEnded
+		if d.ackTimer != nil {
+			d.ackTimer.Stop()
 		}
-		cc.mu.RUnlock()
-	}
-}
+		if d.billTimer != nil {
+			d.billTimer.Stop()
+		}
+		delete(cc.activeCalls, key)
+		utils.ActiveCalls.Dec()
+		log.Printf("[CallControl] Call %s ended (%d %s by %s)", d.call.CallID, code, reason, hangupBy)
 
-// billingWorker processes deductions in parallel
-func (cc *CallControl) billingWorker() {
-	for call := range cc.jobQueue {
-		err := cc.billing.Deduct(call.From, call.Rate)
-		if err != nil {
-			log.Printf("[BillingWorker] Insufficient funds for %s. Terminating %s", call.From, call.CallID)
-			cc.forceTerminate(call.CallID)
-			utils.BillingDeductionErrors.Inc()
+		record := buildCDR(d.call, time.Now(), code, reason, hangupBy)
+		if !d.call.Inbound {
+			go cc.settle(d.call.From, d.call.Reserved, record)
 		}
+		go cc.saveCDR(record)
 	}
 }
 
-
 func (cc *CallControl) GetActiveCalls() []*models.ActiveCall {
 	cc.mu.RLock()
 	defer cc.mu.RUnlock()
 
 	list := make([]*models.ActiveCall, 0, len(cc.activeCalls))
-	for _, c := range cc.activeCalls {
-		list = append(list, c)
+	for _, d := range cc.activeCalls {
+		call := *d.call
+		list = append(list, &call)
 	}
 	return list
 }
 
-func (cc *CallControl) forceTerminate(callID string) {
-	// In a real system, this would send a BYE to both parties
-	cc.EndCall(callID)
+// Rater picks the rate for a dialed number
+type Rater interface {
+	Rate(tenantID, userDeck, number string) (models.CallRate, error)
+}
+
+// CDRStore persists call detail records
+type CDRStore interface {
+	Save(cdr models.CDR) error
+	Query(f cdr.Filter, cursor string, limit int) ([]models.CDR, string, error)
+	Export(f cdr.Filter, fn func(models.CDR) error) error
 }
 
 // Interface expansion for Billing
 type BillingEngine interface {
 	CanCall(from string, to string) (bool, error)
-	Deduct(user string, amount float64) error
-	SetBalance(user string, amount float64)
+	Reserve(user string, amount money.Amount, callID string, ttl time.Duration) (money.Amount, error)
+	Settle(user string, cost money.Amount, callID string) error
+	SetBalance(user string, amount money.Amount, actor, reason string) (models.Transaction, error)
+	Post(user string, t models.Transaction) (models.Transaction, error)
+	Transactions(user string, cursor string, limit int) ([]models.Transaction, string, error)
+	VerifyBalance(user string) (billing.Verification, error)
 	ListUsers() ([]models.User, error)
-	SaveUser(u models.User)
-	DeleteUser(uri string)
+	GetUser(uri string) (models.User, bool)
+	SaveUser(u models.User) error
+	DeleteUser(uri string) error
 }
-
@@ -0,0 +1,65 @@
+package engine
+
+import (
+	"nextgen-sip/internal/cdr"
+	"nextgen-sip/internal/models"
+	"testing"
+	"time"
+)
+
+// cdrSink is a CDRStore handing every saved record to the test
+type cdrSink chan models.CDR
+
+func (s cdrSink) Save(c models.CDR) error { s <- c; return nil }
+
+func (s cdrSink) Query(cdr.Filter, string, int) ([]models.CDR, string, error) {
+	return nil, "", nil
+}
+
+func (s cdrSink) Export(cdr.Filter, func(models.CDR) error) error { return nil }
+
+// next waits for the next record saved
+func (s cdrSink) next(t *testing.T) models.CDR {
+	t.Helper()
+	select {
+	case c := <-s:
+		return c
+	case <-time.After(time.Second):
+		t.Fatal("no CDR saved")
+		return models.CDR{}
+	}
+}
+
+func TestRejectCall(t *testing.T) {
+	tests := []struct {
+		name   string
+		code   int
+		reason string
+	}{
+		{"not found", 404, "Not Found"},
+		{"flow failed", 430, "Flow Failed"},
+		{"not allowed", 403, "Destination Not Allowed"},
+	}
+	for _, tt := range tests {
+		sink := make(cdrSink, 1)
+		cc := NewCallControl(nil, nil, sink)
+		cc.RejectCall("sip:100@example.com", "sip:+15550100@example.com", "call-1", "acme", tt.code, tt.reason)
+
+		c := sink.next(t)
+		if c.Status != models.CDRFailed {
+			t.Errorf("%s: status = %s, want %s", tt.name, c.Status, models.CDRFailed)
+		}
+		if c.DisconnectCode != tt.code || c.DisconnectReason != tt.reason {
+			t.Errorf("%s: disconnect = %d %q, want %d %q", tt.name, c.DisconnectCode, c.DisconnectReason, tt.code, tt.reason)
+		}
+		if c.ID == "" || c.TenantID != "acme" || c.CallID != "call-1" || c.From != "sip:100@example.com" || c.To != "sip:+15550100@example.com" {
+			t.Errorf("%s: record = %+v", tt.name, c)
+		}
+		if c.SetupTime.IsZero() || !c.EndTime.Equal(c.SetupTime) || !c.AnswerTime.IsZero() {
+			t.Errorf("%s: times setup %v answer %v end %v", tt.name, c.SetupTime, c.AnswerTime, c.EndTime)
+		}
+		if c.Duration != 0 || c.Cost != 0 {
+			t.Errorf("%s: duration %v cost %v, want none", tt.name, c.Duration, c.Cost)
+		}
+	}
+}
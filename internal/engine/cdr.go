@@ -0,0 +1,59 @@
+package engine
+
+import (
+	"log"
+	"math"
+	"nextgen-sip/internal/models"
+	"nextgen-sip/internal/rating"
+	"time"
+)
+
+// buildCDR turns a finished call into its detail record
+func buildCDR(call *models.ActiveCall, end time.Time, code int, reason, hangupBy string) models.CDR {
+	record := models.CDR{
+		ID:               call.SessionID,
+		TenantID:         call.TenantID,
+		CallID:           call.CallID,
+		From:             call.From,
+		To:               call.To,
+		SetupTime:        call.StartTime,
+		AnswerTime:       call.AnswerTime,
+		EndTime:          end,
+		DisconnectCode:   code,
+		DisconnectReason: reason,
+		HangupBy:         hangupBy,
+		Trunk:            call.Trunk,
+		Rate:             call.Rate,
+		Currency:         call.Rate.Currency,
+	}
+
+	switch {
+	case !call.AnswerTime.IsZero():
+		record.Status = models.CDRAnswered
+		talk := end.Sub(call.AnswerTime).Seconds()
+		if call.MaxDuration > 0 && talk > float64(call.MaxDuration) {
+			// Cut off by us when the reservation ran out; the few ms it
+			// took to tear down must not bill another increment
+			talk = float64(call.MaxDuration)
+		}
+		record.Duration = math.Ceil(talk)
+		if !call.Inbound {
+			record.BillableDuration, record.Cost = rating.Cost(call.Rate, talk)
+		}
+	case code == 486 || code == 600:
+		record.Status = models.CDRBusy
+	case code == 408 || code == 480:
+		record.Status = models.CDRNoAnswer
+	case code == 487:
+		record.Status = models.CDRCanceled
+	default:
+		record.Status = models.CDRFailed
+	}
+	return record
+}
+
+func (cc *CallControl) saveCDR(record models.CDR) {
+	if err := cc.cdrs.Save(record); err != nil {
+		log.Printf("[CDR] ✗ Failed to store CDR %s: %v", record.ID, err)
+	}
+}
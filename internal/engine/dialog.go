@@ -0,0 +1,226 @@
+package engine
+
+import (
+	"log"
+	"nextgen-sip/internal/dialplan"
+	"nextgen-sip/internal/models"
+	"time"
+
+	"github.com/emiago/sipgo/sip"
+)
+
+// dialog tracks one INVITE-initiated call as seen by the proxy. The call is
+// keyed by Call-ID plus the caller's From tag; until a 2xx arrives, every
+// To tag seen in a 1xx is a separate (possibly forked) early dialog.
+type dialog struct {
+	call      *models.ActiveCall
+	early     map[string]models.CallState // To tag -> early dialog state
+	confirmed bool                        // ACK for the 2xx seen
+	ackTimer  *time.Timer
+	billTimer *time.Timer // next reservation top-up or cutoff
+	legs      *dialogLegs // route state for proxy-generated requests
+}
+
+func newDialog(call *models.ActiveCall) *dialog {
+	return &dialog{
+		call:  call,
+		early: make(map[string]models.CallState),
+	}
+}
+
+func dialogKey(callID, fromTag string) string {
+	return callID + ";" + fromTag
+}
+
+// lookupLocked finds the dialog for an in-dialog request, which may come
+// from either party, so both tag orders are tried.
+func (cc *CallControl) lookupLocked(callID, fromTag, toTag string) (string, *dialog) {
+	if d, ok := cc.activeCalls[dialogKey(callID, fromTag)]; ok {
+		return dialogKey(callID, fromTag), d
+	}
+	if d, ok := cc.activeCalls[dialogKey(callID, toTag)]; ok {
+		return dialogKey(callID, toTag), d
+	}
+	return "", nil
+}
+
+// DialogState reports whether an in-dialog request belongs to a call we
+// answered, its tags being the caller's and the callee's in either order,
+// and whether the caller has ACKed the answer
+func (cc *CallControl) DialogState(callID, fromTag, toTag string) (confirmed, ok bool) {
+	cc.mu.RLock()
+	defer cc.mu.RUnlock()
+
+	_, d := cc.lookupLocked(callID, fromTag, toTag)
+	if d == nil || d.call.State != models.StateConnected {
+		return false, false
+	}
+	if fromTag != d.call.ToTag && toTag != d.call.ToTag {
+		return false, false
+	}
+	return d.confirmed, true
+}
+
+// CallTenant returns the tenant of the call a request belongs to, the
+// default tenant for requests outside of any call we track
+func (cc *CallControl) CallTenant(callID, fromTag, toTag string) string {
+	cc.mu.RLock()
+	defer cc.mu.RUnlock()
+
+	if _, d := cc.lookupLocked(callID, fromTag, toTag); d != nil {
+		return d.call.TenantID
+	}
+	return dialplan.DefaultTenant
+}
+
+// OnProvisional records a 1xx response. A tagged 1xx creates or updates an
+// early dialog; 180/183 move the call to ringing.
+func (cc *CallControl) OnProvisional(callID, fromTag, toTag string, code int) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	d, ok := cc.activeCalls[dialogKey(callID, fromTag)]
+	if !ok || d.call.State == models.StateConnected {
+		return
+	}
+
+	state := models.StateTrying
+	if code == 180 || code == 183 {
+		state = models.StateRinging
+	}
+	if toTag != "" {
+		if _, known := d.early[toTag]; !known && len(d.early) > 0 {
+			log.Printf("[CallControl] Call %s forked, early dialog %s", callID, toTag)
+		}
+		d.early[toTag] = state
+	}
+	if state == models.StateRinging {
+		d.call.State = state
+	}
+}
+
+// OnAnswer moves the call to connected on the first 2xx. Any other early
+// dialogs are dropped; a 2xx from a second fork is left to the caller,
+// which is expected to ACK and BYE it.
+func (cc *CallControl) OnAnswer(callID, fromTag, toTag string, legs *dialogLegs) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	key := dialogKey(callID, fromTag)
+	d, ok := cc.activeCalls[key]
+	if !ok {
+		return
+	}
+	if d.call.State == models.StateConnected {
+		if d.call.ToTag != toTag {
+			log.Printf("[CallControl] Call %s: ignoring 2xx from fork %s", callID, toTag)
+		}
+		return
+	}
+
+	d.call.State = models.StateConnected
+	d.call.ToTag = toTag
+	d.call.AnswerTime = time.Now()
+	d.early = nil
+	d.legs = legs
+
+	// A 2xx that is never ACKed means the caller never saw it (RFC 3261 13.3.1.4)
+	d.ackTimer = time.AfterFunc(sip.Timer_H, func() {
+		cc.mu.Lock()
+		defer cc.mu.Unlock()
+		if cur, ok := cc.activeCalls[key]; ok && cur == d && !d.confirmed {
+			log.Printf("[CallControl] Call %s: no ACK for 2xx, tearing down", callID)
+			cc.endLocked(key, 408, "no ACK for 2xx", models.HangupSystem)
+		}
+	})
+	if !d.call.Inbound {
+		go cc.topUp(key, d)
+	}
+	log.Printf("[CallControl] Call %s connected", callID)
+}
+
+// OnTrunk records the carrier trunk a call came in from or is being tried
+// on; after a failover the last one tried is the one that carried it
+func (cc *CallControl) OnTrunk(callID, fromTag, trunkID string) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	if d, ok := cc.activeCalls[dialogKey(callID, fromTag)]; ok && d.call.State != models.StateConnected {
+		d.call.Trunk = trunkID
+	}
+}
+
+// OnAck confirms the dialog. An ACK for the 2xx of another fork, which the
+// caller is expected to ACK and BYE, does not.
+func (cc *CallControl) OnAck(callID, fromTag, toTag string) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	_, d := cc.lookupLocked(callID, fromTag, toTag)
+	if d == nil || d.call.State != models.StateConnected {
+		return
+	}
+	if toTag == d.call.ToTag || fromTag == d.call.ToTag {
+		d.confirmed = true
+		if d.ackTimer != nil {
+			d.ackTimer.Stop()
+		}
+	}
+}
+
+// OnFailure ends a call that received a final non-2xx response
+func (cc *CallControl) OnFailure(callID, fromTag string, code int, reason string) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	key := dialogKey(callID, fromTag)
+	if d, ok := cc.activeCalls[key]; ok && d.call.State != models.StateConnected {
+		log.Printf("[CallControl] Call %s failed with %d", callID, code)
+		cc.endLocked(key, code, reason, models.HangupCallee)
+	}
+}
+
+// OnBye ends a call from whichever side hung up. A BYE to another fork
+// that answered is not for this call.
+func (cc *CallControl) OnBye(callID, fromTag, toTag string) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	key, d := cc.lookupLocked(callID, fromTag, toTag)
+	if d == nil {
+		return
+	}
+	if d.call.State == models.StateConnected && toTag != d.call.ToTag && fromTag != d.call.ToTag {
+		return
+	}
+	hangupBy := models.HangupCallee
+	if fromTag == d.call.FromTag {
+		hangupBy = models.HangupCaller
+	}
+	cc.endLocked(key, 200, "BYE", hangupBy)
+}
+
+// OnCancel ends a call the caller abandoned before it was answered
+func (cc *CallControl) OnCancel(callID, fromTag string) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	key := dialogKey(callID, fromTag)
+	if d, ok := cc.activeCalls[key]; ok && d.call.State != models.StateConnected {
+		log.Printf("[CallControl] Call %s canceled", callID)
+		cc.endLocked(key, 487, "CANCEL", models.HangupCaller)
+	}
+}
+
+// OnTimeout cleans up a call whose INVITE transaction timed out or failed
+// at the transport layer before a final response
+func (cc *CallControl) OnTimeout(callID, fromTag string) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	key := dialogKey(callID, fromTag)
+	if d, ok := cc.activeCalls[key]; ok && d.call.State != models.StateConnected {
+		log.Printf("[CallControl] Call %s timed out", callID)
+		cc.endLocked(key, 408, "Request Timeout", models.HangupSystem)
+	}
+}
@@ -0,0 +1,158 @@
+package engine
+
+import (
+	"nextgen-sip/internal/models"
+	"testing"
+)
+
+// step is one SIP event of a test call, from caller tag "f" on Call-ID "c"
+type step struct {
+	op   string // provisional, answer, ack, fail, bye-caller, bye-callee, cancel, timeout
+	tag  string // callee's To tag
+	code int
+}
+
+func (s step) apply(cc *CallControl) {
+	switch s.op {
+	case "provisional":
+		cc.OnProvisional("c", "f", s.tag, s.code)
+	case "answer":
+		cc.OnAnswer("c", "f", s.tag, nil)
+	case "ack":
+		cc.OnAck("c", "f", s.tag)
+	case "fail":
+		cc.OnFailure("c", "f", s.code, "failed")
+	case "bye-caller":
+		cc.OnBye("c", "f", s.tag)
+	case "bye-callee":
+		cc.OnBye("c", s.tag, "f")
+	case "cancel":
+		cc.OnCancel("c", "f")
+	case "timeout":
+		cc.OnTimeout("c", "f")
+	}
+}
+
+func TestDialogLifecycle(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []step
+		// Calls still up
+		state     models.CallState
+		toTag     string
+		confirmed bool
+		// Calls that ended
+		status   string
+		hangupBy string
+		code     int
+	}{
+		{name: "trying", steps: []step{{"provisional", "", 100}},
+			state: models.StateTrying},
+		{name: "ringing", steps: []step{{"provisional", "t1", 180}},
+			state: models.StateRinging},
+		{name: "answered", steps: []step{{"provisional", "t1", 180}, {"answer", "t1", 200}},
+			state: models.StateConnected, toTag: "t1"},
+		{name: "confirmed", steps: []step{{"answer", "t1", 200}, {"ack", "t1", 0}},
+			state: models.StateConnected, toTag: "t1", confirmed: true},
+		{name: "ack for another fork", steps: []step{{"answer", "t1", 200}, {"ack", "t2", 0}},
+			state: models.StateConnected, toTag: "t1"},
+		{name: "forked, second fork answers", steps: []step{{"provisional", "t1", 180}, {"provisional", "t2", 183}, {"answer", "t2", 200}, {"answer", "t1", 200}},
+			state: models.StateConnected, toTag: "t2"},
+		{name: "bye to another fork", steps: []step{{"answer", "t1", 200}, {"answer", "t2", 200}, {"ack", "t2", 0}, {"bye-caller", "t2", 0}},
+			state: models.StateConnected, toTag: "t1"},
+		{name: "failure after answer ignored", steps: []step{{"answer", "t1", 200}, {"fail", "", 486}},
+			state: models.StateConnected, toTag: "t1"},
+		{name: "cancel after answer ignored", steps: []step{{"answer", "t1", 200}, {"cancel", "", 0}},
+			state: models.StateConnected, toTag: "t1"},
+		{name: "caller hangs up", steps: []step{{"answer", "t1", 200}, {"ack", "t1", 0}, {"bye-caller", "t1", 0}},
+			status: models.CDRAnswered, hangupBy: models.HangupCaller, code: 200},
+		{name: "callee hangs up", steps: []step{{"answer", "t1", 200}, {"ack", "t1", 0}, {"bye-callee", "t1", 0}},
+			status: models.CDRAnswered, hangupBy: models.HangupCallee, code: 200},
+		{name: "busy", steps: []step{{"provisional", "t1", 180}, {"fail", "", 486}},
+			status: models.CDRBusy, hangupBy: models.HangupCallee, code: 486},
+		{name: "no answer", steps: []step{{"provisional", "t1", 180}, {"fail", "", 480}},
+			status: models.CDRNoAnswer, hangupBy: models.HangupCallee, code: 480},
+		{name: "rejected", steps: []step{{"fail", "", 503}},
+			status: models.CDRFailed, hangupBy: models.HangupCallee, code: 503},
+		{name: "canceled", steps: []step{{"provisional", "t1", 180}, {"cancel", "", 0}},
+			status: models.CDRCanceled, hangupBy: models.HangupCaller, code: 487},
+		{name: "timed out", steps: []step{{"provisional", "t1", 180}, {"timeout", "", 0}},
+			status: models.CDRNoAnswer, hangupBy: models.HangupSystem, code: 408},
+	}
+	for _, tt := range tests {
+		sink := make(cdrSink, 1)
+		cc := NewCallControl(nil, nil, sink)
+		if _, err := cc.StartCall("sip:+15550100@carrier.example.com", "sip:100@example.com", "c", "f", "acme", true); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		for _, s := range tt.steps {
+			s.apply(cc)
+		}
+
+		calls := cc.GetActiveCalls()
+		if tt.status == "" {
+			if len(calls) != 1 {
+				t.Errorf("%s: %d calls up, want 1", tt.name, len(calls))
+				continue
+			}
+			if calls[0].State != tt.state || calls[0].ToTag != tt.toTag {
+				t.Errorf("%s: state %s to tag %q, want %s %q", tt.name, calls[0].State, calls[0].ToTag, tt.state, tt.toTag)
+			}
+			confirmed, ok := cc.DialogState("c", "f", tt.toTag)
+			if tt.state == models.StateConnected && (!ok || confirmed != tt.confirmed) {
+				t.Errorf("%s: DialogState = %v, %v, want %v, true", tt.name, confirmed, ok, tt.confirmed)
+			}
+			continue
+		}
+
+		if len(calls) != 0 {
+			t.Errorf("%s: call still up in state %s", tt.name, calls[0].State)
+		}
+		c := sink.next(t)
+		if c.Status != tt.status || c.HangupBy != tt.hangupBy || c.DisconnectCode != tt.code {
+			t.Errorf("%s: CDR %s by %s (%d), want %s by %s (%d)", tt.name, c.Status, c.HangupBy, c.DisconnectCode, tt.status, tt.hangupBy, tt.code)
+		}
+		if c.Status == models.CDRAnswered && c.AnswerTime.IsZero() {
+			t.Errorf("%s: answered call without answer time", tt.name)
+		}
+	}
+}
+
+func TestDialogStateTags(t *testing.T) {
+	cc := NewCallControl(nil, nil, make(cdrSink, 1))
+	cc.StartCall("sip:+15550100@carrier.example.com", "sip:100@example.com", "c", "f", "acme", true)
+	if _, ok := cc.DialogState("c", "f", "t1"); ok {
+		t.Errorf("unanswered call accepted an in-dialog request")
+	}
+	cc.OnAnswer("c", "f", "t1", nil)
+
+	tests := []struct {
+		name          string
+		callID        string
+		fromTag       string
+		toTag         string
+		ok, confirmed bool
+	}{
+		{"from caller", "c", "f", "t1", true, false},
+		{"from callee", "c", "t1", "f", true, false},
+		{"wrong callee tag", "c", "f", "t2", false, false},
+		{"wrong call", "d", "f", "t1", false, false},
+	}
+	for _, tt := range tests {
+		confirmed, ok := cc.DialogState(tt.callID, tt.fromTag, tt.toTag)
+		if ok != tt.ok || confirmed != tt.confirmed {
+			t.Errorf("%s: DialogState = %v, %v, want %v, %v", tt.name, confirmed, ok, tt.confirmed, tt.ok)
+		}
+	}
+
+	cc.OnAck("c", "f", "t1")
+	if confirmed, ok := cc.DialogState("c", "t1", "f"); !ok || !confirmed {
+		t.Errorf("after ACK: DialogState = %v, %v, want confirmed", confirmed, ok)
+	}
+	if got := cc.CallTenant("c", "t1", "f"); got != "acme" {
+		t.Errorf("CallTenant = %q, want acme", got)
+	}
+	if got := cc.CallTenant("d", "f", "t1"); got != "default" {
+		t.Errorf("CallTenant of an unknown call = %q, want default", got)
+	}
+}
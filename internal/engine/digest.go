@@ -0,0 +1,98 @@
+package engine
+
+import (
+	"errors"
+	"log"
+	"net"
+	"nextgen-sip/internal/auth"
+	"nextgen-sip/internal/dialplan"
+	"nextgen-sip/internal/models"
+
+	"github.com/emiago/sipgo/sip"
+)
+
+// ─── Helper: source IP without port (firewall key) ───────────────
+func sourceIP(req *sip.Request) string {
+	host, _, err := net.SplitHostPort(req.Source())
+	if err != nil {
+		return req.Source()
+	}
+	return host
+}
+
+// lookupPassword resolves digest usernames against the subscriber store
+func (e *SIPEngine) lookupPassword(username string) (string, bool) {
+	u, ok := e.cc.billing.GetUser(username)
+	if !ok || u.Password == "" {
+		return "", false
+	}
+	return u.Password, true
+}
+
+// authenticate enforces digest authentication on req for the given AOR and
+// returns the subscriber it proved to be. REGISTER is challenged with
+// 401/WWW-Authenticate, everything else with 407/Proxy-Authenticate. When
+// it returns false the transaction has already been answered and the
+// request must be dropped.
+func (e *SIPEngine) authenticate(req *sip.Request, tx sip.ServerTransaction, aor sip.Uri) (models.User, bool) {
+	code, reason := 407, "Proxy Authentication Required"
+	authzName, authnName := "Proxy-Authorization", "Proxy-Authenticate"
+	if req.Method == sip.REGISTER {
+		code, reason = 401, "Unauthorized"
+		authzName, authnName = "Authorization", "WWW-Authenticate"
+	}
+
+	header := ""
+	if h := req.GetHeader(authzName); h != nil {
+		header = h.Value()
+	}
+
+	ip := sourceIP(req)
+	username, err := e.auth.Verify(req.Method.String(), header, e.lookupPassword)
+	switch {
+	case err == nil:
+	case errors.Is(err, auth.ErrNoCredentials):
+		e.challenge(tx, req, code, reason, authnName, false)
+		return models.User{}, false
+	case errors.Is(err, auth.ErrStaleNonce):
+		e.challenge(tx, req, code, reason, authnName, true)
+		return models.User{}, false
+	default:
+		log.Printf("[AUTH] ✗ %s digest failed for %q from %s", req.Method, username, ip)
+		e.fw.RecordFailedAuth(ip, username)
+		e.challenge(tx, req, code, reason, authnName, false)
+		return models.User{}, false
+	}
+
+	// Valid credentials only authorize the subscriber's own AOR
+	if username != aor.User {
+		log.Printf("[AUTH] ✗ %q tried to act as %s from %s", username, aor.Addr(), ip)
+		e.fw.RecordFailedAuth(ip, username)
+		e.reply(tx, req, 403, "Forbidden")
+		return models.User{}, false
+	}
+
+	e.fw.ClearFailedAuth(ip, username)
+	u, _ := e.cc.billing.GetUser(username)
+	return u, true
+}
+
+// userTenant is the tenant a subscriber's requests are for. It is never
+// taken from the request, which anyone can write.
+func userTenant(u models.User) string {
+	if u.TenantID == "" {
+		return dialplan.DefaultTenant
+	}
+	return u.TenantID
+}
+
+func (e *SIPEngine) challenge(tx sip.ServerTransaction, req *sip.Request, code int, reason, header string, stale bool) {
+	resp := sip.NewResponseFromRequest(req, sip.StatusCode(code), reason, nil)
+	for _, v := range e.auth.Challenges(stale) {
+		resp.AppendHeader(sip.NewHeader(header, v))
+	}
+	resp.SetDestination(req.Source())
+	if err := tx.Respond(resp); err != nil {
+		log.Printf("[SIP] Failed to respond %d: %v", code, err)
+	}
+}
@@ -0,0 +1,255 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"nextgen-sip/internal/registrar"
+	"nextgen-sip/internal/router"
+	"nextgen-sip/pkg/utils"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emiago/sipgo"
+	"github.com/emiago/sipgo/sip"
+)
+
+// How many bindings are pinged at the same time
+const keepaliveConcurrency = 64
+
+// KeepaliveConfig tunes the pinging of NATed bindings
+type KeepaliveConfig struct {
+	Interval    time.Duration // How often each NATed binding is pinged
+	Timeout     time.Duration // How long to wait for the answer to an OPTIONS
+	MaxFailures int           // Missed pings in a row before the binding is dropped
+}
+
+// Reachability is what the keepalives have learned about one binding
+type Reachability struct {
+	Reachable bool      `json:"reachable"`
+	Method    string    `json:"method"`           // OPTIONS, or CRLF on TCP and TLS flows
+	RTT       float64   `json:"rtt_ms,omitempty"` // Round trip of the last answered OPTIONS
+	LastPing  time.Time `json:"last_ping"`
+	Failures  int       `json:"failures"` // Missed pings in a row
+	LastError string    `json:"last_error,omitempty"`
+}
+
+// pinger sends one keepalive to a binding; implemented by SIPEngine
+type pinger interface {
+	ping(ctx context.Context, b registrar.Binding) (method string, rtt time.Duration, err error)
+	holdsFlow(b registrar.Binding) bool // b is reached through this proxy
+}
+
+// Keepalive pings the registered contacts that sit behind a NAT, so their
+// pinholes stay open and bindings whose client has gone away are dropped
+// before an INVITE times out on them
+type Keepalive struct {
+	pinger pinger
+	reg    router.Registrar
+	cfg    KeepaliveConfig
+
+	mu    sync.Mutex
+	state map[string]Reachability // by reachKey
+	done  chan struct{}
+}
+
+func NewKeepalive(p pinger, reg router.Registrar, cfg KeepaliveConfig) *Keepalive {
+	k := &Keepalive{
+		pinger: p,
+		reg:    reg,
+		cfg:    cfg,
+		state:  make(map[string]Reachability),
+		done:   make(chan struct{}),
+	}
+	go k.loop()
+	return k
+}
+
+// Close stops the pinging
+func (k *Keepalive) Close() {
+	close(k.done)
+}
+
+// Reachability returns the keepalive state of binding b of aor; ok is
+// false until it has been pinged
+func (k *Keepalive) Reachability(aor string, b registrar.Binding) (Reachability, bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	r, ok := k.state[reachKey(aor, b)]
+	return r, ok
+}
+
+// reachKey identifies a binding; the flows of one outbound instance can
+// share a Contact
+func reachKey(aor string, b registrar.Binding) string {
+	return fmt.Sprintf("%s\x00%s\x00%s\x00%d", aor, b.Contact, b.Instance, b.RegID)
+}
+
+func (k *Keepalive) loop() {
+	ticker := time.NewTicker(k.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			k.round()
+		case <-k.done:
+			return
+		}
+	}
+}
+
+// round pings every NATed binding whose flow this proxy holds once and
+// drops the ones that have missed MaxFailures pings in a row. Bindings
+// that came in through another edge proxy are that proxy's to ping.
+func (k *Keepalive) round() {
+	regs, err := k.reg.Registrations()
+	if err != nil {
+		log.Printf("[Keepalive] ✗ Listing registrations failed: %v", err)
+		return
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, keepaliveConcurrency)
+	seen := make(map[string]bool)
+	for _, reg := range regs {
+		for _, b := range reg.Bindings {
+			if !b.NAT || !k.pinger.holdsFlow(b) {
+				continue
+			}
+			seen[reachKey(reg.AOR, b)] = true
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(aor string, b registrar.Binding) {
+				defer wg.Done()
+				defer func() { <-sem }()
+				k.check(aor, b)
+			}(reg.AOR, b)
+		}
+	}
+	wg.Wait()
+
+	// Forget bindings that expired or were removed since the last round
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	unreachable := 0
+	for key, r := range k.state {
+		if !seen[key] {
+			delete(k.state, key)
+			continue
+		}
+		if !r.Reachable {
+			unreachable++
+		}
+	}
+	utils.KeepaliveBindings.Set(float64(len(k.state)))
+	utils.KeepaliveUnreachable.Set(float64(unreachable))
+}
+
+// check pings one binding and records the outcome
+func (k *Keepalive) check(aor string, b registrar.Binding) {
+	ctx, cancel := context.WithTimeout(context.Background(), k.cfg.Timeout)
+	defer cancel()
+	method, rtt, err := k.pinger.ping(ctx, b)
+
+	key := reachKey(aor, b)
+	k.mu.Lock()
+	r := k.state[key]
+	r.Method = method
+	r.LastPing = time.Now()
+	if err == nil {
+		r.Reachable, r.Failures, r.LastError = true, 0, ""
+		if rtt > 0 {
+			r.RTT = float64(rtt.Microseconds()) / 1000
+			utils.KeepaliveRTT.Observe(rtt.Seconds())
+		}
+		k.state[key] = r
+		k.mu.Unlock()
+		return
+	}
+	r.Reachable = false
+	r.Failures++
+	r.LastError = err.Error()
+	drop := k.cfg.MaxFailures > 0 && r.Failures >= k.cfg.MaxFailures
+	if drop {
+		delete(k.state, key)
+	} else {
+		k.state[key] = r
+	}
+	k.mu.Unlock()
+
+	if !drop {
+		log.Printf("[Keepalive] ✗ %s at %s missed %s ping %d: %v", aor, b.Contact, method, r.Failures, err)
+		return
+	}
+	// Only this flow goes; other flows of the same instance stay
+	flow := registrar.Contact{URI: b.Contact, Instance: b.Instance, RegID: b.RegID}
+	if _, err := k.reg.Update(aor, nil, registrar.Update{Contacts: []registrar.Contact{flow}}); err != nil {
+		log.Printf("[Keepalive] ✗ Dropping %s at %s failed: %v", aor, b.Contact, err)
+		return
+	}
+	utils.KeepaliveDrops.Inc()
+	log.Printf("[Keepalive] Dropped %s at %s after %d missed pings", aor, b.Contact, r.Failures)
+}
+
+// ping sends an OPTIONS to b, or a double-CRLF keepalive (RFC 5626 section
+// 3.5.1) down the connection of a TCP or TLS flow. Any answer to the
+// OPTIONS counts, even an error status; a CRLF ping succeeds as long as
+// the connection is open.
+func (e *SIPEngine) ping(ctx context.Context, b registrar.Binding) (string, time.Duration, error) {
+	dest, transport, err := router.BindingDest(b)
+	if err != nil {
+		return "OPTIONS", 0, err
+	}
+	if b.Received != "" && (transport == "tcp" || transport == "tls") {
+		return "CRLF", 0, e.pingFlow(transport, dest)
+	}
+
+	var uri sip.Uri
+	if err := sip.ParseUri(b.Contact, &uri); err != nil {
+		return "OPTIONS", 0, err
+	}
+	req := sip.NewRequest(sip.OPTIONS, uri)
+	req.SetTransport(strings.ToUpper(transport))
+	req.SetDestination(dest)
+
+	start := time.Now()
+	clTx, err := e.clientFor(req).TransactionRequest(ctx, req, sipgo.ClientRequestBuild)
+	if err != nil {
+		return "OPTIONS", 0, err
+	}
+	defer clTx.Terminate()
+
+	select {
+	case _, more := <-clTx.Responses():
+		if !more {
+			return "OPTIONS", 0, fmt.Errorf("transaction closed")
+		}
+		return "OPTIONS", time.Since(start), nil
+	case <-clTx.Done():
+		return "OPTIONS", 0, clTx.Err()
+	case <-ctx.Done():
+		return "OPTIONS", 0, fmt.Errorf("no answer within %s", time.Since(start).Round(time.Millisecond))
+	}
+}
+
+func (e *SIPEngine) holdsFlow(b registrar.Binding) bool {
+	return e.router.HoldsFlow(b)
+}
+
+// pingFlow writes a double CRLF to the open connection to dest
+func (e *SIPEngine) pingFlow(transport, dest string) error {
+	conn, err := e.tp.GetConnection(transport, dest)
+	if err != nil {
+		return fmt.Errorf("flow closed: %w", err)
+	}
+	defer conn.TryClose()
+
+	w, ok := conn.(io.Writer)
+	if !ok {
+		return fmt.Errorf("%s connection does not take raw writes", transport)
+	}
+	_, err = w.Write([]byte("\r\n\r\n"))
+	return err
+}
@@ -0,0 +1,155 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"nextgen-sip/internal/registrar"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakePinger fails the pings to the contacts marked down and holds the flows
+// of every contact but those marked foreign
+type fakePinger struct {
+	mu      sync.Mutex
+	down    map[string]bool
+	foreign map[string]bool
+	pings   map[string]int
+}
+
+func (p *fakePinger) ping(ctx context.Context, b registrar.Binding) (string, time.Duration, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pings[b.Contact]++
+	if p.down[b.Contact] {
+		return "OPTIONS", 0, errors.New("no answer")
+	}
+	return "OPTIONS", 20 * time.Millisecond, nil
+}
+
+func (p *fakePinger) holdsFlow(b registrar.Binding) bool {
+	return !p.foreign[b.Contact]
+}
+
+func (p *fakePinger) setDown(contact string, down bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.down[contact] = down
+}
+
+const keepaliveAOR = "sip:100@example.com"
+
+// keepaliveTest registers NATed contacts n1 and n2, n3 whose flow is
+// another proxy's, and d which is not behind a NAT
+func keepaliveTest(t *testing.T, maxFailures int) (*Keepalive, *fakePinger, *registrar.MemoryRegistrar) {
+	t.Helper()
+	reg := registrar.NewMemoryRegistrar(time.Hour)
+	t.Cleanup(reg.Close)
+	u := registrar.Update{CallID: "reg", CSeq: 1, TenantID: "default", Contacts: []registrar.Contact{
+		{URI: "sip:100@10.0.0.1:5060", Q: 1, Expires: 600, NAT: true},
+		{URI: "sip:100@10.0.0.2:5060", Q: 1, Expires: 600, NAT: true},
+		{URI: "sip:100@10.0.0.3:5060", Q: 1, Expires: 600, NAT: true},
+		{URI: "sip:100@203.0.113.4:5060", Q: 1, Expires: 600},
+	}}
+	if _, err := reg.Update(keepaliveAOR, []string{keepaliveAOR}, u); err != nil {
+		t.Fatal(err)
+	}
+	p := &fakePinger{
+		down:    map[string]bool{},
+		foreign: map[string]bool{"sip:100@10.0.0.3:5060": true},
+		pings:   map[string]int{},
+	}
+	k := NewKeepalive(p, reg, KeepaliveConfig{Interval: time.Hour, Timeout: time.Second, MaxFailures: maxFailures})
+	t.Cleanup(k.Close)
+	return k, p, reg
+}
+
+// contacts lists the contacts still registered
+func contacts(t *testing.T, reg *registrar.MemoryRegistrar) map[string]registrar.Binding {
+	t.Helper()
+	regs, err := reg.Registrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := make(map[string]registrar.Binding)
+	for _, r := range regs {
+		for _, b := range r.Bindings {
+			m[b.Contact] = b
+		}
+	}
+	return m
+}
+
+func TestKeepaliveDrop(t *testing.T) {
+	k, p, reg := keepaliveTest(t, 3)
+	p.setDown("sip:100@10.0.0.1:5060", true)
+
+	for round := 1; round <= 3; round++ {
+		k.round()
+		bound := contacts(t, reg)
+		b, registered := bound["sip:100@10.0.0.1:5060"]
+		r, pinged := k.Reachability(keepaliveAOR, b)
+		if round < 3 {
+			if !registered || !pinged || r.Reachable || r.Failures != round {
+				t.Errorf("round %d: registered %v, reachability %+v", round, registered, r)
+			}
+			continue
+		}
+		if registered {
+			t.Errorf("round %d: unreachable contact still registered", round)
+		}
+		if len(bound) != 3 {
+			t.Errorf("round %d: %d contacts left, want the other 3", round, len(bound))
+		}
+	}
+
+	bound := contacts(t, reg)
+	if r, ok := k.Reachability(keepaliveAOR, bound["sip:100@10.0.0.2:5060"]); !ok || !r.Reachable || r.RTT != 20 {
+		t.Errorf("reachable contact: %+v, %v", r, ok)
+	}
+	for _, c := range []string{"sip:100@10.0.0.3:5060", "sip:100@203.0.113.4:5060"} {
+		if p.pings[c] != 0 {
+			t.Errorf("%s pinged %d times", c, p.pings[c])
+		}
+		if _, ok := k.Reachability(keepaliveAOR, bound[c]); ok {
+			t.Errorf("%s has a reachability", c)
+		}
+	}
+}
+
+func TestKeepaliveRecovers(t *testing.T) {
+	k, p, reg := keepaliveTest(t, 3)
+	contact := "sip:100@10.0.0.1:5060"
+	p.setDown(contact, true)
+	k.round()
+	k.round()
+	p.setDown(contact, false)
+	k.round()
+	p.setDown(contact, true)
+	k.round()
+	k.round()
+
+	b, ok := contacts(t, reg)[contact]
+	if !ok {
+		t.Fatal("contact dropped though it answered in between")
+	}
+	if r, _ := k.Reachability(keepaliveAOR, b); r.Failures != 2 {
+		t.Errorf("failures = %d, want 2 since the last answer", r.Failures)
+	}
+}
+
+func TestKeepaliveNoDrop(t *testing.T) {
+	k, p, reg := keepaliveTest(t, 0)
+	p.setDown("sip:100@10.0.0.1:5060", true)
+	for i := 0; i < 5; i++ {
+		k.round()
+	}
+	b, ok := contacts(t, reg)["sip:100@10.0.0.1:5060"]
+	if !ok {
+		t.Fatal("contact dropped with MaxFailures 0")
+	}
+	if r, _ := k.Reachability(keepaliveAOR, b); r.Reachable || r.Failures != 5 {
+		t.Errorf("reachability %+v, want unreachable after 5 failures", r)
+	}
+}
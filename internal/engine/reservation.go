@@ -0,0 +1,93 @@
+package engine
+
+import (
+	"log"
+	"nextgen-sip/internal/models"
+	"nextgen-sip/internal/money"
+	"nextgen-sip/internal/rating"
+	"nextgen-sip/pkg/utils"
+	"time"
+)
+
+// Prepaid calls hold part of the caller's balance instead of being charged
+// as they go. On answer a chunk of talk time is reserved at the call's rate
+// and a timer is set to top it up shortly before it runs out. When no more
+// balance can be reserved the timer instead cuts the call off at exactly
+// the talk time the reservation pays for. The real cost is settled at hangup.
+// A hold lapses unless topped up in time, so one left by a call that was
+// never settled does not keep the balance held.
+const (
+	reserveChunk = 5 * time.Minute                        // talk time reserved per top-up
+	topUpLead    = 30 * time.Second                       // top up this long before the reservation runs out
+	holdTTL      = reserveChunk + topUpLead + time.Minute // a hold not renewed by then outlived its call
+)
+
+// topUp reserves the next chunk of talk time for a connected call and
+// schedules the following top-up or the cutoff
+func (cc *CallControl) topUp(key string, d *dialog) {
+	cc.mu.RLock()
+	if cc.activeCalls[key] != d {
+		cc.mu.RUnlock()
+		return
+	}
+	call := d.call
+	from, rate := call.From, call.Rate
+	held, covered := call.Reserved, call.MaxDuration
+	cc.mu.RUnlock()
+
+	// Reserve what the next chunk costs on top of what is already held
+	_, target := rating.Cost(rate, float64(covered)+reserveChunk.Seconds())
+	want := target - held
+	granted, err := cc.billing.Reserve(from, want, call.CallID, holdTTL)
+	if err != nil {
+		log.Printf("[Billing] ✗ Reservation for %s failed: %v", call.CallID, err)
+	}
+
+	cc.mu.Lock()
+	if cc.activeCalls[key] != d {
+		cc.mu.Unlock()
+		// Hung up while we were reserving
+		if granted > 0 {
+			cc.billing.Settle(from, 0, call.CallID)
+		}
+		return
+	}
+	call.Reserved += granted
+	maxDur, unlimited := rating.MaxDuration(rate, call.Reserved)
+	if unlimited {
+		call.MaxDuration = 0
+		cc.mu.Unlock()
+		return
+	}
+	call.MaxDuration = maxDur
+	cutoff := call.AnswerTime.Add(time.Duration(maxDur) * time.Second)
+
+	if granted < want || err != nil {
+		// Balance exhausted: the call ends when the reservation does
+		wait := time.Until(cutoff)
+		log.Printf("[Billing] Call %s limited to %ds", call.CallID, maxDur)
+		d.billTimer = time.AfterFunc(wait, func() {
+			log.Printf("[Billing] Reservation exhausted for %s. Terminating %s", from, call.CallID)
+			utils.BillingDeductionErrors.Inc()
+			cc.terminate(key, 402, "insufficient funds")
+		})
+		cc.mu.Unlock()
+		return
+	}
+
+	d.billTimer = time.AfterFunc(time.Until(cutoff.Add(-topUpLead)), func() {
+		cc.topUp(key, d)
+	})
+	cc.mu.Unlock()
+}
+
+// settle releases a finished call's reservation and charges its real cost
+func (cc *CallControl) settle(user string, reserved money.Amount, record models.CDR) {
+	if reserved == 0 && record.Cost == 0 {
+		return
+	}
+	if err := cc.billing.Settle(user, record.Cost, record.CallID); err != nil {
+		log.Printf("[Billing] ✗ Failed to settle %s (%s of %s reserved): %v", record.CallID, record.Cost, reserved, err)
+		utils.BillingDeductionErrors.Inc()
+	}
+}
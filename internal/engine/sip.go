@@ -2,10 +2,18 @@ package engine
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
+	"net/http"
+	"strconv"
 	"strings"
+	"time"
+	"nextgen-sip/internal/auth"
+	"nextgen-sip/internal/dialplan"
 	"nextgen-sip/internal/firewall"
 	"nextgen-sip/internal/router"
+	"nextgen-sip/internal/trunk"
 	"nextgen-sip/pkg/utils"
 
 	"github.com/emiago/sipgo"
@@ -15,12 +23,17 @@ import (
 type SIPEngine struct {
 	server *sipgo.Server
 	client *sipgo.Client
+	flows  *sipgo.Client // Sends over the connections clients opened to us
+	tp     *sip.TransportLayer
 	router *router.RoutingEngine
 	cc     *CallControl
 	fw     *firewall.Firewall
+	auth   *auth.DigestAuthenticator
+
+	trunkRegs *TrunkRegistrations // nil when no trunk registers
 }
 
-func NewSIPEngine(ua *sipgo.UserAgent, r *router.RoutingEngine, cc *CallControl, fw *firewall.Firewall, clientAddr string) *SIPEngine {
+func NewSIPEngine(ua *sipgo.UserAgent, r *router.RoutingEngine, cc *CallControl, fw *firewall.Firewall, da *auth.DigestAuthenticator, clientAddr string) *SIPEngine {
 	s, err := sipgo.NewServer(ua)
 	if err != nil {
 		log.Fatal(err)
@@ -29,42 +42,96 @@ func NewSIPEngine(ua *sipgo.UserAgent, r *router.RoutingEngine, cc *CallControl,
 	if err != nil {
 		log.Fatal(err)
 	}
-	return &SIPEngine{
+	// Without a fixed local port the transport layer reuses an open
+	// connection to the destination instead of dialing a new one
+	flows, err := sipgo.NewClient(ua)
+	if err != nil {
+		log.Fatal(err)
+	}
+	e := &SIPEngine{
 		server: s,
 		client: c,
+		flows:  flows,
+		tp:     ua.TransportLayer(),
 		router: r,
 		cc:     cc,
 		fw:     fw,
+		auth:   da,
 	}
+	cc.bye = e
+	return e
 }
 
 func (e *SIPEngine) Start(ctx context.Context, network, addr string) error {
-	e.server.OnInvite(e.onInvite)
-	e.server.OnRegister(e.onRegister)
-	e.server.OnBye(e.proxyRoute)
-	e.server.OnMessage(e.proxyRoute)
-	e.server.OnOptions(e.onOptions)
-	e.server.OnAck(e.onAck)
-	e.server.OnCancel(e.proxyRoute)
+	e.server.OnInvite(stampVia(e.onInvite))
+	e.server.OnRegister(stampVia(e.onRegister))
+	e.server.OnBye(stampVia(e.proxyRoute))
+	e.server.OnMessage(stampVia(e.proxyRoute))
+	e.server.OnOptions(stampVia(e.onOptions))
+	e.server.OnAck(stampVia(e.onAck))
+	e.server.OnCancel(stampVia(e.proxyRoute))
 
 	log.Printf("=== XSIP Carrier Engine v6.0 ===")
 	log.Printf("Listening on %s (%s)", addr, network)
 	return e.server.ListenAndServe(ctx, network, addr)
 }
 
+// ─── Helper: RFC 3581 received/rport on every request ────────────
+func stampVia(handler sipgo.RequestHandler) sipgo.RequestHandler {
+	return func(req *sip.Request, tx sip.ServerTransaction) {
+		router.StampVia(req)
+		handler(req, tx)
+	}
+}
+
+// ─── Helper: pick the client handle for a request's transport ────
+// UDP goes out from the listening port, so replies and NAT pinholes line
+// up; connection-oriented transports reuse the client's own connection.
+func (e *SIPEngine) clientFor(req *sip.Request) *sipgo.Client {
+	if strings.EqualFold(req.Transport(), "udp") {
+		return e.client
+	}
+	return e.flows
+}
+
 // ─── Helper: send a response back to the request source ──────────
 func (e *SIPEngine) reply(tx sip.ServerTransaction, req *sip.Request, code int, reason string) {
-	resp := sip.NewResponseFromRequest(req, sip.StatusCode(code), reason, nil)
+	e.respond(tx, req, sip.NewResponseFromRequest(req, sip.StatusCode(code), reason, nil))
+}
+
+// routeFailed answers a request that could not be routed: 430 when it was
+// for a flow of ours that is gone (RFC 5626 section 5.3), 481 and 403 for
+// dialogs and route sets that are not ours, else 404
+func (e *SIPEngine) routeFailed(tx sip.ServerTransaction, req *sip.Request, err error) {
+	code, reason := routeFailure(err)
+	e.reply(tx, req, code, reason)
+}
+
+// routeFailure is the answer routeFailed gives for err
+func routeFailure(err error) (int, string) {
+	switch {
+	case errors.Is(err, router.ErrFlowFailed):
+		return 430, "Flow Failed"
+	case errors.Is(err, router.ErrNoDialog):
+		return 481, "Call/Transaction Does Not Exist"
+	case errors.Is(err, router.ErrForeignRoute):
+		return 403, "Forbidden"
+	default:
+		return 404, "Not Found"
+	}
+}
+
+func (e *SIPEngine) respond(tx sip.ServerTransaction, req *sip.Request, resp *sip.Response) {
 	resp.SetDestination(req.Source())
 	if err := tx.Respond(resp); err != nil {
-		log.Printf("[SIP] Failed to respond %d: %v", code, err)
+		log.Printf("[SIP] Failed to respond %d: %v", resp.StatusCode, err)
 	}
 }
 
 // ─── Generic Proxy Route (BYE, MESSAGE, CANCEL, etc.) ────────────
 // Follows the official sipgo proxy pattern: SetDestination + ClientRequestAddVia
 func (e *SIPEngine) proxyRoute(req *sip.Request, tx sip.ServerTransaction) {
-	ip := req.Source()
+	ip := sourceIP(req)
 	if !e.fw.IsAllowed(ip) {
 		return
 	}
@@ -74,25 +141,48 @@ func (e *SIPEngine) proxyRoute(req *sip.Request, tx sip.ServerTransaction) {
 	to := req.To().Address.String()
 	log.Printf("[%s] %s -> %s", method, from, to)
 
-	// Handle BYE call tracking
-	if method == sip.BYE {
-		e.cc.EndCall(req.CallID().Value())
+	// Dialog tracking
+	callID := req.CallID().Value()
+	fromTag, _ := req.From().Params.Get("tag")
+	toTag, _ := req.To().Params.Get("tag")
+
+	// Within a dialog we only route for calls we are tracking
+	if toTag != "" && method != sip.CANCEL {
+		if _, ok := e.cc.DialogState(callID, fromTag, toTag); !ok {
+			log.Printf("[%s] ✗ Unknown dialog %s from %s", method, callID, ip)
+			e.reply(tx, req, 481, "Call/Transaction Does Not Exist")
+			return
+		}
+	}
+
+	shift := e.cc.CSeqShift(callID, fromTag, toTag)
+	switch method {
+	case sip.BYE:
+		e.cc.OnBye(callID, fromTag, toTag)
+	case sip.CANCEL:
+		e.cc.OnCancel(callID, fromTag)
+	default:
+		if toTag != "" {
+			e.cc.OnInDialogRequest(callID, fromTag, toTag, req.CSeq().SeqNo+shift)
+		}
 	}
 
 	// Route to find destination
-	dest, err := e.router.Route(req)
+	dest, err := e.router.Route(req, e.cc.CallTenant(callID, fromTag, toTag))
 	if err != nil {
 		log.Printf("[%s] ✗ Route failed: %v", method, err)
-		e.reply(tx, req, 404, "Not Found")
+		e.routeFailed(tx, req, err)
 		return
 	}
 	log.Printf("[%s] ✓ Dest: %s", method, dest)
 
 	// ★ KEY: Set destination on the ORIGINAL request (don't build a new one!)
-	req.SetDestination(dest)
+	// unless its CSeq has to be moved up for the callee
+	out := shifted(req, shift)
+	out.SetDestination(dest)
 
 	// ★ KEY: Use ClientRequestAddVia so sipgo properly manages Via headers
-	clTx, err := e.client.TransactionRequest(context.Background(), req, sipgo.ClientRequestAddVia)
+	clTx, err := e.clientFor(out).TransactionRequest(context.Background(), out, sipgo.ClientRequestAddVia)
 	if err != nil {
 		log.Printf("[%s] ✗ Proxy failed: %v", method, err)
 		e.reply(tx, req, 502, "Bad Gateway")
@@ -113,6 +203,7 @@ func (e *SIPEngine) proxyRoute(req *sip.Request, tx sip.ServerTransaction) {
 			// ★ KEY: Set destination back to caller and remove top Via
 			res.SetDestination(req.Source())
 			res.RemoveHeader("Via")
+			res.CSeq().SeqNo = req.CSeq().SeqNo
 
 			if err := tx.Respond(res); err != nil {
 				log.Printf("[%s] ✗ Relay response failed: %v", method, err)
@@ -141,66 +232,233 @@ func (e *SIPEngine) proxyRoute(req *sip.Request, tx sip.ServerTransaction) {
 
 // ─── REGISTER ─────────────────────────────────────────────────────
 func (e *SIPEngine) onRegister(req *sip.Request, tx sip.ServerTransaction) {
-	ip := req.Source()
+	ip := sourceIP(req)
 	if !e.fw.IsAllowed(ip) {
 		log.Printf("[FIREWALL] Blocked REGISTER from %s", ip)
 		return
 	}
 
-	result, err := e.router.Route(req)
+	user, ok := e.authenticate(req, tx, req.To().Address)
+	if !ok {
+		return
+	}
+
+	bindings, err := e.router.Register(req, userTenant(user))
+	var rerr *router.RegisterError
+	if errors.As(err, &rerr) {
+		log.Printf("[SIP] ✗ Registration rejected: %v", rerr)
+		resp := sip.NewResponseFromRequest(req, sip.StatusCode(rerr.Code), rerr.Reason, nil)
+		if rerr.MinExpires > 0 {
+			resp.AppendHeader(sip.NewHeader("Min-Expires", strconv.Itoa(rerr.MinExpires)))
+		}
+		e.respond(tx, req, resp)
+		return
+	}
 	if err != nil {
-		e.fw.RecordFailedAuth(ip)
-		e.reply(tx, req, 401, "Unauthorized")
+		log.Printf("[SIP] ✗ Registration failed: %v", err)
+		e.reply(tx, req, 500, "Server Internal Error")
 		return
 	}
 
-	log.Printf("[SIP] ✓ Registration: %s", result)
-	e.reply(tx, req, 200, "OK")
+	// The 200 OK lists every current binding with its remaining lifetime,
+	// echoes the Path (RFC 3327 section 5.3) and confirms outbound
+	now := time.Now()
+	resp := sip.NewResponseFromRequest(req, 200, "OK", nil)
+	for _, b := range bindings {
+		value := fmt.Sprintf("<%s>;expires=%d", b.Contact, b.ExpiresIn(now))
+		if b.Q != 1 {
+			value += ";q=" + strconv.FormatFloat(b.Q, 'f', -1, 64)
+		}
+		if b.Instance != "" {
+			value += fmt.Sprintf(`;+sip.instance="<%s>"`, b.Instance)
+		}
+		if b.RegID > 0 {
+			value += ";reg-id=" + strconv.Itoa(b.RegID)
+		}
+		resp.AppendHeader(sip.NewHeader("Contact", value))
+	}
+	sip.CopyHeaders("Path", req, resp)
+	if router.OutboundRegister(req) {
+		resp.AppendHeader(sip.NewHeader("Require", "outbound"))
+	}
+	resp.AppendHeader(sip.NewHeader("Date", now.UTC().Format(http.TimeFormat)))
+	log.Printf("[SIP] ✓ Registration: %s has %d binding(s)", req.To().Address.String(), len(bindings))
+	e.respond(tx, req, resp)
 }
 
 // ─── INVITE ───────────────────────────────────────────────────────
 func (e *SIPEngine) onInvite(req *sip.Request, tx sip.ServerTransaction) {
-	ip := req.Source()
+	ip := sourceIP(req)
 	if !e.fw.IsAllowed(ip) {
 		utils.FirewallBlocks.Inc()
 		return
 	}
 
+	// Only dialog-creating INVITEs are challenged; re-INVITEs ride a
+	// dialog we set up and the caller confirmed, and calls from a carrier
+	// we are registered with come over that registration. A To tag alone
+	// proves nothing.
+	toTag, inDialog := req.To().Params.Get("tag")
+	if inDialog {
+		fromTag, _ := req.From().Params.Get("tag")
+		if confirmed, ok := e.cc.DialogState(req.CallID().Value(), fromTag, toTag); !ok || !confirmed {
+			log.Printf("[INVITE] ✗ re-INVITE from %s for unknown dialog %s", ip, req.CallID().Value())
+			e.reply(tx, req, 481, "Call/Transaction Does Not Exist")
+			return
+		}
+	}
+	// The tenant is the subscriber's, or for calls from a carrier the one
+	// of the DID called; re-INVITEs keep the call's
+	tenantID := dialplan.DefaultTenant
+	var inbound trunk.Trunk
+	fromTrunk := false
+	if inDialog {
+		fromTag, _ := req.From().Params.Get("tag")
+		tenantID = e.cc.CallTenant(req.CallID().Value(), fromTag, toTag)
+	} else if inbound, fromTrunk = e.trunkRegs.Inbound(req); fromTrunk {
+		log.Printf("[INVITE] Inbound call from trunk %s", inbound.ID)
+	} else {
+		user, ok := e.authenticate(req, tx, req.From().Address)
+		if !ok {
+			return
+		}
+		tenantID = userTenant(user)
+	}
+
 	from := req.From().Address.String()
 	to := req.To().Address.String()
 	callID := req.CallID().Value()
+	fromTag, _ := req.From().Params.Get("tag")
 
-	tenantID := "default"
-	if h := req.GetHeader("X-Tenant-ID"); h != nil {
-		tenantID = h.Value()
-	}
 	utils.SipRequestsTotal.WithLabelValues("INVITE", tenantID).Inc()
 
 	log.Printf("[INVITE] %s -> %s (CallID: %s)", from, to, callID)
 
-	// Route
-	dest, err := e.router.Route(req)
+	// The caller's transport, before routing retargets the request
+	transport := req.Transport()
+	if router.FixContact(req.Contact(), req.Via(), req.Source(), transport) {
+		log.Printf("[INVITE] Caller behind NAT, Contact rewritten to %s", req.Contact().Address.String())
+	}
+
+	// Route. The INVITE as it came in is kept, to send to the next trunk
+	// should the first fail the call.
+	var orig *sip.Request
+	if !inDialog {
+		orig = req.Clone()
+		orig.SetBody(req.Body())
+	}
+	target, err := e.router.Resolve(req, tenantID, fromTrunk)
 	if err != nil {
 		log.Printf("[INVITE] ✗ Route failed: %v", err)
-		e.reply(tx, req, 404, "Not Found")
+		if !inDialog {
+			code, reason := routeFailure(err)
+			e.cc.RejectCall(from, to, callID, tenantID, code, reason)
+		}
+		e.routeFailed(tx, req, err)
 		return
 	}
+	dest := target.Dest
 	log.Printf("[INVITE] ✓ Dest: %s", dest)
 
-	// Track call
-	e.cc.StartCall(from, to, callID, tenantID)
+	// Track call; re-INVITEs belong to an existing dialog. out is the
+	// INVITE as the callee gets it.
+	out := req
+	if inDialog {
+		shift := e.cc.CSeqShift(callID, fromTag, toTag)
+		e.cc.OnInDialogRequest(callID, fromTag, toTag, req.CSeq().SeqNo+shift)
+		out = shifted(req, shift)
+	} else {
+		// Calls to a DID are the DID's tenant's
+		if target.TenantID != "" {
+			tenantID = target.TenantID
+		}
+		if _, err := e.cc.StartCall(from, to, callID, fromTag, tenantID, fromTrunk); err != nil {
+			log.Printf("[INVITE] ✗ Rating failed for %s: %v", to, err)
+			e.cc.RejectCall(from, to, callID, tenantID, 403, "Destination Not Allowed")
+			e.reply(tx, req, 403, "Destination Not Allowed")
+			return
+		}
+
+		// ★ KEY: Stay on the dialog path so BYE/ACK/re-INVITE come through us
+		req.PrependHeader(e.router.RecordRoute(transport))
+		switch {
+		case target.Trunk != nil:
+			e.cc.OnTrunk(callID, fromTag, target.Trunk.ID)
+		case fromTrunk:
+			e.cc.OnTrunk(callID, fromTag, inbound.ID)
+		}
+	}
 
 	// ★ KEY: Set destination on original request
-	req.SetDestination(dest)
+	out.SetDestination(dest)
+
+	// Our own answers to the caller are built from the INVITE as it was
+	// asked, without the Via forwarding adds
+	asked := req.Clone()
 
 	// ★ KEY: Forward with proper Via and Record-Route
-	clTx, err := e.client.TransactionRequest(context.Background(), req, sipgo.ClientRequestAddVia)
+	client := e.clientFor(out)
+	clTx, err := client.TransactionRequest(context.Background(), out, sipgo.ClientRequestAddVia)
+	authed := false // Sent credentials to the trunk
+
+	// A ring group member rings only so long before the next is tried
+	var ringing <-chan time.Time
+	if target.Ring > 0 {
+		ringing = time.After(target.Ring)
+	}
+
+	// failover sends the call to the hop after the one that failed it: the
+	// next trunk left, or the next ring group member, skipping those that
+	// cannot be reached. It is false when none is left.
+	failover := func() bool {
+		if orig == nil {
+			return false
+		}
+		for {
+			retry := orig.Clone()
+			retry.SetBody(orig.Body())
+			next, ok := e.router.Next(retry, target)
+			if !ok {
+				return false
+			}
+			target, dest = next, next.Dest
+			retry.PrependHeader(e.router.RecordRoute(transport))
+			retry.SetDestination(dest)
+			if target.Trunk != nil {
+				e.cc.OnTrunk(callID, fromTag, target.Trunk.ID)
+			}
+
+			c := e.clientFor(retry)
+			t, err := c.TransactionRequest(context.Background(), retry, sipgo.ClientRequestAddVia)
+			if err != nil {
+				log.Printf("[INVITE] ✗ %s unreachable: %v", dest, err)
+				continue
+			}
+			log.Printf("[INVITE] Failing over to %s", dest)
+			out, client, clTx, authed = retry, c, t, false
+			ringing = nil
+			if target.Ring > 0 {
+				ringing = time.After(target.Ring)
+			}
+			return true
+		}
+	}
+
 	if err != nil {
 		log.Printf("[INVITE] ✗ Proxy failed: %v", err)
-		e.reply(tx, req, 503, "Service Unavailable")
-		return
+		if !failover() {
+			if !inDialog {
+				e.cc.OnTimeout(callID, fromTag)
+			}
+			e.reply(tx, asked, 503, "Service Unavailable")
+			return
+		}
 	}
-	defer clTx.Terminate()
+	defer func() {
+		if clTx != nil {
+			clTx.Terminate()
+		}
+	}()
 
 	log.Printf("[INVITE] ✓ Forwarded, blocking for response...")
 
@@ -214,13 +472,65 @@ func (e *SIPEngine) onInvite(req *sip.Request, tx sip.ServerTransaction) {
 
 			log.Printf("[INVITE] ← %d %s", res.StatusCode, res.Reason)
 
+			// A trunk's challenge is ours to answer, once; the caller
+			// has no credentials for it
+			if target.Trunk != nil && (res.StatusCode == 401 || res.StatusCode == 407) {
+				retry, authTx, err := e.authenticateTrunk(client, out, res, target.Trunk, authed)
+				if err != nil {
+					log.Printf("[INVITE] ✗ Trunk %s: %v", target.Trunk.ID, err)
+					clTx.Terminate()
+					if failover() {
+						continue
+					}
+					if !inDialog {
+						e.cc.OnFailure(callID, fromTag, 503, "trunk authentication failed")
+					}
+					e.reply(tx, asked, 503, "Service Unavailable")
+					return
+				}
+				log.Printf("[INVITE] Trunk %s challenged, resent with credentials", target.Trunk.ID)
+				clTx.Terminate()
+				out, clTx, authed = retry, authTx, true
+				continue
+			}
+
+			// A carrier that cannot complete the call hands it on to the
+			// next trunk, a ring group member that does not take it to the
+			// next member; its final response only reaches the caller when
+			// no hop is left
+			if target.Retry(int(res.StatusCode)) {
+				log.Printf("[INVITE] ✗ %s failed the call with %d", dest, res.StatusCode)
+				clTx.Terminate()
+				if failover() {
+					continue
+				}
+			}
+
+			if router.FixContact(res.Contact(), nil, res.Source(), res.Transport()) {
+				log.Printf("[INVITE] Callee behind NAT, Contact rewritten to %s", res.Contact().Address.String())
+			}
 			res.SetDestination(req.Source())
 			res.RemoveHeader("Via")
+			res.CSeq().SeqNo = req.CSeq().SeqNo
 
 			if err := tx.Respond(res); err != nil {
 				log.Printf("[INVITE] ✗ Relay failed: %v", err)
 			}
 
+			if !inDialog {
+				toTag, _ := res.To().Params.Get("tag")
+				switch {
+				case res.IsProvisional():
+					e.cc.OnProvisional(callID, fromTag, toTag, int(res.StatusCode))
+				case res.IsSuccess():
+					legs := newDialogLegs(out, res, transport, dest, e.router)
+					legs.shift = out.CSeq().SeqNo - req.CSeq().SeqNo
+					e.cc.OnAnswer(callID, fromTag, toTag, legs)
+				default:
+					e.cc.OnFailure(callID, fromTag, int(res.StatusCode), res.Reason)
+				}
+			}
+
 			if res.StatusCode >= 200 {
 				log.Printf("[INVITE] ✓ Final response %d relayed!", res.StatusCode)
 				return
@@ -230,30 +540,58 @@ func (e *SIPEngine) onInvite(req *sip.Request, tx sip.ServerTransaction) {
 			// Relay ACK to callee
 			log.Printf("[INVITE] ACK received, relaying to %s", dest)
 			ack.SetDestination(dest)
-			e.client.WriteRequest(ack, sipgo.ClientRequestAddVia)
+			ack.SetTransport(out.Transport())
+			ack.CSeq().SeqNo = out.CSeq().SeqNo
+			client.WriteRequest(ack, sipgo.ClientRequestAddVia)
 
 		case <-clTx.Done():
 			err := clTx.Err()
 			if err != nil {
 				log.Printf("[INVITE] Client tx done with error: %v", err)
+				if failover() {
+					continue
+				}
+				if !inDialog {
+					e.cc.OnTimeout(callID, fromTag)
+				}
+				e.reply(tx, asked, 408, "Request Timeout")
 			} else {
 			    log.Printf("[INVITE] Client tx done")
 			}
 			return
 
+		case <-ringing:
+			// The member rang out; its transaction is canceled and left
+			// to finish with the 487 the CANCEL gets
+			log.Printf("[INVITE] %s did not answer in %s", dest, target.Ring)
+			clTx.Cancel()
+			abandon(clTx)
+			if failover() {
+				continue
+			}
+			clTx = nil
+			if !inDialog {
+				e.cc.OnFailure(callID, fromTag, 480, "no answer")
+			}
+			e.reply(tx, asked, 480, "Temporarily Unavailable")
+			return
+
 		case <-tx.Done():
 			err := tx.Err()
 			if err != nil {
 				// If error contains "canceled", forward CANCEL to callee
 				if strings.Contains(err.Error(), "canceled") || strings.Contains(err.Error(), "terminated") {
 					log.Printf("[INVITE] Caller canceled, forwarding CANCEL")
-					cancelReq := sip.NewRequest(sip.CANCEL, req.Recipient)
-					sip.CopyHeaders("Via", req, cancelReq)
-					sip.CopyHeaders("From", req, cancelReq)
-					sip.CopyHeaders("To", req, cancelReq)
-					sip.CopyHeaders("Call-ID", req, cancelReq)
+					e.cc.OnCancel(callID, fromTag)
+					cancelReq := sip.NewRequest(sip.CANCEL, out.Recipient)
+					sip.CopyHeaders("Via", out, cancelReq)
+					sip.CopyHeaders("From", out, cancelReq)
+					sip.CopyHeaders("To", out, cancelReq)
+					sip.CopyHeaders("Call-ID", out, cancelReq)
+					cancelReq.AppendHeader(&sip.CSeqHeader{SeqNo: out.CSeq().SeqNo, MethodName: sip.CANCEL})
 					cancelReq.SetDestination(dest)
-					e.client.Do(context.Background(), cancelReq)
+					cancelReq.SetTransport(out.Transport())
+					client.Do(context.Background(), cancelReq)
 					return
 				}
 				log.Printf("[INVITE] Server tx error: %v", err)
@@ -264,16 +602,69 @@ func (e *SIPEngine) onInvite(req *sip.Request, tx sip.ServerTransaction) {
 	}
 }
 
+// abandon lets a canceled INVITE transaction run to its final response in
+// the background, so that it is acknowledged, then ends it
+func abandon(clTx sip.ClientTransaction) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 32*time.Second)
+		defer cancel()
+		finalResponse(ctx, clTx)
+		clTx.Terminate()
+	}()
+}
+
+// ─── Helper: CSeq numbers used up towards a trunk ────────────────
+// shifted returns req as the callee gets it: a copy moved up by shift CSeq
+// numbers when the proxy used some authenticating to a trunk, else req
+func shifted(req *sip.Request, shift uint32) *sip.Request {
+	if shift == 0 {
+		return req
+	}
+	out := req.Clone()
+	out.SetBody(req.Body())
+	out.CSeq().SeqNo += shift
+	return out
+}
+
+// authenticateTrunk resends an INVITE that trunk t challenged, with
+// digest credentials and the next CSeq, as a new transaction. It gives up
+// when req already carried credentials, which the trunk then refused.
+func (e *SIPEngine) authenticateTrunk(client *sipgo.Client, req *sip.Request, res *sip.Response, t *trunk.Trunk, retried bool) (*sip.Request, sip.ClientTransaction, error) {
+	if t.Username == "" {
+		return nil, nil, fmt.Errorf("challenged with %d but no credentials are configured", res.StatusCode)
+	}
+	if retried {
+		return nil, nil, fmt.Errorf("credentials refused with %d", res.StatusCode)
+	}
+	retry := req.Clone()
+	retry.SetBody(req.Body())
+	clTx, err := client.DoDigestAuth(context.Background(), retry, res, sipgo.DigestAuth{Username: t.Username, Password: t.Password})
+	if err != nil {
+		return nil, nil, err
+	}
+	return retry, clTx, nil
+}
+
 // ─── ACK (standalone, outside INVITE tx) ──────────────────────────
 func (e *SIPEngine) onAck(req *sip.Request, tx sip.ServerTransaction) {
-	dest, err := e.router.Route(req)
+	// An ACK for a 2xx follows the dialog; one for a call we are not
+	// tracking goes nowhere, as ACKs get no answer
+	fromTag, _ := req.From().Params.Get("tag")
+	toTag, _ := req.To().Params.Get("tag")
+	if _, ok := e.cc.DialogState(req.CallID().Value(), fromTag, toTag); !ok {
+		return
+	}
+	dest, err := e.router.Route(req, e.cc.CallTenant(req.CallID().Value(), fromTag, toTag))
 	if err != nil {
 		return
 	}
 
+	req.CSeq().SeqNo += e.cc.CSeqShift(req.CallID().Value(), fromTag, toTag)
+	e.cc.OnAck(req.CallID().Value(), fromTag, toTag)
+
 	log.Printf("[ACK] Relaying to %s", dest)
 	req.SetDestination(dest)
-	e.client.WriteRequest(req, sipgo.ClientRequestAddVia)
+	e.clientFor(req).WriteRequest(req, sipgo.ClientRequestAddVia)
 }
 
 // ─── OPTIONS ──────────────────────────────────────────────────────
@@ -0,0 +1,218 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"nextgen-sip/internal/models"
+	"nextgen-sip/internal/router"
+	"time"
+
+	"github.com/emiago/sipgo"
+	"github.com/emiago/sipgo/sip"
+)
+
+// How long to wait for each party to answer a proxy-generated BYE
+const byeTimeout = 8 * time.Second
+
+// dialogLeg holds what the proxy needs to send an in-dialog request to one
+// party of a confirmed dialog
+type dialogLeg struct {
+	target    sip.Uri   // remote target, from the party's Contact
+	routes    []sip.Uri // route set from us towards the party
+	dest      string    // first hop address
+	transport string
+	cseq      uint32 // highest CSeq the other party sent towards this one
+}
+
+// dialogLegs is the route state of both sides of a call, captured on 2xx
+type dialogLegs struct {
+	callID string
+	from   sip.Uri // caller AOR and tag
+	tag    string
+	to     sip.Uri // callee AOR and tag
+	toTag  string
+	caller dialogLeg
+	callee dialogLeg
+	shift  uint32 // CSeq numbers we used towards the callee authenticating to a trunk
+}
+
+// newDialogLegs derives both legs from the forwarded INVITE and its 2xx.
+// The Record-Route entries above ours lead to the callee (in reverse), the
+// ones below ours lead back to the caller.
+func newDialogLegs(invite *sip.Request, res *sip.Response, callerTransport, calleeDest string, rt *router.RoutingEngine) *dialogLegs {
+	fromTag, _ := invite.From().Params.Get("tag")
+	toTag, _ := res.To().Params.Get("tag")
+	l := &dialogLegs{
+		callID: invite.CallID().Value(),
+		from:   *invite.From().Address.Clone(),
+		tag:    fromTag,
+		to:     *res.To().Address.Clone(),
+		toTag:  toTag,
+		caller: dialogLeg{
+			dest:      invite.Source(),
+			transport: callerTransport,
+		},
+		callee: dialogLeg{
+			dest:      calleeDest,
+			transport: invite.Transport(),
+			cseq:      invite.CSeq().SeqNo,
+		},
+	}
+	if c := invite.Contact(); c != nil {
+		l.caller.target = *c.Address.Clone()
+	}
+	if c := res.Contact(); c != nil {
+		l.callee.target = *c.Address.Clone()
+	}
+
+	rr := res.GetHeaders("Record-Route")
+	for i, h := range rr {
+		if !rt.IsLocal(h.(*sip.RecordRouteHeader).Address) {
+			continue
+		}
+		for j := i - 1; j >= 0; j-- {
+			l.callee.routes = append(l.callee.routes, *rr[j].(*sip.RecordRouteHeader).Address.Clone())
+		}
+		for _, h := range rr[i+1:] {
+			l.caller.routes = append(l.caller.routes, *h.(*sip.RecordRouteHeader).Address.Clone())
+		}
+		break
+	}
+	for _, leg := range []*dialogLeg{&l.caller, &l.callee} {
+		if len(leg.routes) > 0 {
+			leg.dest = router.HostPort(leg.routes[0], leg.transport)
+		}
+	}
+	return l
+}
+
+// byes builds a BYE towards each party. Each one carries the dialog
+// identifiers as the opposite party would send them, so the UA accepts it.
+func (l *dialogLegs) byes(code int, reason string) []*sip.Request {
+	return []*sip.Request{
+		l.newBye(&l.callee, l.from, l.tag, l.to, l.toTag, code, reason),
+		l.newBye(&l.caller, l.to, l.toTag, l.from, l.tag, code, reason),
+	}
+}
+
+func (l *dialogLegs) newBye(leg *dialogLeg, from sip.Uri, fromTag string, to sip.Uri, toTag string, code int, reason string) *sip.Request {
+	leg.cseq++
+
+	bye := sip.NewRequest(sip.BYE, *leg.target.Clone())
+	fh := &sip.FromHeader{Address: *from.Clone(), Params: sip.NewParams()}
+	fh.Params.Add("tag", fromTag)
+	th := &sip.ToHeader{Address: *to.Clone(), Params: sip.NewParams()}
+	th.Params.Add("tag", toTag)
+	callID := sip.CallIDHeader(l.callID)
+
+	bye.AppendHeader(fh)
+	bye.AppendHeader(th)
+	bye.AppendHeader(&callID)
+	bye.AppendHeader(&sip.CSeqHeader{SeqNo: leg.cseq, MethodName: sip.BYE})
+	for _, r := range leg.routes {
+		bye.AppendHeader(&sip.RouteHeader{Address: *r.Clone()})
+	}
+	// RFC 3326
+	bye.AppendHeader(sip.NewHeader("Reason", fmt.Sprintf("SIP;cause=%d;text=%q", code, reason)))
+
+	bye.SetTransport(leg.transport)
+	bye.SetDestination(leg.dest)
+	return bye
+}
+
+// OnInDialogRequest keeps track of the CSeq each party uses so that
+// proxy-generated requests stay in sequence
+func (cc *CallControl) OnInDialogRequest(callID, fromTag, toTag string, cseq uint32) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	_, d := cc.lookupLocked(callID, fromTag, toTag)
+	if d == nil || d.legs == nil {
+		return
+	}
+	leg := &d.legs.caller
+	if fromTag == d.call.FromTag {
+		leg = &d.legs.callee
+	}
+	if cseq > leg.cseq {
+		leg.cseq = cseq
+	}
+}
+
+// CSeqShift is how far the callee's view of the dialog's CSeq is ahead of
+// the caller's, after the proxy authenticated to a trunk. Requests from the
+// caller are moved up by it; requests from the callee are not shifted.
+func (cc *CallControl) CSeqShift(callID, fromTag, toTag string) uint32 {
+	cc.mu.RLock()
+	defer cc.mu.RUnlock()
+
+	_, d := cc.lookupLocked(callID, fromTag, toTag)
+	if d == nil || d.legs == nil || fromTag != d.call.FromTag {
+		return 0
+	}
+	return d.legs.shift
+}
+
+// byeSender delivers proxy-generated BYEs; implemented by SIPEngine
+type byeSender interface {
+	sendBye(ctx context.Context, bye *sip.Request) (*sip.Response, error)
+}
+
+// sendBye delivers a proxy-generated BYE and waits for its final response
+func (e *SIPEngine) sendBye(ctx context.Context, bye *sip.Request) (*sip.Response, error) {
+	clTx, err := e.clientFor(bye).TransactionRequest(ctx, bye, sipgo.ClientRequestBuild)
+	if err != nil {
+		return nil, err
+	}
+	defer clTx.Terminate()
+
+	for {
+		select {
+		case res, more := <-clTx.Responses():
+			if !more {
+				return nil, fmt.Errorf("transaction closed")
+			}
+			if res.IsProvisional() {
+				continue
+			}
+			return res, nil
+		case <-clTx.Done():
+			return nil, clTx.Err()
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// terminate ends the call right away and tears down both legs in the
+// background. The CDR records the reason regardless of how the parties
+// answer the BYEs.
+func (cc *CallControl) terminate(key string, code int, reason string) {
+	cc.mu.Lock()
+	d, ok := cc.activeCalls[key]
+	if !ok {
+		cc.mu.Unlock()
+		return
+	}
+	var byes []*sip.Request
+	if d.legs != nil && cc.bye != nil {
+		byes = d.legs.byes(code, reason)
+	}
+	cc.endLocked(key, code, reason, models.HangupSystem)
+	cc.mu.Unlock()
+
+	for _, bye := range byes {
+		go func(bye *sip.Request) {
+			ctx, cancel := context.WithTimeout(context.Background(), byeTimeout)
+			defer cancel()
+
+			res, err := cc.bye.sendBye(ctx, bye)
+			if err != nil {
+				log.Printf("[CallControl] ✗ BYE to %s for %s failed: %v", bye.Destination(), d.call.CallID, err)
+				return
+			}
+			log.Printf("[CallControl] BYE to %s for %s ← %d %s", bye.Destination(), d.call.CallID, res.StatusCode, res.Reason)
+		}(bye)
+	}
+}
@@ -0,0 +1,176 @@
+package engine
+
+import (
+	"context"
+	"nextgen-sip/internal/models"
+	"nextgen-sip/internal/router"
+	"testing"
+	"time"
+
+	"github.com/emiago/sipgo/sip"
+)
+
+// byeRecorder answers every BYE with 200 and hands it to the test
+type byeRecorder chan *sip.Request
+
+func (r byeRecorder) sendBye(ctx context.Context, bye *sip.Request) (*sip.Response, error) {
+	r <- bye
+	return sip.NewResponseFromRequest(bye, 200, "OK", nil), nil
+}
+
+// parse reads a SIP message given line by line, without a body
+func parse(t *testing.T, lines ...string) sip.Message {
+	t.Helper()
+	raw := ""
+	for _, l := range lines {
+		raw += l + "\r\n"
+	}
+	msg, err := sip.ParseMessage([]byte(raw + "Content-Length: 0\r\n\r\n"))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	return msg
+}
+
+// answeredLegs is a call from 100 through an edge proxy in front of it, to
+// 200 behind another proxy, answered through us at 198.51.100.1
+func answeredLegs(t *testing.T) *dialogLegs {
+	t.Helper()
+	invite := parse(t,
+		"INVITE sip:200@192.0.2.20:5060 SIP/2.0",
+		"Via: SIP/2.0/UDP 198.51.100.1:5060;branch=z9hG4bK2",
+		"Via: SIP/2.0/UDP 192.0.2.10:5060;branch=z9hG4bK1",
+		"From: <sip:100@example.com>;tag=f",
+		"To: <sip:200@example.com>",
+		"Call-ID: c",
+		"CSeq: 7 INVITE",
+		"Contact: <sip:100@203.0.113.5:5060>",
+		"Max-Forwards: 69",
+	).(*sip.Request)
+	invite.SetSource("192.0.2.10:5060")
+	res := parse(t,
+		"SIP/2.0 200 OK",
+		"Via: SIP/2.0/UDP 198.51.100.1:5060;branch=z9hG4bK2",
+		"Via: SIP/2.0/UDP 192.0.2.10:5060;branch=z9hG4bK1",
+		"Record-Route: <sip:192.0.2.20:5070;lr>",
+		"Record-Route: <sip:198.51.100.1:5060;transport=udp;lr>",
+		"Record-Route: <sip:192.0.2.10;lr>",
+		"From: <sip:100@example.com>;tag=f",
+		"To: <sip:200@example.com>;tag=t1",
+		"Call-ID: c",
+		"CSeq: 7 INVITE",
+		"Contact: <sip:200@203.0.113.9:5062>",
+	).(*sip.Response)
+	rt := router.NewRoutingEngine(nil, nil, nil, nil, nil, nil, time.Second,
+		sip.Uri{Host: "198.51.100.1", Port: 5060}, router.ExpiryLimits{})
+	return newDialogLegs(invite, res, "UDP", "192.0.2.20:5070", rt)
+}
+
+func TestDialogLegs(t *testing.T) {
+	l := answeredLegs(t)
+	tests := []struct {
+		name   string
+		leg    dialogLeg
+		target string
+		routes []string
+		dest   string
+	}{
+		{"caller", l.caller, "sip:100@203.0.113.5:5060", []string{"sip:192.0.2.10;lr"}, "192.0.2.10:5060"},
+		{"callee", l.callee, "sip:200@203.0.113.9:5062", []string{"sip:192.0.2.20:5070;lr"}, "192.0.2.20:5070"},
+	}
+	for _, tt := range tests {
+		if got := tt.leg.target.String(); got != tt.target {
+			t.Errorf("%s: target %s, want %s", tt.name, got, tt.target)
+		}
+		var routes []string
+		for _, r := range tt.leg.routes {
+			routes = append(routes, r.String())
+		}
+		if len(routes) != len(tt.routes) || (len(routes) > 0 && routes[0] != tt.routes[0]) {
+			t.Errorf("%s: routes %v, want %v", tt.name, routes, tt.routes)
+		}
+		if tt.leg.dest != tt.dest {
+			t.Errorf("%s: dest %s, want %s", tt.name, tt.leg.dest, tt.dest)
+		}
+	}
+}
+
+func TestTerminate(t *testing.T) {
+	sink := make(cdrSink, 1)
+	byes := make(byeRecorder, 2)
+	cc := NewCallControl(nil, nil, sink)
+	cc.bye = byes
+	cc.StartCall("sip:100@example.com", "sip:200@example.com", "c", "f", "acme", true)
+	cc.OnAnswer("c", "f", "t1", answeredLegs(t))
+	cc.OnAck("c", "f", "t1")
+	// The callee sent a re-INVITE of its own, numbered from its side
+	cc.OnInDialogRequest("c", "t1", "f", 3)
+
+	cc.terminate(dialogKey("c", "f"), 402, "insufficient funds")
+
+	if calls := cc.GetActiveCalls(); len(calls) != 0 {
+		t.Errorf("call still up after terminate")
+	}
+	c := sink.next(t)
+	if c.Status != models.CDRAnswered || c.DisconnectCode != 402 || c.HangupBy != models.HangupSystem {
+		t.Errorf("CDR %s %d by %s, want answered 402 by system", c.Status, c.DisconnectCode, c.HangupBy)
+	}
+
+	want := map[string]struct {
+		from, fromTag, to, toTag string
+		cseq                     uint32
+		route                    string
+	}{
+		"192.0.2.20:5070": {"sip:100@example.com", "f", "sip:200@example.com", "t1", 8, "<sip:192.0.2.20:5070;lr>"},
+		"192.0.2.10:5060": {"sip:200@example.com", "t1", "sip:100@example.com", "f", 4, "<sip:192.0.2.10;lr>"},
+	}
+	for i := 0; i < 2; i++ {
+		var bye *sip.Request
+		select {
+		case bye = <-byes:
+		case <-time.After(time.Second):
+			t.Fatal("BYE not sent")
+		}
+		w, ok := want[bye.Destination()]
+		if !ok {
+			t.Errorf("BYE sent to %s", bye.Destination())
+			continue
+		}
+		delete(want, bye.Destination())
+		fromTag, _ := bye.From().Params.Get("tag")
+		toTag, _ := bye.To().Params.Get("tag")
+		if bye.From().Address.String() != w.from || fromTag != w.fromTag || bye.To().Address.String() != w.to || toTag != w.toTag {
+			t.Errorf("BYE to %s: From %s;tag=%s To %s;tag=%s, want %s;tag=%s %s;tag=%s", bye.Destination(),
+				bye.From().Address.String(), fromTag, bye.To().Address.String(), toTag, w.from, w.fromTag, w.to, w.toTag)
+		}
+		if bye.CallID().Value() != "c" || bye.CSeq().SeqNo != w.cseq || bye.CSeq().MethodName != sip.BYE {
+			t.Errorf("BYE to %s: Call-ID %s CSeq %s, want c %d BYE", bye.Destination(), bye.CallID().Value(), bye.CSeq().Value(), w.cseq)
+		}
+		if r := bye.GetHeader("Route"); r == nil || r.Value() != w.route {
+			t.Errorf("BYE to %s: Route %v, want %s", bye.Destination(), r, w.route)
+		}
+		if r := bye.GetHeader("Reason"); r == nil || r.Value() != `SIP;cause=402;text="insufficient funds"` {
+			t.Errorf("BYE to %s: Reason %v", bye.Destination(), r)
+		}
+	}
+}
+
+func TestTerminateUnanswered(t *testing.T) {
+	sink := make(cdrSink, 1)
+	byes := make(byeRecorder, 2)
+	cc := NewCallControl(nil, nil, sink)
+	cc.bye = byes
+	cc.StartCall("sip:100@example.com", "sip:200@example.com", "c", "f", "acme", true)
+	cc.terminate(dialogKey("c", "f"), 402, "insufficient funds")
+
+	if c := sink.next(t); c.Status != models.CDRFailed {
+		t.Errorf("CDR status %s, want %s", c.Status, models.CDRFailed)
+	}
+	select {
+	case bye := <-byes:
+		t.Errorf("BYE sent to %s for a call without a dialog", bye.Destination())
+	case <-time.After(50 * time.Millisecond):
+	}
+	// Terminating a call already gone does nothing
+	cc.terminate(dialogKey("c", "f"), 402, "insufficient funds")
+}
@@ -0,0 +1,530 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"nextgen-sip/internal/router"
+	"nextgen-sip/internal/trunk"
+	"nextgen-sip/pkg/utils"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emiago/sipgo"
+	"github.com/emiago/sipgo/sip"
+)
+
+// Registrations are refreshed this long before they expire, or halfway
+// through when they are granted for less than twice as long
+const refreshLead = time.Minute
+
+// Default lifetime asked of carriers, in seconds
+const defaultRegisterExpires = 3600
+
+// Trunk registration states
+const (
+	TrunkRegistering = "registering"
+	TrunkRegistered  = "registered"
+	TrunkRegFailed   = "failed"
+)
+
+// TrunkRegConfig tunes the registrations to carriers
+type TrunkRegConfig struct {
+	Contact  sip.Uri       // Our public address, registered with the trunk's username as user
+	Check    time.Duration // How often trunks are checked for a registration due
+	Timeout  time.Duration // How long one registration may take, challenge included
+	RetryMin time.Duration // Wait after a failed registration, doubled on each failure in a row
+	RetryMax time.Duration
+}
+
+// TrunkRegistration is the state of our registration with one carrier
+type TrunkRegistration struct {
+	TrunkID      string    `json:"trunk_id"`
+	AOR          string    `json:"aor"`
+	Contact      string    `json:"contact"`
+	State        string    `json:"state"`
+	Expires      int       `json:"expires,omitempty"` // Seconds granted
+	RegisteredAt time.Time `json:"registered_at"`
+	ExpiresAt    time.Time `json:"expires_at"`
+	NextAttempt  time.Time `json:"next_attempt"`
+	Failures     int       `json:"failures"` // Failed attempts in a row
+	LastCode     int       `json:"last_code,omitempty"`
+	LastError    string    `json:"last_error,omitempty"`
+}
+
+// registerResult is the carrier's answer to a REGISTER
+type registerResult struct {
+	code    int
+	reason  string
+	expires int    // Seconds granted, for a 2xx
+	source  string // Address the answer came from
+	cseq    uint32 // Last CSeq used
+}
+
+// registrant sends REGISTERs to carriers; implemented by SIPEngine
+type registrant interface {
+	registerTrunk(ctx context.Context, t trunk.Trunk, contact sip.Uri, callID string, cseq uint32, expires int) (registerResult, error)
+}
+
+// trunkReg is one trunk's registration
+type trunkReg struct {
+	status TrunkRegistration
+	trunk  trunk.Trunk // As registered, to spot changes
+	callID string      // The same for every REGISTER of the binding (RFC 3261 section 10.2)
+	cseq   uint32
+	busy   bool            // A REGISTER is in flight
+	addrs  map[string]bool // IPs the carrier answers and calls from
+}
+
+// TrunkRegistrations keeps us registered with the carriers of trunks that
+// ask for it, so that they send calls for our DIDs to us. INVITEs that
+// come back over a registration are the trunk's.
+type TrunkRegistrations struct {
+	sender registrant
+	trunks *trunk.Trunks
+	cfg    TrunkRegConfig
+
+	mu   sync.Mutex
+	regs map[string]*trunkReg // by trunk ID
+	done chan struct{}
+}
+
+func NewTrunkRegistrations(e *SIPEngine, trunks *trunk.Trunks, cfg TrunkRegConfig) *TrunkRegistrations {
+	r := &TrunkRegistrations{
+		sender: e,
+		trunks: trunks,
+		cfg:    cfg,
+		regs:   make(map[string]*trunkReg),
+		done:   make(chan struct{}),
+	}
+	e.trunkRegs = r
+	go r.loop()
+	return r
+}
+
+// Close stops refreshing and removes every registration
+func (r *TrunkRegistrations) Close() {
+	close(r.done)
+	r.mu.Lock()
+	regs := make([]*trunkReg, 0, len(r.regs))
+	for id, s := range r.regs {
+		if s.status.State == TrunkRegistered {
+			regs = append(regs, s)
+		}
+		delete(r.regs, id)
+	}
+	r.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, s := range regs {
+		wg.Add(1)
+		go func(s *trunkReg) {
+			defer wg.Done()
+			r.unregister(s)
+		}(s)
+	}
+	wg.Wait()
+}
+
+// List returns the registration of every trunk that registers, ordered by
+// trunk ID
+func (r *TrunkRegistrations) List() []TrunkRegistration {
+	list := make([]TrunkRegistration, 0)
+	for _, t := range r.trunks.List() {
+		if s, ok := r.Get(t.ID); ok {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
+// Get returns the registration of one trunk
+func (r *TrunkRegistrations) Get(id string) (TrunkRegistration, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.regs[id]
+	if !ok {
+		return TrunkRegistration{}, false
+	}
+	return s.status, true
+}
+
+// Inbound returns the trunk a request came in over: one whose carrier we
+// are registered with and that sent it. When several registrations share
+// the carrier's address, the one whose contact it was sent to wins.
+func (r *TrunkRegistrations) Inbound(req *sip.Request) (trunk.Trunk, bool) {
+	if r == nil {
+		return trunk.Trunk{}, false
+	}
+	ip := sourceIP(req)
+	now := time.Now()
+
+	r.mu.Lock()
+	var ids []string
+	for id, s := range r.regs {
+		if !s.addrs[ip] || !now.Before(s.status.ExpiresAt) {
+			continue
+		}
+		if req.Recipient.User == s.trunk.Username {
+			ids = []string{id}
+			break
+		}
+		ids = append(ids, id)
+	}
+	r.mu.Unlock()
+
+	if len(ids) != 1 {
+		return trunk.Trunk{}, false
+	}
+	t, ok := r.trunks.Get(ids[0])
+	return t, ok && t.Register && !t.Disabled
+}
+
+func (r *TrunkRegistrations) loop() {
+	ticker := time.NewTicker(r.cfg.Check)
+	defer ticker.Stop()
+	r.round()
+	for {
+		select {
+		case <-ticker.C:
+			r.round()
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// round starts the registrations that are due and follows changes to the
+// trunks: registrations of trunks that were removed, disabled or moved to
+// another carrier or account are taken down
+func (r *TrunkRegistrations) round() {
+	want := make(map[string]trunk.Trunk)
+	for _, t := range r.trunks.List() {
+		if t.Register && !t.Disabled {
+			want[t.ID] = t
+		}
+	}
+
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	registered := 0
+	for id, s := range r.regs {
+		if s.busy {
+			continue
+		}
+		if t, ok := want[id]; ok && sameRegistration(s.trunk, t) {
+			s.trunk = t
+			if s.status.State == TrunkRegistered {
+				registered++
+			}
+			continue
+		}
+		delete(r.regs, id)
+		if s.status.State == TrunkRegistered {
+			go r.unregister(s)
+		}
+	}
+	utils.TrunksRegistered.Set(float64(registered))
+
+	for id, t := range want {
+		s, ok := r.regs[id]
+		if !ok {
+			s = r.newTrunkReg(t)
+			r.regs[id] = s
+		}
+		if s.busy || now.Before(s.status.NextAttempt) {
+			continue
+		}
+		s.busy = true
+		go r.register(s)
+	}
+}
+
+func (r *TrunkRegistrations) newTrunkReg(t trunk.Trunk) *trunkReg {
+	aor, contact := t.AOR(), r.contact(t)
+	return &trunkReg{
+		status: TrunkRegistration{
+			TrunkID: t.ID,
+			AOR:     aor.String(),
+			Contact: contact.String(),
+			State:   TrunkRegistering,
+		},
+		trunk:  t,
+		callID: sip.GenerateTagN(24),
+		addrs:  make(map[string]bool),
+	}
+}
+
+// contact is our address as registered for t
+func (r *TrunkRegistrations) contact(t trunk.Trunk) sip.Uri {
+	uri := r.cfg.Contact
+	uri.User = t.Username
+	uri.UriParams = sip.NewParams()
+	uri.Headers = sip.NewParams()
+	if t.Transport != "udp" {
+		uri.UriParams.Add("transport", t.Transport)
+	}
+	return uri
+}
+
+// register sends one REGISTER for s and schedules the next: the refresh
+// before it expires, or a retry backing off after a failure
+func (r *TrunkRegistrations) register(s *trunkReg) {
+	r.mu.Lock()
+	t := s.trunk
+	s.cseq++
+	cseq := s.cseq
+	r.mu.Unlock()
+
+	expires := t.RegisterExpires
+	if expires == 0 {
+		expires = defaultRegisterExpires
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), r.cfg.Timeout)
+	res, err := r.sender.registerTrunk(ctx, t, r.contact(t), s.callID, cseq, expires)
+	cancel()
+	if err == nil && res.code/100 == 2 && res.expires <= 0 {
+		err = fmt.Errorf("carrier granted no lifetime")
+	}
+
+	// Calls come from the carrier's address, which the lookup may add to
+	var addrs []string
+	if err == nil && res.code/100 == 2 {
+		addrs, _ = net.LookupHost(t.Host)
+	}
+
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s.busy = false
+	if res.cseq > s.cseq {
+		s.cseq = res.cseq
+	}
+	st := &s.status
+	st.LastCode = res.code
+
+	if err != nil || res.code/100 != 2 {
+		if err == nil {
+			err = fmt.Errorf("%d %s", res.code, res.reason)
+		}
+		st.State = TrunkRegFailed
+		st.Failures++
+		st.LastError = err.Error()
+		wait := r.cfg.RetryMin << (st.Failures - 1)
+		if wait > r.cfg.RetryMax || wait <= 0 {
+			wait = r.cfg.RetryMax
+		}
+		st.NextAttempt = now.Add(wait)
+		log.Printf("[TrunkReg] ✗ %s at %s failed (%d in a row), retrying in %s: %v", t.ID, t.Dest(), st.Failures, wait, err)
+		return
+	}
+
+	lifetime := time.Duration(res.expires) * time.Second
+	lead := refreshLead
+	if lead > lifetime/2 {
+		lead = lifetime / 2
+	}
+	if st.State != TrunkRegistered {
+		log.Printf("[TrunkReg] ✓ %s registered as %s for %ds", t.ID, st.AOR, res.expires)
+	}
+	st.State = TrunkRegistered
+	st.Expires = res.expires
+	st.RegisteredAt = now
+	st.ExpiresAt = now.Add(lifetime)
+	st.NextAttempt = now.Add(lifetime - lead)
+	st.Failures = 0
+	st.LastError = ""
+	if host, _, err := net.SplitHostPort(res.source); err == nil {
+		s.addrs[host] = true
+	}
+	for _, a := range addrs {
+		s.addrs[a] = true
+	}
+}
+
+// unregister removes a registration from its carrier, best effort
+func (r *TrunkRegistrations) unregister(s *trunkReg) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.cfg.Timeout)
+	defer cancel()
+	res, err := r.sender.registerTrunk(ctx, s.trunk, r.contact(s.trunk), s.callID, s.cseq+1, 0)
+	if err == nil && res.code/100 != 2 {
+		err = fmt.Errorf("%d %s", res.code, res.reason)
+	}
+	if err != nil {
+		log.Printf("[TrunkReg] ✗ Unregistering %s failed: %v", s.trunk.ID, err)
+		return
+	}
+	log.Printf("[TrunkReg] %s unregistered", s.trunk.ID)
+}
+
+// sameRegistration reports whether trunk b registers the same binding as a
+func sameRegistration(a, b trunk.Trunk) bool {
+	return a.Host == b.Host && a.Port == b.Port && a.Transport == b.Transport &&
+		a.Username == b.Username && a.Password == b.Password && a.RegisterExpires == b.RegisterExpires
+}
+
+// registerTrunk sends a REGISTER for t binding contact for expires
+// seconds, answering a digest challenge with the trunk's credentials and
+// a 423 with the lifetime the carrier asks for
+func (e *SIPEngine) registerTrunk(ctx context.Context, t trunk.Trunk, contact sip.Uri, callID string, cseq uint32, expires int) (registerResult, error) {
+	result := registerResult{cseq: cseq}
+	req := newRegister(t, contact, callID, cseq, expires)
+	client := e.clientFor(req)
+	clTx, err := client.TransactionRequest(ctx, req, sipgo.ClientRequestAddVia)
+	if err != nil {
+		return result, err
+	}
+	authed, retried := false, false
+	for {
+		res, err := finalResponse(ctx, clTx)
+		clTx.Terminate()
+		if err != nil {
+			return result, err
+		}
+		result.code, result.reason, result.source = int(res.StatusCode), res.Reason, res.Source()
+		result.cseq = req.CSeq().SeqNo
+
+		switch {
+		case (res.StatusCode == 401 || res.StatusCode == 407) && !authed:
+			authed = true
+			clTx, err = client.DoDigestAuth(ctx, req, res, sipgo.DigestAuth{Username: t.Username, Password: t.Password})
+		case res.StatusCode == 423 && !retried && expires > 0:
+			// Interval Too Brief (RFC 3261 section 10.2.8)
+			h := res.GetHeader("Min-Expires")
+			if h == nil {
+				return result, nil
+			}
+			if expires, err = strconv.Atoi(strings.TrimSpace(h.Value())); err != nil {
+				return result, fmt.Errorf("invalid Min-Expires %q", h.Value())
+			}
+			retried = true
+			req.RemoveHeader("Expires")
+			req.AppendHeader(sip.NewHeader("Expires", strconv.Itoa(expires)))
+			req.CSeq().SeqNo++
+			req.RemoveHeader("Via")
+			clTx, err = client.TransactionRequest(ctx, req, sipgo.ClientRequestAddVia)
+		default:
+			if res.IsSuccess() {
+				result.expires = grantedExpires(res, contact, expires)
+			}
+			return result, nil
+		}
+		if err != nil {
+			return result, err
+		}
+	}
+}
+
+// newRegister builds a REGISTER binding contact to t's AOR
+func newRegister(t trunk.Trunk, contact sip.Uri, callID string, cseq uint32, expires int) *sip.Request {
+	aor := t.AOR()
+	req := sip.NewRequest(sip.REGISTER, t.RegistrarURI())
+	from := &sip.FromHeader{Address: aor, Params: sip.NewParams()}
+	from.Params.Add("tag", sip.GenerateTagN(16))
+	req.AppendHeader(from)
+	req.AppendHeader(&sip.ToHeader{Address: aor, Params: sip.NewParams()})
+	id := sip.CallIDHeader(callID)
+	req.AppendHeader(&id)
+	req.AppendHeader(&sip.CSeqHeader{SeqNo: cseq, MethodName: sip.REGISTER})
+	maxFwd := sip.MaxForwardsHeader(70)
+	req.AppendHeader(&maxFwd)
+	req.AppendHeader(&sip.ContactHeader{Address: contact})
+	req.AppendHeader(sip.NewHeader("Expires", strconv.Itoa(expires)))
+	req.SetTransport(strings.ToUpper(t.Transport))
+	req.SetDestination(t.Dest())
+	return req
+}
+
+// grantedExpires is the lifetime the carrier gave our contact: its expires
+// parameter in the 200 OK, else the Expires header, else what was asked.
+// sipgo lets a later address's parameters overwrite an earlier one's when a
+// 200 OK lists the bindings comma-separated, so with several contacts (or
+// one that cannot be read) no single expires is trusted and the shortest in
+// sight is used: a refresh that comes early costs one REGISTER, one that
+// comes late loses the registration.
+func grantedExpires(res *sip.Response, contact sip.Uri, asked int) int {
+	header := 0
+	if h := res.GetHeader("Expires"); h != nil {
+		if n, err := strconv.Atoi(strings.TrimSpace(h.Value())); err == nil && n > 0 {
+			header = n
+		}
+	}
+	contacts, err := router.Contacts(res)
+	if err == nil && len(contacts) <= 1 {
+		for _, c := range contacts {
+			if c.Address.User != contact.User || c.Address.Host != contact.Host || c.Address.Port != contact.Port {
+				continue
+			}
+			if v, ok := c.Params.Get("expires"); ok {
+				if n, err := strconv.Atoi(v); err == nil && n > 0 {
+					return n
+				}
+				log.Printf("[TrunkReg] ✗ Invalid expires %q on our contact from %s", v, res.Source())
+			}
+		}
+		if header > 0 {
+			return header
+		}
+		return asked
+	}
+	if err != nil {
+		log.Printf("[TrunkReg] ✗ Unreadable Contact from %s: %v; taking the shortest expires given", res.Source(), err)
+	}
+	granted := asked
+	if header > 0 && header < granted {
+		granted = header
+	}
+	for _, h := range res.GetHeaders("Contact") {
+		for _, n := range expiresParams(h.Value()) {
+			if n > 0 && n < granted {
+				granted = n
+			}
+		}
+	}
+	return granted
+}
+
+// expiresParams finds every expires parameter in a Contact header value,
+// reading the digits each one starts with so that values sipgo ran into
+// the next address (and quoted) still count
+func expiresParams(text string) []int {
+	var values []int
+	lower := strings.ToLower(text)
+	for {
+		i := strings.Index(lower, ";expires=")
+		if i < 0 {
+			return values
+		}
+		lower = strings.TrimPrefix(lower[i+len(";expires="):], `"`)
+		end := 0
+		for end < len(lower) && lower[end] >= '0' && lower[end] <= '9' {
+			end++
+		}
+		if n, err := strconv.Atoi(lower[:end]); err == nil {
+			values = append(values, n)
+		}
+	}
+}
+
+// finalResponse waits for the final response of a client transaction
+func finalResponse(ctx context.Context, clTx sip.ClientTransaction) (*sip.Response, error) {
+	for {
+		select {
+		case res, more := <-clTx.Responses():
+			if !more {
+				return nil, fmt.Errorf("transaction closed")
+			}
+			if !res.IsProvisional() {
+				return res, nil
+			}
+		case <-clTx.Done():
+			return nil, clTx.Err()
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,275 @@
+package engine
+
+import (
+	"context"
+	"nextgen-sip/internal/trunk"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emiago/sipgo/sip"
+)
+
+func TestGrantedExpires(t *testing.T) {
+	ours := sip.Uri{User: "acct", Host: "198.51.100.1", Port: 5060}
+	tests := []struct {
+		name    string
+		headers []string
+		asked   int
+		want    int
+	}{
+		{"contact param", []string{"Contact: <sip:acct@198.51.100.1:5060>;expires=1800", "Expires: 3000"}, 3600, 1800},
+		{"expires header", []string{"Contact: <sip:acct@198.51.100.1:5060>", "Expires: 3000"}, 3600, 3000},
+		{"nothing granted", []string{"Contact: <sip:acct@198.51.100.1:5060>"}, 3600, 3600},
+		{"no contact", []string{"Expires: 600"}, 3600, 600},
+		{"other contact only", []string{"Contact: <sip:other@192.0.2.1>;expires=60"}, 3600, 3600},
+		{"invalid param", []string{"Contact: <sip:acct@198.51.100.1:5060>;expires=soon", "Expires: 900"}, 3600, 900},
+		// sipgo gives both addresses expires=120 here, so ours cannot be told
+		// apart from the other binding: the shortest lifetime wins
+		{"comma list", []string{"Contact: <sip:other@192.0.2.1>;expires=3600, <sip:acct@198.51.100.1:5060>;expires=120"}, 3600, 120},
+		// Parsed as expires="300, <sip:acct@...>" on the first address
+		{"comma list run on", []string{"Contact: <sip:other@192.0.2.1>;expires=300, <sip:acct@198.51.100.1:5060>;q=1"}, 3600, 300},
+		{"separate lines", []string{"Contact: <sip:other@192.0.2.1>;expires=240", "Contact: <sip:acct@198.51.100.1:5060>;expires=1800"}, 3600, 240},
+		{"several capped by asked", []string{"Contact: <sip:other@192.0.2.1>;expires=7200", "Contact: <sip:acct@198.51.100.1:5060>;expires=7200"}, 3600, 3600},
+		{"several capped by header", []string{"Contact: <sip:other@192.0.2.1>", "Contact: <sip:acct@198.51.100.1:5060>", "Expires: 500"}, 3600, 500},
+	}
+	for _, tt := range tests {
+		res := response(t, tt.headers)
+		if got := grantedExpires(res, ours, tt.asked); got != tt.want {
+			t.Errorf("%s: grantedExpires = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestExpiresParams(t *testing.T) {
+	tests := []struct {
+		text string
+		want []int
+	}{
+		{"<sip:a@h>", nil},
+		{"<sip:a@h>;expires=60", []int{60}},
+		{"<sip:a@h>;EXPIRES=60;q=1", []int{60}},
+		{"<sip:a@h>;q=0.5;expires=30, <sip:b@h>;expires=90", []int{30, 90}},
+		{"<sip:a@h>;expires=", nil},
+		{`<sip:a@h>;expires="300, <sip:b@h>";q=1`, []int{300}},
+	}
+	for _, tt := range tests {
+		got := expiresParams(tt.text)
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: expiresParams = %v, want %v", tt.text, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s: expiresParams = %v, want %v", tt.text, got, tt.want)
+			}
+		}
+	}
+}
+
+// response parses a 200 OK to a REGISTER carrying headers
+func response(t *testing.T, headers []string) *sip.Response {
+	t.Helper()
+	raw := "SIP/2.0 200 OK\r\n" +
+		"Via: SIP/2.0/UDP 198.51.100.1:5060;branch=z9hG4bK1\r\n" +
+		"From: <sip:acct@carrier.example.com>;tag=a\r\n" +
+		"To: <sip:acct@carrier.example.com>;tag=b\r\n" +
+		"Call-ID: reg-1\r\n" +
+		"CSeq: 1 REGISTER\r\n"
+	if len(headers) > 0 {
+		raw += strings.Join(headers, "\r\n") + "\r\n"
+	}
+	raw += "Content-Length: 0\r\n\r\n"
+	msg, err := sip.ParseMessage([]byte(raw))
+	if err != nil {
+		t.Fatalf("parse response: %v", err)
+	}
+	return msg.(*sip.Response)
+}
+
+// fakeRegistrant answers REGISTERs with the results queued, 200 for 3600s
+// from the carrier once they run out, and records what it was asked
+type fakeRegistrant struct {
+	mu      sync.Mutex
+	results []registerResult
+	sent    []sentRegister
+}
+
+type sentRegister struct {
+	trunkID string
+	contact string
+	callID  string
+	cseq    uint32
+	expires int
+}
+
+func (f *fakeRegistrant) registerTrunk(ctx context.Context, t trunk.Trunk, contact sip.Uri, callID string, cseq uint32, expires int) (registerResult, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sent = append(f.sent, sentRegister{t.ID, contact.String(), callID, cseq, expires})
+	res := registerResult{code: 200, expires: 3600, source: t.Host + ":5060", cseq: cseq}
+	if len(f.results) > 0 {
+		res, f.results = f.results[0], f.results[1:]
+	}
+	return res, nil
+}
+
+// trunkRegTest returns registrations of the trunks, none of them started
+func trunkRegTest(t *testing.T, sender registrant, list ...trunk.Trunk) *TrunkRegistrations {
+	t.Helper()
+	trunks, err := trunk.NewTrunks("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tr := range list {
+		if _, err := trunks.Set(tr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &TrunkRegistrations{
+		sender: sender,
+		trunks: trunks,
+		cfg: TrunkRegConfig{
+			Contact:  sip.Uri{Host: "198.51.100.1", Port: 5060},
+			Timeout:  time.Second,
+			RetryMin: 30 * time.Second,
+			RetryMax: 5 * time.Minute,
+		},
+		regs: make(map[string]*trunkReg),
+		done: make(chan struct{}),
+	}
+}
+
+// registerNow sends trunk id's next REGISTER and waits for the outcome
+func (r *TrunkRegistrations) registerNow(id string) TrunkRegistration {
+	r.mu.Lock()
+	s, ok := r.regs[id]
+	if !ok {
+		t, _ := r.trunks.Get(id)
+		s = r.newTrunkReg(t)
+		r.regs[id] = s
+	}
+	r.mu.Unlock()
+	r.register(s)
+	st, _ := r.Get(id)
+	return st
+}
+
+func TestTrunkRegister(t *testing.T) {
+	steps := []struct {
+		name     string
+		res      registerResult
+		state    string
+		failures int
+		expires  int
+		next     time.Duration // until the next attempt
+	}{
+		{"registered", registerResult{code: 200, expires: 3600}, TrunkRegistered, 0, 3600, 3600*time.Second - refreshLead},
+		{"short lifetime refreshes halfway", registerResult{code: 200, expires: 90}, TrunkRegistered, 0, 90, 45 * time.Second},
+		{"rejected", registerResult{code: 403, reason: "Forbidden"}, TrunkRegFailed, 1, 90, 30 * time.Second},
+		{"backing off", registerResult{code: 503, reason: "Service Unavailable"}, TrunkRegFailed, 2, 90, time.Minute},
+		{"no lifetime granted", registerResult{code: 200}, TrunkRegFailed, 3, 90, 2 * time.Minute},
+		{"capped", registerResult{code: 408, reason: "Request Timeout"}, TrunkRegFailed, 4, 90, 4 * time.Minute},
+		{"capped again", registerResult{code: 408, reason: "Request Timeout"}, TrunkRegFailed, 5, 90, 5 * time.Minute},
+		{"recovered", registerResult{code: 200, expires: 600}, TrunkRegistered, 0, 600, 600*time.Second - refreshLead},
+	}
+	sender := &fakeRegistrant{}
+	r := trunkRegTest(t, sender, trunk.Trunk{ID: "carrier", Host: "192.0.2.50", Username: "acct", Register: true})
+	for i, st := range steps {
+		st.res.source = "192.0.2.50:5060"
+		sender.results = append(sender.results, st.res)
+		before := time.Now()
+		got := r.registerNow("carrier")
+		if got.State != st.state || got.Failures != st.failures || got.Expires != st.expires || got.LastCode != st.res.code {
+			t.Errorf("%s: %s, %d failures, expires %d, code %d, want %s, %d, %d, %d", st.name,
+				got.State, got.Failures, got.Expires, got.LastCode, st.state, st.failures, st.expires, st.res.code)
+		}
+		if next := got.NextAttempt.Sub(before); next < st.next || next > st.next+time.Second {
+			t.Errorf("%s: next attempt in %s, want %s", st.name, next, st.next)
+		}
+
+		// Every REGISTER of the binding shares the Call-ID, in sequence
+		sent := sender.sent[i]
+		if sent.callID != sender.sent[0].callID || sent.cseq != uint32(i+1) {
+			t.Errorf("%s: Call-ID %s CSeq %d, want %s %d", st.name, sent.callID, sent.cseq, sender.sent[0].callID, i+1)
+		}
+		if sent.contact != "sip:acct@198.51.100.1:5060" || sent.expires != 3600 {
+			t.Errorf("%s: sent contact %s for %d", st.name, sent.contact, sent.expires)
+		}
+	}
+}
+
+func TestTrunkRegisterCSeq(t *testing.T) {
+	// A 423 retried with Min-Expires used up a CSeq the next REGISTER
+	// must not reuse
+	sender := &fakeRegistrant{results: []registerResult{{code: 200, expires: 3600, cseq: 2}}}
+	r := trunkRegTest(t, sender, trunk.Trunk{ID: "carrier", Host: "192.0.2.50", Username: "acct", Register: true, RegisterExpires: 60})
+	r.registerNow("carrier")
+	r.registerNow("carrier")
+	if got := sender.sent[1].cseq; got != 3 {
+		t.Errorf("second REGISTER CSeq %d, want 3", got)
+	}
+	if got := sender.sent[0].expires; got != 60 {
+		t.Errorf("asked for %d, want the trunk's 60", got)
+	}
+}
+
+func TestInbound(t *testing.T) {
+	sender := &fakeRegistrant{}
+	r := trunkRegTest(t, sender,
+		trunk.Trunk{ID: "main", Host: "192.0.2.50", Username: "main", Register: true},
+		trunk.Trunk{ID: "sales", Host: "192.0.2.50", Username: "sales", Register: true},
+		trunk.Trunk{ID: "other", Host: "192.0.2.60", Username: "other", Register: true},
+		trunk.Trunk{ID: "failed", Host: "192.0.2.70", Username: "failed", Register: true},
+		trunk.Trunk{ID: "unregistered", Host: "192.0.2.80", Username: "unregistered"},
+	)
+	for _, id := range []string{"main", "sales", "other"} {
+		r.registerNow(id)
+	}
+	sender.results = []registerResult{{code: 403, source: "192.0.2.70:5060"}}
+	r.registerNow("failed")
+
+	tests := []struct {
+		name   string
+		source string
+		user   string
+		trunk  string // empty when not from a trunk
+	}{
+		{"to the account", "192.0.2.50:5060", "sales", "sales"},
+		{"to the other account", "192.0.2.50:5060", "main", "main"},
+		{"shared carrier, unknown user", "192.0.2.50:5060", "+15550100", ""},
+		{"single registration", "192.0.2.60:5060", "+15550100", "other"},
+		{"another port of the carrier", "192.0.2.60:5080", "other", "other"},
+		{"not a carrier", "203.0.113.9:5060", "other", ""},
+		{"registration failed", "192.0.2.70:5060", "failed", ""},
+		{"trunk not registering", "192.0.2.80:5060", "unregistered", ""},
+	}
+	for _, tt := range tests {
+		req := sip.NewRequest(sip.INVITE, sip.Uri{User: tt.user, Host: "198.51.100.1", Port: 5060})
+		req.SetSource(tt.source)
+		got, ok := r.Inbound(req)
+		if ok != (tt.trunk != "") || got.ID != tt.trunk {
+			t.Errorf("%s: Inbound = %q, %v, want %q", tt.name, got.ID, ok, tt.trunk)
+		}
+	}
+
+	// A registration that lapsed or a trunk disabled since no longer counts
+	r.mu.Lock()
+	r.regs["other"].status.ExpiresAt = time.Now().Add(-time.Second)
+	r.mu.Unlock()
+	sales, _ := r.trunks.Get("sales")
+	sales.Disabled = true
+	r.trunks.Set(sales)
+	for _, tt := range []struct{ source, user string }{{"192.0.2.60:5060", "other"}, {"192.0.2.50:5060", "sales"}} {
+		req := sip.NewRequest(sip.INVITE, sip.Uri{User: tt.user, Host: "198.51.100.1", Port: 5060})
+		req.SetSource(tt.source)
+		if got, ok := r.Inbound(req); ok {
+			t.Errorf("%s from %s: Inbound = %q after the registration went", tt.user, tt.source, got.ID)
+		}
+	}
+	var none *TrunkRegistrations
+	if _, ok := none.Inbound(sip.NewRequest(sip.INVITE, sip.Uri{Host: "198.51.100.1"})); ok {
+		t.Errorf("Inbound without registrations found a trunk")
+	}
+}
@@ -3,19 +3,38 @@ package firewall
 import (
 	"log"
 	"sync"
+	"time"
+)
+
+// Failed authentications block the source IP once one username fails this
+// often from it, or the IP fails this often in total, within failureWindow.
+// A success only clears its own username's count: an attacker holding one
+// valid account must not be able to reset the IP's count with it.
+const (
+	maxUserFailures = 5
+	maxIPFailures   = 20
+	failureWindow   = time.Hour
 )
 
 // Firewall handles IP blacklisting and brute-force protection
 type Firewall struct {
-	mu           sync.RWMutex
-	blacklisted  map[string]bool
-	failedAuths  map[string]int
+	mu          sync.RWMutex
+	blacklisted map[string]bool
+	failedAuths map[string]*failures // by IP
+	failedUsers map[string]*failures // by IP and username
+}
+
+// failures counts failed authentications since the first one in the window
+type failures struct {
+	count int
+	since time.Time
 }
 
 func NewFirewall() *Firewall {
 	return &Firewall{
 		blacklisted: make(map[string]bool),
-		failedAuths: make(map[string]int),
+		failedAuths: make(map[string]*failures),
+		failedUsers: make(map[string]*failures),
 	}
 }
 
@@ -25,15 +44,33 @@ func (f *Firewall) IsAllowed(ip string) bool {
 	return !f.blacklisted[ip]
 }
 
-func (f *Firewall) RecordFailedAuth(ip string) {
+// RecordFailedAuth counts a failed authentication of username from ip
+func (f *Firewall) RecordFailedAuth(ip, username string) {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
-	f.failedAuths[ip]++
-	if f.failedAuths[ip] >= 5 {
+	now := time.Now()
+	byUser := count(f.failedUsers, userKey(ip, username), now)
+	byIP := count(f.failedAuths, ip, now)
+	if byUser >= maxUserFailures || byIP >= maxIPFailures {
 		f.blacklisted[ip] = true
-		log.Printf("[Firewall] !!! IP %s blockaded after 5 failed attempts !!!", ip)
+		log.Printf("[Firewall] !!! IP %s blockaded after %d failed attempts (%d for %q) !!!", ip, byIP, byUser, username)
+	}
+}
+
+// count adds a failure under key and returns the failures in the window
+func count(m map[string]*failures, key string, now time.Time) int {
+	c, ok := m[key]
+	if !ok || now.Sub(c.since) > failureWindow {
+		c = &failures{since: now}
+		m[key] = c
 	}
+	c.count++
+	return c.count
+}
+
+func userKey(ip, username string) string {
+	return ip + "\x00" + username
 }
 
 func (f *Firewall) GetBlacklist() []string {
@@ -46,3 +83,11 @@ func (f *Firewall) GetBlacklist() []string {
 	}
 	return list
 }
+
+// ClearFailedAuth resets the failure counter of username from ip after it
+// authenticated successfully. The IP's own count is left to expire.
+func (f *Firewall) ClearFailedAuth(ip, username string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.failedUsers, userKey(ip, username))
+}
@@ -0,0 +1,58 @@
+package firewall
+
+import (
+	"strconv"
+	"testing"
+)
+
+// attempt is one authentication from 192.0.2.1
+type attempt struct {
+	user string
+	ok   bool
+}
+
+func repeat(user string, ok bool, n int) []attempt {
+	list := make([]attempt, n)
+	for i := range list {
+		list[i] = attempt{user, ok}
+	}
+	return list
+}
+
+func TestFailedAuth(t *testing.T) {
+	var spread []attempt
+	for i := 0; i < maxIPFailures; i++ {
+		spread = append(spread, attempt{"user" + strconv.Itoa(i), false})
+	}
+
+	tests := []struct {
+		name     string
+		attempts []attempt
+		blocked  bool
+	}{
+		{"under the limit", repeat("alice", false, maxUserFailures-1), false},
+		{"one user over", repeat("alice", false, maxUserFailures), true},
+		{"cleared by own success", append(append(repeat("alice", false, maxUserFailures-1), attempt{"alice", true}), repeat("alice", false, maxUserFailures-1)...), false},
+		// A valid account of the attacker's must not reset the guesses at
+		// another
+		{"not cleared by other success", append(append(repeat("alice", false, maxUserFailures-1), attempt{"mallory", true}), attempt{"alice", false}), true},
+		{"spread over users", spread, true},
+		{"spread with successes", append(append(spread[:maxIPFailures/2:maxIPFailures/2], attempt{"mallory", true}), spread[maxIPFailures/2:]...), true},
+	}
+	for _, tt := range tests {
+		f := NewFirewall()
+		for _, a := range tt.attempts {
+			if a.ok {
+				f.ClearFailedAuth("192.0.2.1", a.user)
+			} else {
+				f.RecordFailedAuth("192.0.2.1", a.user)
+			}
+		}
+		if allowed := f.IsAllowed("192.0.2.1"); allowed == tt.blocked {
+			t.Errorf("%s: allowed = %v, want %v", tt.name, allowed, !tt.blocked)
+		}
+		if !f.IsAllowed("198.51.100.1") {
+			t.Errorf("%s: another IP was blocked", tt.name)
+		}
+	}
+}
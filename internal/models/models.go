@@ -1,6 +1,9 @@
 package models
 
-import "time"
+import (
+	"nextgen-sip/internal/money"
+	"time"
+)
 
 // CallState represents the current state of a SIP call
 type CallState string
@@ -15,37 +18,114 @@ const (
 
 // ActiveCall represents a call currently in progress
 type ActiveCall struct {
-	SessionID string    `json:"session_id"`
-	TenantID  string    `json:"tenant_id"`
-	From      string    `json:"from"`
-	To        string    `json:"to"`
-	CallID    string    `json:"call_id"`
-	Source    string    `json:"source"`
-	State     CallState `json:"state"`
-	StartTime time.Time `json:"start_time"`
-	Rate      float64   `json:"rate"` // Price per second
+	SessionID   string       `json:"session_id"`
+	TenantID    string       `json:"tenant_id"`
+	From        string       `json:"from"`
+	To          string       `json:"to"`
+	CallID      string       `json:"call_id"`
+	FromTag     string       `json:"from_tag"`
+	ToTag       string       `json:"to_tag,omitempty"`
+	Source      string       `json:"source"`
+	Trunk       string       `json:"trunk,omitempty"` // Carrier trunk the call came in from or left through
+	State       CallState    `json:"state"`
+	StartTime   time.Time    `json:"start_time"`
+	AnswerTime  time.Time    `json:"answer_time"`
+	Rate        CallRate     `json:"rate"`
+	Reserved    money.Amount `json:"reserved"`          // Balance held for this call
+	MaxDuration int          `json:"max_duration"`      // Talk seconds covered by Reserved, 0 if unlimited
+	Inbound     bool         `json:"inbound,omitempty"` // From a carrier trunk: not rated, no subscriber is billed
+}
+
+// Rate is one rate deck entry, matched by longest prefix
+type Rate struct {
+	Prefix         string       `json:"prefix"`
+	Description    string       `json:"description"`
+	PerMinute      money.Amount `json:"per_minute"`
+	ConnectionFee  money.Amount `json:"connection_fee"`
+	MinDuration    int          `json:"min_duration"`    // Seconds
+	FirstIncrement int          `json:"first_increment"` // Seconds, 60 in "60/60"
+	NextIncrement  int          `json:"next_increment"`  // Seconds, 6 in "30/6"
+}
+
+// CallRate is the rate chosen for a call and the deck it came from
+type CallRate struct {
+	DeckID      string         `json:"deck_id"`
+	DeckVersion int            `json:"deck_version"`
+	Currency    string         `json:"currency"`
+	Rounding    money.Rounding `json:"rounding"`
+	Rate
 }
 
+// CDR status values
+const (
+	CDRAnswered = "ANSWERED"
+	CDRBusy     = "BUSY"
+	CDRNoAnswer = "NO_ANSWER"
+	CDRCanceled = "CANCELED"
+	CDRFailed   = "FAILED"
+)
+
+// Who tore the call down
+const (
+	HangupCaller = "caller"
+	HangupCallee = "callee"
+	HangupSystem = "system"
+)
+
 // CDR for billing
 type CDR struct {
-	ID        string    `json:"id"`
-	TenantID  string    `json:"tenant_id"`
-	From      string    `json:"from"`
-	To        string    `json:"to"`
-	StartTime time.Time `json:"start_time"`
-	EndTime   time.Time `json:"end_time"`
-	Duration  float64   `json:"duration"`
-	Cost      float64   `json:"cost"`
-	Status    string    `json:"status"`
+	ID               string       `json:"id"`
+	TenantID         string       `json:"tenant_id"`
+	CallID           string       `json:"call_id"`
+	From             string       `json:"from"`
+	To               string       `json:"to"`
+	SetupTime        time.Time    `json:"setup_time"`
+	AnswerTime       time.Time    `json:"answer_time"`
+	EndTime          time.Time    `json:"end_time"`
+	Duration         float64      `json:"duration"`          // Connected seconds
+	BillableDuration int          `json:"billable_duration"` // After minimum and increments
+	Trunk            string       `json:"trunk,omitempty"`   // Carrier trunk the call came in from or left through
+	Rate             CallRate     `json:"rate"`
+	Cost             money.Amount `json:"cost"`
+	Currency         string       `json:"currency"`
+	Status           string       `json:"status"`
+	DisconnectCode   int          `json:"disconnect_code"` // SIP status that ended the call
+	DisconnectReason string       `json:"disconnect_reason"`
+	HangupBy         string       `json:"hangup_by"`
 }
 
-
 // User represents a VoIP subscriber
 type User struct {
-	ID        string `json:"id"`
-	TenantID  string `json:"tenant_id"`
-	Username  string `json:"username"`
-	Password  string `json:"password"`
-	Balance   float64 `json:"balance"`
-	Level     int    `json:"level"` // 0: User, 1: Reseller, 2: Admin
+	ID       string       `json:"id"`
+	TenantID string       `json:"tenant_id"`
+	Username string       `json:"username"`
+	Password string       `json:"password"`
+	Balance  money.Amount `json:"balance"`
+	Currency string       `json:"currency,omitempty"`  // Defaults to money.DefaultCurrency
+	Level    int          `json:"level"`               // 0: User, 1: Reseller, 2: Admin
+	RateDeck string       `json:"rate_deck,omitempty"` // Overrides the tenant deck
+}
+
+// Ledger transaction types
+const (
+	TxTopUp      = "topup"
+	TxCharge     = "charge"
+	TxRefund     = "refund"
+	TxAdjustment = "adjustment"
+)
+
+// Transaction is one immutable balance ledger entry. Amount is signed:
+// credits to the subscriber are positive, charges negative. The opposite
+// side of the entry is booked to CounterAccount.
+type Transaction struct {
+	ID             string       `json:"id"`
+	UserID         string       `json:"user_id"`
+	Type           string       `json:"type"`
+	Amount         money.Amount `json:"amount"`
+	Balance        money.Amount `json:"balance"` // Subscriber balance after this entry
+	CounterAccount string       `json:"counter_account"`
+	Actor          string       `json:"actor"`
+	Reason         string       `json:"reason"`
+	Reference      string       `json:"reference,omitempty"` // e.g. the Call-ID of a charge
+	Time           time.Time    `json:"time"`
 }
@@ -0,0 +1,208 @@
+// Package money represents amounts as integer micro-units so that repeated
+// small charges never drift the way float64 sums do.
+package money
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Scale is the number of micro-units in one currency unit
+const Scale = 1_000_000
+
+// DefaultCurrency applies to users and rate decks that do not name one
+var DefaultCurrency = "USD"
+
+var ErrInvalid = errors.New("invalid amount")
+
+// Amount is a quantity of money in micro-units (1e-6 of the currency
+// unit). In JSON it is a plain decimal number of currency units, so the
+// API and stored records written while amounts were float64 still decode,
+// without passing through a float.
+type Amount int64
+
+// FromFloat converts a float value, rounding half away from zero. It is
+// only meant for migrating values that were stored as floats.
+func FromFloat(f float64) Amount {
+	return Amount(math.Round(f * Scale))
+}
+
+// Parse reads a decimal string such as "12.5", "-0.000125" or "1e-3"
+func Parse(s string) (Amount, error) {
+	s = strings.TrimSpace(s)
+	if strings.ContainsAny(s, "eE") {
+		// Exponent notation only comes from float encoders
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil || math.IsNaN(f) || math.Abs(f) >= math.MaxInt64/Scale {
+			// Same bound as the decimal path; larger values overflow
+			return 0, ErrInvalid
+		}
+		return FromFloat(f), nil
+	}
+
+	neg := strings.HasPrefix(s, "-")
+	if neg {
+		s = s[1:]
+	} else {
+		s = strings.TrimPrefix(s, "+")
+	}
+	whole, frac, _ := strings.Cut(s, ".")
+	if whole == "" && frac == "" {
+		return 0, ErrInvalid
+	}
+	if len(frac) > 6 {
+		// Round half away from zero on the seventh digit
+		if strings.Trim(frac[6:], "0123456789") != "" {
+			return 0, ErrInvalid
+		}
+		up := frac[6] >= '5'
+		frac = frac[:6]
+		a, err := parseParts(whole, frac)
+		if err != nil {
+			return 0, err
+		}
+		if up {
+			a++
+		}
+		return sign(a, neg), nil
+	}
+	a, err := parseParts(whole, frac+strings.Repeat("0", 6-len(frac)))
+	if err != nil {
+		return 0, err
+	}
+	return sign(a, neg), nil
+}
+
+// parseParts reads the digits either side of the point. ParseInt alone
+// would take a sign in either part, so "1.+5" or "-.-5" are refused here.
+func parseParts(whole, frac string) (Amount, error) {
+	if !digits(whole) || !digits(frac) {
+		return 0, ErrInvalid
+	}
+	var w, f int64
+	var err error
+	if whole != "" {
+		if w, err = strconv.ParseInt(whole, 10, 64); err != nil {
+			return 0, ErrInvalid
+		}
+	}
+	if f, err = strconv.ParseInt(frac, 10, 64); err != nil {
+		return 0, ErrInvalid
+	}
+	if w > math.MaxInt64/Scale-1 {
+		return 0, ErrInvalid
+	}
+	return Amount(w*Scale + f), nil
+}
+
+func digits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func sign(a Amount, neg bool) Amount {
+	if neg {
+		return -a
+	}
+	return a
+}
+
+// Float returns the amount in currency units, for display and metrics only
+func (a Amount) Float() float64 {
+	return float64(a) / Scale
+}
+
+// String formats the amount in currency units without trailing zeros,
+// keeping at least two decimals: "12.50", "-0.000125"
+func (a Amount) String() string {
+	neg := a < 0
+	u := int64(a)
+	if neg {
+		u = -u
+	}
+	frac := strings.TrimRight(fmt.Sprintf("%06d", u%Scale), "0")
+	for len(frac) < 2 {
+		frac += "0"
+	}
+	s := strconv.FormatInt(u/Scale, 10) + "." + frac
+	if neg {
+		s = "-" + s
+	}
+	return s
+}
+
+func (a Amount) MarshalJSON() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+// UnmarshalJSON accepts a number or a quoted decimal string
+func (a *Amount) UnmarshalJSON(data []byte) error {
+	s := string(data)
+	if s == "null" {
+		return nil
+	}
+	v, err := Parse(strings.Trim(s, `"`))
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalid, s)
+	}
+	*a = v
+	return nil
+}
+
+// Rounding decides how fractions of a micro-unit are resolved
+type Rounding string
+
+const (
+	RoundHalfUp Rounding = "half_up" // nearest, halves away from zero
+	RoundUp     Rounding = "up"      // towards +infinity, in the carrier's favour
+	RoundDown   Rounding = "down"    // towards zero, in the customer's favour
+)
+
+func (r Rounding) Valid() bool {
+	switch r {
+	case "", RoundHalfUp, RoundUp, RoundDown:
+		return true
+	}
+	return false
+}
+
+// MulDiv returns a*num/den rounded with r; an empty r rounds half up.
+// den must be positive.
+func (a Amount) MulDiv(num, den int64, r Rounding) Amount {
+	p := int64(a) * num
+	q, rem := p/den, p%den
+	if rem == 0 {
+		return Amount(q)
+	}
+	switch r {
+	case RoundUp:
+		if rem > 0 {
+			q++
+		}
+	case RoundDown:
+		// Go division already truncates towards zero
+	default:
+		if 2*abs(rem) >= den {
+			if p < 0 {
+				q--
+			} else {
+				q++
+			}
+		}
+	}
+	return Amount(q)
+}
+
+func abs(v int64) int64 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
@@ -0,0 +1,136 @@
+package money
+
+import "testing"
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Amount
+		invalid bool
+	}{
+		{in: "0", want: 0},
+		{in: "12.5", want: 12_500_000},
+		{in: "+12.5", want: 12_500_000},
+		{in: " 3 ", want: 3_000_000},
+		{in: ".5", want: 500_000},
+		{in: "5.", want: 5_000_000},
+		{in: "-0.000125", want: -125},
+		{in: "0.0000005", want: 1},
+		{in: "0.0000004999", want: 0},
+		{in: "-0.0000005", want: -1},
+		{in: "1e-3", want: 1_000},
+		{in: "-2.5E2", want: -250_000_000},
+		{in: "1.+5", invalid: true},
+		{in: "1.-5", invalid: true},
+		{in: "+-1", invalid: true},
+		{in: "--1", invalid: true},
+		{in: "-.-5", invalid: true},
+		{in: "1.2345678x", invalid: true},
+		{in: "1,5", invalid: true},
+		{in: "1 5", invalid: true},
+		{in: "", invalid: true},
+		{in: "-", invalid: true},
+		{in: ".", invalid: true},
+		{in: "abc", invalid: true},
+		{in: "e", invalid: true},
+		{in: "99999999999999", invalid: true},
+		{in: "9223372036854", invalid: true},
+		{in: "9223372036853", want: 9_223_372_036_853_000_000},
+		{in: "1e20", invalid: true},
+		{in: "-1e20", invalid: true},
+		{in: "9.3e12", invalid: true},
+		{in: "9.2e12", want: 9_200_000_000_000_000_000},
+		{in: "1e400", invalid: true},
+		{in: "NaNe", invalid: true},
+	}
+	for _, tt := range tests {
+		got, err := Parse(tt.in)
+		if tt.invalid {
+			if err != ErrInvalid {
+				t.Errorf("Parse(%q) = %d, %v; want ErrInvalid", tt.in, got, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("Parse(%q) = %d, %v; want %d", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestString(t *testing.T) {
+	tests := []struct {
+		in   Amount
+		want string
+	}{
+		{0, "0.00"},
+		{12_500_000, "12.50"},
+		{-125, "-0.000125"},
+		{1, "0.000001"},
+		{100_000_000, "100.00"},
+	}
+	for _, tt := range tests {
+		if got := tt.in.String(); got != tt.want {
+			t.Errorf("Amount(%d).String() = %q, want %q", int64(tt.in), got, tt.want)
+		}
+		back, err := Parse(tt.want)
+		if err != nil || back != tt.in {
+			t.Errorf("Parse(%q) = %d, %v; want %d", tt.want, back, err, tt.in)
+		}
+	}
+}
+
+func TestMulDiv(t *testing.T) {
+	tests := []struct {
+		name     string
+		a        Amount
+		num, den int64
+		r        Rounding
+		want     Amount
+	}{
+		{"exact", 600, 1, 60, RoundHalfUp, 10},
+		{"half up rounds half away", 15, 1, 10, RoundHalfUp, 2},
+		{"half up below half", 14, 1, 10, RoundHalfUp, 1},
+		{"half up negative", -15, 1, 10, RoundHalfUp, -2},
+		{"empty is half up", 15, 1, 10, "", 2},
+		{"up", 11, 1, 10, RoundUp, 2},
+		{"up negative goes towards +inf", -19, 1, 10, RoundUp, -1},
+		{"down", 19, 1, 10, RoundDown, 1},
+		{"down negative goes towards zero", -19, 1, 10, RoundDown, -1},
+		{"per minute for 7s", 10_000, 7, 60, RoundHalfUp, 1_167},
+		{"per minute for 7s up", 10_000, 7, 60, RoundUp, 1_167},
+		{"per minute for 7s down", 10_000, 7, 60, RoundDown, 1_166},
+	}
+	for _, tt := range tests {
+		if got := tt.a.MulDiv(tt.num, tt.den, tt.r); got != tt.want {
+			t.Errorf("%s: %d.MulDiv(%d, %d, %q) = %d, want %d", tt.name, int64(tt.a), tt.num, tt.den, tt.r, got, tt.want)
+		}
+	}
+}
+
+func TestUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Amount
+		invalid bool
+	}{
+		{in: `1.25`, want: 1_250_000},
+		{in: `"1.25"`, want: 1_250_000},
+		{in: `0.1`, want: 100_000},
+		{in: `1e-06`, want: 1},
+		{in: `"1.+5"`, invalid: true},
+		{in: `true`, invalid: true},
+	}
+	for _, tt := range tests {
+		var a Amount
+		err := a.UnmarshalJSON([]byte(tt.in))
+		if tt.invalid {
+			if err == nil {
+				t.Errorf("UnmarshalJSON(%s) = %d, want an error", tt.in, a)
+			}
+			continue
+		}
+		if err != nil || a != tt.want {
+			t.Errorf("UnmarshalJSON(%s) = %d, %v; want %d", tt.in, a, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package rating
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"nextgen-sip/internal/models"
+	"nextgen-sip/internal/money"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxCSVErrors bounds how many row errors are reported for one upload
+const maxCSVErrors = 20
+
+// CSV columns, matched case-insensitively against the header row. The
+// first five are required; connection_fee and min_duration are optional.
+var requiredColumns = []string{"prefix", "description", "rate", "increments", "effective_date"}
+
+// CSVError lists every invalid row of an upload
+type CSVError struct {
+	Errors []string
+}
+
+func (e *CSVError) Error() string {
+	return fmt.Sprintf("%d invalid rows: %s", len(e.Errors), strings.Join(e.Errors, "; "))
+}
+
+// ParseCSV reads a carrier rate deck. rate is the price per minute, read
+// exactly as a decimal, and increments is "first/next" in seconds, e.g.
+// "60/60" or "30/6". It returns the rates and the latest effective_date
+// found, which is when the deck as a whole may take effect (zero if every
+// row left it empty).
+func ParseCSV(r io.Reader) ([]models.Rate, time.Time, error) {
+	cr := csv.NewReader(r)
+	cr.TrimLeadingSpace = true
+
+	header, err := cr.Read()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, time.Time{}, fmt.Errorf("empty CSV")
+		}
+		return nil, time.Time{}, err
+	}
+	col := make(map[string]int, len(header))
+	for i, h := range header {
+		col[strings.ToLower(strings.TrimSpace(strings.TrimPrefix(h, "\ufeff")))] = i
+	}
+	for _, name := range requiredColumns {
+		if _, ok := col[name]; !ok {
+			return nil, time.Time{}, fmt.Errorf("missing column %q", name)
+		}
+	}
+
+	var (
+		rates     []models.Rate
+		effective time.Time
+		rowErrs   []string
+		seen      = make(map[string]int)
+	)
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		line, _ := cr.FieldPos(0)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		field := func(name string) string {
+			i, ok := col[name]
+			if !ok || i >= len(rec) {
+				return ""
+			}
+			return strings.TrimSpace(rec[i])
+		}
+
+		rate, eff, err := parseRow(field)
+		if err == nil {
+			if prev, dup := seen[rate.Prefix]; dup {
+				err = fmt.Errorf("duplicate prefix %q (line %d)", rate.Prefix, prev)
+			}
+		}
+		if err != nil {
+			if len(rowErrs) < maxCSVErrors {
+				rowErrs = append(rowErrs, fmt.Sprintf("line %d: %v", line, err))
+			}
+			continue
+		}
+		seen[rate.Prefix] = line
+		rates = append(rates, rate)
+		if eff.After(effective) {
+			effective = eff
+		}
+	}
+
+	if len(rowErrs) > 0 {
+		return nil, time.Time{}, &CSVError{Errors: rowErrs}
+	}
+	if len(rates) == 0 {
+		return nil, time.Time{}, fmt.Errorf("rate deck is empty")
+	}
+	return rates, effective, nil
+}
+
+func parseRow(field func(string) string) (models.Rate, time.Time, error) {
+	r := models.Rate{
+		Prefix:      Normalize(field("prefix")),
+		Description: field("description"),
+	}
+	if field("prefix") != "" && r.Prefix == "" {
+		return r, time.Time{}, fmt.Errorf("invalid prefix %q", field("prefix"))
+	}
+
+	var err error
+	if r.PerMinute, err = money.Parse(field("rate")); err != nil {
+		return r, time.Time{}, fmt.Errorf("invalid rate %q", field("rate"))
+	}
+	if v := field("connection_fee"); v != "" {
+		if r.ConnectionFee, err = money.Parse(v); err != nil {
+			return r, time.Time{}, fmt.Errorf("invalid connection_fee %q", v)
+		}
+	}
+	if v := field("min_duration"); v != "" {
+		if r.MinDuration, err = strconv.Atoi(v); err != nil {
+			return r, time.Time{}, fmt.Errorf("invalid min_duration %q", v)
+		}
+	}
+	if r.FirstIncrement, r.NextIncrement, err = ParseIncrements(field("increments")); err != nil {
+		return r, time.Time{}, err
+	}
+
+	var eff time.Time
+	if v := field("effective_date"); v != "" {
+		if eff, err = ParseTime(v); err != nil {
+			return r, time.Time{}, fmt.Errorf("invalid effective_date %q", v)
+		}
+	}
+	return r, eff, Validate(r)
+}
+
+// ParseIncrements parses "first/next" billing increments such as "60/60"
+func ParseIncrements(s string) (int, int, error) {
+	first, next, ok := strings.Cut(s, "/")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid increments %q, want first/next", s)
+	}
+	f, err1 := strconv.Atoi(strings.TrimSpace(first))
+	n, err2 := strconv.Atoi(strings.TrimSpace(next))
+	if err1 != nil || err2 != nil || f <= 0 || n <= 0 {
+		return 0, 0, fmt.Errorf("invalid increments %q, want first/next", s)
+	}
+	return f, n, nil
+}
+
+// ParseTime accepts RFC3339 timestamps or plain dates (midnight UTC)
+func ParseTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", s)
+}
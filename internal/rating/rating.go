@@ -0,0 +1,497 @@
+package rating
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"nextgen-sip/internal/dialplan"
+	"nextgen-sip/internal/models"
+	"nextgen-sip/internal/money"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNoDeck     = errors.New("no rate deck assigned")
+	ErrNoRate     = errors.New("destination not rated")
+	ErrNoVersion  = errors.New("rate deck version not found")
+	ErrNoFallback = errors.New("no earlier version to roll back to")
+	errBadDeckID  = errors.New("deck id may only contain letters, digits, '-' and '_'")
+	validDeckIDRe = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+)
+
+// RateDeck is one version of a named price list. Every upload adds a new
+// version; the newest version whose EffectiveAt has passed and that was not
+// rolled back is the one used for rating.
+type RateDeck struct {
+	ID          string         `json:"id"`
+	Name        string         `json:"name"`
+	Currency    string         `json:"currency"`
+	Rounding    money.Rounding `json:"rounding"` // Applied to each billing increment
+	Version     int            `json:"version"`
+	UploadedAt  time.Time      `json:"uploaded_at"`
+	EffectiveAt time.Time      `json:"effective_at"`
+	RolledBack  bool           `json:"rolled_back,omitempty"`
+	Source      string         `json:"source,omitempty"`
+	Rates       []models.Rate  `json:"rates,omitempty"`
+}
+
+// DeckSummary describes a deck without its rates
+type DeckSummary struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`
+	Active  int       `json:"active_version"` // 0 when nothing is in effect yet
+	Pending []int     `json:"pending_versions"`
+	Latest  *RateDeck `json:"latest,omitempty"`
+}
+
+// compiledDeck indexes rates by prefix for longest-prefix matching
+type compiledDeck struct {
+	deck    RateDeck
+	byPref  map[string]models.Rate
+	longest int
+}
+
+func compile(d RateDeck) *compiledDeck {
+	c := &compiledDeck{
+		deck:   d,
+		byPref: make(map[string]models.Rate, len(d.Rates)),
+	}
+	for _, r := range d.Rates {
+		c.byPref[r.Prefix] = r
+		if len(r.Prefix) > c.longest {
+			c.longest = len(r.Prefix)
+		}
+	}
+	return c
+}
+
+func (c *compiledDeck) match(number string) (models.Rate, bool) {
+	n := len(number)
+	if n > c.longest {
+		n = c.longest
+	}
+	// An empty prefix acts as the deck's catch-all
+	for ; n >= 0; n-- {
+		if r, ok := c.byPref[number[:n]]; ok {
+			return r, true
+		}
+	}
+	return models.Rate{}, false
+}
+
+// active returns the version in effect at t from versions sorted oldest first
+func active(versions []*compiledDeck, t time.Time) *compiledDeck {
+	for i := len(versions) - 1; i >= 0; i-- {
+		v := versions[i]
+		if !v.deck.RolledBack && !v.deck.EffectiveAt.After(t) {
+			return v
+		}
+	}
+	return nil
+}
+
+// Engine picks the rate for a call: the user's own deck first, then the
+// tenant's deck, then the default deck.
+type Engine struct {
+	mu          sync.RWMutex
+	decks       map[string][]*compiledDeck // deck ID -> versions, oldest first
+	tenantDecks map[string]string
+	defaultDeck string
+	store       *Store
+	plans       *dialplan.Plans
+}
+
+// NewEngine creates a rating engine. With a non-nil store all deck versions
+// are loaded from it and every change is written back. Dialed numbers are
+// rated in E.164 as normalized by the tenant's dial plan.
+func NewEngine(store *Store, plans *dialplan.Plans) (*Engine, error) {
+	e := &Engine{
+		decks:       make(map[string][]*compiledDeck),
+		tenantDecks: make(map[string]string),
+		store:       store,
+		plans:       plans,
+	}
+	if store == nil {
+		return e, nil
+	}
+	decks, err := store.Load()
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range decks {
+		e.decks[d.ID] = append(e.decks[d.ID], compile(d))
+	}
+	if e.tenantDecks, err = store.LoadAssignments(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Publish validates d and adds it as the next version of its deck. A zero
+// EffectiveAt makes it effective immediately.
+func (e *Engine) Publish(d RateDeck) (RateDeck, error) {
+	if !validDeckIDRe.MatchString(d.ID) {
+		return RateDeck{}, errBadDeckID
+	}
+	if err := ValidateRates(d.Rates); err != nil {
+		return RateDeck{}, err
+	}
+	if !d.Rounding.Valid() {
+		return RateDeck{}, fmt.Errorf("unknown rounding %q", d.Rounding)
+	}
+	if d.Currency = strings.ToUpper(d.Currency); d.Currency == "" {
+		d.Currency = money.DefaultCurrency
+	}
+	if d.Rounding == "" {
+		d.Rounding = money.RoundHalfUp
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	now := time.Now()
+	versions := e.decks[d.ID]
+	d.Version = 1
+	if n := len(versions); n > 0 {
+		d.Version = versions[n-1].deck.Version + 1
+		if d.Name == "" {
+			d.Name = versions[n-1].deck.Name
+		}
+	}
+	d.UploadedAt = now
+	if d.EffectiveAt.IsZero() {
+		d.EffectiveAt = now
+	}
+	d.RolledBack = false
+
+	if e.store != nil {
+		if err := e.store.Save(d); err != nil {
+			return RateDeck{}, err
+		}
+	}
+	e.decks[d.ID] = append(versions, compile(d))
+	return d, nil
+}
+
+// Rollback withdraws a version of a deck; version 0 means the one currently
+// in effect, in which case the previous effective version takes over.
+// Withdrawing a future version cancels its scheduled activation.
+func (e *Engine) Rollback(id string, version int) (RateDeck, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	versions := e.decks[id]
+	var target *compiledDeck
+	if version == 0 {
+		target = active(versions, time.Now())
+		if target == nil {
+			return RateDeck{}, ErrNoVersion
+		}
+	} else {
+		for _, v := range versions {
+			if v.deck.Version == version {
+				target = v
+			}
+		}
+		if target == nil || target.deck.RolledBack {
+			return RateDeck{}, ErrNoVersion
+		}
+	}
+
+	// Never leave a deck that was in effect with nothing to rate against
+	if target == active(versions, time.Now()) {
+		target.deck.RolledBack = true
+		fallback := active(versions, time.Now())
+		target.deck.RolledBack = false
+		if fallback == nil {
+			return RateDeck{}, ErrNoFallback
+		}
+	}
+
+	d := target.deck
+	d.RolledBack = true
+	if e.store != nil {
+		if err := e.store.Save(d); err != nil {
+			return RateDeck{}, err
+		}
+	}
+	target.deck.RolledBack = true
+	d.Rates = nil
+	return d, nil
+}
+
+// GetDeck returns the version of a deck currently in effect
+func (e *Engine) GetDeck(id string) (RateDeck, bool) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	c := active(e.decks[id], time.Now())
+	if c == nil {
+		return RateDeck{}, false
+	}
+	return c.deck, true
+}
+
+// GetVersion returns one version of a deck, including its rates
+func (e *Engine) GetVersion(id string, version int) (RateDeck, bool) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	for _, v := range e.decks[id] {
+		if v.deck.Version == version {
+			return v.deck, true
+		}
+	}
+	return RateDeck{}, false
+}
+
+// Versions lists every version of a deck, newest first, without rates
+func (e *Engine) Versions(id string) []RateDeck {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	versions := e.decks[id]
+	list := make([]RateDeck, 0, len(versions))
+	for i := len(versions) - 1; i >= 0; i-- {
+		d := versions[i].deck
+		d.Rates = nil
+		list = append(list, d)
+	}
+	return list
+}
+
+func (e *Engine) ListDecks() []DeckSummary {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	now := time.Now()
+	list := make([]DeckSummary, 0, len(e.decks))
+	for id, versions := range e.decks {
+		latest := versions[len(versions)-1].deck
+		latest.Rates = nil
+		s := DeckSummary{ID: id, Name: latest.Name, Pending: []int{}, Latest: &latest}
+		if c := active(versions, now); c != nil {
+			s.Active = c.deck.Version
+		}
+		for _, v := range versions {
+			if !v.deck.RolledBack && v.deck.EffectiveAt.After(now) {
+				s.Pending = append(s.Pending, v.deck.Version)
+			}
+		}
+		list = append(list, s)
+	}
+	return list
+}
+
+// AssignTenant sets the deck for a tenant; an empty deck removes the assignment
+func (e *Engine) AssignTenant(tenantID, deckID string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, ok := e.decks[deckID]; !ok && deckID != "" {
+		return fmt.Errorf("unknown rate deck %q", deckID)
+	}
+
+	tenants := make(map[string]string, len(e.tenantDecks)+1)
+	for k, v := range e.tenantDecks {
+		tenants[k] = v
+	}
+	if deckID == "" {
+		delete(tenants, tenantID)
+	} else {
+		tenants[tenantID] = deckID
+	}
+	if e.store != nil {
+		if err := e.store.SaveAssignments(tenants); err != nil {
+			return err
+		}
+	}
+	e.tenantDecks = tenants
+	return nil
+}
+
+func (e *Engine) TenantAssignments() map[string]string {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	m := make(map[string]string, len(e.tenantDecks))
+	for k, v := range e.tenantDecks {
+		m[k] = v
+	}
+	return m
+}
+
+func (e *Engine) SetDefault(deckID string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.defaultDeck = deckID
+}
+
+func (e *Engine) DefaultDeck() string {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.defaultDeck
+}
+
+// HasDeck reports whether any version of a deck exists
+func (e *Engine) HasDeck(id string) bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return len(e.decks[id]) > 0
+}
+
+// Rate finds the rate for the dialed number in the deck version in effect now
+func (e *Engine) Rate(tenantID, userDeck, number string) (models.CallRate, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	deckID := userDeck
+	if deckID == "" {
+		deckID = e.tenantDecks[tenantID]
+	}
+	if deckID == "" {
+		deckID = e.defaultDeck
+	}
+	c := active(e.decks[deckID], time.Now())
+	if c == nil {
+		return models.CallRate{}, ErrNoDeck
+	}
+
+	r, ok := c.match(Normalize(e.plans.Normalize(tenantID, userPart(number))))
+	if !ok {
+		return models.CallRate{}, ErrNoRate
+	}
+	return models.CallRate{
+		DeckID:      deckID,
+		DeckVersion: c.deck.Version,
+		Currency:    c.deck.Currency,
+		Rounding:    c.deck.Rounding,
+		Rate:        r,
+	}, nil
+}
+
+// CarrierCost prices a one-minute call to an E.164 number on a carrier's
+// deck, to rank the trunks that could carry it
+func (e *Engine) CarrierCost(deckID, number string) (money.Amount, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	c := active(e.decks[deckID], time.Now())
+	if c == nil {
+		return 0, ErrNoDeck
+	}
+	r, ok := c.match(Normalize(number))
+	if !ok {
+		return 0, ErrNoRate
+	}
+	_, cost := Cost(models.CallRate{Rounding: c.deck.Rounding, Rate: r}, 60)
+	return cost, nil
+}
+
+// Normalize reduces an E.164 number or prefix, or a URI holding one, to the
+// digits used for prefix matching: no scheme, domain, + or visual
+// separators. Dialed numbers are first brought to E.164 by the tenant's
+// dial plan, which alone knows the international prefix.
+func Normalize(number string) string {
+	s := strings.TrimPrefix(userPart(number), "+")
+
+	var b strings.Builder
+	for _, r := range s {
+		if r >= '0' && r <= '9' {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// userPart strips the scheme, domain and parameters off a dialed URI
+func userPart(uri string) string {
+	s := strings.TrimPrefix(uri, "sip:")
+	s = strings.TrimPrefix(s, "sips:")
+	if idx := strings.IndexAny(s, "@;"); idx >= 0 {
+		s = s[:idx]
+	}
+	return s
+}
+
+// Validate checks a rate for values that would break billing
+func Validate(r models.Rate) error {
+	switch {
+	case strings.Trim(r.Prefix, "0123456789") != "":
+		return fmt.Errorf("prefix must be digits only")
+	case r.PerMinute < 0 || r.ConnectionFee < 0:
+		return fmt.Errorf("negative price")
+	case r.MinDuration < 0:
+		return fmt.Errorf("negative minimum duration")
+	case r.FirstIncrement <= 0 || r.NextIncrement <= 0:
+		return fmt.Errorf("billing increments must be positive")
+	}
+	return nil
+}
+
+// ValidateRates checks every rate of a deck and rejects duplicate prefixes
+func ValidateRates(rates []models.Rate) error {
+	if len(rates) == 0 {
+		return fmt.Errorf("rate deck is empty")
+	}
+	seen := make(map[string]bool, len(rates))
+	for _, r := range rates {
+		if err := Validate(r); err != nil {
+			return fmt.Errorf("prefix %q: %w", r.Prefix, err)
+		}
+		if seen[r.Prefix] {
+			return fmt.Errorf("prefix %q: duplicate", r.Prefix)
+		}
+		seen[r.Prefix] = true
+	}
+	return nil
+}
+
+// Billable applies minimum duration and billing increments to a connected
+// duration, e.g. with 30/6 a 31s call bills 36s and with 60/60 it bills 60s.
+func Billable(r models.Rate, seconds float64) int {
+	if seconds <= 0 {
+		return 0
+	}
+	secs := int(math.Ceil(seconds))
+	if secs < r.MinDuration {
+		secs = r.MinDuration
+	}
+	if secs <= r.FirstIncrement {
+		return r.FirstIncrement
+	}
+	rest := secs - r.FirstIncrement
+	steps := (rest + r.NextIncrement - 1) / r.NextIncrement
+	return r.FirstIncrement + steps*r.NextIncrement
+}
+
+// incrementCost prices one billing increment of secs seconds. Each
+// increment is rounded on its own, so every next increment of a call costs
+// the same number of micro-units and reservations divide exactly.
+func incrementCost(r models.CallRate, secs int) money.Amount {
+	return r.PerMinute.MulDiv(int64(secs), 60, r.Rounding)
+}
+
+// Cost returns the billable seconds and price of a call connected for
+// seconds: the connection fee, the first increment and every next increment
+func Cost(r models.CallRate, seconds float64) (int, money.Amount) {
+	billable := Billable(r.Rate, seconds)
+	if billable == 0 {
+		return 0, 0
+	}
+	next := money.Amount((billable - r.FirstIncrement) / r.NextIncrement)
+	return billable, r.ConnectionFee + incrementCost(r, r.FirstIncrement) + next*incrementCost(r, r.NextIncrement)
+}
+
+// MaxDuration returns the longest talk time in seconds whose cost fits in
+// amount. unlimited is true when further increments cost nothing.
+func MaxDuration(r models.CallRate, amount money.Amount) (seconds int, unlimited bool) {
+	first, firstCost := Cost(r, 1)
+	if firstCost > amount {
+		return 0, false
+	}
+	step := incrementCost(r, r.NextIncrement)
+	if step == 0 {
+		return 0, true
+	}
+	steps := int((amount - firstCost) / step)
+	return first + steps*r.NextIncrement, false
+}
@@ -0,0 +1,140 @@
+package rating
+
+import (
+	"nextgen-sip/internal/models"
+	"nextgen-sip/internal/money"
+	"testing"
+)
+
+func callRate(perMinute, fee string, first, next, min int, r money.Rounding) models.CallRate {
+	pm, err := money.Parse(perMinute)
+	if err != nil {
+		panic(err)
+	}
+	cf, err := money.Parse(fee)
+	if err != nil {
+		panic(err)
+	}
+	return models.CallRate{
+		Rounding: r,
+		Rate: models.Rate{
+			PerMinute:      pm,
+			ConnectionFee:  cf,
+			FirstIncrement: first,
+			NextIncrement:  next,
+			MinDuration:    min,
+		},
+	}
+}
+
+func TestBillable(t *testing.T) {
+	tests := []struct {
+		name        string
+		first, next int
+		min         int
+		seconds     float64
+		want        int
+	}{
+		{"not connected", 60, 60, 0, 0, 0},
+		{"60/60 one second", 60, 60, 0, 1, 60},
+		{"60/60 exactly a minute", 60, 60, 0, 60, 60},
+		{"60/60 just over", 60, 60, 0, 60.2, 120},
+		{"30/6 within first", 30, 6, 0, 29, 30},
+		{"30/6 31s", 30, 6, 0, 31, 36},
+		{"30/6 36s", 30, 6, 0, 36, 36},
+		{"30/6 37s", 30, 6, 0, 37, 42},
+		{"1/1 fraction rounds up", 1, 1, 0, 4.01, 5},
+		{"minimum below first", 30, 6, 10, 5, 30},
+		{"minimum above first", 30, 6, 45, 5, 48},
+	}
+	for _, tt := range tests {
+		r := models.Rate{FirstIncrement: tt.first, NextIncrement: tt.next, MinDuration: tt.min}
+		if got := Billable(r, tt.seconds); got != tt.want {
+			t.Errorf("%s: Billable(%v) = %d, want %d", tt.name, tt.seconds, got, tt.want)
+		}
+	}
+}
+
+func TestCost(t *testing.T) {
+	tests := []struct {
+		name     string
+		rate     models.CallRate
+		seconds  float64
+		billable int
+		cost     string
+	}{
+		{"not connected pays no fee", callRate("0.10", "0.05", 60, 60, 0, ""), 0, 0, "0"},
+		{"60/60 first minute", callRate("0.10", "0", 60, 60, 0, ""), 10, 60, "0.10"},
+		{"60/60 with fee", callRate("0.10", "0.05", 60, 60, 0, ""), 61, 120, "0.25"},
+		{"30/6 31s", callRate("0.10", "0", 30, 6, 0, ""), 31, 36, "0.06"},
+		// 0.0123/min is 6150 micro-units for the first 30s and 1230 per 6s
+		{"30/6 uneven rate", callRate("0.0123", "0", 30, 6, 0, ""), 40, 42, "0.008610"},
+		// One second of 0.01/min is 166.67 micro-units per increment
+		{"1/1 half up", callRate("0.01", "0", 1, 1, 0, money.RoundHalfUp), 3, 3, "0.000501"},
+		{"1/1 up", callRate("0.01", "0", 1, 1, 0, money.RoundUp), 3, 3, "0.000501"},
+		{"1/1 down", callRate("0.01", "0", 1, 1, 0, money.RoundDown), 3, 3, "0.000498"},
+		{"free rate still pays fee", callRate("0", "0.02", 60, 60, 0, ""), 300, 300, "0.02"},
+	}
+	for _, tt := range tests {
+		billable, cost := Cost(tt.rate, tt.seconds)
+		want, _ := money.Parse(tt.cost)
+		if billable != tt.billable || cost != want {
+			t.Errorf("%s: Cost(%v) = %d, %s; want %d, %s", tt.name, tt.seconds, billable, cost, tt.billable, want)
+		}
+	}
+}
+
+func TestMaxDuration(t *testing.T) {
+	tests := []struct {
+		name      string
+		rate      models.CallRate
+		amount    string
+		seconds   int
+		unlimited bool
+	}{
+		{"cannot afford first increment", callRate("0.10", "0", 60, 60, 0, ""), "0.09", 0, false},
+		{"exactly the first increment", callRate("0.10", "0", 60, 60, 0, ""), "0.10", 60, false},
+		{"part of a next increment", callRate("0.10", "0", 60, 60, 0, ""), "0.29", 120, false},
+		{"fee comes first", callRate("0.10", "0.05", 60, 60, 0, ""), "0.30", 120, false},
+		{"30/6", callRate("0.10", "0", 30, 6, 0, ""), "0.10", 60, false},
+		{"minimum duration", callRate("0.60", "0", 1, 1, 30, ""), "0.30", 30, false},
+		{"free rate", callRate("0", "0.01", 60, 60, 0, ""), "1", 0, true},
+		{"free rate unaffordable fee", callRate("0", "0.01", 60, 60, 0, ""), "0.005", 0, false},
+	}
+	for _, tt := range tests {
+		amount, _ := money.Parse(tt.amount)
+		seconds, unlimited := MaxDuration(tt.rate, amount)
+		if seconds != tt.seconds || unlimited != tt.unlimited {
+			t.Errorf("%s: MaxDuration(%s) = %d, %v; want %d, %v", tt.name, amount, seconds, unlimited, tt.seconds, tt.unlimited)
+			continue
+		}
+		if seconds == 0 {
+			continue
+		}
+		// The granted time must be affordable and one second more must not
+		if _, cost := Cost(tt.rate, float64(seconds)); cost > amount {
+			t.Errorf("%s: %ds costs %s, more than %s", tt.name, seconds, cost, amount)
+		}
+		if _, cost := Cost(tt.rate, float64(seconds+1)); cost <= amount {
+			t.Errorf("%s: %ds costs %s, still within %s", tt.name, seconds+1, cost, amount)
+		}
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"+4930123456", "4930123456"},
+		{"sip:+1 (555) 010-9999@carrier.example;user=phone", "15550109999"},
+		{"sips:442071234567@example.com", "442071234567"},
+		// International prefixes belong to the tenant's dial plan
+		{"004930123456", "004930123456"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := Normalize(tt.in); got != tt.want {
+			t.Errorf("Normalize(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
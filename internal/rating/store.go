@@ -0,0 +1,103 @@
+package rating
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Store keeps every deck version as its own JSON file, <dir>/<deck>/<version>.json,
+// so earlier versions stay available for rollback across restarts. Tenant
+// assignments are kept beside them in <dir>/tenants.json.
+type Store struct {
+	dir string
+}
+
+func NewStore(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &Store{dir: dir}, nil
+}
+
+// Save writes a deck version, replacing an earlier copy of the same version
+func (s *Store) Save(d RateDeck) error {
+	dir := filepath.Join(s.dir, d.ID)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+
+	return writeFile(filepath.Join(dir, fmt.Sprintf("%d.json", d.Version)), data)
+}
+
+// SaveAssignments replaces the stored tenant to deck assignments
+func (s *Store) SaveAssignments(tenants map[string]string) error {
+	data, err := json.Marshal(tenants)
+	if err != nil {
+		return err
+	}
+	return writeFile(filepath.Join(s.dir, "tenants.json"), data)
+}
+
+// LoadAssignments reads the tenant to deck assignments; none were saved
+// yet when the file does not exist
+func (s *Store) LoadAssignments() (map[string]string, error) {
+	path := filepath.Join(s.dir, "tenants.json")
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	tenants := make(map[string]string)
+	if err := json.Unmarshal(data, &tenants); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return tenants, nil
+}
+
+// writeFile writes and renames so a crash never leaves a half-written file
+func writeFile(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Load reads every stored version, ordered by deck and version
+func (s *Store) Load() ([]RateDeck, error) {
+	paths, err := filepath.Glob(filepath.Join(s.dir, "*", "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	decks := make([]RateDeck, 0, len(paths))
+	for _, p := range paths {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+		var d RateDeck
+		if err := json.Unmarshal(data, &d); err != nil {
+			return nil, fmt.Errorf("%s: %w", p, err)
+		}
+		decks = append(decks, d)
+	}
+
+	sort.Slice(decks, func(i, j int) bool {
+		if decks[i].ID != decks[j].ID {
+			return decks[i].ID < decks[j].ID
+		}
+		return decks[i].Version < decks[j].Version
+	})
+	return decks, nil
+}
@@ -0,0 +1,76 @@
+package rating
+
+import (
+	"nextgen-sip/internal/models"
+	"testing"
+)
+
+// reopen starts an engine on the decks and assignments stored in dir
+func reopen(t *testing.T, dir string) *Engine {
+	t.Helper()
+	store, err := NewStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := NewEngine(store, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func TestAssignmentsPersist(t *testing.T) {
+	dir := t.TempDir()
+	e := reopen(t, dir)
+	for _, id := range []string{"retail", "wholesale"} {
+		deck := RateDeck{ID: id, Rates: []models.Rate{{Prefix: "1", FirstIncrement: 60, NextIncrement: 60}}}
+		if _, err := e.Publish(deck); err != nil {
+			t.Fatalf("publish %s: %v", id, err)
+		}
+	}
+
+	steps := []struct {
+		tenant, deck string
+		fails        bool
+		want         map[string]string
+	}{
+		{"acme", "retail", false, map[string]string{"acme": "retail"}},
+		{"globex", "wholesale", false, map[string]string{"acme": "retail", "globex": "wholesale"}},
+		{"acme", "wholesale", false, map[string]string{"acme": "wholesale", "globex": "wholesale"}},
+		{"initech", "missing", true, map[string]string{"acme": "wholesale", "globex": "wholesale"}},
+		{"globex", "", false, map[string]string{"acme": "wholesale"}},
+	}
+	for _, st := range steps {
+		err := e.AssignTenant(st.tenant, st.deck)
+		if (err != nil) != st.fails {
+			t.Errorf("assign %s to %q: err = %v, want failure %v", st.tenant, st.deck, err, st.fails)
+		}
+		// Every change must survive a restart
+		got := reopen(t, dir).TenantAssignments()
+		if len(got) != len(st.want) {
+			t.Errorf("assign %s to %q: reloaded %v, want %v", st.tenant, st.deck, got, st.want)
+			continue
+		}
+		for tenant, deck := range st.want {
+			if got[tenant] != deck {
+				t.Errorf("assign %s to %q: reloaded %v, want %v", st.tenant, st.deck, got, st.want)
+			}
+		}
+	}
+}
+
+func TestAssignmentsNoStore(t *testing.T) {
+	e, err := NewEngine(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.Publish(RateDeck{ID: "retail", Rates: []models.Rate{{Prefix: "1", FirstIncrement: 60, NextIncrement: 60}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.AssignTenant("acme", "retail"); err != nil {
+		t.Fatal(err)
+	}
+	if got := e.TenantAssignments()["acme"]; got != "retail" {
+		t.Errorf("acme deck = %q, want retail", got)
+	}
+}
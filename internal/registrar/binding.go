@@ -0,0 +1,206 @@
+package registrar
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+// ErrNotFound means none of the looked up addresses is registered
+var ErrNotFound = errors.New("not registered")
+
+// ErrOutOfOrder rejects a REGISTER that is older than the one that last
+// changed a binding (RFC 3261 section 10.3, step 7)
+var ErrOutOfOrder = errors.New("REGISTER out of order")
+
+// Binding is one registered contact of an address-of-record
+type Binding struct {
+	Contact   string    `json:"contact"` // Contact URI as registered
+	Q         float64   `json:"q"`       // Preference from 0 to 1
+	Expires   time.Time `json:"expires"`
+	CallID    string    `json:"call_id"`
+	CSeq      uint32    `json:"cseq"`
+	Source    string    `json:"source"`             // host:port the REGISTER came from
+	Transport string    `json:"transport"`          // Transport the REGISTER came over
+	Received  string    `json:"received,omitempty"` // Flow to reach the contact over, when it cannot be reached directly
+	NAT       bool      `json:"nat"`                // Contact is behind a NAT
+	Path      []string  `json:"path,omitempty"`     // Route back to the contact (RFC 3327), first hop first
+	Instance  string    `json:"instance_id,omitempty"`
+	RegID     int       `json:"reg_id,omitempty"` // Flow of the instance (RFC 5626)
+	UserAgent string    `json:"user_agent,omitempty"`
+	TenantID  string    `json:"tenant_id,omitempty"`
+	Updated   time.Time `json:"updated"`
+}
+
+// ExpiresIn returns the seconds left on the binding, rounded up
+func (b Binding) ExpiresIn(now time.Time) int {
+	left := b.Expires.Sub(now)
+	if left <= 0 {
+		return 0
+	}
+	return int((left + time.Second - 1) / time.Second)
+}
+
+// Contact is one Contact of a REGISTER
+type Contact struct {
+	URI      string
+	Q        float64
+	Expires  int    // Seconds, 0 removes the binding
+	Received string // URI of the flow the REGISTER came in on, if the contact is only reachable over it
+	NAT      bool
+	Path     []string
+	Instance string // +sip.instance, identifies the device across contacts
+	RegID    int    // With Instance, identifies one of the device's flows
+}
+
+// Update is the set of binding changes carried by one REGISTER
+type Update struct {
+	CallID    string
+	CSeq      uint32
+	Source    string
+	Transport string
+	UserAgent string
+	TenantID  string
+	RemoveAll bool // Contact: * with Expires: 0
+	Contacts  []Contact
+	Received  time.Time // When the REGISTER came in, if not now, e.g. for updates buffered for replay
+}
+
+// Registration is the registration state of one address-of-record
+type Registration struct {
+	AOR      string    `json:"aor"`
+	TenantID string    `json:"tenant_id,omitempty"` // Scope of the aliases
+	Aliases  []string  `json:"aliases"`
+	Bindings []Binding `json:"bindings"`
+}
+
+// aliasKeys scopes aliases to a tenant, so that the same number or user
+// registered in two tenants indexes two different AORs
+func aliasKeys(tenantID string, aliases []string) []string {
+	keys := make([]string, len(aliases))
+	for i, alias := range aliases {
+		keys[i] = tenantID + ":" + alias
+	}
+	return keys
+}
+
+// updateTenant returns the tenant u indexes its AOR under: its own, or for
+// updates that carry none, such as removals, the one already indexed
+func updateTenant(u Update, current string) string {
+	if u.TenantID != "" {
+		return u.TenantID
+	}
+	return current
+}
+
+// removal is the update that drops contact from an AOR, or every binding
+// when contact is empty. It carries no Call-ID, so it is never out of order.
+func removal(contact string) Update {
+	if contact == "" {
+		return Update{RemoveAll: true}
+	}
+	return Update{Contacts: []Contact{{URI: contact}}}
+}
+
+// Apply returns the bindings left after u, following RFC 3261 section 10.3.
+// Expired bindings are dropped; the rest are ordered by Active. Bindings u
+// creates or refreshes run from when it was received, so an update applied
+// late does not outlive the lifetime it was granted.
+func Apply(current []Binding, u Update, now time.Time) ([]Binding, error) {
+	bindings := Active(current, now)
+	at := now
+	if !u.Received.IsZero() && u.Received.Before(now) {
+		at = u.Received
+	}
+
+	if u.RemoveAll {
+		for _, b := range bindings {
+			if b.CallID == u.CallID && u.CSeq <= b.CSeq {
+				return nil, ErrOutOfOrder
+			}
+		}
+		return nil, nil
+	}
+
+	for _, c := range u.Contacts {
+		i := indexOf(bindings, c)
+		if i >= 0 && bindings[i].CallID == u.CallID && u.CSeq <= bindings[i].CSeq {
+			return nil, ErrOutOfOrder
+		}
+		if c.Expires == 0 {
+			for i >= 0 {
+				bindings = append(bindings[:i], bindings[i+1:]...)
+				i = indexOf(bindings, c)
+			}
+			continue
+		}
+		b := Binding{
+			Contact:   c.URI,
+			Q:         c.Q,
+			Expires:   at.Add(time.Duration(c.Expires) * time.Second),
+			CallID:    u.CallID,
+			CSeq:      u.CSeq,
+			Source:    u.Source,
+			Transport: u.Transport,
+			Received:  c.Received,
+			NAT:       c.NAT,
+			Path:      c.Path,
+			Instance:  c.Instance,
+			RegID:     c.RegID,
+			UserAgent: u.UserAgent,
+			TenantID:  u.TenantID,
+			Updated:   at,
+		}
+		if i >= 0 {
+			bindings[i] = b
+		} else {
+			bindings = append(bindings, b)
+		}
+	}
+	return Active(bindings, now), nil
+}
+
+// Active drops expired bindings and orders the rest by preference: highest
+// q first, then the most recently refreshed
+func Active(bindings []Binding, now time.Time) []Binding {
+	list := make([]Binding, 0, len(bindings))
+	for _, b := range bindings {
+		if b.Expires.After(now) {
+			list = append(list, b)
+		}
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		if list[i].Q != list[j].Q {
+			return list[i].Q > list[j].Q
+		}
+		return list[i].Updated.After(list[j].Updated)
+	})
+	return list
+}
+
+// lastExpiry returns when the last of the bindings expires
+func lastExpiry(bindings []Binding) time.Time {
+	var last time.Time
+	for _, b := range bindings {
+		if b.Expires.After(last) {
+			last = b.Expires
+		}
+	}
+	return last
+}
+
+// indexOf returns the binding c refreshes: with an instance ID the one of
+// the same instance and flow (RFC 5626 section 6), else the one of the same
+// Contact URI
+func indexOf(bindings []Binding, c Contact) int {
+	for i, b := range bindings {
+		if c.Instance != "" {
+			if b.Instance == c.Instance && b.RegID == c.RegID {
+				return i
+			}
+		} else if b.Contact == c.URI {
+			return i
+		}
+	}
+	return -1
+}
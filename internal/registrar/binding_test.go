@@ -0,0 +1,198 @@
+package registrar
+
+import (
+	"testing"
+	"time"
+)
+
+func TestApply(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	existing := []Binding{
+		{Contact: "sip:a@10.0.0.1", Q: 1, Expires: now.Add(time.Minute), CallID: "c1", CSeq: 5, Updated: now.Add(-time.Minute)},
+		{Contact: "sip:b@10.0.0.2", Q: 0.5, Expires: now.Add(time.Hour), CallID: "c2", CSeq: 1, Updated: now.Add(-time.Hour)},
+		{Contact: "sip:old@10.0.0.3", Q: 1, Expires: now, CallID: "c3", CSeq: 1},
+	}
+	type want struct {
+		contact string
+		expires time.Duration // From now
+	}
+	tests := []struct {
+		name string
+		u    Update
+		want []want
+		err  error
+	}{
+		{
+			name: "query keeps the unexpired",
+			u:    Update{CallID: "c9", CSeq: 1},
+			want: []want{{"sip:a@10.0.0.1", time.Minute}, {"sip:b@10.0.0.2", time.Hour}},
+		},
+		{
+			name: "new contact",
+			u:    Update{CallID: "c9", CSeq: 1, Contacts: []Contact{{URI: "sip:c@10.0.0.4", Q: 0.8, Expires: 300}}},
+			want: []want{{"sip:a@10.0.0.1", time.Minute}, {"sip:c@10.0.0.4", 300 * time.Second}, {"sip:b@10.0.0.2", time.Hour}},
+		},
+		{
+			name: "refresh with a higher CSeq",
+			u:    Update{CallID: "c1", CSeq: 6, Contacts: []Contact{{URI: "sip:a@10.0.0.1", Q: 1, Expires: 3600}}},
+			want: []want{{"sip:a@10.0.0.1", time.Hour}, {"sip:b@10.0.0.2", time.Hour}},
+		},
+		{
+			name: "refresh may shorten",
+			u:    Update{CallID: "c2", CSeq: 2, Contacts: []Contact{{URI: "sip:b@10.0.0.2", Q: 0.5, Expires: 10}}},
+			want: []want{{"sip:a@10.0.0.1", time.Minute}, {"sip:b@10.0.0.2", 10 * time.Second}},
+		},
+		{
+			name: "same CSeq is out of order",
+			u:    Update{CallID: "c1", CSeq: 5, Contacts: []Contact{{URI: "sip:a@10.0.0.1", Expires: 3600}}},
+			err:  ErrOutOfOrder,
+		},
+		{
+			name: "lower CSeq is out of order",
+			u:    Update{CallID: "c1", CSeq: 4, Contacts: []Contact{{URI: "sip:a@10.0.0.1", Expires: 0}}},
+			err:  ErrOutOfOrder,
+		},
+		{
+			name: "another Call-ID may take over",
+			u:    Update{CallID: "c9", CSeq: 1, Contacts: []Contact{{URI: "sip:a@10.0.0.1", Q: 1, Expires: 120}}},
+			want: []want{{"sip:a@10.0.0.1", 2 * time.Minute}, {"sip:b@10.0.0.2", time.Hour}},
+		},
+		{
+			name: "zero expires removes",
+			u:    Update{CallID: "c1", CSeq: 6, Contacts: []Contact{{URI: "sip:a@10.0.0.1", Expires: 0}}},
+			want: []want{{"sip:b@10.0.0.2", time.Hour}},
+		},
+		{
+			name: "removing an unknown contact",
+			u:    Update{CallID: "c9", CSeq: 1, Contacts: []Contact{{URI: "sip:z@10.0.0.9", Expires: 0}}},
+			want: []want{{"sip:a@10.0.0.1", time.Minute}, {"sip:b@10.0.0.2", time.Hour}},
+		},
+		{
+			name: "remove all",
+			u:    Update{CallID: "c9", CSeq: 1, RemoveAll: true},
+		},
+		{
+			name: "remove all out of order",
+			u:    Update{CallID: "c2", CSeq: 1, RemoveAll: true},
+			err:  ErrOutOfOrder,
+		},
+		{
+			name: "expired binding does not block its Call-ID",
+			u:    Update{CallID: "c3", CSeq: 1, Contacts: []Contact{{URI: "sip:old@10.0.0.3", Q: 1, Expires: 60}}},
+			want: []want{{"sip:old@10.0.0.3", time.Minute}, {"sip:a@10.0.0.1", time.Minute}, {"sip:b@10.0.0.2", time.Hour}},
+		},
+	}
+	for _, tt := range tests {
+		current := append([]Binding(nil), existing...)
+		got, err := Apply(current, tt.u, now)
+		if err != tt.err {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: %d bindings %v, want %d", tt.name, len(got), got, len(tt.want))
+			continue
+		}
+		for i, w := range tt.want {
+			if got[i].Contact != w.contact || got[i].Expires.Sub(now) != w.expires {
+				t.Errorf("%s: binding %d = %s expiring in %v, want %s in %v",
+					tt.name, i, got[i].Contact, got[i].Expires.Sub(now), w.contact, w.expires)
+			}
+		}
+	}
+}
+
+func TestApplyInstance(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	existing := []Binding{
+		{Contact: "sip:a@10.0.0.1:5060", Instance: "<urn:uuid:1>", RegID: 1, Expires: now.Add(time.Hour), CallID: "c1", CSeq: 1},
+		{Contact: "sip:a@10.0.0.1:5062", Instance: "<urn:uuid:1>", RegID: 2, Expires: now.Add(time.Hour), CallID: "c2", CSeq: 1},
+	}
+	tests := []struct {
+		name     string
+		contact  Contact
+		contacts []string
+	}{
+		{"same flow replaces its binding", Contact{URI: "sip:a@10.0.0.9:5070", Instance: "<urn:uuid:1>", RegID: 1, Expires: 60},
+			[]string{"sip:a@10.0.0.9:5070", "sip:a@10.0.0.1:5062"}},
+		{"new flow adds a binding", Contact{URI: "sip:a@10.0.0.9:5070", Instance: "<urn:uuid:1>", RegID: 3, Expires: 60},
+			[]string{"sip:a@10.0.0.9:5070", "sip:a@10.0.0.1:5060", "sip:a@10.0.0.1:5062"}},
+		{"other instance at the same URI adds a binding", Contact{URI: "sip:a@10.0.0.1:5060", Instance: "<urn:uuid:2>", RegID: 1, Expires: 60},
+			[]string{"sip:a@10.0.0.1:5060", "sip:a@10.0.0.1:5060", "sip:a@10.0.0.1:5062"}},
+		{"removing the flow", Contact{URI: "sip:a@10.0.0.1:5062", Instance: "<urn:uuid:1>", RegID: 2, Expires: 0},
+			[]string{"sip:a@10.0.0.1:5060"}},
+	}
+	for _, tt := range tests {
+		u := Update{CallID: "c9", CSeq: 1, Contacts: []Contact{tt.contact}}
+		got, err := Apply(append([]Binding(nil), existing...), u, now)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		var contacts []string
+		for _, b := range got {
+			contacts = append(contacts, b.Contact)
+		}
+		if len(contacts) != len(tt.contacts) {
+			t.Errorf("%s: contacts %v, want %v", tt.name, contacts, tt.contacts)
+			continue
+		}
+		for i := range contacts {
+			if contacts[i] != tt.contacts[i] {
+				t.Errorf("%s: contacts %v, want %v", tt.name, contacts, tt.contacts)
+				break
+			}
+		}
+	}
+}
+
+func TestExpiresIn(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		left time.Duration
+		want int
+	}{
+		{time.Hour, 3600},
+		{1500 * time.Millisecond, 2},
+		{time.Millisecond, 1},
+		{0, 0},
+		{-time.Second, 0},
+	}
+	for _, tt := range tests {
+		b := Binding{Expires: now.Add(tt.left)}
+		if got := b.ExpiresIn(now); got != tt.want {
+			t.Errorf("ExpiresIn with %v left = %d, want %d", tt.left, got, tt.want)
+		}
+	}
+}
+
+func TestApplyReceived(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		received time.Time
+		expires  time.Duration // From now, 0 if the binding is gone
+	}{
+		{"now", time.Time{}, time.Minute},
+		{"runs from when it was received", now.Add(-20 * time.Second), 40 * time.Second},
+		{"already lapsed when applied", now.Add(-2 * time.Minute), 0},
+		{"receive time in the future is ignored", now.Add(time.Hour), time.Minute},
+	}
+	for _, tt := range tests {
+		u := Update{CallID: "c1", CSeq: 1, Received: tt.received, Contacts: []Contact{{URI: "sip:a@10.0.0.1", Q: 1, Expires: 60}}}
+		got, err := Apply(nil, u, now)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if tt.expires == 0 {
+			if len(got) != 0 {
+				t.Errorf("%s: %d bindings, want none", tt.name, len(got))
+			}
+			continue
+		}
+		if len(got) != 1 || got[0].Expires.Sub(now) != tt.expires {
+			t.Errorf("%s: bindings %v, want one expiring in %v", tt.name, got, tt.expires)
+		}
+	}
+}
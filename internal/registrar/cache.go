@@ -0,0 +1,370 @@
+package registrar
+
+import (
+	"errors"
+	"log"
+	"nextgen-sip/pkg/utils"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Store is a shared registrar that can become unreachable
+type Store interface {
+	Lookup(tenantID string, aliases []string) (string, []Binding, error)
+	Bindings(aor string) ([]Binding, error)
+	Update(aor string, aliases []string, u Update) ([]Binding, error)
+	Registrations() ([]Registration, error)
+	Health() Health
+}
+
+// Health describes a registrar's connection to its store
+type Health struct {
+	Backend   string    `json:"backend"`
+	Healthy   bool      `json:"healthy"`
+	Degraded  bool      `json:"degraded"` // Serving from the local cache
+	Since     time.Time `json:"since"`    // When the store went down, zero if up
+	LastError string    `json:"last_error,omitempty"`
+	Buffered  int       `json:"buffered_writes"` // Updates waiting for replay
+	Cached    int       `json:"cached"`          // Lookups and records held locally
+}
+
+// CacheConfig tunes a CachedRegistrar
+type CacheConfig struct {
+	StaleFor      time.Duration // How long cached entries are served while the store is down
+	MaxBuffered   int           // Updates held for replay; the oldest are dropped beyond this
+	CheckInterval time.Duration // How often the store's health is probed
+}
+
+type cachedLookup struct {
+	aor      string
+	bindings []Binding
+	fetched  time.Time
+}
+
+type cachedRecord struct {
+	tenantID string
+	aliases  []string
+	bindings []Binding
+	fetched  time.Time
+}
+
+type pendingUpdate struct {
+	aor     string
+	aliases []string
+	u       Update
+}
+
+// CachedRegistrar fronts a shared store with a local copy of what it has
+// read and written. While the store is reachable every call goes through
+// to it. When a call fails the registrar turns degraded: lookups are
+// answered from entries younger than StaleFor and registrations are
+// applied locally and buffered, then replayed in order once the health
+// probe sees the store again. Degraded mode does not wait on the store, so
+// a Redis outage does not stall call setup.
+type CachedRegistrar struct {
+	store Store
+	cfg   CacheConfig
+
+	mu       sync.Mutex
+	lookups  map[string]cachedLookup // by tenant and joined aliases
+	records  map[string]cachedRecord // by AOR
+	aliases  map[string]string       // tenant:alias -> AOR, from updates seen here
+	pending  []pendingUpdate
+	degraded bool
+	since    time.Time
+	lastErr  error
+	done     chan struct{}
+}
+
+func NewCachedRegistrar(store Store, cfg CacheConfig) *CachedRegistrar {
+	c := &CachedRegistrar{
+		store:   store,
+		cfg:     cfg,
+		lookups: make(map[string]cachedLookup),
+		records: make(map[string]cachedRecord),
+		aliases: make(map[string]string),
+		done:    make(chan struct{}),
+	}
+	go c.healthLoop()
+	return c
+}
+
+// Close stops the health probe
+func (c *CachedRegistrar) Close() {
+	close(c.done)
+}
+
+func (c *CachedRegistrar) Lookup(tenantID string, aliases []string) (string, []Binding, error) {
+	scoped := aliasKeys(tenantID, aliases)
+	key := strings.Join(scoped, "\x00")
+	if !c.isDegraded() {
+		aor, bindings, err := c.store.Lookup(tenantID, aliases)
+		switch err {
+		case nil:
+			c.mu.Lock()
+			now := time.Now()
+			c.lookups[key] = cachedLookup{aor: aor, bindings: bindings, fetched: now}
+			c.mu.Unlock()
+			return aor, bindings, nil
+		case ErrNotFound:
+			c.mu.Lock()
+			delete(c.lookups, key)
+			c.mu.Unlock()
+			return "", nil, err
+		}
+		c.fail(err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	// Registrations made through this instance are the freshest
+	for _, k := range scoped {
+		if aor, ok := c.aliases[k]; ok {
+			if rec, ok := c.records[aor]; ok && c.fresh(rec.fetched, now) {
+				if bindings := Active(rec.bindings, now); len(bindings) > 0 {
+					return aor, bindings, nil
+				}
+			}
+		}
+	}
+	if l, ok := c.lookups[key]; ok && c.fresh(l.fetched, now) {
+		if bindings := Active(l.bindings, now); len(bindings) > 0 {
+			log.Printf("[Registrar] Serving cached lookup for %s (%s old)", l.aor, now.Sub(l.fetched).Round(time.Second))
+			return l.aor, bindings, nil
+		}
+	}
+	return "", nil, ErrNotFound
+}
+
+func (c *CachedRegistrar) Bindings(aor string) ([]Binding, error) {
+	if !c.isDegraded() {
+		bindings, err := c.store.Bindings(aor)
+		if err == nil {
+			return bindings, nil
+		}
+		c.fail(err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if rec, ok := c.records[aor]; ok && c.fresh(rec.fetched, now) {
+		return Active(rec.bindings, now), nil
+	}
+	return nil, nil
+}
+
+func (c *CachedRegistrar) Update(aor string, aliases []string, u Update) ([]Binding, error) {
+	if aliases == nil {
+		c.mu.Lock()
+		aliases = c.records[aor].aliases
+		c.mu.Unlock()
+	}
+	if !c.isDegraded() {
+		bindings, err := c.store.Update(aor, aliases, u)
+		if err == nil {
+			c.mu.Lock()
+			c.rememberLocked(aor, updateTenant(u, c.records[aor].tenantID), aliases, bindings)
+			c.mu.Unlock()
+			return bindings, nil
+		}
+		if err == ErrOutOfOrder {
+			return nil, err
+		}
+		c.fail(err)
+	}
+
+	// Apply locally against what we know and replay later. The update keeps
+	// the time it came in, so the replay grants no more than this does.
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if u.Received.IsZero() {
+		u.Received = time.Now()
+	}
+	bindings, err := Apply(c.records[aor].bindings, u, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	c.rememberLocked(aor, updateTenant(u, c.records[aor].tenantID), aliases, bindings)
+	c.pending = append(c.pending, pendingUpdate{aor: aor, aliases: aliases, u: u})
+	if over := len(c.pending) - c.cfg.MaxBuffered; c.cfg.MaxBuffered > 0 && over > 0 {
+		log.Printf("[Registrar] ✗ Write buffer full, dropping %d oldest update(s)", over)
+		c.pending = c.pending[over:]
+	}
+	utils.RegistrarBufferedWrites.Set(float64(len(c.pending)))
+	return bindings, nil
+}
+
+// Remove drops the binding of contact from aor, or all of its bindings
+// when contact is empty. While degraded the removal is buffered like any
+// other update.
+func (c *CachedRegistrar) Remove(aor, contact string) error {
+	_, err := c.Update(aor, nil, removal(contact))
+	return err
+}
+
+// Registrations lists the store's registrations, or while degraded the
+// ones this instance has seen recently
+func (c *CachedRegistrar) Registrations() ([]Registration, error) {
+	if !c.isDegraded() {
+		regs, err := c.store.Registrations()
+		if err == nil {
+			return regs, nil
+		}
+		c.fail(err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	var regs []Registration
+	for aor, rec := range c.records {
+		if !c.fresh(rec.fetched, now) {
+			continue
+		}
+		if bindings := Active(rec.bindings, now); len(bindings) > 0 {
+			regs = append(regs, Registration{AOR: aor, TenantID: rec.tenantID, Aliases: rec.aliases, Bindings: bindings})
+		}
+	}
+	return regs, nil
+}
+
+// Health probes the store and reports what is held locally
+func (c *CachedRegistrar) Health() Health {
+	h := c.store.Health()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	h.Degraded = c.degraded
+	h.Buffered = len(c.pending)
+	h.Cached = len(c.lookups) + len(c.records)
+	if c.degraded {
+		h.Since = c.since
+		if h.LastError == "" && c.lastErr != nil {
+			h.LastError = c.lastErr.Error()
+		}
+	}
+	return h
+}
+
+func (c *CachedRegistrar) rememberLocked(aor, tenantID string, aliases []string, bindings []Binding) {
+	keys := aliasKeys(tenantID, aliases)
+	if old, ok := c.records[aor]; ok {
+		for _, k := range without(aliasKeys(old.tenantID, old.aliases), keys) {
+			if c.aliases[k] == aor {
+				delete(c.aliases, k)
+			}
+		}
+	}
+	if len(bindings) == 0 {
+		for _, k := range keys {
+			if c.aliases[k] == aor {
+				delete(c.aliases, k)
+			}
+		}
+		delete(c.records, aor)
+		return
+	}
+	c.records[aor] = cachedRecord{tenantID: tenantID, aliases: aliases, bindings: bindings, fetched: time.Now()}
+	for _, k := range keys {
+		c.aliases[k] = aor
+	}
+}
+
+func (c *CachedRegistrar) fresh(fetched, now time.Time) bool {
+	return now.Sub(fetched) <= c.cfg.StaleFor
+}
+
+func (c *CachedRegistrar) isDegraded() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.degraded
+}
+
+// fail switches to degraded mode after a store error
+func (c *CachedRegistrar) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastErr = err
+	if !c.degraded {
+		c.degraded = true
+		c.since = time.Now()
+		utils.RegistrarDegraded.Set(1)
+		log.Printf("[Registrar] ✗ Store unavailable, serving from local cache: %v", err)
+	}
+}
+
+func (c *CachedRegistrar) healthLoop() {
+	ticker := time.NewTicker(c.cfg.CheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.check()
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// check probes the store, replays buffered updates once it is back and
+// prunes cache entries too old to be served
+func (c *CachedRegistrar) check() {
+	h := c.store.Health()
+	if !h.Healthy {
+		c.fail(errors.New(h.LastError))
+	} else if c.isDegraded() && c.replay() {
+		c.mu.Lock()
+		log.Printf("[Registrar] ✓ Store back after %s", time.Since(c.since).Round(time.Second))
+		c.degraded = false
+		c.since = time.Time{}
+		utils.RegistrarDegraded.Set(0)
+		c.mu.Unlock()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for key, l := range c.lookups {
+		if !c.fresh(l.fetched, now) {
+			delete(c.lookups, key)
+		}
+	}
+	for aor, rec := range c.records {
+		if !c.fresh(rec.fetched, now) || len(Active(rec.bindings, now)) == 0 {
+			c.rememberLocked(aor, rec.tenantID, rec.aliases, nil)
+		}
+	}
+}
+
+// replay sends the buffered updates to the store in order. It reports
+// whether all of them were delivered; the rest stay buffered.
+func (c *CachedRegistrar) replay() bool {
+	for {
+		c.mu.Lock()
+		if len(c.pending) == 0 {
+			c.mu.Unlock()
+			return true
+		}
+		p := c.pending[0]
+		c.mu.Unlock()
+
+		_, err := c.store.Update(p.aor, p.aliases, p.u)
+		if err != nil && err != ErrOutOfOrder {
+			c.mu.Lock()
+			c.lastErr = err
+			c.mu.Unlock()
+			log.Printf("[Registrar] ✗ Replay of %s failed: %v", p.aor, err)
+			return false
+		}
+		if err == ErrOutOfOrder {
+			log.Printf("[Registrar] Dropped buffered update of %s, superseded in the store", p.aor)
+		}
+
+		c.mu.Lock()
+		c.pending = c.pending[1:]
+		utils.RegistrarBufferedWrites.Set(float64(len(c.pending)))
+		c.mu.Unlock()
+	}
+}
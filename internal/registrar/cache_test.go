@@ -0,0 +1,245 @@
+package registrar
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+var errStoreDown = errors.New("connection refused")
+
+// flakyStore is a MemoryRegistrar that can be taken down
+type flakyStore struct {
+	*MemoryRegistrar
+	mu   sync.Mutex
+	down bool
+}
+
+func (s *flakyStore) setDown(down bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.down = down
+}
+
+func (s *flakyStore) isDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.down
+}
+
+func (s *flakyStore) Lookup(tenantID string, aliases []string) (string, []Binding, error) {
+	if s.isDown() {
+		return "", nil, errStoreDown
+	}
+	return s.MemoryRegistrar.Lookup(tenantID, aliases)
+}
+
+func (s *flakyStore) Bindings(aor string) ([]Binding, error) {
+	if s.isDown() {
+		return nil, errStoreDown
+	}
+	return s.MemoryRegistrar.Bindings(aor)
+}
+
+func (s *flakyStore) Update(aor string, aliases []string, u Update) ([]Binding, error) {
+	if s.isDown() {
+		return nil, errStoreDown
+	}
+	return s.MemoryRegistrar.Update(aor, aliases, u)
+}
+
+func (s *flakyStore) Registrations() ([]Registration, error) {
+	if s.isDown() {
+		return nil, errStoreDown
+	}
+	return s.MemoryRegistrar.Registrations()
+}
+
+func (s *flakyStore) Health() Health {
+	if s.isDown() {
+		return Health{Backend: "flaky", LastError: errStoreDown.Error()}
+	}
+	return Health{Backend: "flaky", Healthy: true}
+}
+
+func newCachedTest(cfg CacheConfig) (*flakyStore, *CachedRegistrar) {
+	store := &flakyStore{MemoryRegistrar: NewMemoryRegistrar(time.Hour)}
+	// The tests probe the store themselves
+	cfg.CheckInterval = time.Hour
+	return store, NewCachedRegistrar(store, cfg)
+}
+
+func TestCachedDegradedLookup(t *testing.T) {
+	tests := []struct {
+		name     string
+		staleFor time.Duration
+		alias    string
+		found    bool
+	}{
+		{"registered here", time.Minute, "100", true},
+		{"looked up before the outage", time.Minute, "200", true},
+		{"never seen", time.Minute, "300", false},
+		{"registered here, too old", 0, "100", false},
+		{"looked up before the outage, too old", 0, "200", false},
+	}
+	for _, tt := range tests {
+		store, c := newCachedTest(CacheConfig{StaleFor: tt.staleFor})
+		register(t, c, "sip:100@example.com", "acme", []string{"100"}, Contact{URI: "sip:100@10.0.0.1", Q: 1, Expires: 60})
+		register(t, store, "sip:200@example.com", "acme", []string{"200"}, Contact{URI: "sip:200@10.0.0.2", Q: 1, Expires: 60})
+		register(t, store, "sip:300@example.com", "acme", []string{"300"}, Contact{URI: "sip:300@10.0.0.3", Q: 1, Expires: 60})
+		if _, _, err := c.Lookup("acme", []string{"200"}); err != nil {
+			t.Fatalf("%s: lookup while up: %v", tt.name, err)
+		}
+
+		store.setDown(true)
+		aor, bindings, err := c.Lookup("acme", []string{tt.alias})
+		if tt.found != (err == nil) {
+			t.Errorf("%s: Lookup = %s, %v; want found=%v", tt.name, aor, err, tt.found)
+		}
+		if tt.found && (aor != "sip:"+tt.alias+"@example.com" || len(bindings) != 1) {
+			t.Errorf("%s: Lookup = %s with %d bindings", tt.name, aor, len(bindings))
+		}
+		if _, _, err := c.Lookup("beta", []string{tt.alias}); err != ErrNotFound {
+			t.Errorf("%s: found in another tenant: %v", tt.name, err)
+		}
+		if h := c.Health(); !h.Degraded || h.Healthy {
+			t.Errorf("%s: health %+v, want degraded", tt.name, h)
+		}
+		c.Close()
+		store.Close()
+	}
+}
+
+func TestCachedReplay(t *testing.T) {
+	store, c := newCachedTest(CacheConfig{StaleFor: time.Minute})
+	defer store.Close()
+	defer c.Close()
+	register(t, c, "sip:100@example.com", "acme", []string{"100"}, Contact{URI: "sip:100@10.0.0.1", Q: 1, Expires: 60})
+
+	store.setDown(true)
+	c.check()
+	updates := []struct {
+		aor, alias string
+		u          Update
+	}{
+		{"sip:200@example.com", "200", Update{CallID: "r2", CSeq: 1, TenantID: "acme", Contacts: []Contact{{URI: "sip:200@10.0.0.2", Q: 1, Expires: 60}}}},
+		{"sip:200@example.com", "200", Update{CallID: "r2", CSeq: 2, Contacts: []Contact{{URI: "sip:200@10.0.0.9", Q: 1, Expires: 60}}}},
+		{"sip:100@example.com", "100", removal("")},
+	}
+	for i, up := range updates {
+		if _, err := c.Update(up.aor, []string{up.alias}, up.u); err != nil {
+			t.Fatalf("update %d while down: %v", i, err)
+		}
+	}
+	if h := c.Health(); h.Buffered != len(updates) {
+		t.Errorf("buffered %d, want %d", h.Buffered, len(updates))
+	}
+	c.mu.Lock()
+	for i, p := range c.pending {
+		if p.u.Received.IsZero() {
+			t.Errorf("buffered update %d has no receive time", i)
+		}
+	}
+	c.mu.Unlock()
+	if bindings, _ := store.MemoryRegistrar.Bindings("sip:200@example.com"); len(bindings) != 0 {
+		t.Errorf("store changed while down: %v", bindings)
+	}
+
+	// Still down: nothing is replayed
+	c.check()
+	if h := c.Health(); !h.Degraded || h.Buffered != len(updates) {
+		t.Errorf("health while down %+v", h)
+	}
+
+	store.setDown(false)
+	c.check()
+	if h := c.Health(); h.Degraded || h.Buffered != 0 {
+		t.Errorf("health after replay %+v", h)
+	}
+	tests := []struct {
+		aor      string
+		contacts []string
+	}{
+		{"sip:100@example.com", nil},
+		{"sip:200@example.com", []string{"sip:200@10.0.0.2", "sip:200@10.0.0.9"}},
+	}
+	for _, tt := range tests {
+		bindings, _ := store.MemoryRegistrar.Bindings(tt.aor)
+		if len(bindings) != len(tt.contacts) {
+			t.Errorf("%s after replay: %v, want %v", tt.aor, bindings, tt.contacts)
+			continue
+		}
+		want := make(map[string]bool)
+		for _, c := range tt.contacts {
+			want[c] = true
+		}
+		for _, b := range bindings {
+			if !want[b.Contact] {
+				t.Errorf("%s after replay: unexpected %s", tt.aor, b.Contact)
+			}
+		}
+	}
+	if aor, _, err := store.MemoryRegistrar.Lookup("acme", []string{"200"}); err != nil || aor != "sip:200@example.com" {
+		t.Errorf("alias after replay: %s, %v", aor, err)
+	}
+}
+
+func TestCachedReplayOutOfOrder(t *testing.T) {
+	store, c := newCachedTest(CacheConfig{StaleFor: time.Minute})
+	defer store.Close()
+	defer c.Close()
+
+	store.setDown(true)
+	c.check()
+	stale := Update{CallID: "r1", CSeq: 1, TenantID: "acme", Contacts: []Contact{{URI: "sip:100@10.0.0.1", Q: 1, Expires: 60}}}
+	if _, err := c.Update("sip:100@example.com", []string{"100"}, stale); err != nil {
+		t.Fatal(err)
+	}
+	// Another proxy got a newer REGISTER of the same Call-ID to the store
+	newer := Update{CallID: "r1", CSeq: 5, TenantID: "acme", Contacts: []Contact{{URI: "sip:100@10.0.0.1", Q: 1, Expires: 300}}}
+	if _, err := store.MemoryRegistrar.Update("sip:100@example.com", []string{"100"}, newer); err != nil {
+		t.Fatal(err)
+	}
+
+	store.setDown(false)
+	c.check()
+	if h := c.Health(); h.Degraded || h.Buffered != 0 {
+		t.Errorf("health after replay %+v", h)
+	}
+	bindings, _ := store.MemoryRegistrar.Bindings("sip:100@example.com")
+	if len(bindings) != 1 || bindings[0].CSeq != 5 {
+		t.Errorf("superseded update overwrote the store: %v", bindings)
+	}
+}
+
+func TestCachedBufferLimit(t *testing.T) {
+	tests := []struct {
+		max, updates, buffered int
+		first                  uint32 // CSeq of the oldest update kept
+	}{
+		{0, 5, 5, 1},
+		{10, 5, 5, 1},
+		{3, 5, 3, 3},
+		{1, 5, 1, 5},
+	}
+	for _, tt := range tests {
+		store, c := newCachedTest(CacheConfig{StaleFor: time.Minute, MaxBuffered: tt.max})
+		store.setDown(true)
+		c.check()
+		for i := 1; i <= tt.updates; i++ {
+			u := Update{CallID: "r1", CSeq: uint32(i), Contacts: []Contact{{URI: "sip:100@10.0.0.1", Q: 1, Expires: 60}}}
+			if _, err := c.Update("sip:100@example.com", []string{"100"}, u); err != nil {
+				t.Fatal(err)
+			}
+		}
+		c.mu.Lock()
+		buffered, first := len(c.pending), c.pending[0].u.CSeq
+		c.mu.Unlock()
+		if buffered != tt.buffered || first != tt.first {
+			t.Errorf("max %d: %d buffered from CSeq %d, want %d from %d", tt.max, buffered, first, tt.buffered, tt.first)
+		}
+		c.Close()
+		store.Close()
+	}
+}
@@ -0,0 +1,176 @@
+package registrar
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// MemoryRegistrar keeps registrations in process, for single-node
+// deployments and tests that run without Redis. It follows the same
+// binding and alias rules as RedisRegistrar; expired bindings are swept
+// in the background.
+type MemoryRegistrar struct {
+	mu      sync.RWMutex
+	records map[string]*Registration // by AOR
+	aliases map[string]string        // tenant:alias -> AOR
+	done    chan struct{}
+}
+
+// NewMemoryRegistrar starts a registrar that sweeps expired bindings every
+// sweep interval
+func NewMemoryRegistrar(sweep time.Duration) *MemoryRegistrar {
+	r := &MemoryRegistrar{
+		records: make(map[string]*Registration),
+		aliases: make(map[string]string),
+		done:    make(chan struct{}),
+	}
+	go r.sweepLoop(sweep)
+	return r
+}
+
+// Close stops the sweeper
+func (r *MemoryRegistrar) Close() {
+	close(r.done)
+}
+
+// Update applies the changes of one REGISTER to the bindings of aor,
+// indexes aor under aliases and returns the bindings now in effect. Nil
+// aliases keep those already indexed.
+func (r *MemoryRegistrar) Update(aor string, aliases []string, u Update) ([]Binding, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	rec, ok := r.records[aor]
+	if !ok {
+		rec = &Registration{AOR: aor}
+	}
+	bindings, err := Apply(rec.Bindings, u, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	tenantID := updateTenant(u, rec.TenantID)
+	if aliases == nil {
+		aliases = rec.Aliases
+	}
+	if len(bindings) == 0 {
+		aliases = nil
+	}
+	keys := aliasKeys(tenantID, aliases)
+	r.unindexLocked(aor, without(aliasKeys(rec.TenantID, rec.Aliases), keys))
+
+	if len(bindings) == 0 {
+		delete(r.records, aor)
+	} else {
+		rec.TenantID = tenantID
+		rec.Aliases = append([]string(nil), aliases...)
+		rec.Bindings = bindings
+		r.records[aor] = rec
+		for _, k := range keys {
+			r.aliases[k] = aor
+		}
+	}
+	log.Printf("[Registrar] %s now has %d binding(s), %d alias(es)", aor, len(bindings), len(aliases))
+	return bindings, nil
+}
+
+// Remove drops the binding of contact from aor, or all of its bindings
+// when contact is empty
+func (r *MemoryRegistrar) Remove(aor, contact string) error {
+	_, err := r.Update(aor, nil, removal(contact))
+	return err
+}
+
+// Registrations returns every AOR with unexpired bindings
+func (r *MemoryRegistrar) Registrations() ([]Registration, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	now := time.Now()
+	regs := make([]Registration, 0, len(r.records))
+	for _, rec := range r.records {
+		if bindings := Active(rec.Bindings, now); len(bindings) > 0 {
+			regs = append(regs, Registration{AOR: rec.AOR, TenantID: rec.TenantID, Aliases: rec.Aliases, Bindings: bindings})
+		}
+	}
+	return regs, nil
+}
+
+// Bindings returns the unexpired bindings of aor, most preferred first
+func (r *MemoryRegistrar) Bindings(aor string) ([]Binding, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	rec, ok := r.records[aor]
+	if !ok {
+		return nil, nil
+	}
+	return Active(rec.Bindings, time.Now()), nil
+}
+
+// Lookup returns the AOR and bindings of the first alias registered in the
+// tenant, or ErrNotFound
+func (r *MemoryRegistrar) Lookup(tenantID string, aliases []string) (string, []Binding, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	now := time.Now()
+	for _, k := range aliasKeys(tenantID, aliases) {
+		aor, ok := r.aliases[k]
+		if !ok {
+			continue
+		}
+		if rec, ok := r.records[aor]; ok {
+			if bindings := Active(rec.Bindings, now); len(bindings) > 0 {
+				return aor, bindings, nil
+			}
+		}
+	}
+	return "", nil, ErrNotFound
+}
+
+// Health reports the registrar as always reachable
+func (r *MemoryRegistrar) Health() Health {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return Health{Backend: "memory", Healthy: true, Cached: len(r.records)}
+}
+
+func (r *MemoryRegistrar) sweepLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.sweep(time.Now())
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// sweep drops expired bindings, and the records and aliases left empty
+func (r *MemoryRegistrar) sweep(now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	expired := 0
+	for aor, rec := range r.records {
+		active := Active(rec.Bindings, now)
+		expired += len(rec.Bindings) - len(active)
+		if len(active) == 0 {
+			r.unindexLocked(aor, aliasKeys(rec.TenantID, rec.Aliases))
+			delete(r.records, aor)
+			continue
+		}
+		rec.Bindings = active
+	}
+	if expired > 0 {
+		log.Printf("[Registrar] Swept %d expired binding(s)", expired)
+	}
+}
+
+// unindexLocked removes the tenant-scoped aliases that still name aor
+func (r *MemoryRegistrar) unindexLocked(aor string, scoped []string) {
+	for _, k := range scoped {
+		if r.aliases[k] == aor {
+			delete(r.aliases, k)
+		}
+	}
+}
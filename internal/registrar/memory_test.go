@@ -0,0 +1,109 @@
+package registrar
+
+import (
+	"testing"
+	"time"
+)
+
+// testCSeq numbers the REGISTERs of the tests, so that none is out of order
+var testCSeq uint32
+
+func register(t *testing.T, r Store, aor, tenantID string, aliases []string, contacts ...Contact) {
+	t.Helper()
+	testCSeq++
+	u := Update{CallID: aor, CSeq: testCSeq, TenantID: tenantID, Contacts: contacts}
+	if _, err := r.Update(aor, aliases, u); err != nil {
+		t.Fatalf("register %s: %v", aor, err)
+	}
+}
+
+func TestMemoryLookup(t *testing.T) {
+	r := NewMemoryRegistrar(time.Hour)
+	defer r.Close()
+	register(t, r, "sip:100@acme.example", "acme", []string{"sip:100@acme.example", "+15550100"},
+		Contact{URI: "sip:100@10.0.0.1", Q: 1, Expires: 60})
+	register(t, r, "sip:100@beta.example", "beta", []string{"sip:100@beta.example", "+15550100"},
+		Contact{URI: "sip:100@10.0.0.2", Q: 1, Expires: 60})
+
+	tests := []struct {
+		name    string
+		tenant  string
+		aliases []string
+		aor     string
+	}{
+		{"by AOR", "acme", []string{"sip:100@acme.example"}, "sip:100@acme.example"},
+		{"by number", "acme", []string{"+15550100"}, "sip:100@acme.example"},
+		{"same number in another tenant", "beta", []string{"+15550100"}, "sip:100@beta.example"},
+		{"first alias that is registered", "beta", []string{"+15550199", "+15550100"}, "sip:100@beta.example"},
+		{"AOR of another tenant", "beta", []string{"sip:100@acme.example"}, ""},
+		{"unknown tenant", "gamma", []string{"+15550100"}, ""},
+		{"unknown alias", "acme", []string{"+15550199"}, ""},
+	}
+	for _, tt := range tests {
+		aor, bindings, err := r.Lookup(tt.tenant, tt.aliases)
+		if tt.aor == "" {
+			if err != ErrNotFound {
+				t.Errorf("%s: Lookup = %s, %v; want ErrNotFound", tt.name, aor, err)
+			}
+			continue
+		}
+		if err != nil || aor != tt.aor || len(bindings) != 1 {
+			t.Errorf("%s: Lookup = %s, %d bindings, %v; want %s", tt.name, aor, len(bindings), err, tt.aor)
+		}
+	}
+
+	// Re-registering with other aliases drops the old ones
+	register(t, r, "sip:100@acme.example", "acme", []string{"sip:100@acme.example", "+15550111"},
+		Contact{URI: "sip:100@10.0.0.1", Q: 1, Expires: 60})
+	if _, _, err := r.Lookup("acme", []string{"+15550100"}); err != ErrNotFound {
+		t.Errorf("old alias still found: %v", err)
+	}
+	if aor, _, err := r.Lookup("acme", []string{"+15550111"}); err != nil || aor != "sip:100@acme.example" {
+		t.Errorf("new alias: %s, %v", aor, err)
+	}
+
+	// Removing the last binding unindexes the AOR
+	if err := r.Remove("sip:100@beta.example", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := r.Lookup("beta", []string{"+15550100"}); err != ErrNotFound {
+		t.Errorf("removed AOR still found: %v", err)
+	}
+}
+
+func TestMemorySweep(t *testing.T) {
+	r := NewMemoryRegistrar(time.Hour)
+	defer r.Close()
+	register(t, r, "sip:a@example.com", "acme", []string{"sip:a@example.com", "a"},
+		Contact{URI: "sip:a@10.0.0.1", Q: 1, Expires: 60},
+		Contact{URI: "sip:a@10.0.0.2", Q: 1, Expires: 3600})
+	register(t, r, "sip:b@example.com", "acme", []string{"sip:b@example.com", "b"},
+		Contact{URI: "sip:b@10.0.0.3", Q: 1, Expires: 60})
+
+	now := time.Now()
+	tests := []struct {
+		after    time.Duration
+		records  int
+		aliases  int
+		bindings int // Of sip:a
+	}{
+		{0, 2, 4, 2},
+		{30 * time.Second, 2, 4, 2},
+		{2 * time.Minute, 1, 2, 1},
+		{2 * time.Hour, 0, 0, 0},
+	}
+	for _, tt := range tests {
+		r.sweep(now.Add(tt.after))
+		r.mu.RLock()
+		records, aliases := len(r.records), len(r.aliases)
+		bindings := 0
+		if rec, ok := r.records["sip:a@example.com"]; ok {
+			bindings = len(rec.Bindings)
+		}
+		r.mu.RUnlock()
+		if records != tt.records || aliases != tt.aliases || bindings != tt.bindings {
+			t.Errorf("sweep after %v: %d records, %d aliases, %d bindings of a; want %d, %d, %d",
+				tt.after, records, aliases, bindings, tt.records, tt.aliases, tt.bindings)
+		}
+	}
+}
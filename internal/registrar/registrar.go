@@ -2,6 +2,7 @@ package registrar
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"log"
 	"time"
@@ -9,6 +10,32 @@ import (
 	"github.com/go-redis/redis/v8"
 )
 
+// Each address-of-record is one key, registrar:aor:<aor>, holding its
+// bindings and aliases as JSON. Every alias (see router.addressAliases) is
+// a key registrar:alias:<tenant>:<alias> naming the AOR, scoped to the
+// tenant of the subscriber who registered it. Both expire with the last
+// binding.
+const (
+	aorKeyPrefix   = "registrar:aor:"
+	aliasKeyPrefix = "registrar:alias:"
+)
+
+// lookupScript resolves the alias keys in KEYS, in order, and returns the
+// first AOR record found, so a lookup is one round trip however many
+// aliases a number has
+var lookupScript = redis.NewScript(`
+for _, key in ipairs(KEYS) do
+	local aor = redis.call('GET', key)
+	if aor then
+		local rec = redis.call('GET', ARGV[1] .. aor)
+		if rec then
+			return rec
+		end
+	end
+end
+return false
+`)
+
 type RedisRegistrar struct {
 	rdb *redis.Client
 	ctx context.Context
@@ -31,19 +58,221 @@ func NewRedisRegistrar(addr string) *RedisRegistrar {
 	}
 }
 
-func (r *RedisRegistrar) Register(uri string, contact string) error {
-	key := fmt.Sprintf("reg:%s", uri)
-	log.Printf("[Registrar] Storing %s => %s", key, contact)
-	return r.rdb.Set(r.ctx, key, contact, 1*time.Hour).Err()
+// Update applies the changes of one REGISTER to the bindings of aor,
+// indexes aor under aliases and returns the bindings now in effect. Nil
+// aliases keep those already indexed. When the last binding goes, the
+// record and all its aliases go with it. The aliases are those of the
+// update's tenant, or of the one already indexed when it names none.
+// Concurrent updates of the same AOR are retried, so none is lost.
+func (r *RedisRegistrar) Update(aor string, aliases []string, u Update) ([]Binding, error) {
+	key := aorKeyPrefix + aor
+	var bindings []Binding
+	var indexed []string
+	txf := func(tx *redis.Tx) error {
+		rec, err := r.load(tx, key)
+		if err != nil {
+			return err
+		}
+		if bindings, err = Apply(rec.Bindings, u, time.Now()); err != nil {
+			return err
+		}
+		tenantID := updateTenant(u, rec.TenantID)
+		indexed = aliases
+		if indexed == nil {
+			indexed = rec.Aliases
+		}
+		if len(bindings) == 0 {
+			indexed = nil
+		}
+		keys := aliasKeys(tenantID, indexed)
+		stale, err := r.ownedAliases(tx, aor, without(aliasKeys(rec.TenantID, rec.Aliases), keys))
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.TxPipelined(r.ctx, func(pipe redis.Pipeliner) error {
+			if len(stale) > 0 {
+				pipe.Del(r.ctx, stale...)
+			}
+			if len(bindings) == 0 {
+				pipe.Del(r.ctx, key)
+				return nil
+			}
+			data, err := json.Marshal(Registration{AOR: aor, TenantID: tenantID, Aliases: indexed, Bindings: bindings})
+			if err != nil {
+				return err
+			}
+			expires := lastExpiry(bindings)
+			pipe.Set(r.ctx, key, data, 0)
+			pipe.PExpireAt(r.ctx, key, expires)
+			for _, k := range keys {
+				pipe.Set(r.ctx, aliasKeyPrefix+k, aor, 0)
+				pipe.PExpireAt(r.ctx, aliasKeyPrefix+k, expires)
+			}
+			return nil
+		})
+		return err
+	}
+
+	for i := 0; i < 5; i++ {
+		err := r.rdb.Watch(r.ctx, txf, key)
+		if err != redis.TxFailedErr {
+			if err == nil {
+				log.Printf("[Registrar] %s now has %d binding(s), %d alias(es)", aor, len(bindings), len(indexed))
+			}
+			return bindings, err
+		}
+	}
+	return nil, fmt.Errorf("update of %s kept conflicting", aor)
+}
+
+// ownedAliases watches the keys of the tenant-scoped aliases and returns
+// those that still name aor; an alias taken over by another AOR is left
+// alone
+func (r *RedisRegistrar) ownedAliases(tx *redis.Tx, aor string, scoped []string) ([]string, error) {
+	if len(scoped) == 0 {
+		return nil, nil
+	}
+	keys := make([]string, len(scoped))
+	for i, k := range scoped {
+		keys[i] = aliasKeyPrefix + k
+	}
+	if err := tx.Watch(r.ctx, keys...).Err(); err != nil {
+		return nil, err
+	}
+	vals, err := tx.MGet(r.ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	owned := keys[:0]
+	for i, v := range vals {
+		if s, ok := v.(string); ok && s == aor {
+			owned = append(owned, keys[i])
+		}
+	}
+	return owned, nil
+}
+
+// Health pings Redis
+func (r *RedisRegistrar) Health() Health {
+	ctx, cancel := context.WithTimeout(r.ctx, 2*time.Second)
+	defer cancel()
+	h := Health{Backend: "redis", Healthy: true}
+	if err := r.rdb.Ping(ctx).Err(); err != nil {
+		h.Healthy = false
+		h.LastError = err.Error()
+	}
+	return h
 }
 
-func (r *RedisRegistrar) Lookup(uri string) (string, error) {
-	key := fmt.Sprintf("reg:%s", uri)
-	val, err := r.rdb.Get(r.ctx, key).Result()
+// Remove drops the binding of contact from aor, or all of its bindings
+// when contact is empty
+func (r *RedisRegistrar) Remove(aor, contact string) error {
+	_, err := r.Update(aor, nil, removal(contact))
+	return err
+}
+
+// Registrations returns every AOR with unexpired bindings
+func (r *RedisRegistrar) Registrations() ([]Registration, error) {
+	var keys []string
+	iter := r.rdb.Scan(r.ctx, 0, aorKeyPrefix+"*", 500).Iterator()
+	for iter.Next(r.ctx) {
+		keys = append(keys, iter.Val())
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+
+	var regs []Registration
+	now := time.Now()
+	for start := 0; start < len(keys); start += 500 {
+		end := start + 500
+		if end > len(keys) {
+			end = len(keys)
+		}
+		vals, err := r.rdb.MGet(r.ctx, keys[start:end]...).Result()
+		if err != nil {
+			return nil, err
+		}
+		for i, v := range vals {
+			data, ok := v.(string)
+			if !ok {
+				continue // Expired since the scan
+			}
+			var rec Registration
+			if err := json.Unmarshal([]byte(data), &rec); err != nil {
+				log.Printf("[Registrar] ✗ Skipping corrupt record %s: %v", keys[start+i], err)
+				continue
+			}
+			if rec.Bindings = Active(rec.Bindings, now); len(rec.Bindings) > 0 {
+				regs = append(regs, rec)
+			}
+		}
+	}
+	return regs, nil
+}
+
+// Bindings returns the unexpired bindings of aor, most preferred first
+func (r *RedisRegistrar) Bindings(aor string) ([]Binding, error) {
+	rec, err := r.load(r.rdb, aorKeyPrefix+aor)
+	if err != nil {
+		return nil, err
+	}
+	return Active(rec.Bindings, time.Now()), nil
+}
+
+// Lookup returns the AOR and bindings of the first alias registered in the
+// tenant, or ErrNotFound
+func (r *RedisRegistrar) Lookup(tenantID string, aliases []string) (string, []Binding, error) {
+	keys := aliasKeys(tenantID, aliases)
+	for i, k := range keys {
+		keys[i] = aliasKeyPrefix + k
+	}
+	data, err := lookupScript.Run(r.ctx, r.rdb, keys, aorKeyPrefix).Text()
 	if err == redis.Nil {
-		return "", fmt.Errorf("user %s not found", uri)
+		return "", nil, ErrNotFound
 	} else if err != nil {
-		return "", err
+		return "", nil, err
+	}
+	var rec Registration
+	if err := json.Unmarshal([]byte(data), &rec); err != nil {
+		return "", nil, fmt.Errorf("corrupt registration record: %w", err)
+	}
+	bindings := Active(rec.Bindings, time.Now())
+	if len(bindings) == 0 {
+		return "", nil, ErrNotFound
+	}
+	return rec.AOR, bindings, nil
+}
+
+func (r *RedisRegistrar) load(c redis.Cmdable, key string) (Registration, error) {
+	var rec Registration
+	data, err := c.Get(r.ctx, key).Bytes()
+	if err == redis.Nil {
+		return rec, nil
+	} else if err != nil {
+		return rec, err
+	}
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return rec, fmt.Errorf("corrupt bindings in %s: %w", key, err)
+	}
+	return rec, nil
+}
+
+// without returns the entries of list that are not in drop
+func without(list, drop []string) []string {
+	var out []string
+	for _, s := range list {
+		found := false
+		for _, d := range drop {
+			if s == d {
+				found = true
+				break
+			}
+		}
+		if !found {
+			out = append(out, s)
+		}
 	}
-	return val, nil
+	return out
 }
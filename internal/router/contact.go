@@ -0,0 +1,77 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/emiago/sipgo/sip"
+)
+
+// ErrContactList rejects a Contact header listing several addresses.
+// sipgo splits such a list at the wrong commas and lets parameters run
+// into the next address, so "Contact: <a>;q=0.5, <b>" would bind a with
+// the wrong parameters. The raw text is gone by the time we see it, so the
+// list is refused rather than guessed at; one Contact header per address
+// is read correctly.
+var ErrContactList = errors.New("comma-separated Contact list")
+
+// Contacts returns every Contact of a request or response, one per address
+func Contacts(msg sip.Message) ([]*sip.ContactHeader, error) {
+	var list []*sip.ContactHeader
+	for _, h := range msg.GetHeaders("Contact") {
+		if c, ok := h.(*sip.ContactHeader); ok {
+			if misSplit(c) {
+				return nil, ErrContactList
+			}
+			list = append(list, c)
+			continue
+		}
+		// Built by us rather than parsed by sipgo
+		for _, text := range splitContacts(h.Value()) {
+			c := &sip.ContactHeader{Params: sip.NewParams()}
+			name, err := sip.ParseAddressValue(text, &c.Address, c.Params)
+			if err != nil {
+				return nil, fmt.Errorf("invalid Contact %q: %w", text, err)
+			}
+			c.DisplayName = name
+			list = append(list, c)
+		}
+	}
+	return list, nil
+}
+
+// misSplit reports whether sipgo parsed c out of a comma-separated list:
+// the rest of the list then ends up in its parameter names or values,
+// where no comma belongs
+func misSplit(c *sip.ContactHeader) bool {
+	for _, params := range []sip.HeaderParams{c.Params, c.Address.UriParams} {
+		for k, v := range params {
+			if strings.Contains(k, ",") || strings.Contains(v, ",") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// splitContacts splits a Contact header value at commas outside quotes
+// and angle brackets
+func splitContacts(text string) []string {
+	var parts []string
+	inQuotes, inBrackets, start := false, false, 0
+	for i, c := range text {
+		switch {
+		case c == '"':
+			inQuotes = !inQuotes
+		case c == '<' && !inQuotes:
+			inBrackets = true
+		case c == '>' && !inQuotes:
+			inBrackets = false
+		case c == ',' && !inQuotes && !inBrackets:
+			parts = append(parts, strings.TrimSpace(text[start:i]))
+			start = i + 1
+		}
+	}
+	return append(parts, strings.TrimSpace(text[start:]))
+}
@@ -0,0 +1,98 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/emiago/sipgo/sip"
+)
+
+var (
+	// ErrNoDialog means an in-dialog request is for no dialog we
+	// Record-Routed (481 Call/Transaction Does Not Exist)
+	ErrNoDialog = errors.New("no dialog of ours")
+	// ErrForeignRoute means an out-of-dialog request was preloaded with
+	// hops past us, which we do not relay to (403 Forbidden)
+	ErrForeignRoute = errors.New("route set past this proxy")
+)
+
+// RecordRoute builds the Record-Route header this proxy inserts on
+// dialog-creating requests so that it stays on the path of the dialog
+func (e *RoutingEngine) RecordRoute(transport string) *sip.RecordRouteHeader {
+	uri := sip.Uri{
+		Host:      e.local.Host,
+		Port:      e.local.Port,
+		UriParams: sip.NewParams(),
+		Headers:   sip.NewParams(),
+	}
+	uri.UriParams.Add("transport", strings.ToLower(transport))
+	uri.UriParams.Add("lr", "")
+	return &sip.RecordRouteHeader{Address: uri}
+}
+
+// IsLocal reports whether uri addresses this proxy
+func (e *RoutingEngine) IsLocal(uri sip.Uri) bool {
+	if !strings.EqualFold(uri.Host, e.local.Host) {
+		return false
+	}
+	port := uri.Port
+	if port == 0 {
+		port = 5060
+	}
+	localPort := e.local.Port
+	if localPort == 0 {
+		localPort = 5060
+	}
+	return port == localPort
+}
+
+// routeInDialog implements loose routing (RFC 3261 section 16.4 and 16.6)
+// for dialogs we Record-Routed. Our own entries are popped off the Route
+// set, and one naming a flow of ours sends the request down it; otherwise
+// an in-dialog request goes to the next Route hop or the remote target in
+// the Request-URI. A To tag whose Route set does not start with us, or an
+// out-of-dialog request preloaded with hops past us, is not routed, as
+// that would relay it anywhere the sender asks. ok is false for an
+// out-of-dialog request that needs a registrar lookup.
+func (e *RoutingEngine) routeInDialog(req *sip.Request) (string, bool, error) {
+	_, inDialog := req.To().Params.Get("tag")
+	if rh := req.Route(); inDialog && (rh == nil || !e.IsLocal(rh.Address)) {
+		return "", false, ErrNoDialog
+	}
+	if dest, ok, err := e.popLocalRoutes(req); err != nil || ok {
+		return dest, ok, err
+	}
+
+	if rh := req.Route(); rh != nil {
+		if !inDialog {
+			return "", false, ErrForeignRoute
+		}
+		return nextHop(req, rh.Address), true, nil
+	}
+
+	if inDialog {
+		return nextHop(req, req.Recipient), true, nil
+	}
+	return "", false, nil
+}
+
+// nextHop returns the address of hop and switches req to the transport
+// hop asks for, which may differ from the one req came in on
+func nextHop(req *sip.Request, hop sip.Uri) string {
+	if hop.UriParams != nil {
+		if t, ok := hop.UriParams.Get("transport"); ok && t != "" {
+			req.SetTransport(strings.ToUpper(t))
+		}
+	}
+	return HostPort(hop, req.Transport())
+}
+
+// HostPort returns the host:port to send to for uri, filling in the default port
+func HostPort(uri sip.Uri, transport string) string {
+	port := uri.Port
+	if port == 0 {
+		port = sip.DefaultPort(transport)
+	}
+	return fmt.Sprintf("%s:%d", uri.Host, port)
+}
@@ -0,0 +1,87 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"nextgen-sip/internal/did"
+	"time"
+
+	"github.com/emiago/sipgo/sip"
+)
+
+// ErrNotOurDID means a call from a carrier is for no DID in the inventory
+// (404 Not Found); carriers never reach subscribers or trunks otherwise
+var ErrNotOurDID = errors.New("not one of our DIDs")
+
+// lookupDID finds the DID of ours req is for, by its To user and failing
+// that its Request-URI user, which carriers sending calls to a
+// registration may set to the DID instead
+func (e *RoutingEngine) lookupDID(req *sip.Request, tenantID string) (did.DID, bool) {
+	if e.dids == nil {
+		return did.DID{}, false
+	}
+	for _, user := range []string{extractUser(req.To().Address.String()), req.Recipient.User} {
+		if d, ok := e.dids.Get(e.plans.Normalize(tenantID, user)); ok {
+			return d, true
+		}
+	}
+	return did.DID{}, false
+}
+
+// toDID retargets req where the inventory sends calls to d, asking its
+// webhook first if it has one. The call is one of d's tenant.
+func (e *RoutingEngine) toDID(req *sip.Request, d did.DID) (Target, error) {
+	target := d.Target
+	if target.Type == did.TargetWebhook {
+		ctx, cancel := context.WithTimeout(context.Background(), e.hooks.Timeout)
+		defer cancel()
+		answer, err := did.Ask(ctx, e.hooks, target.URL, did.Call{
+			DID:      d.Number,
+			TenantID: d.TenantID,
+			From:     req.From().Address.String(),
+			To:       req.To().Address.String(),
+			CallID:   req.CallID().Value(),
+		})
+		if err != nil {
+			log.Printf("[Router] ✗ DID %s webhook %s: %v", d.Number, target.URL, err)
+			return Target{}, fmt.Errorf("DID %s webhook: %w", d.Number, err)
+		}
+		target = answer
+	}
+
+	t := Target{TenantID: d.TenantID}
+	switch target.Type {
+	case did.TargetSubscriber:
+		dest, err := e.toSubscriber(req, target.Subscriber, d.TenantID)
+		if err != nil {
+			return Target{}, err
+		}
+		log.Printf("[Router] ✓ DID %s => %s (%s %s)", d.Number, target.Subscriber, req.Transport(), dest)
+		t.Dest = dest
+		return t, nil
+
+	case did.TargetRingGroup:
+		t.group = true
+		t.members = target.Members
+		t.Ring = time.Duration(target.RingTimeout) * time.Second
+		log.Printf("[Router] DID %s rings group %v", d.Number, target.Members)
+		next, ok := e.Next(req, t)
+		if !ok {
+			return Target{}, fmt.Errorf("no member of DID %s's ring group is registered", d.Number)
+		}
+		return next, nil
+
+	case did.TargetForward:
+		number := e.plans.Normalize(d.TenantID, target.Number)
+		log.Printf("[Router] DID %s forwards to %s", d.Number, number)
+		t, ok := e.offNet(req, d.TenantID, number)
+		if !ok {
+			return Target{}, fmt.Errorf("DID %s forwards to %s, which no trunk takes", d.Number, number)
+		}
+		t.TenantID, t.Forward = d.TenantID, true
+		return t, nil
+	}
+	return Target{}, fmt.Errorf("DID %s has unroutable target type %q", d.Number, target.Type)
+}
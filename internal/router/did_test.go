@@ -0,0 +1,110 @@
+package router
+
+import (
+	"nextgen-sip/internal/dialplan"
+	"nextgen-sip/internal/did"
+	"nextgen-sip/internal/registrar"
+	"nextgen-sip/internal/trunk"
+	"testing"
+	"time"
+
+	"github.com/emiago/sipgo/sip"
+)
+
+// fakeBilling lets every caller but the broke ones call, and counts
+// checks. Like the real backends it keys accounts by user part only.
+type fakeBilling struct {
+	broke  map[string]bool
+	checks int
+}
+
+func (b *fakeBilling) CanCall(from, to string) (bool, error) {
+	b.checks++
+	return !b.broke[extractUser(from)], nil
+}
+
+func didEngine(t *testing.T) (*RoutingEngine, *fakeBilling) {
+	t.Helper()
+	reg := registrar.NewMemoryRegistrar(time.Hour)
+	t.Cleanup(reg.Close)
+	plans, err := dialplan.NewPlans("", dialplan.Plan{
+		CountryCode: "1", NationalPrefix: "1", InternationalPrefix: "011",
+		Routes: []dialplan.Route{{Match: `^\+44`, Trunk: "uk"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dids, err := did.NewInventory("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dids.Set(did.DID{Number: "+15550100", Target: did.Target{Type: did.TargetSubscriber, Subscriber: "100"}}); err != nil {
+		t.Fatal(err)
+	}
+	bill := &fakeBilling{broke: map[string]bool{"+15550199": true, "200": true}}
+	e := NewRoutingEngine(reg, bill, plans, testTrunks(t, trunk.Trunk{ID: "uk"}), nil, dids, time.Second,
+		sip.Uri{Host: "198.51.100.1", Port: 5060}, ExpiryLimits{Min: 60, Max: 3600, Default: 600})
+
+	aor := "sip:100@example.com"
+	u := registrar.Update{CallID: "reg-100", CSeq: 1, TenantID: dialplan.DefaultTenant,
+		Contacts: []registrar.Contact{{URI: "sip:100@203.0.113.7:5060", Q: 1, Expires: 60}}}
+	if _, err := reg.Update(aor, e.addressAliases(aor, dialplan.DefaultTenant), u); err != nil {
+		t.Fatal(err)
+	}
+	return e, bill
+}
+
+func TestResolveFromTrunk(t *testing.T) {
+	tests := []struct {
+		name      string
+		from, to  string
+		fromTrunk bool
+		dest      string
+		err       error // Wanted when fails, nil for any error
+		fails     bool
+		checked   bool // Balance checked
+	}{
+		{"subscriber dials subscriber", "sip:101@example.com", "sip:100@example.com", false, "203.0.113.7:5060", nil, false, true},
+		{"subscriber dials the DID", "sip:101@example.com", "sip:+15550100@example.com", false, "203.0.113.7:5060", nil, false, true},
+		{"subscriber dials off-net", "sip:101@example.com", "sip:011442071234567@example.com", false, "gw.example.com:5060", nil, false, true},
+		{"broke subscriber", "sip:200@example.com", "sip:100@example.com", false, "", nil, true, true},
+		{"carrier calls the DID", "sip:+15550199@carrier.example", "sip:+15550100@198.51.100.1", true, "203.0.113.7:5060", nil, false, false},
+		{"carrier caller ID names a local account", "sip:200@carrier.example", "sip:+15550100@198.51.100.1", true, "203.0.113.7:5060", nil, false, false},
+		{"carrier calls an extension", "sip:+15550199@carrier.example", "sip:100@198.51.100.1", true, "", ErrNotOurDID, true, false},
+		{"carrier calls a subscriber AOR", "sip:+15550199@carrier.example", "sip:100@example.com", true, "", ErrNotOurDID, true, false},
+		{"carrier calls off-net", "sip:+15550199@carrier.example", "sip:+442071234567@198.51.100.1", true, "", ErrNotOurDID, true, false},
+	}
+	for _, tt := range tests {
+		e, bill := didEngine(t)
+		target, err := e.Resolve(invite(t, tt.from, tt.to), dialplan.DefaultTenant, tt.fromTrunk)
+		switch {
+		case tt.fails && (err == nil || tt.err != nil && err != tt.err):
+			t.Errorf("%s: err = %v, want %v", tt.name, err, tt.err)
+		case !tt.fails && err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case !tt.fails && target.Dest != tt.dest:
+			t.Errorf("%s: dest %s, want %s", tt.name, target.Dest, tt.dest)
+		}
+		if (bill.checks > 0) != tt.checked {
+			t.Errorf("%s: %d balance checks, want checked=%v", tt.name, bill.checks, tt.checked)
+		}
+	}
+}
+
+func invite(t *testing.T, from, to string) *sip.Request {
+	t.Helper()
+	msg, err := sip.ParseMessage([]byte("INVITE " + to + " SIP/2.0\r\n" +
+		"Via: SIP/2.0/UDP 203.0.113.9:5060;branch=z9hG4bK74bf9\r\n" +
+		"From: <" + from + ">;tag=9fxced76sl\r\n" +
+		"To: <" + to + ">\r\n" +
+		"Call-ID: 3848276298220188511@203.0.113.9\r\n" +
+		"CSeq: 1 INVITE\r\n" +
+		"Contact: <sip:caller@203.0.113.9:5060>\r\n" +
+		"Content-Length: 0\r\n\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := msg.(*sip.Request)
+	req.SetSource("203.0.113.9:5060")
+	return req
+}
@@ -0,0 +1,144 @@
+package router
+
+import (
+	"fmt"
+	"net"
+	"nextgen-sip/internal/registrar"
+	"strconv"
+	"strings"
+
+	"github.com/emiago/sipgo/sip"
+)
+
+// Carrier-grade NAT space (RFC 6598), not covered by net.IP.IsPrivate
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// StampVia records in the top Via where req really came from (RFC 3581
+// section 4): received when the sent-by host is not the packet source, and
+// the source port in rport when the client asked for it. Responses carry
+// the Via back, so the client learns its public address.
+func StampVia(req *sip.Request) {
+	via := req.Via()
+	if via == nil {
+		return
+	}
+	host, port, err := net.SplitHostPort(req.Source())
+	if err != nil {
+		return
+	}
+	if via.Params == nil {
+		via.Params = sip.NewParams()
+	}
+	if via.Host != host {
+		via.Params.Add("received", host)
+	}
+	if via.Params.Has("rport") {
+		via.Params.Add("rport", port)
+	}
+}
+
+// IsPrivate reports whether host is an address that is not routable on
+// the internet: RFC 1918, shared CGNAT, link-local or unique local space
+func IsPrivate(host string) bool {
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+	if ip == nil {
+		return false
+	}
+	return ip.IsPrivate() || ip.IsLinkLocalUnicast() || sharedAddressSpace.Contains(ip)
+}
+
+// natDetected reports whether a client that sent contact from source sits
+// behind a NAT: the Contact names a private address other than the source,
+// or the sent-by of its Via is not where the message came from. Over TCP
+// and TLS the source port is ephemeral, so only the host is compared.
+func natDetected(contact sip.Uri, via *sip.ViaHeader, source string) bool {
+	host, port, err := net.SplitHostPort(source)
+	if err != nil {
+		return false
+	}
+	if IsPrivate(contact.Host) && contact.Host != host {
+		return true
+	}
+	if via == nil {
+		return false
+	}
+	if via.Host != host {
+		return true
+	}
+	if !strings.EqualFold(via.Transport, "udp") {
+		return false
+	}
+	viaPort := via.Port
+	if viaPort == 0 {
+		viaPort = sip.DefaultPort(via.Transport)
+	}
+	return strconv.Itoa(viaPort) != port
+}
+
+// needsFlow reports whether contact can only be reached back over the flow
+// it came in on: it is behind a NAT, or it came over a connection-oriented
+// transport from another address, where we could not open a connection to
+// it ourselves
+func needsFlow(contact sip.Uri, nat bool, source, transport string) bool {
+	if nat {
+		return true
+	}
+	return !strings.EqualFold(transport, "udp") && HostPort(contact, transport) != source
+}
+
+// flowURI is the URI of the flow a message came in on
+func flowURI(source, transport string) string {
+	return fmt.Sprintf("sip:%s;transport=%s", source, strings.ToLower(transport))
+}
+
+// FixContact points the Contact of a message from a client behind a NAT
+// at the address the message came from, so that requests inside the
+// dialog find their way back through the NAT. via is the client's Via for
+// requests and nil for responses. It reports whether the Contact changed.
+func FixContact(h *sip.ContactHeader, via *sip.ViaHeader, source, transport string) bool {
+	if h == nil || h.Address.Wildcard {
+		return false
+	}
+	if !needsFlow(h.Address, natDetected(h.Address, via, source), source, transport) {
+		return false
+	}
+	host, port, err := net.SplitHostPort(source)
+	if err != nil {
+		return false
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return false
+	}
+	h.Address.Host = host
+	h.Address.Port = p
+	if h.Address.UriParams == nil {
+		h.Address.UriParams = sip.NewParams()
+	}
+	if strings.EqualFold(transport, "udp") {
+		h.Address.UriParams.Remove("transport")
+	} else {
+		h.Address.UriParams.Add("transport", strings.ToLower(transport))
+	}
+	return true
+}
+
+// BindingDest returns the host:port and transport to reach b at: the flow
+// it registered over when it has one, otherwise its Contact
+func BindingDest(b registrar.Binding) (string, string, error) {
+	target := b.Received
+	if target == "" {
+		target = b.Contact
+	}
+	var uri sip.Uri
+	if err := sip.ParseUri(target, &uri); err != nil {
+		return "", "", fmt.Errorf("invalid contact %s: %w", target, err)
+	}
+	transport := "udp"
+	if uri.UriParams != nil {
+		if t, ok := uri.UriParams.Get("transport"); ok {
+			transport = strings.ToLower(t)
+		}
+	}
+	return HostPort(uri, transport), transport, nil
+}
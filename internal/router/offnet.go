@@ -0,0 +1,142 @@
+package router
+
+import (
+	"errors"
+	"log"
+	"math"
+	"math/rand"
+	"nextgen-sip/internal/money"
+	"nextgen-sip/internal/rating"
+	"nextgen-sip/internal/trunk"
+	"sort"
+	"strings"
+
+	"github.com/emiago/sipgo/sip"
+)
+
+// offNet sends a call to an E.164 number that is not one of our
+// subscribers out through the cheapest trunk the tenant's dial plan routes
+// it to; the others are left in the target to fail over to. ok is false
+// when no route matches or none of its trunks can take the call.
+func (e *RoutingEngine) offNet(req *sip.Request, tenantID, number string) (Target, bool) {
+	plan := e.plans.For(tenantID)
+	ids := plan.TrunksFor(number)
+	if len(ids) == 0 {
+		return Target{}, false
+	}
+	ranked := e.rankTrunks(ids, number)
+	if len(ranked) == 0 {
+		log.Printf("[Router] ✗ No trunk of %v can take %s", ids, number)
+		return Target{}, false
+	}
+	if len(ranked) > 1 {
+		order := make([]string, len(ranked))
+		for i, t := range ranked {
+			order[i] = t.ID
+		}
+		log.Printf("[Router] LCR for %s: %s", number, strings.Join(order, ", "))
+	}
+
+	t := Target{
+		Failover: ranked,
+		number:   number,
+		caller:   plan.Normalize(extractUser(req.From().Address.String())),
+	}
+	return e.nextTrunk(req, t), true
+}
+
+// nextTrunk retargets req at the first trunk left in t
+func (e *RoutingEngine) nextTrunk(req *sip.Request, t Target) Target {
+	next := t.Failover[0]
+	e.toTrunk(req, next, t.number, t.caller)
+	log.Printf("[Router] ✓ %s is off-net, via trunk %s => %s (%s)", t.number, next.ID, req.Recipient.String(), next.Dest())
+	t.Dest = next.Dest()
+	t.Trunk = &next
+	t.Failover = t.Failover[1:]
+	return t
+}
+
+// toTrunk retargets req at number on trunk t and asserts the caller's
+// identity to the carrier (RFC 3325) as the trunk's caller ID policy says
+func (e *RoutingEngine) toTrunk(req *sip.Request, t trunk.Trunk, number, caller string) {
+	req.Recipient = t.RequestURI(number)
+	req.SetTransport(strings.ToUpper(t.Transport))
+
+	// An identity the caller asserted itself is not to be trusted
+	for req.GetHeader("P-Asserted-Identity") != nil {
+		req.RemoveHeader("P-Asserted-Identity")
+	}
+	id, withheld := t.Identity(caller)
+	pai := sip.Uri{User: id, Host: e.local.Host}
+	req.AppendHeader(sip.NewHeader("P-Asserted-Identity", "<"+pai.String()+">"))
+	if withheld && req.GetHeader("Privacy") == nil {
+		req.AppendHeader(sip.NewHeader("Privacy", "id"))
+	}
+}
+
+// ─── Least-Cost Routing ─────────────────────────────────────
+
+// candidate is a trunk that could carry a call and what it costs us
+type candidate struct {
+	trunk  trunk.Trunk
+	cost   money.Amount
+	priced bool
+	draw   float64 // Random key ordering ties by weight
+}
+
+// rankTrunks orders the enabled trunks among ids for a call to number: by
+// priority, then cheapest first by the carrier's deck, trunks without a
+// deck after those with one. Ties are shuffled in proportion to weight. A
+// trunk whose deck has no rate for the number is left out, as the carrier
+// does not take such calls.
+func (e *RoutingEngine) rankTrunks(ids []string, number string) []trunk.Trunk {
+	list := make([]candidate, 0, len(ids))
+	for _, id := range ids {
+		t, ok := e.trunks.Get(id)
+		if !ok || t.Disabled {
+			log.Printf("[Router] ✗ Route for %s names trunk %s, which is missing or disabled", number, id)
+			continue
+		}
+		c := candidate{trunk: t, draw: weightedDraw(t.Weight)}
+		if t.RateDeck != "" && e.rates != nil {
+			cost, err := e.rates.CarrierCost(t.RateDeck, number)
+			switch {
+			case errors.Is(err, rating.ErrNoRate):
+				log.Printf("[Router] Trunk %s does not rate %s, skipped", id, number)
+				continue
+			case err != nil:
+				log.Printf("[Router] ✗ Trunk %s deck %s: %v", id, t.RateDeck, err)
+			default:
+				c.cost, c.priced = cost, true
+			}
+		}
+		list = append(list, c)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		a, b := list[i], list[j]
+		switch {
+		case a.trunk.Priority != b.trunk.Priority:
+			return a.trunk.Priority < b.trunk.Priority
+		case a.priced != b.priced:
+			return a.priced
+		case a.cost != b.cost:
+			return a.cost < b.cost
+		}
+		return a.draw > b.draw
+	})
+	ranked := make([]trunk.Trunk, len(list))
+	for i, c := range list {
+		ranked[i] = c.trunk
+	}
+	return ranked
+}
+
+// weightedDraw returns a random key such that, sorting highest first, each
+// trunk comes first in proportion to its weight (Efraimidis-Spirakis)
+func weightedDraw(weight int) float64 {
+	if weight <= 0 {
+		weight = 1
+	}
+	return math.Pow(rand.Float64(), 1/float64(weight))
+}
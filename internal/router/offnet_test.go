@@ -0,0 +1,118 @@
+package router
+
+import (
+	"nextgen-sip/internal/money"
+	"nextgen-sip/internal/rating"
+	"nextgen-sip/internal/trunk"
+	"strings"
+	"testing"
+)
+
+// fakeRates prices a minute on each deck; a deck missing from the map
+// has no rate for the number
+type fakeRates map[string]string
+
+func (f fakeRates) CarrierCost(deckID, number string) (money.Amount, error) {
+	if deckID == "broken" {
+		return 0, rating.ErrNoDeck
+	}
+	v, ok := f[deckID]
+	if !ok {
+		return 0, rating.ErrNoRate
+	}
+	return money.Parse(v)
+}
+
+func testTrunks(t *testing.T, list ...trunk.Trunk) *trunk.Trunks {
+	t.Helper()
+	trunks, err := trunk.NewTrunks("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tr := range list {
+		tr.Host = "gw.example.com"
+		if _, err := trunks.Set(tr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return trunks
+}
+
+func TestRankTrunks(t *testing.T) {
+	trunks := testTrunks(t,
+		trunk.Trunk{ID: "cheap", RateDeck: "cheap"},
+		trunk.Trunk{ID: "dear", RateDeck: "dear"},
+		trunk.Trunk{ID: "unpriced"},
+		trunk.Trunk{ID: "norate", RateDeck: "none"},
+		trunk.Trunk{ID: "broken", RateDeck: "broken"},
+		trunk.Trunk{ID: "primary", RateDeck: "dear", Priority: -1},
+		trunk.Trunk{ID: "last", RateDeck: "cheap", Priority: 5},
+		trunk.Trunk{ID: "off", RateDeck: "cheap", Disabled: true},
+	)
+	rates := fakeRates{"cheap": "0.01", "dear": "0.05"}
+	e := &RoutingEngine{trunks: trunks, rates: rates}
+
+	tests := []struct {
+		name string
+		ids  []string
+		want []string
+	}{
+		{"cheapest first", []string{"dear", "cheap"}, []string{"cheap", "dear"}},
+		{"priced before unpriced", []string{"unpriced", "dear"}, []string{"dear", "unpriced"}},
+		{"deck errors count as unpriced", []string{"broken", "cheap"}, []string{"cheap", "broken"}},
+		{"priority before cost", []string{"cheap", "last", "primary"}, []string{"primary", "cheap", "last"}},
+		{"no rate for the number", []string{"norate", "dear"}, []string{"dear"}},
+		{"disabled and missing skipped", []string{"off", "gone", "dear"}, []string{"dear"}},
+		{"nothing left", []string{"off", "norate"}, []string{}},
+	}
+	for _, tt := range tests {
+		got := ids(e.rankTrunks(tt.ids, "+14155550100"))
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("%s: rankTrunks(%v) = %v, want %v", tt.name, tt.ids, got, tt.want)
+		}
+	}
+
+	// Without carrier rates only priority counts
+	e.rates = nil
+	got := ids(e.rankTrunks([]string{"last", "norate", "primary"}, "+14155550100"))
+	if len(got) != 3 || got[0] != "primary" || got[2] != "last" {
+		t.Errorf("rankTrunks without rates = %v, want primary, norate, last", got)
+	}
+}
+
+func TestRankTrunksWeight(t *testing.T) {
+	trunks := testTrunks(t,
+		trunk.Trunk{ID: "heavy", Weight: 3},
+		trunk.Trunk{ID: "light", Weight: 1},
+		trunk.Trunk{ID: "zero"}, // Counts as 1
+	)
+	e := &RoutingEngine{trunks: trunks}
+
+	const rounds = 10000
+	first := make(map[string]int)
+	for i := 0; i < rounds; i++ {
+		first[e.rankTrunks([]string{"heavy", "light", "zero"}, "+1")[0].ID]++
+	}
+	tests := []struct {
+		id    string
+		share float64
+	}{
+		{"heavy", 0.6},
+		{"light", 0.2},
+		{"zero", 0.2},
+	}
+	for _, tt := range tests {
+		got := float64(first[tt.id]) / rounds
+		if got < tt.share-0.03 || got > tt.share+0.03 {
+			t.Errorf("%s came first in %.3f of calls, want about %.1f", tt.id, got, tt.share)
+		}
+	}
+}
+
+func ids(list []trunk.Trunk) []string {
+	out := make([]string, len(list))
+	for i, t := range list {
+		out[i] = t.ID
+	}
+	return out
+}
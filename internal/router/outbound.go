@@ -0,0 +1,216 @@
+package router
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"nextgen-sip/internal/registrar"
+	"strconv"
+	"strings"
+
+	"github.com/emiago/sipgo/sip"
+)
+
+// ErrFlowFailed means a request was routed to a flow of ours that no
+// longer exists (RFC 5626 section 5.3, 430 Flow Failed)
+var ErrFlowFailed = errors.New("flow failed")
+
+// ─── Flow tokens ────────────────────────────────────────────
+// When this proxy is the edge for a client, it puts itself in the Path of
+// the registration with the flow the REGISTER came over encoded in the user
+// part (RFC 5626 section 5.2). Any proxy sharing the registrar then routes
+// to the client through us, and we send down that flow. Tokens are signed
+// with a key that lives as long as the process, like the flows they name.
+
+type flowTokens struct {
+	key []byte
+}
+
+func newFlowTokens() *flowTokens {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(fmt.Sprintf("flow token key: %v", err))
+	}
+	return &flowTokens{key: key}
+}
+
+func (t *flowTokens) encode(transport, addr string) string {
+	flow := strings.ToLower(transport) + "/" + addr
+	mac := hmac.New(sha256.New, t.key)
+	mac.Write([]byte(flow))
+	return base64.RawURLEncoding.EncodeToString(append(mac.Sum(nil)[:10], flow...))
+}
+
+func (t *flowTokens) decode(token string) (transport, addr string, ok bool) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(data) <= 10 {
+		return "", "", false
+	}
+	mac := hmac.New(sha256.New, t.key)
+	mac.Write(data[10:])
+	if !hmac.Equal(data[:10], mac.Sum(nil)[:10]) {
+		return "", "", false
+	}
+	transport, addr, ok = strings.Cut(string(data[10:]), "/")
+	return transport, addr, ok
+}
+
+// edgePath is the Path entry that routes back to us and down the flow a
+// message came in on
+func (e *RoutingEngine) edgePath(source, transport string) string {
+	uri := sip.Uri{
+		User:      e.flows.encode(transport, source),
+		Host:      e.local.Host,
+		Port:      e.local.Port,
+		UriParams: sip.NewParams(),
+		Headers:   sip.NewParams(),
+	}
+	uri.UriParams.Add("transport", strings.ToLower(transport))
+	uri.UriParams.Add("lr", "")
+	uri.UriParams.Add("ob", "")
+	return uri.String()
+}
+
+// popLocalRoutes removes our own entries from the top of the Route set. An
+// entry carrying one of our flow tokens ends the route: the request goes
+// down that flow. ok is false when no flow was found.
+func (e *RoutingEngine) popLocalRoutes(req *sip.Request) (dest string, ok bool, err error) {
+	for {
+		rh := req.Route()
+		if rh == nil || !e.IsLocal(rh.Address) {
+			return "", false, nil
+		}
+		req.RemoveHeader("Route")
+		if rh.Address.User == "" {
+			continue
+		}
+		transport, addr, valid := e.flows.decode(rh.Address.User)
+		if !valid {
+			return "", false, ErrFlowFailed
+		}
+		req.SetTransport(strings.ToUpper(transport))
+		return addr, true, nil
+	}
+}
+
+// HoldsFlow reports whether b is reached through this proxy: it was
+// registered here directly, or its Path starts with us
+func (e *RoutingEngine) HoldsFlow(b registrar.Binding) bool {
+	if len(b.Path) == 0 {
+		return true
+	}
+	var uri sip.Uri
+	if err := sip.ParseUri(b.Path[0], &uri); err != nil {
+		return false
+	}
+	return e.IsLocal(uri) && uri.User != ""
+}
+
+// ─── Path and Outbound parameters ───────────────────────────
+
+// requestPath returns the Path URIs of req (RFC 3327), topmost first
+func requestPath(req *sip.Request) ([]string, error) {
+	var path []string
+	for _, h := range req.GetHeaders("Path") {
+		for _, text := range splitContacts(h.Value()) {
+			var uri sip.Uri
+			if _, err := sip.ParseAddressValue(text, &uri, sip.NewParams()); err != nil {
+				return nil, fmt.Errorf("invalid Path %q: %w", text, err)
+			}
+			path = append(path, uri.String())
+		}
+	}
+	return path, nil
+}
+
+// instanceID returns the +sip.instance of a Contact without its quotes and
+// angle brackets, and its reg-id (RFC 5626 section 4.1), 0 when absent
+func instanceID(c *sip.ContactHeader) (string, int, error) {
+	v, ok := c.Params.Get("+sip.instance")
+	if !ok {
+		return "", 0, nil
+	}
+	id := strings.Trim(v, `"<>`)
+	if id == "" {
+		return "", 0, fmt.Errorf("empty +sip.instance")
+	}
+	regID := 0
+	if v, ok := c.Params.Get("reg-id"); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return "", 0, fmt.Errorf("invalid reg-id %q", v)
+		}
+		regID = n
+	}
+	return id, regID, nil
+}
+
+// hasOb reports whether a Path URI carries the ob parameter, i.e. its
+// proxy keeps flows (RFC 5626 section 5.1)
+func hasOb(path string) bool {
+	var uri sip.Uri
+	if err := sip.ParseUri(path, &uri); err != nil {
+		return false
+	}
+	return uri.UriParams != nil && uri.UriParams.Has("ob")
+}
+
+// supports reports whether req lists option in Supported
+func supports(req *sip.Request, option string) bool {
+	for _, h := range req.GetHeaders("Supported") {
+		for _, tag := range strings.Split(h.Value(), ",") {
+			if strings.EqualFold(strings.TrimSpace(tag), option) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// OutboundRegister reports whether a REGISTER asks for RFC 5626 outbound:
+// it supports outbound and a Contact carries a reg-id
+func OutboundRegister(req *sip.Request) bool {
+	if !supports(req, "outbound") {
+		return false
+	}
+	contacts, err := Contacts(req)
+	if err != nil {
+		return false
+	}
+	for _, c := range contacts {
+		if _, ok := c.Params.Get("reg-id"); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// pathRoute pre-loads the Route set of req with the Path of b (RFC 3327
+// section 5.3) and returns its first hop. When that hop is us, the request
+// goes straight down the flow named in our entry, or the one the binding
+// recorded if our token predates a restart.
+func (e *RoutingEngine) pathRoute(req *sip.Request, b registrar.Binding) (string, error) {
+	for i := len(b.Path) - 1; i >= 0; i-- {
+		var uri sip.Uri
+		if err := sip.ParseUri(b.Path[i], &uri); err != nil {
+			return "", fmt.Errorf("invalid Path %s: %w", b.Path[i], err)
+		}
+		req.PrependHeader(&sip.RouteHeader{Address: uri})
+	}
+	dest, ok, err := e.popLocalRoutes(req)
+	if ok {
+		return dest, nil
+	}
+	if rh := req.Route(); rh != nil && err == nil {
+		return nextHop(req, rh.Address), nil
+	}
+	if err != nil && b.Received == "" {
+		return "", err
+	}
+	dest, transport, err := BindingDest(b)
+	req.SetTransport(strings.ToUpper(transport))
+	return dest, err
+}
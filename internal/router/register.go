@@ -0,0 +1,166 @@
+package router
+
+import (
+	"fmt"
+	"log"
+	"nextgen-sip/internal/registrar"
+	"strconv"
+	"strings"
+
+	"github.com/emiago/sipgo/sip"
+)
+
+// ExpiryLimits bounds the registration lifetimes the registrar grants, in
+// seconds. Default applies when the REGISTER asks for none.
+type ExpiryLimits struct {
+	Min     int
+	Max     int
+	Default int
+}
+
+// RegisterError rejects a REGISTER with a SIP status
+type RegisterError struct {
+	Code       int
+	Reason     string
+	MinExpires int // Set with 423 Interval Too Brief
+}
+
+func (e *RegisterError) Error() string {
+	return fmt.Sprintf("%d %s", e.Code, e.Reason)
+}
+
+// Register processes a REGISTER (RFC 3261 section 10.3) and returns the
+// bindings of its address-of-record. A REGISTER without Contact only
+// queries them. tenantID is that of the subscriber who authenticated it.
+func (e *RoutingEngine) Register(req *sip.Request, tenantID string) ([]registrar.Binding, error) {
+	aor := CanonicalAOR(req.To().Address.String())
+	u, err := e.parseRegister(req, tenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	if !u.RemoveAll && len(u.Contacts) == 0 {
+		return e.registrar.Bindings(aor)
+	}
+	log.Printf("[Router] Registering %s: %d contact(s), remove all=%v, source=%s", aor, len(u.Contacts), u.RemoveAll, u.Source)
+
+	bindings, err := e.registrar.Update(aor, e.addressAliases(aor, u.TenantID), u)
+	if err == registrar.ErrOutOfOrder {
+		return nil, &RegisterError{Code: 500, Reason: "Out Of Order REGISTER"}
+	}
+	return bindings, err
+}
+
+// CanonicalAOR returns the address-of-record a SIP or SIPS URI registers
+// under: scheme, user and lowercased host, without port, parameters or
+// headers, so every spelling of an address shares its bindings. Anything
+// else, such as a bare user name, is returned as given.
+func CanonicalAOR(uri string) string {
+	lower := strings.ToLower(uri)
+	if !strings.HasPrefix(lower, "sip:") && !strings.HasPrefix(lower, "sips:") {
+		return uri
+	}
+	var u sip.Uri
+	if err := sip.ParseUri(uri, &u); err != nil {
+		return uri
+	}
+	scheme := "sip:"
+	if u.Encrypted {
+		scheme = "sips:"
+	}
+	if u.User == "" {
+		return scheme + strings.ToLower(u.Host)
+	}
+	return scheme + u.User + "@" + strings.ToLower(u.Host)
+}
+
+// parseRegister reads the Contact, Expires and Path headers of a REGISTER
+// into an update, applying the expiry limits. A client that registers with
+// us directly over a flow it alone can use gets us as its Path, so that
+// other proxies sharing the registrar route to it through us.
+func (e *RoutingEngine) parseRegister(req *sip.Request, tenantID string) (registrar.Update, error) {
+	u := registrar.Update{
+		CallID:    req.CallID().Value(),
+		CSeq:      req.CSeq().SeqNo,
+		Source:    req.Source(),
+		Transport: strings.ToLower(req.Transport()),
+		TenantID:  tenantID,
+	}
+	if h := req.GetHeader("User-Agent"); h != nil {
+		u.UserAgent = h.Value()
+	}
+
+	expires, hasExpires := e.expiry.Default, false
+	if h := req.GetHeader("Expires"); h != nil {
+		n, err := strconv.Atoi(strings.TrimSpace(h.Value()))
+		if err != nil || n < 0 {
+			return u, &RegisterError{Code: 400, Reason: "Invalid Expires"}
+		}
+		expires, hasExpires = n, true
+	}
+
+	contacts, err := Contacts(req)
+	if err != nil {
+		return u, &RegisterError{Code: 400, Reason: "Invalid Contact"}
+	}
+	path, err := requestPath(req)
+	if err != nil {
+		return u, &RegisterError{Code: 400, Reason: "Invalid Path"}
+	}
+	// Outbound needs an edge proxy that keeps the flow: us, or the one
+	// that added the last Path entry (RFC 5626 section 6)
+	outbound := supports(req, "outbound")
+	if outbound && len(path) > 0 && OutboundRegister(req) && !hasOb(path[len(path)-1]) {
+		return u, &RegisterError{Code: 439, Reason: "First Hop Lacks Outbound Support"}
+	}
+	for _, c := range contacts {
+		if c.Address.Wildcard {
+			if len(contacts) != 1 || !hasExpires || expires != 0 {
+				return u, &RegisterError{Code: 400, Reason: "Invalid Wildcard Contact"}
+			}
+			u.RemoveAll = true
+			return u, nil
+		}
+
+		contact := registrar.Contact{URI: c.Address.String(), Q: 1, Expires: expires}
+		if contact.Instance, contact.RegID, err = instanceID(c); err != nil {
+			return u, &RegisterError{Code: 400, Reason: "Invalid Outbound Parameters"}
+		}
+		if !outbound {
+			contact.RegID = 0 // reg-id only counts with outbound
+		}
+		if len(path) > 0 {
+			// The edge proxy in the Path deals with NAT and flows
+			contact.Path = path
+		} else {
+			contact.NAT = natDetected(c.Address, req.Via(), u.Source)
+			if contact.RegID > 0 || needsFlow(c.Address, contact.NAT, u.Source, u.Transport) {
+				contact.Received = flowURI(u.Source, u.Transport)
+				contact.Path = []string{e.edgePath(u.Source, u.Transport)}
+			}
+		}
+		if v, ok := c.Params.Get("expires"); ok {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return u, &RegisterError{Code: 400, Reason: "Invalid Contact Expires"}
+			}
+			contact.Expires = n
+		}
+		if v, ok := c.Params.Get("q"); ok {
+			q, err := strconv.ParseFloat(v, 64)
+			if err != nil || q < 0 || q > 1 {
+				return u, &RegisterError{Code: 400, Reason: "Invalid Contact q-value"}
+			}
+			contact.Q = q
+		}
+
+		if contact.Expires > 0 && contact.Expires < e.expiry.Min {
+			return u, &RegisterError{Code: 423, Reason: "Interval Too Brief", MinExpires: e.expiry.Min}
+		}
+		if e.expiry.Max > 0 && contact.Expires > e.expiry.Max {
+			contact.Expires = e.expiry.Max
+		}
+		u.Contacts = append(u.Contacts, contact)
+	}
+	return u, nil
+}
@@ -0,0 +1,100 @@
+package router
+
+import (
+	"testing"
+
+	"github.com/emiago/sipgo/sip"
+)
+
+func TestParseRegisterExpiry(t *testing.T) {
+	e := &RoutingEngine{expiry: ExpiryLimits{Min: 60, Max: 3600, Default: 600}, flows: newFlowTokens()}
+	tests := []struct {
+		name    string
+		headers string
+		expires []int
+		code    int
+	}{
+		{"default", "Contact: <sip:alice@203.0.113.5:5060>\r\n", []int{600}, 0},
+		{"header", "Contact: <sip:alice@203.0.113.5:5060>\r\nExpires: 120\r\n", []int{120}, 0},
+		{"contact parameter wins", "Contact: <sip:alice@203.0.113.5:5060>;expires=300\r\nExpires: 120\r\n", []int{300}, 0},
+		{"capped at max", "Contact: <sip:alice@203.0.113.5:5060>\r\nExpires: 7200\r\n", []int{3600}, 0},
+		{"zero removes below min", "Contact: <sip:alice@203.0.113.5:5060>\r\nExpires: 0\r\n", []int{0}, 0},
+		{"too brief", "Contact: <sip:alice@203.0.113.5:5060>\r\nExpires: 30\r\n", nil, 423},
+		{"too brief by parameter", "Contact: <sip:alice@203.0.113.5:5060>;expires=59\r\n", nil, 423},
+		{"each contact on its own",
+			"Contact: <sip:alice@203.0.113.5:5060>;expires=90\r\nContact: <sip:alice@203.0.113.5:5062>\r\nExpires: 9999\r\n",
+			[]int{90, 3600}, 0},
+		{"invalid header", "Contact: <sip:alice@203.0.113.5:5060>\r\nExpires: soon\r\n", nil, 400},
+		{"negative header", "Contact: <sip:alice@203.0.113.5:5060>\r\nExpires: -1\r\n", nil, 400},
+		{"invalid parameter", "Contact: <sip:alice@203.0.113.5:5060>;expires=x\r\n", nil, 400},
+		{"wildcard", "Contact: *\r\nExpires: 0\r\n", nil, 0},
+		{"wildcard needs zero expires", "Contact: *\r\nExpires: 60\r\n", nil, 400},
+		{"wildcard needs an Expires header", "Contact: *\r\n", nil, 400},
+	}
+	for _, tt := range tests {
+		req := register(t, tt.headers)
+		u, err := e.parseRegister(req, "acme")
+		if tt.code != 0 {
+			re, ok := err.(*RegisterError)
+			if !ok || re.Code != tt.code {
+				t.Errorf("%s: err = %v, want %d", tt.name, err, tt.code)
+			} else if tt.code == 423 && re.MinExpires != 60 {
+				t.Errorf("%s: Min-Expires %d, want 60", tt.name, re.MinExpires)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if len(u.Contacts) != len(tt.expires) {
+			t.Errorf("%s: %d contacts, want %d", tt.name, len(u.Contacts), len(tt.expires))
+			continue
+		}
+		for i, c := range u.Contacts {
+			if c.Expires != tt.expires[i] {
+				t.Errorf("%s: contact %d expires %d, want %d", tt.name, i, c.Expires, tt.expires[i])
+			}
+		}
+	}
+}
+
+func register(t *testing.T, headers string) *sip.Request {
+	t.Helper()
+	msg, err := sip.ParseMessage([]byte("REGISTER sip:example.com SIP/2.0\r\n" +
+		"Via: SIP/2.0/UDP 203.0.113.5:5060;branch=z9hG4bK776asdhds\r\n" +
+		"From: <sip:alice@example.com>;tag=456248\r\n" +
+		"To: <sip:alice@example.com>\r\n" +
+		"Call-ID: 843817637684230@998sdasdh09\r\n" +
+		"CSeq: 1826 REGISTER\r\n" +
+		headers +
+		"Content-Length: 0\r\n\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := msg.(*sip.Request)
+	req.SetSource("203.0.113.5:5060")
+	return req
+}
+
+func TestCanonicalAOR(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"sip:alice@Example.COM", "sip:alice@example.com"},
+		{"<sip:alice@example.com:5060;transport=tcp>", "<sip:alice@example.com:5060;transport=tcp>"},
+		{"sip:alice@example.com:5060;transport=tcp", "sip:alice@example.com"},
+		{"SIP:alice@example.com", "sip:alice@example.com"},
+		{"sips:alice@example.com", "sips:alice@example.com"},
+		{"sip:+14155550100@example.com;user=phone", "sip:+14155550100@example.com"},
+		{"sip:Alice@example.com", "sip:Alice@example.com"},
+		{"sip:example.com", "sip:example.com"},
+		{"alice", "alice"},
+		{"tel:+14155550100", "tel:+14155550100"},
+	}
+	for _, tt := range tests {
+		if got := CanonicalAOR(tt.in); got != tt.want {
+			t.Errorf("CanonicalAOR(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
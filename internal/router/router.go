@@ -3,7 +3,14 @@ package router
 import (
 	"fmt"
 	"log"
+	"net/http"
+	"nextgen-sip/internal/dialplan"
+	"nextgen-sip/internal/did"
+	"nextgen-sip/internal/money"
+	"nextgen-sip/internal/registrar"
+	"nextgen-sip/internal/trunk"
 	"strings"
+	"time"
 
 	"github.com/emiago/sipgo/sip"
 )
@@ -12,27 +19,53 @@ import (
 type RoutingEngine struct {
 	registrar Registrar
 	billing   BillingEngine
+	plans     *dialplan.Plans
+	trunks    *trunk.Trunks
+	rates     CarrierRates
+	dids      *did.Inventory
+	hooks     *http.Client // Asks DID routing webhooks
+	local     sip.Uri      // our own address, used for Record-Route and Path
+	expiry    ExpiryLimits
+	flows     *flowTokens
 }
 
 type Registrar interface {
-	Lookup(uri string) (string, error)
-	Register(uri string, contact string) error
+	Lookup(tenantID string, aliases []string) (string, []registrar.Binding, error)
+	Bindings(aor string) ([]registrar.Binding, error)
+	Update(aor string, aliases []string, u registrar.Update) ([]registrar.Binding, error)
+	Registrations() ([]registrar.Registration, error)
+	Remove(aor, contact string) error
+	Health() registrar.Health
 }
 
 type BillingEngine interface {
 	CanCall(from string, to string) (bool, error)
 }
 
-func NewRoutingEngine(reg Registrar, bill BillingEngine) *RoutingEngine {
+// CarrierRates prices calls on the carriers' rate decks, for least-cost
+// routing
+type CarrierRates interface {
+	CarrierCost(deckID, number string) (money.Amount, error)
+}
+
+func NewRoutingEngine(reg Registrar, bill BillingEngine, plans *dialplan.Plans, trunks *trunk.Trunks, rates CarrierRates, dids *did.Inventory, hookTimeout time.Duration, local sip.Uri, expiry ExpiryLimits) *RoutingEngine {
 	return &RoutingEngine{
 		registrar: reg,
 		billing:   bill,
+		plans:     plans,
+		trunks:    trunks,
+		rates:     rates,
+		dids:      dids,
+		hooks:     &http.Client{Timeout: hookTimeout},
+		local:     local,
+		expiry:    expiry,
+		flows:     newFlowTokens(),
 	}
 }
 
 // ─── Phone Number Normalization ─────────────────────────────
-// Strips sip: prefix, @domain, country codes, and + sign
-// to get the raw local number for flexible lookup
+// Strips sip: prefix and @domain to get the number as dialed; the
+// tenant's dial plan turns it into E.164
 func extractUser(uri string) string {
 	s := uri
 	// Remove sip: / sips: prefix
@@ -45,141 +78,176 @@ func extractUser(uri string) string {
 	return s
 }
 
-// stripDialPrefix removes +, country codes, and common prefixes
-// to normalize "how people dial" vs "how they registered"
-func stripDialPrefix(number string) string {
-	s := number
-	// Remove leading +
-	s = strings.TrimPrefix(s, "+")
-	// Common country code prefixes to strip
-	prefixes := []string{
-		"972", "971", "970", "966", "965", "964", "963", "962", "961",
-		"20", "90", "44", "1", "49", "33", "86",
-	}
-	for _, p := range prefixes {
-		if strings.HasPrefix(s, p) && len(s) > len(p)+3 {
-			stripped := s[len(p):]
-			// Remove leading 0 after country code
-			stripped = strings.TrimPrefix(stripped, "0")
-			return stripped
-		}
+// addressAliases returns the forms a registered or dialed URI is indexed
+// under in its tenant: the canonical AOR and its user part as normalized
+// by the tenant's dial plan, E.164 for phone numbers. Registration and
+// lookup use the same forms, so any way of dialing a number finds its
+// binding.
+func (e *RoutingEngine) addressAliases(uri, tenantID string) []string {
+	aliases := []string{CanonicalAOR(uri)}
+	if user := e.plans.Normalize(tenantID, extractUser(uri)); user != "" {
+		aliases = append(aliases, user)
 	}
-	// Remove leading 0
-	s = strings.TrimPrefix(s, "0")
-	return s
+	return aliases
 }
 
-// generateLookupKeys creates all possible registration keys from a dialed URI
-func generateLookupKeys(uri string) []string {
-	user := extractUser(uri)
-	stripped := stripDialPrefix(user)
-
-	// Extract domain for full URI matching
-	domain := ""
-	if idx := strings.Index(uri, "@"); idx >= 0 {
-		raw := strings.TrimPrefix(uri, "sip:")
-		raw = strings.TrimPrefix(raw, "sips:")
-		if idx2 := strings.Index(raw, "@"); idx2 >= 0 {
-			domain = raw[idx2+1:]
-		}
-	}
+// ─── Route ──────────────────────────────────────────────────
 
-	keys := []string{
-		uri, // exact: sip:+972056233121@domain.com
-	}
+// Target is where a request goes: the next hop and, for calls leaving
+// through a carrier, the trunk and those left to fail over to
+type Target struct {
+	Dest     string
+	Trunk    *trunk.Trunk
+	Failover []trunk.Trunk
+	TenantID string        // Tenant of the DID called, if one was
+	Forward  bool          // A DID forwards the call off our network
+	Ring     time.Duration // How long the hop rings before the next is tried, 0 for no limit
+
+	number  string   // E.164 number called
+	caller  string   // E.164 number calling
+	group   bool     // The hop is a ring group member
+	members []string // Ring group members left to try
+}
 
-	if domain != "" {
-		keys = append(keys,
-			fmt.Sprintf("sip:%s@%s", user, domain),      // sip:+972056233121@domain
-			fmt.Sprintf("sip:%s@%s", stripped, domain),   // sip:56233121@domain
-			fmt.Sprintf("sip:0%s@%s", stripped, domain),  // sip:056233121@domain
-		)
+// Retry reports whether a final response from t's hop hands the call on to
+// the next: for trunks when the carrier could not complete it, for ring
+// group members unless they answered or declined
+func (t Target) Retry(code int) bool {
+	switch {
+	case code < 300 || code == 603:
+		return false
+	case t.Trunk != nil:
+		return code == 408 || code >= 500
 	}
+	return t.group
+}
 
-	keys = append(keys,
-		fmt.Sprintf("sip:%s@localhost", user),            // sip:+972056233121@localhost
-		fmt.Sprintf("sip:%s@localhost", stripped),         // sip:56233121@localhost
-		fmt.Sprintf("sip:0%s@localhost", stripped),        // sip:056233121@localhost
-	)
+// Next retargets req, a fresh copy of the INVITE, at the hop after t: the
+// next trunk left for calls leaving through a carrier, or the next ring
+// group member that is registered. ok is false when there is none.
+func (e *RoutingEngine) Next(req *sip.Request, t Target) (Target, bool) {
+	if len(t.Failover) > 0 {
+		return e.nextTrunk(req, t), true
+	}
+	for len(t.members) > 0 {
+		member := t.members[0]
+		t.members = t.members[1:]
+		dest, err := e.toSubscriber(req, member, t.TenantID)
+		if err != nil {
+			log.Printf("[Router] Ring group member %s skipped: %v", member, err)
+			continue
+		}
+		log.Printf("[Router] ✓ Ringing group member %s => %s", member, dest)
+		t.Dest = dest
+		return t, true
+	}
+	return Target{}, false
+}
 
-	return keys
+// Route returns the next hop of req, sent by a party of tenantID
+func (e *RoutingEngine) Route(req *sip.Request, tenantID string) (string, error) {
+	t, err := e.Resolve(req, tenantID, false)
+	return t.Dest, err
 }
 
-// ─── Route ──────────────────────────────────────────────────
-func (e *RoutingEngine) Route(req *sip.Request) (string, error) {
-	if req.Method == sip.REGISTER {
-		return e.handleRegister(req)
+// Resolve works out where req, sent by a party of tenantID, goes and
+// retargets it there. The tenant is the caller's to vouch for: it picks the
+// dial plan and trunks the request is routed with. fromTrunk marks requests
+// from a carrier, whose From is whatever caller ID the carrier passed on
+// and never one of our subscribers.
+func (e *RoutingEngine) Resolve(req *sip.Request, tenantID string, fromTrunk bool) (Target, error) {
+	// In-dialog requests follow the route set, never the registrar
+	dest, ok, err := e.routeInDialog(req)
+	if err != nil {
+		return Target{}, err
 	}
-	return e.handleGenericRoute(req)
+	if ok {
+		log.Printf("[Router] %s routed by route set => %s", req.Method, dest)
+		return Target{Dest: dest}, nil
+	}
+	return e.handleGenericRoute(req, tenantID, fromTrunk)
 }
 
-func (e *RoutingEngine) handleGenericRoute(req *sip.Request) (string, error) {
+func (e *RoutingEngine) handleGenericRoute(req *sip.Request, tenantID string, fromTrunk bool) (Target, error) {
 	from := req.From().Address.String()
 	to := req.To().Address.String()
 
 	log.Printf("[Router] Routing %s: %s -> %s", req.Method, from, to)
 
-	// Billing check (only for INVITE and MESSAGE)
-	if req.Method == sip.INVITE || req.Method == sip.MESSAGE {
+	// Billing check (only for INVITE and MESSAGE from our subscribers)
+	if !fromTrunk && (req.Method == sip.INVITE || req.Method == sip.MESSAGE) {
 		canCall, err := e.billing.CanCall(from, to)
 		if err != nil {
 			log.Printf("[Router] Billing check error (allowing anyway): %v", err)
 			// Don't block — treat billing errors as permissive
 		} else if !canCall {
-			return "", fmt.Errorf("insufficient balance for %s", from)
+			return Target{}, fmt.Errorf("insufficient balance for %s", from)
 		}
 	}
 
-	// Try all possible lookup keys for the destination
-	lookupKeys := generateLookupKeys(to)
-	for _, key := range lookupKeys {
-		dest, err := e.registrar.Lookup(key)
-		if err == nil {
-			log.Printf("[Router] ✓ Found %s via key: %s => %s", to, key, dest)
-			return dest, nil
+	// Our DIDs go where the inventory says. Carriers reach us through
+	// them alone. Otherwise one lookup resolves every alias of the dialed
+	// number; numbers that are not our subscribers leave through a trunk.
+	if d, ok := e.lookupDID(req, tenantID); ok {
+		return e.toDID(req, d)
+	}
+	if fromTrunk {
+		log.Printf("[Router] ✗ %s from a trunk is not one of our DIDs", to)
+		return Target{}, ErrNotOurDID
+	}
+	aliases := e.addressAliases(to, tenantID)
+	aor, bindings, err := e.registrar.Lookup(tenantID, aliases)
+	if err == registrar.ErrNotFound {
+		number := e.plans.Normalize(tenantID, extractUser(to))
+		if t, ok := e.offNet(req, tenantID, number); ok {
+			return t, nil
 		}
+		log.Printf("[Router] ✗ No registration found for %s (aliases %v)", to, aliases)
+		return Target{}, fmt.Errorf("user %s not registered", to)
 	}
-
-	log.Printf("[Router] ✗ No registration found for %s (tried %d keys)", to, len(lookupKeys))
-	return "", fmt.Errorf("user %s not registered", to)
+	if err != nil {
+		return Target{}, err
+	}
+	dest, err := e.toBinding(req, bindings[0])
+	if err != nil {
+		return Target{}, err
+	}
+	log.Printf("[Router] ✓ Found %s via %s => %s (%s %s)", to, aor, bindings[0].Contact, req.Transport(), dest)
+	return Target{Dest: dest}, nil
 }
 
-func (e *RoutingEngine) handleRegister(req *sip.Request) (string, error) {
-	from := req.From().Address.String()
-	contact := req.Contact().Address.String()
-	source := req.Source()
-
-	user := extractUser(from)
-	stripped := stripDialPrefix(user)
-	destValue := source
-
-	// Extract domain
-	domain := ""
-	raw := strings.TrimPrefix(from, "sip:")
-	if idx := strings.Index(raw, "@"); idx >= 0 {
-		domain = raw[idx+1:]
+// toSubscriber retargets req at a registered user of a tenant, given as
+// an AOR or a user name
+func (e *RoutingEngine) toSubscriber(req *sip.Request, user, tenantID string) (string, error) {
+	aliases := e.addressAliases(user, tenantID)
+	_, bindings, err := e.registrar.Lookup(tenantID, aliases)
+	if err == registrar.ErrNotFound {
+		return "", fmt.Errorf("user %s not registered", user)
 	}
-
-	log.Printf("[Router] Registering user=%s contact=%s source=%s", from, contact, source)
-
-	// Register under MANY keys so we can find this user no matter how they're dialed
-	keysToRegister := []string{
-		from, // original: sip:055@domain.com
-		fmt.Sprintf("sip:%s@localhost", user),       // sip:055@localhost
-		fmt.Sprintf("sip:%s@localhost", stripped),    // sip:55@localhost  (stripped)
+	if err != nil {
+		return "", err
 	}
+	return e.toBinding(req, bindings[0])
+}
 
-	if domain != "" {
-		keysToRegister = append(keysToRegister,
-			fmt.Sprintf("sip:%s@%s", stripped, domain),   // sip:55@domain
-			fmt.Sprintf("sip:0%s@%s", stripped, domain),  // sip:055@domain (with leading 0)
-			fmt.Sprintf("sip:0%s@localhost", stripped),    // sip:055@localhost (with leading 0)
-		)
+// toBinding retargets req at a registered contact and returns the next hop
+func (e *RoutingEngine) toBinding(req *sip.Request, b registrar.Binding) (string, error) {
+	// Retarget to the registered contact (RFC 3261 section 16.5) and send
+	// over the transport, and for NATed or TCP clients the flow, it
+	// registered with. A binding with a Path is reached through the proxies
+	// in it, which may be another edge holding the flow.
+	var contact sip.Uri
+	if err := sip.ParseUri(b.Contact, &contact); err != nil {
+		return "", fmt.Errorf("invalid contact %s: %w", b.Contact, err)
 	}
-
-	for _, key := range keysToRegister {
-		e.registrar.Register(key, destValue)
+	req.Recipient = contact
+	if len(b.Path) > 0 {
+		return e.pathRoute(req, b)
 	}
-
-	return "Registered", nil
+	dest, transport, err := BindingDest(b)
+	if err != nil {
+		return "", err
+	}
+	req.SetTransport(strings.ToUpper(transport))
+	return dest, nil
 }
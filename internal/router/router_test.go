@@ -0,0 +1,36 @@
+package router
+
+import (
+	"nextgen-sip/internal/trunk"
+	"testing"
+)
+
+func TestTargetRetry(t *testing.T) {
+	tr := &trunk.Trunk{ID: "t1"}
+	tests := []struct {
+		name   string
+		target Target
+		code   int
+		want   bool
+	}{
+		{"trunk answered", Target{Trunk: tr}, 200, false},
+		{"trunk redirect", Target{Trunk: tr}, 302, false},
+		{"trunk busy", Target{Trunk: tr}, 486, false},
+		{"trunk not found", Target{Trunk: tr}, 404, false},
+		{"trunk timeout", Target{Trunk: tr}, 408, true},
+		{"trunk server error", Target{Trunk: tr}, 500, true},
+		{"trunk unavailable", Target{Trunk: tr}, 503, true},
+		{"trunk decline", Target{Trunk: tr}, 603, false},
+		{"group member busy", Target{group: true}, 486, true},
+		{"group member unavailable", Target{group: true}, 480, true},
+		{"group member decline", Target{group: true}, 603, false},
+		{"group member answered", Target{group: true}, 200, false},
+		{"subscriber busy", Target{}, 486, false},
+		{"subscriber unavailable", Target{}, 503, false},
+	}
+	for _, tt := range tests {
+		if got := tt.target.Retry(tt.code); got != tt.want {
+			t.Errorf("%s: Retry(%d) = %v, want %v", tt.name, tt.code, got, tt.want)
+		}
+	}
+}
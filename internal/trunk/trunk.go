@@ -0,0 +1,157 @@
+package trunk
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/emiago/sipgo/sip"
+)
+
+var (
+	errBadID    = errors.New("trunk id may only contain letters, digits, '-' and '_'")
+	validIDRe   = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+	transports  = map[string]bool{"udp": true, "tcp": true, "tls": true}
+	callerModes = map[CallerIDMode]bool{CallerIDPassthrough: true, CallerIDFixed: true, CallerIDAnonymous: true}
+)
+
+// CallerIDMode decides which number a trunk is given as the caller
+type CallerIDMode string
+
+const (
+	CallerIDPassthrough CallerIDMode = "passthrough" // The caller's own number, in E.164
+	CallerIDFixed       CallerIDMode = "fixed"       // CallerID.Number, e.g. the company's main line
+	CallerIDAnonymous   CallerIDMode = "anonymous"   // The caller's number with Privacy: id
+)
+
+// CallerID is a trunk's caller ID policy
+type CallerID struct {
+	Mode   CallerIDMode `json:"mode"`
+	Number string       `json:"number,omitempty"` // For fixed
+}
+
+// Trunk is a carrier gateway that takes calls to numbers that are not our
+// subscribers
+type Trunk struct {
+	ID         string   `json:"id"`
+	Name       string   `json:"name"`
+	Host       string   `json:"host"`
+	Port       int      `json:"port"`      // 0 for the transport's default
+	Transport  string   `json:"transport"` // udp, tcp or tls
+	Username   string   `json:"username,omitempty"`
+	Password   string   `json:"password,omitempty"` // For digest challenges from the carrier
+	TechPrefix string   `json:"tech_prefix,omitempty"`
+	StripPlus  bool     `json:"strip_plus"` // Send numbers as digits only
+	CallerID   CallerID `json:"caller_id"`
+	Disabled   bool     `json:"disabled,omitempty"`
+
+	// Least-cost routing among the trunks a route lists: lower priorities
+	// are tried first, then cheaper trunks by the carrier's deck, and calls
+	// are shared by weight between trunks tied on both. Decks of trunks
+	// competing for a route should be in the same currency.
+	RateDeck string `json:"rate_deck,omitempty"` // What the carrier charges us
+	Priority int    `json:"priority,omitempty"`
+	Weight   int    `json:"weight,omitempty"` // 0 counts as 1
+
+	// Carriers that only send calls for our DIDs to a registered contact
+	// are registered with, as Username at Host
+	Register        bool `json:"register,omitempty"`
+	RegisterExpires int  `json:"register_expires,omitempty"` // Seconds asked for, 0 for 3600
+}
+
+// Validate checks t and fills in defaults
+func (t *Trunk) Validate() error {
+	if !validIDRe.MatchString(t.ID) {
+		return errBadID
+	}
+	if t.Host == "" {
+		return errors.New("host is required")
+	}
+	if t.Transport = strings.ToLower(t.Transport); t.Transport == "" {
+		t.Transport = "udp"
+	}
+	if !transports[t.Transport] {
+		return fmt.Errorf("unknown transport %q", t.Transport)
+	}
+	if t.Port < 0 || t.Port > 65535 {
+		return fmt.Errorf("invalid port %d", t.Port)
+	}
+	if strings.Trim(t.TechPrefix, "0123456789#*") != "" {
+		return errors.New("tech prefix may only contain digits, '#' and '*'")
+	}
+	if t.Weight < 0 {
+		return errors.New("weight must not be negative")
+	}
+	if t.Register && t.Username == "" {
+		return errors.New("registering needs a username")
+	}
+	if t.RegisterExpires < 0 {
+		return errors.New("register expires must not be negative")
+	}
+	if t.CallerID.Mode == "" {
+		t.CallerID.Mode = CallerIDPassthrough
+	}
+	if !callerModes[t.CallerID.Mode] {
+		return fmt.Errorf("unknown caller ID mode %q", t.CallerID.Mode)
+	}
+	if t.CallerID.Mode == CallerIDFixed && t.CallerID.Number == "" {
+		return errors.New("fixed caller ID needs a number")
+	}
+	return nil
+}
+
+// Dest is the host:port calls to the trunk are sent to
+func (t Trunk) Dest() string {
+	port := t.Port
+	if port == 0 {
+		port = sip.DefaultPort(t.Transport)
+	}
+	return net.JoinHostPort(t.Host, strconv.Itoa(port))
+}
+
+// RequestURI addresses number at the trunk, with its tech prefix
+func (t Trunk) RequestURI(number string) sip.Uri {
+	if t.StripPlus {
+		number = strings.TrimPrefix(number, "+")
+	}
+	uri := sip.Uri{
+		User:      t.TechPrefix + number,
+		Host:      t.Host,
+		Port:      t.Port,
+		UriParams: sip.NewParams(),
+		Headers:   sip.NewParams(),
+	}
+	if t.Transport != "udp" {
+		uri.UriParams.Add("transport", t.Transport)
+	}
+	return uri
+}
+
+// AOR is the address we register as with the carrier
+func (t Trunk) AOR() sip.Uri {
+	return sip.Uri{User: t.Username, Host: t.Host, UriParams: sip.NewParams(), Headers: sip.NewParams()}
+}
+
+// RegistrarURI is the Request-URI of REGISTERs to the carrier
+func (t Trunk) RegistrarURI() sip.Uri {
+	uri := sip.Uri{Host: t.Host, Port: t.Port, UriParams: sip.NewParams(), Headers: sip.NewParams()}
+	if t.Transport != "udp" {
+		uri.UriParams.Add("transport", t.Transport)
+	}
+	return uri
+}
+
+// Identity is the number the trunk is given as the caller, and whether the
+// carrier is asked to withhold it
+func (t Trunk) Identity(caller string) (string, bool) {
+	if t.CallerID.Mode == CallerIDFixed {
+		caller = t.CallerID.Number
+	}
+	if t.StripPlus {
+		caller = strings.TrimPrefix(caller, "+")
+	}
+	return caller, t.CallerID.Mode == CallerIDAnonymous
+}
@@ -0,0 +1,124 @@
+package trunk
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sort"
+	"sync"
+)
+
+// Trunks holds the configured trunks. With a file set, trunks are loaded
+// from it and every change is written back.
+type Trunks struct {
+	mu     sync.RWMutex
+	trunks map[string]Trunk
+	path   string
+}
+
+func NewTrunks(path string) (*Trunks, error) {
+	t := &Trunks{trunks: make(map[string]Trunk), path: path}
+	if path == "" {
+		return t, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var list []Trunk
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+	for _, tr := range list {
+		if err := tr.Validate(); err != nil {
+			return nil, err
+		}
+		t.trunks[tr.ID] = tr
+	}
+	return t, nil
+}
+
+// Get returns a trunk by ID
+func (t *Trunks) Get(id string) (Trunk, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	tr, ok := t.trunks[id]
+	return tr, ok
+}
+
+// List returns every trunk, ordered by ID
+func (t *Trunks) List() []Trunk {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.listLocked()
+}
+
+// Set validates and stores a trunk. An empty password keeps the one
+// already stored, so a trunk read back without it can be saved again.
+func (t *Trunks) Set(tr Trunk) (Trunk, error) {
+	if err := tr.Validate(); err != nil {
+		return Trunk{}, err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	old, had := t.trunks[tr.ID]
+	if tr.Password == "" && had && tr.Username == old.Username {
+		tr.Password = old.Password
+	}
+	t.trunks[tr.ID] = tr
+	if err := t.saveLocked(); err != nil {
+		if had {
+			t.trunks[tr.ID] = old
+		} else {
+			delete(t.trunks, tr.ID)
+		}
+		return Trunk{}, err
+	}
+	return tr, nil
+}
+
+// Delete removes a trunk
+func (t *Trunks) Delete(id string) (bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	old, ok := t.trunks[id]
+	if !ok {
+		return false, nil
+	}
+	delete(t.trunks, id)
+	if err := t.saveLocked(); err != nil {
+		t.trunks[id] = old
+		return false, err
+	}
+	return true, nil
+}
+
+func (t *Trunks) listLocked() []Trunk {
+	list := make([]Trunk, 0, len(t.trunks))
+	for _, tr := range t.trunks {
+		list = append(list, tr)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// saveLocked writes every trunk to the file, through a rename so a crash
+// never leaves it half-written
+func (t *Trunks) saveLocked() error {
+	if t.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(t.listLocked(), "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := t.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, t.path)
+}
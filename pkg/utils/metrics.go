@@ -25,4 +25,40 @@ var (
 		Name: "firewall_blocks_total",
 		Help: "Total number of IP blocks by firewall",
 	})
+
+	RegistrarDegraded = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "registrar_degraded",
+		Help: "1 while the registrar store is unreachable and lookups are served from the local cache",
+	})
+
+	RegistrarBufferedWrites = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "registrar_buffered_writes",
+		Help: "Registrations waiting to be replayed to the registrar store",
+	})
+
+	KeepaliveBindings = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "registrar_keepalive_bindings",
+		Help: "NATed bindings being pinged",
+	})
+
+	KeepaliveUnreachable = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "registrar_keepalive_unreachable_bindings",
+		Help: "NATed bindings that missed their last keepalive",
+	})
+
+	KeepaliveRTT = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "registrar_keepalive_rtt_seconds",
+		Help:    "Round trip of OPTIONS keepalives to NATed bindings",
+		Buckets: []float64{.01, .025, .05, .1, .25, .5, 1, 2.5},
+	})
+
+	KeepaliveDrops = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "registrar_keepalive_drops_total",
+		Help: "Bindings dropped after missing too many keepalives",
+	})
+
+	TrunksRegistered = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "trunk_registrations_active",
+		Help: "Trunks registered with their carrier",
+	})
 )
@@ -20,6 +20,7 @@ function loadAll() {
 const pageTitles = {
     overview: ['System Overview', 'Real-time carrier network monitoring'],
     subscribers: ['Subscribers', 'Manage subscriber accounts and billing'],
+    registrations: ['Registrations', 'Registered devices and their bindings'],
     calls: ['Live Calls', 'Active call sessions across the network'],
     cdr: ['Call Records', 'Historical call detail records'],
     security: ['Security', 'Firewall rules and threat protection'],
@@ -46,8 +47,10 @@ function navigate(pageId, el) {
 
     // Load data for specific pages
     if (pageId === 'subscribers') fetchUsers();
+    if (pageId === 'registrations') fetchRegistrations();
     if (pageId === 'calls') fetchCalls();
     if (pageId === 'settings') fetchConfig();
+    if (pageId === 'cdr') { fetchCDRs(false); fetchCDRSummary(); }
 }
 
 // ─── Stats ─────────────────────────────────────────────
@@ -153,6 +156,68 @@ function submitBalance(e) {
     });
 }
 
+// ─── Registrations ─────────────────────────────────────
+function searchRegistrations(e) {
+    e.preventDefault();
+    fetchRegistrations();
+}
+
+function fetchRegistrations() {
+    const q = new URLSearchParams();
+    const add = (key, id) => {
+        const v = document.getElementById(id).value.trim();
+        if (v) q.set(key, v);
+    };
+    add('user', 'reg-f-user');
+    add('tenant', 'reg-f-tenant');
+    add('user_agent', 'reg-f-ua');
+    add('source', 'reg-f-source');
+    fetch(API + '/registrations?' + q.toString())
+        .then(r => r.json())
+        .then(regs => {
+            const tb = document.getElementById('reg-tbody');
+            const rows = [];
+            (regs || []).forEach(reg => reg.bindings.forEach(b => rows.push({ aor: reg.aor, b })));
+            setText('reg-count', rows.length);
+            if (rows.length === 0) {
+                tb.innerHTML = '<tr><td colspan="9" class="empty-state">No devices registered</td></tr>';
+                return;
+            }
+            tb.innerHTML = rows.map(({ aor, b }) => `<tr>
+                    <td style="font-family:monospace;font-size:0.78rem">${esc(aor)}</td>
+                    <td style="font-family:monospace;font-size:0.78rem">${esc(b.contact)}</td>
+                    <td>${esc(b.source)}${b.nat ? ' <span class="tier tier-reseller">NAT</span>' : ''}</td>
+                    <td>${esc((b.transport || 'udp').toUpperCase())}</td>
+                    <td>${esc(b.user_agent || '—')}</td>
+                    <td>${b.expires_in}s</td>
+                    <td>${keepaliveCell(b.keepalive)}</td>
+                    <td>${esc(b.tenant_id || 'default')}</td>
+                    <td>
+                        <button class="btn-sm danger" data-aor="${esc(aor)}" data-contact="${esc(b.contact)}" onclick="kickBinding(this)">Kick</button>
+                    </td>
+                </tr>`).join('');
+        })
+        .catch(() => { });
+}
+
+function keepaliveCell(k) {
+    if (!k) return '—';
+    if (!k.reachable) return `<span style="color:var(--red)">✗ ${k.failures} missed</span>`;
+    const rtt = k.rtt_ms ? ` ${k.rtt_ms.toFixed(1)} ms` : '';
+    return `<span style="color:var(--green)">✓ ${esc(k.method)}${rtt}</span>`;
+}
+
+function kickBinding(btn) {
+    const aor = btn.dataset.aor;
+    const contact = btn.dataset.contact;
+    if (!confirm('De-register ' + contact + '?')) return;
+    fetch(API + '/registrations/' + encodeURIComponent(aor) + '?contact=' + encodeURIComponent(contact), { method: 'DELETE' })
+        .then(() => {
+            fetchRegistrations();
+            logActivity('Device de-registered: ' + contact);
+        });
+}
+
 // ─── Calls ─────────────────────────────────────────────
 function fetchCalls() {
     fetch(API + '/calls/active')
@@ -166,7 +231,8 @@ function fetchCalls() {
             }
             setText('call-count', calls.length);
             tb.innerHTML = calls.map(c => {
-                const dur = Math.floor((Date.now() - new Date(c.start_time).getTime()) / 1000);
+                const since = c.state === 'CONNECTED' ? c.answer_time : c.start_time;
+                const dur = Math.floor((Date.now() - new Date(since).getTime()) / 1000);
                 const mm = Math.floor(dur / 60);
                 const ss = dur % 60;
                 return `<tr>
@@ -174,7 +240,7 @@ function fetchCalls() {
                     <td style="font-family:monospace;font-size:0.78rem">${esc(c.to)}</td>
                     <td><span class="tier tier-admin">${esc(c.state)}</span></td>
                     <td>${mm}:${String(ss).padStart(2, '0')}</td>
-                    <td>$${(c.rate || 0.01).toFixed(3)}</td>
+                    <td title="${esc((c.rate && c.rate.deck_id) || '')} ${esc((c.rate && c.rate.prefix) || '*')}">$${((c.rate && c.rate.per_minute) || 0).toFixed(4)}</td>
                     <td>${esc(c.tenant_id || 'default')}</td>
                 </tr>`;
             }).join('');
@@ -182,6 +248,89 @@ function fetchCalls() {
         .catch(() => { });
 }
 
+// ─── CDRs ──────────────────────────────────────────────
+let cdrCursor = '';
+
+function cdrQuery() {
+    const q = new URLSearchParams();
+    const add = (key, id) => {
+        const v = document.getElementById(id).value.trim();
+        if (v) q.set(key, v);
+    };
+    add('caller', 'cdr-f-caller');
+    add('callee', 'cdr-f-callee');
+    add('tenant', 'cdr-f-tenant');
+    add('from', 'cdr-f-from');
+    add('to', 'cdr-f-to');
+    add('status', 'cdr-f-status');
+    return q;
+}
+
+function searchCDRs(e) {
+    e.preventDefault();
+    fetchCDRs(false);
+}
+
+function fetchCDRs(more) {
+    const q = cdrQuery();
+    if (more && cdrCursor) q.set('cursor', cdrCursor);
+    fetch(API + '/cdrs?' + q.toString())
+        .then(r => r.json())
+        .then(d => {
+            const tb = document.getElementById('cdr-tbody');
+            const rows = d.cdrs || [];
+            cdrCursor = d.next_cursor || '';
+            document.getElementById('cdr-more').hidden = !cdrCursor;
+            if (!more && rows.length === 0) {
+                tb.innerHTML = '<tr><td colspan="8" class="empty-state">No call records match</td></tr>';
+                return;
+            }
+            const html = rows.map(c => {
+                const mm = Math.floor(c.duration / 60);
+                const ss = Math.round(c.duration % 60);
+                return `<tr>
+                    <td>${new Date(c.setup_time).toLocaleString()}</td>
+                    <td style="font-family:monospace;font-size:0.78rem">${esc(c.from)}</td>
+                    <td style="font-family:monospace;font-size:0.78rem">${esc(c.to)}</td>
+                    <td><span class="tier tier-admin">${esc(c.status)}</span></td>
+                    <td>${mm}:${String(ss).padStart(2, '0')}</td>
+                    <td>$${(c.cost || 0).toFixed(4)}</td>
+                    <td>${esc(c.hangup_by)} (${c.disconnect_code})</td>
+                    <td>${esc(c.tenant_id || 'default')}</td>
+                </tr>`;
+            }).join('');
+            if (more) tb.insertAdjacentHTML('beforeend', html);
+            else tb.innerHTML = html;
+        })
+        .catch(() => { });
+}
+
+// Today's totals, streamed from the JSON-lines export
+function fetchCDRSummary() {
+    const today = new Date().toISOString().slice(0, 10);
+    fetch(API + '/cdrs/export?format=jsonl&from=' + today)
+        .then(r => r.text())
+        .then(body => {
+            let total = 0, seconds = 0, revenue = 0;
+            body.split('\n').filter(Boolean).forEach(line => {
+                const c = JSON.parse(line);
+                total++;
+                seconds += c.duration || 0;
+                revenue += c.cost || 0;
+            });
+            setText('cdr-total', total);
+            setText('cdr-minutes', Math.round(seconds / 60));
+            setText('cdr-revenue', '$' + revenue.toFixed(2));
+        })
+        .catch(() => { });
+}
+
+function exportCDRs(format) {
+    const q = cdrQuery();
+    q.set('format', format);
+    window.location = API + '/cdrs/export?' + q.toString();
+}
+
 // ─── Config ────────────────────────────────────────────
 function fetchConfig() {
     fetch(API + '/config')
@@ -189,8 +338,9 @@ function fetchConfig() {
         .then(cfg => {
             setText('cfg-proto', cfg.sip_protocol || 'TCP');
             setText('cfg-max', (cfg.max_concurrent_calls || 100000).toLocaleString());
-            setText('cfg-rate', '$' + (cfg.billing_rate || 0.01));
-            setText('cfg-ttl', cfg.registration_ttl || '1h');
+            setText('cfg-rate', cfg.default_rate_deck || 'default');
+            const exp = cfg.registration_expires;
+            setText('cfg-ttl', exp ? `${exp.default}s (${exp.min}–${exp.max}s)` : (cfg.registration_ttl || '1h'));
             setText('cfg-fw', (cfg.firewall_threshold || 5) + ' attempts');
             setText('net-proto', cfg.sip_protocol || 'TCP');
             setText('net-cap', ((cfg.max_concurrent_calls || 100000) / 1000) + 'K');